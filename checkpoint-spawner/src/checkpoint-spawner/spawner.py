@@ -174,14 +174,17 @@ class CheckpointSpawner(KubeSpawner):
 
     # Makes a request to Checkpointer API for checkpoint result and returns the container name.
     async def get_checkpoint_result(self, checkpoint_identifier: str) -> str:
-        cp_url = f'http://{self.checkpoint_service_name}/checkpoint?checkpointIdentifier={checkpoint_identifier}'
+        cp_url = f'http://{self.checkpoint_service_name}/checkpoint?checkpointIdentifier={checkpoint_identifier}&wait=30'
         self.log.info(f'CheckpointSpawner: get_checkpoint_result() to: {cp_url}')
 
-        # Make the request with no timeout, in case it takes too long, the Spawner.start_timeout will be reached,
-        # and it will terminate the coroutine.
-        response = await self.http_client.fetch(HTTPRequest(url=cp_url, request_timeout=0,  method="GET"))
-        data = json.loads(response.body)
-        return data['containerImageName']
+        # Checkpointer responds with 202 while checkpointing is in progress, so keep asking. In case it takes too long,
+        # the Spawner.start_timeout will be reached, and it will terminate the coroutine.
+        while True:
+            response = await self.http_client.fetch(HTTPRequest(url=cp_url, request_timeout=60, method="GET"))
+            data = json.loads(response.body)
+            if response.code == 200:
+                return data['containerImageName']
+            self.log.info(f'CheckpointSpawner: checkpoint still in phase: {data.get("phase")}')
 
 
     # Modifies the container
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"checkpoint-in-k8s/internal"
 	"checkpoint-in-k8s/pkg/checkpoint"
 	"checkpoint-in-k8s/pkg/config"
 	"checkpoint-in-k8s/pkg/manager"
 	"checkpoint-in-k8s/web"
+	"context"
 	"errors"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"net/http"
@@ -30,18 +37,51 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to bootstrap Checkpointer configuration")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == migrateStorageCommand {
+		migrateStorage(clientset, globalConfig, os.Args[2:])
+		return
+	}
+
 	mux := http.NewServeMux()
 
 	cp, err := checkpoint.NewCheckpointer(clientset, inClusterConfig, globalConfig)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create Checkpointer")
 	}
-	storage := manager.NewCheckpointStorage(globalConfig)
-	mgr := manager.NewCheckpointManager(cp, storage)
+	podStopper := checkpoint.NewPodStopper(clientset, inClusterConfig)
+	verifier := checkpoint.NewVerifier(clientset, inClusterConfig, globalConfig.CheckpointConfig)
+	imageCollector := checkpoint.NewImageCollector(clientset, globalConfig.CheckpointConfig)
+	storage, err := manager.OpenCheckpointStorage(globalConfig, clientset)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open checkpoint storage")
+	}
+	callbackDispatcher := manager.NewCallbackDispatcher(globalConfig.CallbackConfig, storage)
+	callbackDispatcher.ResumePending()
+	eventSink := manager.NewEventSink(globalConfig.EventSinkConfig, globalConfig.CheckpointConfig.CheckpointerNode)
+	pendingStorage := manager.NewPendingCheckpointStorage(globalConfig)
+	mgr := manager.NewCheckpointManager(cp, podStopper, verifier, imageCollector, storage, pendingStorage, callbackDispatcher, eventSink, globalConfig.SchedulerConfig, globalConfig.BuildRetryConfig, globalConfig.PublishConfig, globalConfig.RetentionConfig, globalConfig.CheckpointConfig.CheckpointerNode)
+	mgr.RecoverCheckpoints()
 
-	ch := web.NewCheckpointHandler(mgr, globalConfig.CheckpointConfig.CheckpointerNode)
+	ch := web.NewCheckpointHandler(mgr, globalConfig.CheckpointConfig.CheckpointerNode, globalConfig.CallbackConfig, globalConfig.SchedulerConfig, globalConfig.HookConfig)
 	var checkpointHandler http.Handler = http.HandlerFunc(ch.HandleCheckpoint)
 	var stateHandler http.Handler = http.HandlerFunc(ch.HandleCheckState)
+	var scaleUpHandler http.Handler = http.HandlerFunc(ch.HandleScaleOwnerUp)
+	var eventsHandler http.Handler = http.HandlerFunc(ch.HandleCheckpointEvents)
+	var cancelHandler http.Handler = http.HandlerFunc(ch.HandleCancelCheckpoint)
+	var retryHandler http.Handler = http.HandlerFunc(ch.HandleRetryCheckpoint)
+	var listHandler http.Handler = http.HandlerFunc(ch.HandleListCheckpoints)
+	var deleteHandler http.Handler = http.HandlerFunc(ch.HandleDeleteCheckpoint)
+
+	var gh *web.GroupHandler
+	var groupStateHandler http.Handler
+	if globalConfig.GroupConfig.Enabled {
+		memberCheckpointer := web.NewClusterMemberCheckpointer(globalConfig.CheckpointerPort)
+		hookRunner := checkpoint.NewHookRunner(clientset, inClusterConfig)
+		groupCoordinator := manager.NewGroupCoordinator(globalConfig.GroupConfig, clientset, memberCheckpointer, hookRunner, podStopper, storage, globalConfig.CheckpointConfig.CheckpointerNode)
+		groupCoordinator.RecoverGroups()
+		gh = web.NewGroupHandler(groupCoordinator, globalConfig.HookConfig)
+		groupStateHandler = http.HandlerFunc(gh.HandleGroupState)
+	}
 
 	if !globalConfig.DisableRouteForward {
 		proxy := web.NewRouteProxyMiddleware(
@@ -51,11 +91,92 @@ func main() {
 			globalConfig.CheckpointerPort,
 		)
 		checkpointHandler = proxy.CheckpointRouteProxyMiddleware(checkpointHandler)
-		stateHandler = proxy.StateRouteProxyMiddleware(stateHandler)
+		if nodeEntryReader, ok := storage.(manager.NodeEntryReader); ok {
+			orphanHandler := http.HandlerFunc(web.NewOrphanCheckpointHandler(nodeEntryReader).HandleCheckState)
+			stateHandler = proxy.OrphanStateRouteProxyMiddleware(stateHandler, orphanHandler)
+		} else {
+			stateHandler = proxy.StateRouteProxyMiddleware(stateHandler)
+		}
+		scaleUpHandler = proxy.StateRouteProxyMiddleware(scaleUpHandler)
+		eventsHandler = proxy.StateRouteProxyMiddleware(eventsHandler)
+		cancelHandler = proxy.StateRouteProxyMiddleware(cancelHandler)
+		retryHandler = proxy.StateRouteProxyMiddleware(retryHandler)
+		if nodeEntryLister, ok := storage.(manager.NodeEntryLister); ok {
+			listHandler = proxy.OrphanListRouteProxyMiddleware(listHandler, nodeEntryLister)
+		} else {
+			listHandler = proxy.ListRouteProxyMiddleware(listHandler)
+		}
+		deleteHandler = proxy.StateRouteProxyMiddleware(deleteHandler)
+		if globalConfig.GroupConfig.Enabled {
+			groupStateHandler = proxy.StateRouteProxyMiddleware(groupStateHandler)
+		}
 	}
 
 	mux.Handle("POST /checkpoint/{ns}/{pod}/{container}", checkpointHandler)
 	mux.Handle("GET /checkpoint", stateHandler)
+	mux.Handle("DELETE /checkpoint", cancelHandler)
+	mux.Handle("POST /checkpoint/{id}/scale-up", scaleUpHandler)
+	mux.Handle("POST /checkpoint/{id}/retry", retryHandler)
+	mux.Handle("GET /checkpoint/{id}/events", eventsHandler)
+	mux.HandleFunc("GET /checkpoint/{ns}/{pod}/{container}/latest", ch.HandleLatestCheckpoint)
+	mux.Handle("GET /checkpoints", listHandler)
+	mux.Handle("DELETE /checkpoints/{id}", deleteHandler)
+	if globalConfig.GroupConfig.Enabled {
+		mux.HandleFunc("POST /checkpoint-groups", gh.HandleCheckpointGroup)
+		mux.Handle("GET /checkpoint-groups/{id}", groupStateHandler)
+	}
+
+	sh := web.NewSlotHandler(listHandler)
+	mux.HandleFunc("GET /slots/{slot}", sh.HandleSlotLineage)
+	mux.HandleFunc("GET /slots/{slot}/latest", sh.HandleLatestSlotCheckpoint)
+	mux.HandleFunc("GET /slots/{slot}/previous", sh.HandlePreviousSlotCheckpoint)
+	mux.HandleFunc("POST /retention", ch.HandleEnforceRetention)
+
+	if globalConfig.RegistryGCConfig.Enabled {
+		// Cluster-wide storage lists the results of Nodes without a running Checkpointer as well, otherwise the
+		// collection is skipped while any Node's results cannot be listed.
+		var clusterLister manager.ClusterEntryLister = web.NewClusterCheckpointLister(globalConfig.CheckpointerPort)
+		if storageLister, ok := storage.(manager.ClusterEntryLister); ok {
+			clusterLister = storageLister
+		}
+		collector := manager.NewRegistryCollector(globalConfig.RegistryGCConfig, clientset, imageCollector, clusterLister, globalConfig.CheckpointConfig.CheckpointerNamespace, globalConfig.CheckpointConfig.CheckpointerNode)
+		go collector.Run(context.Background())
+	}
+
+	if globalConfig.ControllerConfig.Enabled {
+		dynamicClient, err := dynamic.NewForConfig(inClusterConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to get Kubernetes dynamic client")
+		}
+		controller := manager.NewContainerCheckpointController(globalConfig.ControllerConfig, mgr, clientset, dynamicClient, imageCollector, globalConfig.CheckpointConfig.CheckpointerNode)
+		go controller.Run(context.Background())
+	}
+
+	if globalConfig.ScheduleConfig.Enabled {
+		periodicCheckpointer := manager.NewPeriodicCheckpointer(mgr, clientset, globalConfig.CheckpointConfig.CheckpointerNode)
+		go periodicCheckpointer.Run(context.Background())
+	}
+
+	if globalConfig.DrainGuardConfig.Enabled {
+		drainGuard := manager.NewDrainGuard(globalConfig.DrainGuardConfig, mgr, clientset, globalConfig.CheckpointConfig.CheckpointerNode)
+		go drainGuard.Run(context.Background())
+		go guardShutdown(drainGuard, globalConfig.DrainGuardConfig)
+	}
+
+	if globalConfig.IdleConfig.Enabled {
+		stats, err := internal.NewKubeletStatsReader(globalConfig.KubeletConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create Kubelet stats reader")
+		}
+		idleDetector := manager.NewIdleDetector(globalConfig.IdleConfig, mgr, clientset, stats, globalConfig.CheckpointConfig.CheckpointerNode)
+		go idleDetector.Run(context.Background())
+		ih := web.NewIdleHandler(idleDetector, globalConfig.CheckpointConfig.CheckpointerNode, globalConfig.IdleConfig.DryRun)
+		mux.HandleFunc("GET /idle", ih.HandleIdleReport)
+	}
+
+	if globalConfig.WebhookConfig.Enabled {
+		go serveRestoreWebhook(web.NewRestoreWebhookHandler(mgr, clientset, inClusterConfig, globalConfig), globalConfig.WebhookConfig)
+	}
 
 	portNumber := strconv.FormatInt(globalConfig.CheckpointerPort, 10)
 	log.Info().Msg("starting http server on port: " + portNumber)
@@ -67,3 +188,28 @@ func main() {
 		log.Error().Err(err).Msg("error starting server")
 	}
 }
+
+func serveRestoreWebhook(wh *web.RestoreWebhookHandler, webhookConfig config.WebhookConfig) {
+	webhookMux := http.NewServeMux()
+	webhookMux.HandleFunc("POST /mutate-pods", wh.HandleMutate)
+
+	portNumber := strconv.FormatInt(webhookConfig.Port, 10)
+	log.Info().Msg("starting restore webhook https server on port: " + portNumber)
+	err := http.ListenAndServeTLS(":"+portNumber, webhookConfig.CertFile, webhookConfig.KeyFile, webhookMux)
+	log.Fatal().Err(err).Msg("restore webhook server stopped")
+}
+
+// guardShutdown checkpoints the guarded Pods once Checkpointer receives SIGTERM and exits when they are checkpointed,
+// together with the Pods of a drain in progress, or the guard times out.
+func guardShutdown(drainGuard *manager.DrainGuard, drainGuardConfig config.DrainGuardConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	<-signals
+
+	log.Info().Msg("received SIGTERM, checkpointing guarded Pods before exit")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainGuardConfig.TimeoutSeconds)*time.Second)
+	drainGuard.Drain(ctx, manager.DrainReasonShutdown)
+	drainGuard.Wait(ctx)
+	cancel()
+	os.Exit(0)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"checkpoint-in-k8s/pkg/config"
+	"checkpoint-in-k8s/pkg/manager"
+	"flag"
+	"github.com/rs/zerolog/log"
+	"io"
+	"k8s.io/client-go/kubernetes"
+)
+
+// migrateStorageCommand is the argument that runs the migration of checkpoint results instead of the server.
+const migrateStorageCommand = "migrate-storage"
+
+// migrateStorage copies the checkpoint results from the diskv storage in StorageBasePath to the storage backend given
+// by the --to flag, STORAGE_BACKEND by default. It is meant to be run in the Checkpointer Pod before switching
+// STORAGE_BACKEND, so that the storage paths and credentials are the same as the server's.
+func migrateStorage(clientset *kubernetes.Clientset, globalConfig config.GlobalConfig, args []string) {
+	flags := flag.NewFlagSet(migrateStorageCommand, flag.ExitOnError)
+	to := flags.String("to", string(globalConfig.StorageConfig.Backend), "storage backend to migrate to: bolt or configmap")
+	from := flags.String("from", globalConfig.StorageBasePath, "path to the diskv storage to migrate from")
+	_ = flags.Parse(args)
+
+	globalConfig.StorageConfig.Backend = config.StorageBackend(*to)
+	if globalConfig.StorageConfig.Backend != config.StorageBackendBolt && globalConfig.StorageConfig.Backend != config.StorageBackendConfigMap {
+		log.Fatal().Str("to", *to).Msg("checkpoint results can only be migrated to bolt or configmap storage backend")
+	}
+
+	target, err := manager.OpenCheckpointStorage(globalConfig, clientset)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open target checkpoint storage")
+	}
+	if closer, ok := target.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	migrated, err := manager.MigrateDiskStorage(*from, target)
+	if err != nil {
+		log.Fatal().Err(err).Int("migrated", migrated).Msg("failed to migrate checkpoint results")
+	}
+	log.Info().Int("migrated", migrated).Str("to", *to).Msg("checkpoint results migrated")
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/rs/zerolog"
 	"io"
 	"net/http"
+	"time"
 )
 
 var ErrContainerNotFound = fmt.Errorf("kubelet responded with 404 status code")
@@ -28,6 +29,56 @@ type KubeletController interface {
 	CallKubeletCheckpoint(ctx context.Context, containerPath string) (string, error)
 }
 
+// KubeletStatsReader is responsible for invoking the Kubelet summary API.
+type KubeletStatsReader interface {
+
+	// CallKubeletStatsSummary sends an HTTP request to the Kubelet summary API.
+	// Returns the resource usage of the Pods on the Node, or error.
+	CallKubeletStatsSummary(ctx context.Context) (*StatsSummary, error)
+}
+
+// StatsSummary represents the JSON body that Kubelet summary API responds with, only the fields used by Checkpointer.
+type StatsSummary struct {
+	Pods []PodStats `json:"pods"`
+}
+
+// PodStats represents the resource usage of a Pod.
+type PodStats struct {
+	PodRef     PodReference     `json:"podRef"`
+	Containers []ContainerStats `json:"containers"`
+
+	// Network is missing for Pods in the host network namespace.
+	Network *NetworkStats `json:"network,omitempty"`
+}
+
+// PodReference identifies the Pod of PodStats.
+type PodReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	UID       string `json:"uid"`
+}
+
+// ContainerStats represents the resource usage of a container.
+type ContainerStats struct {
+	Name string    `json:"name"`
+	CPU  *CPUStats `json:"cpu,omitempty"`
+}
+
+// CPUStats represents the CPU usage of a container.
+type CPUStats struct {
+	Time time.Time `json:"time"`
+
+	// UsageNanoCores is the CPU usage averaged over the sampling window of Kubelet.
+	UsageNanoCores *uint64 `json:"usageNanoCores,omitempty"`
+}
+
+// NetworkStats represents the network traffic of the default interface of a Pod since its creation.
+type NetworkStats struct {
+	Time    time.Time `json:"time"`
+	RxBytes *uint64   `json:"rxBytes,omitempty"`
+	TxBytes *uint64   `json:"txBytes,omitempty"`
+}
+
 func NewKubeletController(kubeletConfig config.KubeletConfig) (KubeletController, error) {
 	httpClient, err := newHttpClient(kubeletConfig.CertFile, kubeletConfig.KeyFile, kubeletConfig.AllowInsecure)
 	if err != nil {
@@ -57,6 +108,17 @@ func newHttpClient(kubeletCertFile, kubeletKeyFile string, allowInsecure bool) (
 	}, nil
 }
 
+func NewKubeletStatsReader(kubeletConfig config.KubeletConfig) (KubeletStatsReader, error) {
+	httpClient, err := newHttpClient(kubeletConfig.CertFile, kubeletConfig.KeyFile, kubeletConfig.AllowInsecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating http client for kubelet: %w", err)
+	}
+	return &kubeletController{
+		kubeletConfig.BaseUrl,
+		httpClient,
+	}, nil
+}
+
 type kubeletController struct {
 	// Base URL of Kubelet used to send a checkpoint request.
 	kubeletBaseUrl string
@@ -104,3 +166,35 @@ func (kc kubeletController) CallKubeletCheckpoint(ctx context.Context, container
 	}
 	return kubeletCheckpointResponse.Items[0], nil
 }
+
+func (kc kubeletController) CallKubeletStatsSummary(ctx context.Context) (*StatsSummary, error) {
+	requestURL := fmt.Sprintf("%s/stats/summary", kc.kubeletBaseUrl)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %w", err)
+	}
+
+	zerolog.Ctx(ctx).Debug().Str("requestURL", requestURL).Msg("sending an HTTP request to kubelet")
+
+	res, err := kc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response body: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubelet responded with unexpected status code: %d and body: %s", res.StatusCode, body)
+	}
+
+	var summary StatsSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response from kubelet: %w", err)
+	}
+	return &summary, nil
+}
@@ -77,3 +77,52 @@ func TestCallKubeletCheckpoint_MalformedResponse(t *testing.T) {
 		t.Errorf("CallKubeletCheckpoint returned no error")
 	}
 }
+
+func TestCallKubeletStatsSummary_Success(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats/summary" || r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"node":{"nodeName":"node"},"pods":[{"podRef":{"name":"pod","namespace":"ns","uid":"uid"},` +
+			`"containers":[{"name":"contr","cpu":{"time":"2024-12-15T16:44:20Z","usageNanoCores":2000000}}],` +
+			`"network":{"time":"2024-12-15T16:44:21Z","name":"eth0","rxBytes":100,"txBytes":50}}]}`))
+	}))
+	defer mockServer.Close()
+
+	kubeletCtrl := kubeletController{
+		mockServer.URL,
+		&http.Client{},
+	}
+
+	summary, err := kubeletCtrl.CallKubeletStatsSummary(context.TODO())
+	if err != nil {
+		t.Fatalf("CallKubeletStatsSummary failed with error %v", err)
+	}
+	if len(summary.Pods) != 1 || summary.Pods[0].PodRef.UID != "uid" || len(summary.Pods[0].Containers) != 1 {
+		t.Fatalf("CallKubeletStatsSummary returned wrong Pods: %+v", summary.Pods)
+	}
+	if cpu := summary.Pods[0].Containers[0].CPU; cpu == nil || cpu.UsageNanoCores == nil || *cpu.UsageNanoCores != 2000000 {
+		t.Errorf("CallKubeletStatsSummary returned wrong CPU usage: %+v", cpu)
+	}
+	if network := summary.Pods[0].Network; network == nil || *network.RxBytes != 100 || *network.TxBytes != 50 {
+		t.Errorf("CallKubeletStatsSummary returned wrong network usage: %+v", network)
+	}
+}
+
+func TestCallKubeletStatsSummary_Unauthorized(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer mockServer.Close()
+
+	kubeletCtrl := kubeletController{
+		mockServer.URL,
+		&http.Client{},
+	}
+
+	if _, err := kubeletCtrl.CallKubeletStatsSummary(context.TODO()); err == nil {
+		t.Errorf("CallKubeletStatsSummary returned no error")
+	}
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	OwnerKindDeployment  = "Deployment"
+	OwnerKindStatefulSet = "StatefulSet"
+	OwnerKindReplicaSet  = "ReplicaSet"
+	OwnerKindJob         = "Job"
+)
+
+// Owner represents a controller which owns a Pod and can be scaled.
+type Owner struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// OwnerController is responsible for using the Kubernetes API to find and scale controllers owning Pods.
+type OwnerController interface {
+
+	// FindScalableOwner walks the ownerReferences of podName in namespace up to the top-most Deployment, StatefulSet,
+	// ReplicaSet or Job. Returns nil if the Pod is not owned by any of them or error if a call to Kubernetes API fails.
+	FindScalableOwner(ctx context.Context, podName, namespace string) (*Owner, error)
+
+	// OwnerReplicas returns the number of replicas of the owner, or parallelism in case of Job. Returns error if a call
+	// to Kubernetes API fails.
+	OwnerReplicas(ctx context.Context, owner Owner) (int32, error)
+
+	// ScaleOwner sets the number of replicas of the owner, or parallelism in case of Job, and merges
+	// templateAnnotations into annotations of the owner's Pod template, or of the Job itself as its Pod template is
+	// immutable. Returns the previous number of replicas or
+	// error if a call to Kubernetes API fails.
+	ScaleOwner(ctx context.Context, owner Owner, replicas int32, templateAnnotations map[string]string) (int32, error)
+}
+
+type ownerController struct {
+	client kubernetes.Interface
+}
+
+func NewOwnerController(client kubernetes.Interface) OwnerController {
+	return &ownerController{client}
+}
+
+func (oc *ownerController) FindScalableOwner(ctx context.Context, podName, namespace string) (*Owner, error) {
+	pod, err := oc.client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting pod %s/%s: %w", namespace, podName, err)
+	}
+
+	ownerRef := metav1.GetControllerOf(pod)
+	if ownerRef == nil {
+		return nil, nil
+	}
+
+	switch ownerRef.Kind {
+	case OwnerKindStatefulSet, OwnerKindJob:
+		return &Owner{ownerRef.Kind, ownerRef.Name, namespace}, nil
+	case OwnerKindReplicaSet:
+		replicaSet, err := oc.client.AppsV1().ReplicaSets(namespace).Get(ctx, ownerRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting replicaset %s/%s: %w", namespace, ownerRef.Name, err)
+		}
+		if deploymentRef := metav1.GetControllerOf(replicaSet); deploymentRef != nil && deploymentRef.Kind == OwnerKindDeployment {
+			return &Owner{OwnerKindDeployment, deploymentRef.Name, namespace}, nil
+		}
+		return &Owner{OwnerKindReplicaSet, ownerRef.Name, namespace}, nil
+	}
+	return nil, nil
+}
+
+func (oc *ownerController) OwnerReplicas(ctx context.Context, owner Owner) (int32, error) {
+	var replicas *int32
+	switch owner.Kind {
+	case OwnerKindDeployment:
+		deployment, err := oc.client.AppsV1().Deployments(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("error getting deployment %s/%s: %w", owner.Namespace, owner.Name, err)
+		}
+		replicas = deployment.Spec.Replicas
+	case OwnerKindStatefulSet:
+		statefulSet, err := oc.client.AppsV1().StatefulSets(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("error getting statefulset %s/%s: %w", owner.Namespace, owner.Name, err)
+		}
+		replicas = statefulSet.Spec.Replicas
+	case OwnerKindReplicaSet:
+		replicaSet, err := oc.client.AppsV1().ReplicaSets(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("error getting replicaset %s/%s: %w", owner.Namespace, owner.Name, err)
+		}
+		replicas = replicaSet.Spec.Replicas
+	case OwnerKindJob:
+		job, err := oc.client.BatchV1().Jobs(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("error getting job %s/%s: %w", owner.Namespace, owner.Name, err)
+		}
+		replicas = job.Spec.Parallelism
+	default:
+		return 0, fmt.Errorf("unsupported owner kind: %s", owner.Kind)
+	}
+	return replicasOrDefault(replicas), nil
+}
+
+func (oc *ownerController) ScaleOwner(ctx context.Context, owner Owner, replicas int32, templateAnnotations map[string]string) (int32, error) {
+	var previousReplicas int32
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		switch owner.Kind {
+		case OwnerKindDeployment:
+			previousReplicas, err = oc.scaleDeployment(ctx, owner, replicas, templateAnnotations)
+		case OwnerKindStatefulSet:
+			previousReplicas, err = oc.scaleStatefulSet(ctx, owner, replicas, templateAnnotations)
+		case OwnerKindReplicaSet:
+			previousReplicas, err = oc.scaleReplicaSet(ctx, owner, replicas, templateAnnotations)
+		case OwnerKindJob:
+			previousReplicas, err = oc.scaleJob(ctx, owner, replicas, templateAnnotations)
+		default:
+			return fmt.Errorf("unsupported owner kind: %s", owner.Kind)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to scale %s %s/%s: %w", owner.Kind, owner.Namespace, owner.Name, err)
+	}
+	return previousReplicas, nil
+}
+
+func (oc *ownerController) scaleDeployment(ctx context.Context, owner Owner, replicas int32, templateAnnotations map[string]string) (int32, error) {
+	deployment, err := oc.client.AppsV1().Deployments(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	previousReplicas := replicasOrDefault(deployment.Spec.Replicas)
+	deployment.Spec.Replicas = &replicas
+	deployment.Spec.Template.Annotations = mergeAnnotations(deployment.Spec.Template.Annotations, templateAnnotations)
+	_, err = oc.client.AppsV1().Deployments(owner.Namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+	return previousReplicas, err
+}
+
+func (oc *ownerController) scaleStatefulSet(ctx context.Context, owner Owner, replicas int32, templateAnnotations map[string]string) (int32, error) {
+	statefulSet, err := oc.client.AppsV1().StatefulSets(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	previousReplicas := replicasOrDefault(statefulSet.Spec.Replicas)
+	statefulSet.Spec.Replicas = &replicas
+	statefulSet.Spec.Template.Annotations = mergeAnnotations(statefulSet.Spec.Template.Annotations, templateAnnotations)
+	_, err = oc.client.AppsV1().StatefulSets(owner.Namespace).Update(ctx, statefulSet, metav1.UpdateOptions{})
+	return previousReplicas, err
+}
+
+func (oc *ownerController) scaleReplicaSet(ctx context.Context, owner Owner, replicas int32, templateAnnotations map[string]string) (int32, error) {
+	replicaSet, err := oc.client.AppsV1().ReplicaSets(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	previousReplicas := replicasOrDefault(replicaSet.Spec.Replicas)
+	replicaSet.Spec.Replicas = &replicas
+	replicaSet.Spec.Template.Annotations = mergeAnnotations(replicaSet.Spec.Template.Annotations, templateAnnotations)
+	_, err = oc.client.AppsV1().ReplicaSets(owner.Namespace).Update(ctx, replicaSet, metav1.UpdateOptions{})
+	return previousReplicas, err
+}
+
+// scaleJob uses parallelism as the number of replicas. Pod template of a Job is immutable, therefore
+// templateAnnotations are merged into annotations of the Job, which the restore webhook reads for the Pods of the Job.
+func (oc *ownerController) scaleJob(ctx context.Context, owner Owner, parallelism int32, templateAnnotations map[string]string) (int32, error) {
+	job, err := oc.client.BatchV1().Jobs(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	previousParallelism := replicasOrDefault(job.Spec.Parallelism)
+	job.Spec.Parallelism = &parallelism
+	job.Annotations = mergeAnnotations(job.Annotations, templateAnnotations)
+	_, err = oc.client.BatchV1().Jobs(owner.Namespace).Update(ctx, job, metav1.UpdateOptions{})
+	return previousParallelism, err
+}
+
+// replicasOrDefault returns the value of replicas or 1, which Kubernetes defaults to when replicas are not set.
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+func mergeAnnotations(annotations, toMerge map[string]string) map[string]string {
+	if len(toMerge) == 0 {
+		return annotations
+	}
+	if annotations == nil {
+		annotations = make(map[string]string, len(toMerge))
+	}
+	for key, value := range toMerge {
+		annotations[key] = value
+	}
+	return annotations
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func controllerRef(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func TestFindScalableOwner_Deployment(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns", OwnerReferences: controllerRef("ReplicaSet", "rs")}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "rs", Namespace: "ns", OwnerReferences: controllerRef("Deployment", "deploy")}},
+	)
+
+	owner, err := NewOwnerController(client).FindScalableOwner(context.TODO(), "pod", "ns")
+	if err != nil {
+		t.Fatalf("FindScalableOwner failed with error: %v", err)
+	}
+	if owner == nil || *owner != (Owner{OwnerKindDeployment, "deploy", "ns"}) {
+		t.Fatalf("FindScalableOwner returned wrong owner: %v", owner)
+	}
+}
+
+func TestFindScalableOwner_NoOwner(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns"}})
+
+	owner, err := NewOwnerController(client).FindScalableOwner(context.TODO(), "pod", "ns")
+	if err != nil {
+		t.Fatalf("FindScalableOwner failed with error: %v", err)
+	}
+	if owner != nil {
+		t.Fatalf("FindScalableOwner should not find any owner: %v", owner)
+	}
+}
+
+func TestScaleOwner_StatefulSet(t *testing.T) {
+	replicas := int32(3)
+	client := fake.NewSimpleClientset(
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "sts", Namespace: "ns"}, Spec: appsv1.StatefulSetSpec{Replicas: &replicas}},
+	)
+	ownerController := NewOwnerController(client)
+
+	previous, err := ownerController.ScaleOwner(context.TODO(), Owner{OwnerKindStatefulSet, "sts", "ns"}, 0, map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatalf("ScaleOwner failed with error: %v", err)
+	}
+	if previous != 3 {
+		t.Fatalf("ScaleOwner returned wrong previous replicas: %d", previous)
+	}
+
+	statefulSet, _ := client.AppsV1().StatefulSets("ns").Get(context.TODO(), "sts", metav1.GetOptions{})
+	if *statefulSet.Spec.Replicas != 0 {
+		t.Fatalf("StatefulSet was not scaled to zero")
+	}
+	if statefulSet.Spec.Template.Annotations["key"] != "value" {
+		t.Fatalf("StatefulSet Pod template was not annotated")
+	}
+}
+
+func TestOwnerReplicas(t *testing.T) {
+	replicas := int32(2)
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "deploy", Namespace: "ns"}, Spec: appsv1.DeploymentSpec{Replicas: &replicas}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "ns"}},
+	)
+	ownerController := NewOwnerController(client)
+
+	if replicas, err := ownerController.OwnerReplicas(context.TODO(), Owner{OwnerKindDeployment, "deploy", "ns"}); err != nil || replicas != 2 {
+		t.Fatalf("OwnerReplicas returned wrong replicas: %d, error: %v", replicas, err)
+	}
+	if parallelism, err := ownerController.OwnerReplicas(context.TODO(), Owner{OwnerKindJob, "job", "ns"}); err != nil || parallelism != 1 {
+		t.Fatalf("OwnerReplicas should default parallelism of Job to 1, got: %d, error: %v", parallelism, err)
+	}
+}
+
+func TestScaleOwner_Job(t *testing.T) {
+	client := fake.NewSimpleClientset(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "ns"}})
+	ownerController := NewOwnerController(client)
+
+	if _, err := ownerController.ScaleOwner(context.TODO(), Owner{OwnerKindJob, "job", "ns"}, 1, map[string]string{"key": "value"}); err != nil {
+		t.Fatalf("ScaleOwner failed with error: %v", err)
+	}
+
+	job, _ := client.BatchV1().Jobs("ns").Get(context.TODO(), "job", metav1.GetOptions{})
+	if job.Annotations["key"] != "value" || job.Spec.Template.Annotations != nil {
+		t.Fatalf("Job should be annotated instead of its immutable Pod template, got: %v", job.Annotations)
+	}
+}
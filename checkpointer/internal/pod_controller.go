@@ -10,6 +10,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 	"log"
@@ -32,6 +33,11 @@ type PodController interface {
 	// if timed-out waiting for Pod.
 	AttachAndStreamToContainer(ctx context.Context, container, podName, namespace string, reader io.Reader, timeout time.Duration) error
 
+	// ExecInContainer executes command in container within podName in namespace and writes its output to stdout and
+	// stderr. Returns error if any of the Kubernetes API calls fails or the command exits with non-zero code, in which
+	// case the error is exec.ExitError.
+	ExecInContainer(ctx context.Context, container, podName, namespace string, command []string, stdout, stderr io.Writer) error
+
 	// WaitForPodRunning wait until podName in namespace is in Running phase. Returns an error if timeout is exceeded or
 	// a call to Kubernetes API fails.
 	WaitForPodRunning(ctx context.Context, podName, namespace string, timeout time.Duration) error
@@ -40,6 +46,17 @@ type PodController interface {
 	// a call to Kubernetes API fails.
 	WaitForPodSucceeded(ctx context.Context, podName, namespace string, timeout time.Duration) error
 
+	// WaitForPodReady wait until podName in namespace is Running and all of its containers are ready. Returns an error
+	// if timeout is exceeded, the Pod terminates or a call to Kubernetes API fails.
+	WaitForPodReady(ctx context.Context, podName, namespace string, timeout time.Duration) error
+
+	// WaitForPodStaysRunning watches podName in namespace for duration and returns an error if the Pod leaves the
+	// Running phase, any of its containers restarts or a call to Kubernetes API fails.
+	WaitForPodStaysRunning(ctx context.Context, podName, namespace string, duration time.Duration) error
+
+	// GetPod returns the Pod with podName in namespace or error if a call to Kubernetes API fails.
+	GetPod(ctx context.Context, podName, namespace string) (*v1.Pod, error)
+
 	// DeleteAndWaitForRemoval deletes a podName in namespace and waits until timeout for Kubernetes API to no longer
 	// return the Pod. Returns error if any of the Kubernetes API calls fails or timeout is reached.
 	DeleteAndWaitForRemoval(
@@ -53,6 +70,14 @@ type NodePodController interface {
 	// found, returns empty string instead. Error is returned in case of failed call to Kubernetes API.
 	GetPodIPForNode(ctx context.Context, nodeName, labelSelector string) (string, error)
 
+	// GetPodIPsByNode finds all running Pods based on labelSelector and returns their IP addresses keyed by the name
+	// of the Node they run on. Error is returned in case of failed call to Kubernetes API.
+	GetPodIPsByNode(ctx context.Context, labelSelector string) (map[string]string, error)
+
+	// ListNodes returns the names of all Nodes of the cluster. Error is returned in case of failed call to Kubernetes
+	// API.
+	ListNodes(ctx context.Context) ([]string, error)
+
 	// GetNodeOfPod returns the name of the Node that the Pod is running on or error a call to Kubernetes API fails.
 	// If the Pod does not exist returns empty string and nil error.
 	GetNodeOfPod(ctx context.Context, podName, namespace string) (string, error)
@@ -141,6 +166,37 @@ func (pc *podController) AttachAndStreamToContainer(
 	return nil
 }
 
+func (pc *podController) ExecInContainer(
+	ctx context.Context,
+	container, podName, namespace string,
+	command []string,
+	stdout, stderr io.Writer,
+) error {
+	req := pc.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	zerolog.Ctx(ctx).Debug().Str("container", container).Strs("command", command).Msg("executing command in container")
+
+	executor, err := remotecommand.NewSPDYExecutor(pc.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: stderr,
+		Tty:    false,
+	})
+}
+
 func (pc *podController) GetPodIPForNode(ctx context.Context, nodeName, labelSelector string) (string, error) {
 	pods, err := pc.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
 		LabelSelector: labelSelector,
@@ -159,6 +215,36 @@ func (pc *podController) GetPodIPForNode(ctx context.Context, nodeName, labelSel
 	return "", nil
 }
 
+func (pc *podController) GetPodIPsByNode(ctx context.Context, labelSelector string) (map[string]string, error) {
+	pods, err := pc.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods with label selector %s: %w", labelSelector, err)
+	}
+
+	podIPs := make(map[string]string, len(pods.Items))
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && pod.Status.PodIP != "" {
+			podIPs[pod.Spec.NodeName] = pod.Status.PodIP
+		}
+	}
+	return podIPs, nil
+}
+
+func (pc *podController) ListNodes(ctx context.Context) ([]string, error) {
+	nodes, err := pc.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing nodes: %w", err)
+	}
+
+	nodeNames := make([]string, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		nodeNames = append(nodeNames, node.Name)
+	}
+	return nodeNames, nil
+}
+
 func (pc *podController) GetNodeOfPod(ctx context.Context, podName, namespace string) (string, error) {
 	pod, err := pc.client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
@@ -178,6 +264,61 @@ func (pc *podController) WaitForPodSucceeded(ctx context.Context, podName, names
 	return pc.waitForPodPhase(ctx, podName, namespace, timeout, v1.PodSucceeded, v1.PodFailed)
 }
 
+func (pc *podController) WaitForPodReady(ctx context.Context, podName, namespace string, timeout time.Duration) error {
+	checkPodReady := func(ctx context.Context) (bool, error) {
+		zerolog.Ctx(ctx).Debug().Str("namespace", namespace).Str("podName", podName).Msg("polling for Pod readiness...")
+		pod, err := pc.client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+			return false, fmt.Errorf("pod reached unexpected phase: %s", pod.Status.Phase)
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady {
+				return condition.Status == v1.ConditionTrue, nil
+			}
+		}
+		return false, nil
+	}
+
+	return wait.PollUntilContextTimeout(ctx, time.Second, timeout, true, checkPodReady)
+}
+
+func (pc *podController) WaitForPodStaysRunning(ctx context.Context, podName, namespace string, duration time.Duration) error {
+	checkPodRunning := func(ctx context.Context) (bool, error) {
+		zerolog.Ctx(ctx).Debug().Str("namespace", namespace).Str("podName", podName).Msg("polling for Pod phase...")
+		pod, err := pc.client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase != v1.PodRunning {
+			return false, fmt.Errorf("pod left Running phase: %s", pod.Status.Phase)
+		}
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			if containerStatus.RestartCount > 0 {
+				return false, fmt.Errorf("container %s restarted", containerStatus.Name)
+			}
+		}
+		return false, nil
+	}
+
+	err := wait.PollUntilContextTimeout(ctx, time.Second, duration, true, checkPodRunning)
+	if wait.Interrupted(err) && ctx.Err() == nil {
+		// The Pod stayed running for the whole duration.
+		return nil
+	}
+	return err
+}
+
+func (pc *podController) GetPod(ctx context.Context, podName, namespace string) (*v1.Pod, error) {
+	pod, err := pc.client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting pod %s/%s: %w", namespace, podName, err)
+	}
+	return pod, nil
+}
+
 func (pc *podController) waitForPodPhase(
 	ctx context.Context, podName, namespace string, timeout time.Duration,
 	targetPhase v1.PodPhase, failurePhases ...v1.PodPhase) error {
@@ -202,7 +343,7 @@ func (pc *podController) waitForPodPhase(
 func (pc *podController) DeleteAndWaitForRemoval(
 	ctx context.Context, podName, namespace string, timeout time.Duration) error {
 
-	err := pc.DeletePod(ctx, podName, namespace)
+	err := pc.DeletePod(ctx, namespace, podName)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,363 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrImageNotFound = errors.New("registry responded with 404 status code")
+
+// manifestMediaTypes are the manifest media types accepted from registries, so that the digest of the manifest is
+// the one the image was pushed with.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// challengeParamPattern matches the key="value" parameters of the WWW-Authenticate header.
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// dockerHubRegistry is the registry of image references without a registry host.
+const dockerHubRegistry = "docker.io"
+
+// tagsPageSize is the number of tags requested from registries at once.
+const tagsPageSize = 1000
+
+// ImageReference represents a parsed container image reference, e.g. quay.io/pbaran/checkpointed:138248b8f5936ca3.
+type ImageReference struct {
+	// Registry is the host of the registry, docker.io if the image reference does not contain one.
+	Registry string
+
+	// Repository is the path of the repository within the registry.
+	Repository string
+
+	// Reference is the tag or the digest of the image.
+	Reference string
+}
+
+// ParseImageReference parses container image reference. Returns error if image is not a valid image reference.
+func ParseImageReference(image string) (ImageReference, error) {
+	ref := ImageReference{Registry: dockerHubRegistry, Reference: "latest"}
+
+	name := image
+	if before, digest, found := strings.Cut(image, "@"); found {
+		name, ref.Reference = before, digest
+	} else if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		name, ref.Reference = image[:colon], image[colon+1:]
+	}
+
+	first, rest, found := strings.Cut(name, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry, name = first, rest
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || ref.Reference == "" {
+		return ImageReference{}, fmt.Errorf("invalid image reference: %s", image)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// apiHost returns the host serving the Registry HTTP API V2 of the registry.
+func (ref ImageReference) apiHost() string {
+	if ref.Registry == dockerHubRegistry {
+		return "registry-1.docker.io"
+	}
+	return ref.Registry
+}
+
+// DockerConfig represents the content of Docker config.json, as stored in kubernetes.io/dockerconfigjson Secrets.
+type DockerConfig struct {
+	Auths map[string]DockerAuth `json:"auths"`
+}
+
+// DockerAuth represents the credentials for a single registry in DockerConfig.
+type DockerAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Auth is base64 encoded username:password, used if Username is not set.
+	Auth string `json:"auth,omitempty"`
+}
+
+// credentials returns the username and password for registry. Returns empty strings if there are none.
+func (dc DockerConfig) credentials(registry string) (string, string) {
+	for server, auth := range dc.Auths {
+		host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		if host == "index.docker.io" || host == "registry-1.docker.io" {
+			host = dockerHubRegistry
+		}
+		if host != registry {
+			continue
+		}
+		if auth.Username != "" {
+			return auth.Username, auth.Password
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", ""
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return username, password
+	}
+	return "", ""
+}
+
+// RegistryController is responsible for invoking the Registry HTTP API V2 of container registries.
+type RegistryController interface {
+
+	// DeleteImage deletes the manifest that image points to from its registry, authenticating with the credentials
+	// for the registry from dockerConfig. Returns ErrImageNotFound if the registry does not know the image.
+	DeleteImage(ctx context.Context, image string, dockerConfig DockerConfig) error
+
+	// ManifestDigest returns the digest of the manifest that image points to, authenticating with the credentials for
+	// the registry from dockerConfig. Returns ErrImageNotFound if the registry does not know the image.
+	ManifestDigest(ctx context.Context, image string, dockerConfig DockerConfig) (string, error)
+
+	// ListTags returns every tag of repository, e.g. quay.io/pbaran/checkpointed, authenticating with the credentials
+	// for the registry from dockerConfig. Returns ErrImageNotFound if the registry does not know the repository.
+	ListTags(ctx context.Context, repository string, dockerConfig DockerConfig) ([]string, error)
+}
+
+func NewRegistryController() RegistryController {
+	return &registryController{&http.Client{}, "https"}
+}
+
+type registryController struct {
+	client *http.Client
+	// scheme is the URL scheme registries are called with, https unless testing.
+	scheme string
+}
+
+func (rc registryController) DeleteImage(ctx context.Context, image string, dockerConfig DockerConfig) error {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return err
+	}
+
+	// Registries only delete manifests by digest.
+	digest := ref.Reference
+	if !strings.Contains(digest, ":") {
+		if digest, err = rc.manifestDigest(ctx, ref, dockerConfig); err != nil {
+			return err
+		}
+	}
+
+	res, err := rc.do(ctx, http.MethodDelete, ref, "manifests/"+digest, nil, dockerConfig)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrImageNotFound
+	case http.StatusMethodNotAllowed:
+		return fmt.Errorf("registry %s does not allow deleting images", ref.Registry)
+	}
+	return fmt.Errorf("registry responded with %d status code to delete request", res.StatusCode)
+}
+
+func (rc registryController) ManifestDigest(ctx context.Context, image string, dockerConfig DockerConfig) (string, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	return rc.manifestDigest(ctx, ref, dockerConfig)
+}
+
+func (rc registryController) manifestDigest(ctx context.Context, ref ImageReference, dockerConfig DockerConfig) (string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	res, err := rc.do(ctx, http.MethodHead, ref, "manifests/"+ref.Reference, header, dockerConfig)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", ErrImageNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry responded with %d status code to manifest request", res.StatusCode)
+	}
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry did not respond with manifest digest")
+	}
+	return digest, nil
+}
+
+func (rc registryController) ListTags(ctx context.Context, repository string, dockerConfig DockerConfig) ([]string, error) {
+	ref, err := ParseImageReference(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	path := fmt.Sprintf("tags/list?n=%d", tagsPageSize)
+	for path != "" {
+		res, err := rc.do(ctx, http.MethodGet, ref, path, nil, dockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			return nil, ErrImageNotFound
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("registry responded with %d status code to tags request", res.StatusCode)
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tags response: %w", err)
+		}
+		tags = append(tags, page.Tags...)
+		path = nextTagsPath(res.Header.Get("Link"))
+	}
+	return tags, nil
+}
+
+// nextTagsPath returns the path of the next page of tags within the repository given by the Link header of the
+// previous page, e.g. </v2/checkpoints/tags/list?last=abc&n=100>; rel="next". Returns empty string on the last page.
+func nextTagsPath(link string) string {
+	target, params, found := strings.Cut(link, ";")
+	if !found || !strings.Contains(params, `rel="next"`) {
+		return ""
+	}
+	next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+	if err != nil {
+		return ""
+	}
+	return "tags/list?" + next.RawQuery
+}
+
+// do sends request to the path within the repository of ref. If the registry asks for authentication, the request is
+// sent again authenticated with the credentials from dockerConfig.
+func (rc registryController) do(ctx context.Context, method string, ref ImageReference, path string, header http.Header, dockerConfig DockerConfig) (*http.Response, error) {
+	requestURL := fmt.Sprintf("%s://%s/v2/%s/%s", rc.scheme, ref.apiHost(), ref.Repository, path)
+	zerolog.Ctx(ctx).Debug().Str("requestURL", requestURL).Str("method", method).Msg("sending an HTTP request to registry")
+
+	res, err := rc.send(ctx, method, requestURL, header, "")
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	challenge := res.Header.Get("WWW-Authenticate")
+	res.Body.Close()
+
+	username, password := dockerConfig.credentials(ref.Registry)
+	authorization, err := rc.authorize(ctx, challenge, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return rc.send(ctx, method, requestURL, header, authorization)
+}
+
+func (rc registryController) send(ctx context.Context, method, requestURL string, header http.Header, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := rc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an http request: %w", err)
+	}
+	return res, nil
+}
+
+// authorize answers the WWW-Authenticate challenge of a registry. Returns the value of the Authorization header or
+// error if the challenge cannot be answered.
+func (rc registryController) authorize(ctx context.Context, challenge, username, password string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return "", fmt.Errorf("registry requires credentials, but there are none")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	case "bearer":
+		token, err := rc.fetchToken(ctx, params, username, password)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported registry authentication challenge: %q", challenge)
+}
+
+// fetchToken obtains bearer token from the token service given by params of the challenge.
+func (rc registryController) fetchToken(ctx context.Context, params, username, password string) (string, error) {
+	challenge := make(map[string]string)
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(params, -1) {
+		challenge[match[1]] = match[2]
+	}
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm in registry challenge: %q", challenge["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, found := challenge[key]; found {
+			query.Set(key, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create http request: %w", err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	res, err := rc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send an http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return "", fmt.Errorf("token service responded with %d status code: %s", res.StatusCode, body)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	if tokenResponse.AccessToken != "" {
+		return tokenResponse.AccessToken, nil
+	}
+	return "", fmt.Errorf("token service responded without token")
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  ImageReference
+	}{
+		{"quay.io/pbaran/checkpointed:138248b8", ImageReference{"quay.io", "pbaran/checkpointed", "138248b8"}},
+		{"pbaran555/kaniko-checkpointed:abc", ImageReference{"docker.io", "pbaran555/kaniko-checkpointed", "abc"}},
+		{"ubuntu", ImageReference{"docker.io", "library/ubuntu", "latest"}},
+		{"localhost:5000/checkpoints@sha256:0123", ImageReference{"localhost:5000", "checkpoints", "sha256:0123"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseImageReference(tt.image)
+		if err != nil {
+			t.Errorf("ParseImageReference(%s) failed with error %v", tt.image, err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseImageReference(%s) = %+v, want %+v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestDockerConfig_credentials(t *testing.T) {
+	dockerConfig := DockerConfig{Auths: map[string]DockerAuth{
+		"https://index.docker.io/v1/": {Auth: base64.StdEncoding.EncodeToString([]byte("hub:secret"))},
+		"quay.io":                     {Username: "quay", Password: "pass"},
+	}}
+
+	if username, password := dockerConfig.credentials("docker.io"); username != "hub" || password != "secret" {
+		t.Errorf("credentials of docker.io are wrong: %s:%s", username, password)
+	}
+	if username, password := dockerConfig.credentials("quay.io"); username != "quay" || password != "pass" {
+		t.Errorf("credentials of quay.io are wrong: %s:%s", username, password)
+	}
+	if username, _ := dockerConfig.credentials("ghcr.io"); username != "" {
+		t.Errorf("there should be no credentials of ghcr.io")
+	}
+}
+
+func TestDeleteImage_BearerToken(t *testing.T) {
+	var deleted string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "secret-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:checkpoints:delete"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/v2/checkpoints/manifests/abc":
+			w.Header().Set("Docker-Content-Digest", "sha256:0123")
+		case r.Method == http.MethodDelete && r.URL.Path == "/v2/checkpoints/manifests/sha256:0123":
+			deleted = "sha256:0123"
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	dockerConfig := DockerConfig{Auths: map[string]DockerAuth{host: {Username: "user", Password: "pass"}}}
+	registryCtrl := registryController{&http.Client{}, "http"}
+
+	if err := registryCtrl.DeleteImage(context.TODO(), host+"/checkpoints:abc", dockerConfig); err != nil {
+		t.Fatalf("DeleteImage failed with error %v", err)
+	}
+	if deleted != "sha256:0123" {
+		t.Errorf("DeleteImage did not delete the manifest by its digest")
+	}
+
+	if err := registryCtrl.DeleteImage(context.TODO(), host+"/checkpoints:missing", dockerConfig); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("DeleteImage of missing image should fail with ErrImageNotFound, got: %v", err)
+	}
+}
+
+func TestListTags_Paginated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/checkpoints/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `</v2/checkpoints/tags/list?last=b&n=2>; rel="next"`)
+			w.Write([]byte(`{"name": "checkpoints", "tags": ["a", "b"]}`))
+			return
+		}
+		w.Write([]byte(`{"name": "checkpoints", "tags": ["c"]}`))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	registryCtrl := registryController{&http.Client{}, "http"}
+
+	tags, err := registryCtrl.ListTags(context.TODO(), host+"/checkpoints", DockerConfig{})
+	if err != nil {
+		t.Fatalf("ListTags failed with error %v", err)
+	}
+	if strings.Join(tags, ",") != "a,b,c" {
+		t.Errorf("ListTags should follow the next page, got: %v", tags)
+	}
+
+	if _, err := registryCtrl.ListTags(context.TODO(), host+"/missing", DockerConfig{}); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("ListTags of missing repository should fail with ErrImageNotFound, got: %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"checkpoint-in-k8s/pkg/config"
 	"context"
 	"fmt"
+	"github.com/rs/zerolog"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -13,19 +14,81 @@ import (
 type CheckpointerParams struct {
 
 	// ContainerIdentifier represents the container to be checkpointed.
-	ContainerIdentifier ContainerIdentifier
+	ContainerIdentifier ContainerIdentifier `json:"containerIdentifier"`
 
-	// DeletePod instructs whether to delete the container Pod after checkpoint.
-	DeletePod bool
+	// StopPolicy instructs what to do with the container Pod after the checkpoint image is pushed. It is not applied by
+	// Checkpointer itself, but by its caller through PodStopper.
+	StopPolicy StopPolicy `json:"stopPolicy,omitempty"`
 
 	// CheckpointIdentifier identifies the checkpoint request. It is also used as a unique image tag.
-	CheckpointIdentifier string
+	CheckpointIdentifier string `json:"checkpointIdentifier"`
+
+	// Priority orders the checkpoints waiting to run, higher first. It is not used by Checkpointer itself, but by its
+	// caller.
+	Priority int64 `json:"priority,omitempty"`
+
+	// Publish defines when the checkpoint image is built and pushed. It is not applied by Checkpointer itself, but by
+	// its caller, which calls CheckpointContainer and Checkpoint separately in case of PublishDeferred.
+	Publish PublishMode `json:"publish,omitempty"`
+
+	// Labels are arbitrary key-value pairs recorded with the checkpoint, so that checkpoints can be listed by them.
+	// They are not used by Checkpointer itself, but by its caller.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Slot is the name of the slot whose history the checkpoint joins once it succeeds, so that the latest good
+	// checkpoint of a workload can be found regardless of its Pod. It is not used by Checkpointer itself, but by its
+	// caller. Can be empty.
+	Slot string `json:"slot,omitempty"`
+
+	// Verify instructs to test restore the checkpoint image through Verifier after it is pushed.
+	Verify bool `json:"verify,omitempty"`
+
+	// VerifyNode is the name of the Node to test restore the checkpoint image on. Defaults to the Checkpointer's Node.
+	VerifyNode string `json:"verifyNode,omitempty"`
+
+	// CallbackUrl is the URL the final result of an asynchronous checkpoint is delivered to. It is not used by
+	// Checkpointer itself, but by its caller. Can be empty.
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+
+	// CallbackSecret is the key the delivered result is signed with. Can be empty. It is never persisted, so it is
+	// lost when the checkpoint is recovered after restart.
+	CallbackSecret string `json:"-"`
+
+	// CallbackSigned records that the result has to be signed with CallbackSecret, so that the callback of
+	// a recovered checkpoint, which lost its CallbackSecret, is dropped rather than delivered unsigned.
+	CallbackSigned bool `json:"callbackSigned,omitempty"`
+
+	// CheckpointArchive is the path to the checkpoint archive Kubelet already created for the container. If set,
+	// Checkpointer builds the image from it instead of calling Kubelet, e.g. when resuming an interrupted checkpoint
+	// or retrying a failed build.
+	CheckpointArchive string `json:"checkpointArchive,omitempty"`
+
+	// Hooks are run in the checkpointed container around its checkpoint by Kubelet. If nil, the hooks are read from
+	// the annotations of the checkpointed Pod. They are not run if CheckpointArchive is set.
+	Hooks *Hooks `json:"hooks,omitempty"`
+
+	// OnPhase is called by Checkpointer whenever the checkpoint enters a new Phase. Can be nil.
+	OnPhase func(phase Phase) `json:"-"`
+
+	// OnCheckpointArchive is called by Checkpointer with the path to the checkpoint archive once Kubelet created it.
+	// Can be nil.
+	OnCheckpointArchive func(checkpointArchive string) `json:"-"`
+
+	// OnHookResult is called by Checkpointer with the result of each hook once it finished. Can be nil.
+	OnHookResult func(result HookResult) `json:"-"`
 }
 
 // Checkpointer is responsible for checkpointing containers in Kubernetes.
 type Checkpointer interface {
-	// Checkpoint checkpoints a container based on params and returns the checkpoint image name or error.
+	// Checkpoint checkpoints a container based on params and returns the checkpoint image name or error. The
+	// checkpoint archive created by Kubelet is removed on success, but kept on failure, so that the caller can retry
+	// the build through CheckpointerParams.CheckpointArchive. Removing it afterward is up to the caller.
 	Checkpoint(ctx context.Context, params CheckpointerParams) (string, error)
+
+	// CheckpointContainer checkpoints a container based on params through Kubelet and returns the path to the
+	// checkpoint archive without building the checkpoint image, which can be done later through Checkpoint with
+	// CheckpointerParams.CheckpointArchive.
+	CheckpointContainer(ctx context.Context, params CheckpointerParams) (string, error)
 }
 
 // NewCheckpointer constructs new Checkpointer instance with stdin or filesystem strategy based on the UseKanikoFS
@@ -59,3 +122,34 @@ type ContainerIdentifier struct {
 func (ci ContainerIdentifier) String() string {
 	return ci.Namespace + "/" + ci.Pod + "/" + ci.Container
 }
+
+// checkpointArchive returns the checkpoint archive from params if set, otherwise calls Kubelet to checkpoint the
+// container between its pre and post hooks and reports the created archive to the caller. The post hook runs even if
+// the pre hook or Kubelet failed, but a failure of either takes precedence over a failure of the post hook.
+func (params CheckpointerParams) checkpointArchive(ctx context.Context, podController internal.PodController, kubeletController internal.KubeletController) (string, error) {
+	if params.CheckpointArchive != "" {
+		zerolog.Ctx(ctx).Info().Str("tarName", params.CheckpointArchive).Msg("using existing checkpoint archive")
+		return params.CheckpointArchive, nil
+	}
+	params.reportPhase(PhaseCheckpointingContainer)
+	hooks, err := params.resolveHooks(ctx, podController)
+	if err != nil {
+		return "", err
+	}
+
+	checkpointTarName, err := "", params.runHook(ctx, podController, HookTypePre, hooks.Pre)
+	if err == nil {
+		checkpointTarName, err = kubeletController.CallKubeletCheckpoint(ctx, params.ContainerIdentifier.String())
+		if err == nil && params.OnCheckpointArchive != nil {
+			params.OnCheckpointArchive(checkpointTarName)
+		}
+	}
+	// The post hook must run even if the checkpoint was cancelled, e.g. to resume the paused workload.
+	if postErr := params.runHook(context.WithoutCancel(ctx), podController, HookTypePost, hooks.Post); err == nil {
+		err = postErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return checkpointTarName, nil
+}
@@ -0,0 +1,122 @@
+package checkpoint
+
+import (
+	"checkpoint-in-k8s/internal"
+	"context"
+	"errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ErrorCode is a machine-readable classification of a checkpoint failure.
+type ErrorCode string
+
+const (
+	// ErrorCodeContainerNotFound means Kubelet could not find the container to checkpoint.
+	ErrorCodeContainerNotFound ErrorCode = "ContainerNotFound"
+
+	// ErrorCodeKubeletUnavailable means Kubelet could not be reached or failed to checkpoint the container.
+	ErrorCodeKubeletUnavailable ErrorCode = "KubeletUnavailable"
+
+	// ErrorCodeBuildFailed means the build context of the checkpoint image could not be prepared or the Kaniko Pod
+	// could not be created.
+	ErrorCodeBuildFailed ErrorCode = "BuildFailed"
+
+	// ErrorCodePushFailed means Kaniko failed to build or push the checkpoint image.
+	ErrorCodePushFailed ErrorCode = "PushFailed"
+
+	// ErrorCodeTimeout means the checkpoint did not finish in time.
+	ErrorCodeTimeout ErrorCode = "Timeout"
+
+	// ErrorCodeCancelled means the checkpoint was cancelled before it finished.
+	ErrorCodeCancelled ErrorCode = "Cancelled"
+
+	// ErrorCodeHookFailed means a pre or post checkpoint hook with the abort failure policy failed.
+	ErrorCodeHookFailed ErrorCode = "HookFailed"
+
+	// ErrorCodePodDeleteFailed means the checkpointed Pod could not be stopped according to StopPolicy.
+	ErrorCodePodDeleteFailed ErrorCode = "PodDeleteFailed"
+
+	// ErrorCodeCheckpointerRestarted means the checkpoint was interrupted by Checkpointer restart and could not be
+	// resumed.
+	ErrorCodeCheckpointerRestarted ErrorCode = "CheckpointerRestarted"
+
+	// ErrorCodeInternal means the failure does not fall into any other category.
+	ErrorCodeInternal ErrorCode = "Internal"
+)
+
+// Retryable reports whether a checkpoint that failed with the code might succeed when requested again.
+func (code ErrorCode) Retryable() bool {
+	switch code {
+	case ErrorCodeKubeletUnavailable, ErrorCodePushFailed, ErrorCodeTimeout, ErrorCodePodDeleteFailed, ErrorCodeCheckpointerRestarted:
+		return true
+	}
+	return false
+}
+
+// CheckpointError describes why a checkpoint failed. Unlike plain error, it survives JSON round trip, so it can be
+// stored with the result of the checkpoint and returned to clients.
+type CheckpointError struct {
+	// Code classifies the failure.
+	Code ErrorCode `json:"code"`
+
+	// Message is the human-readable description of the failure.
+	Message string `json:"message"`
+
+	// Phase is the phase the checkpoint failed in.
+	Phase Phase `json:"phase,omitempty"`
+
+	// Retryable is true if the checkpoint might succeed when requested again.
+	Retryable bool `json:"retryable"`
+
+	// cause is the original error, it is not persisted.
+	cause error
+}
+
+// NewCheckpointError constructs new CheckpointError with code, which failed in phase because of cause.
+func NewCheckpointError(code ErrorCode, phase Phase, cause error) *CheckpointError {
+	return &CheckpointError{
+		Code:      code,
+		Message:   cause.Error(),
+		Phase:     phase,
+		Retryable: code.Retryable(),
+		cause:     cause,
+	}
+}
+
+// AsCheckpointError returns err as CheckpointError. If err does not wrap one, err is classified by its cause and
+// by the phase it occurred in.
+func AsCheckpointError(err error, phase Phase) *CheckpointError {
+	var checkpointErr *CheckpointError
+	if errors.As(err, &checkpointErr) {
+		return checkpointErr
+	}
+
+	switch {
+	case errors.Is(err, internal.ErrContainerNotFound):
+		return NewCheckpointError(ErrorCodeContainerNotFound, phase, err)
+	case errors.Is(err, context.Canceled):
+		return NewCheckpointError(ErrorCodeCancelled, phase, err)
+	case errors.Is(err, context.DeadlineExceeded) || wait.Interrupted(err):
+		return NewCheckpointError(ErrorCodeTimeout, phase, err)
+	}
+
+	switch phase {
+	case PhaseCheckpointingContainer:
+		return NewCheckpointError(ErrorCodeKubeletUnavailable, phase, err)
+	case PhaseCreatingBuilder, PhaseBuildingContext:
+		return NewCheckpointError(ErrorCodeBuildFailed, phase, err)
+	case PhasePushing:
+		return NewCheckpointError(ErrorCodePushFailed, phase, err)
+	case PhaseDeletingPod:
+		return NewCheckpointError(ErrorCodePodDeleteFailed, phase, err)
+	}
+	return NewCheckpointError(ErrorCodeInternal, phase, err)
+}
+
+func (e *CheckpointError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+func (e *CheckpointError) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,256 @@
+package checkpoint
+
+import (
+	"checkpoint-in-k8s/internal"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/exec"
+	"time"
+)
+
+const (
+	// PreCheckpointHookAnnotation holds the Hook run in the checkpointed container before it is checkpointed, as JSON.
+	PreCheckpointHookAnnotation = "checkpoint.k8s/pre-checkpoint-hook"
+
+	// PostCheckpointHookAnnotation holds the Hook run in the checkpointed container after it is checkpointed, as JSON.
+	PostCheckpointHookAnnotation = "checkpoint.k8s/post-checkpoint-hook"
+)
+
+// defaultHookTimeout bounds a hook without TimeoutSeconds.
+const defaultHookTimeout = 30 * time.Second
+
+// maxHookOutput is the maximum number of bytes of the standard output and of the standard error of a hook recorded in
+// HookResult, the rest is dropped.
+const maxHookOutput = 4096
+
+// HookFailurePolicy instructs what to do with the checkpoint if its hook fails.
+type HookFailurePolicy string
+
+const (
+	// HookFailurePolicyAbort fails the checkpoint if the hook fails.
+	HookFailurePolicyAbort HookFailurePolicy = "abort"
+
+	// HookFailurePolicyContinue continues the checkpoint even if the hook fails.
+	HookFailurePolicyContinue HookFailurePolicy = "continue"
+)
+
+// HookType identifies when the hook runs.
+type HookType string
+
+const (
+	// HookTypePre runs before Kubelet checkpoints the container, e.g. to flush buffers or close TCP connections.
+	HookTypePre HookType = "pre"
+
+	// HookTypePost runs after Kubelet checkpointed the container, whether it succeeded or failed, and after a failed
+	// pre hook, so that it can undo what the pre hook did.
+	HookTypePost HookType = "post"
+)
+
+// Hook represents a command run in the checkpointed container through pods/exec.
+type Hook struct {
+	// Command is the command with its arguments, it is not run in a shell.
+	Command []string `json:"command"`
+
+	// TimeoutSeconds bounds the run of the command, 30 seconds by default.
+	TimeoutSeconds int64 `json:"timeoutSeconds,omitempty"`
+
+	// OnFailure instructs what to do with the checkpoint if the command fails or times out, HookFailurePolicyAbort
+	// by default.
+	OnFailure HookFailurePolicy `json:"onFailure,omitempty"`
+}
+
+// Hooks represents the hooks run around the checkpoint of a container. Either hook can be nil.
+type Hooks struct {
+	Pre  *Hook `json:"pre,omitempty"`
+	Post *Hook `json:"post,omitempty"`
+}
+
+// Empty reports whether hooks run no command, which disables the hooks from the Pod annotations.
+func (hooks Hooks) Empty() bool {
+	return hooks.Pre == nil && hooks.Post == nil
+}
+
+// HookResult represents a single run of a hook.
+type HookResult struct {
+	// Type identifies the hook.
+	Type HookType `json:"type"`
+
+	// Command is the command that was run.
+	Command []string `json:"command"`
+
+	// ExitCode is the exit code of the command, -1 if it did not exit, e.g. on timeout.
+	ExitCode int `json:"exitCode"`
+
+	// Stdout is the standard output of the command, truncated to its first 4 KiB.
+	Stdout string `json:"stdout,omitempty"`
+
+	// Stderr is the standard error of the command, truncated to its first 4 KiB.
+	Stderr string `json:"stderr,omitempty"`
+
+	// Error is the reason the hook failed, empty if it succeeded.
+	Error string `json:"error,omitempty"`
+
+	// DurationMillis is the time the command ran in milliseconds.
+	DurationMillis int64 `json:"durationMillis"`
+}
+
+// Validate returns error if the hook cannot be run.
+func (hook *Hook) Validate() error {
+	if len(hook.Command) == 0 {
+		return errors.New("hook command must not be empty")
+	}
+	if hook.TimeoutSeconds < 0 {
+		return errors.New("hook timeoutSeconds must not be negative")
+	}
+	if hook.OnFailure != "" && hook.OnFailure != HookFailurePolicyAbort && hook.OnFailure != HookFailurePolicyContinue {
+		return fmt.Errorf("unknown hook failure policy %q, expected %q or %q", hook.OnFailure, HookFailurePolicyAbort, HookFailurePolicyContinue)
+	}
+	return nil
+}
+
+// Validate returns error if any of the hooks cannot be run.
+func (hooks *Hooks) Validate() error {
+	if hooks.Pre != nil {
+		if err := hooks.Pre.Validate(); err != nil {
+			return fmt.Errorf("pre hook: %w", err)
+		}
+	}
+	if hooks.Post != nil {
+		if err := hooks.Post.Validate(); err != nil {
+			return fmt.Errorf("post hook: %w", err)
+		}
+	}
+	return nil
+}
+
+// HookRunner is responsible for running the hooks of a container on their own, e.g. when the checkpoints of several
+// containers have to happen between their hooks.
+type HookRunner interface {
+
+	// RunHook runs the hook of hookType of the container identified by params, taken from params.Hooks or from the
+	// annotations of its Pod, and reports its result through params.OnHookResult. Returns error if the hooks could not
+	// be resolved or the hook failed and its failure policy is HookFailurePolicyAbort.
+	RunHook(ctx context.Context, params CheckpointerParams, hookType HookType) error
+}
+
+// NewHookRunner constructs new HookRunner instance.
+func NewHookRunner(client *kubernetes.Clientset, config *rest.Config) HookRunner {
+	return &hookRunner{internal.NewPodController(client, config)}
+}
+
+type hookRunner struct {
+	podController internal.PodController
+}
+
+func (hr *hookRunner) RunHook(ctx context.Context, params CheckpointerParams, hookType HookType) error {
+	hooks, err := params.resolveHooks(ctx, hr.podController)
+	if err != nil {
+		return err
+	}
+	if hookType == HookTypePre {
+		return params.runHook(ctx, hr.podController, hookType, hooks.Pre)
+	}
+	return params.runHook(ctx, hr.podController, hookType, hooks.Post)
+}
+
+// resolveHooks returns the hooks of params, or the hooks in the annotations of the checkpointed Pod if params have
+// none. Returns CheckpointError if the Pod cannot be read or its annotations are malformed.
+func (params CheckpointerParams) resolveHooks(ctx context.Context, podController internal.PodController) (*Hooks, error) {
+	if params.Hooks != nil {
+		return params.Hooks, nil
+	}
+	pod, err := podController.GetPod(ctx, params.ContainerIdentifier.Pod, params.ContainerIdentifier.Namespace)
+	if err != nil {
+		return nil, NewCheckpointError(ErrorCodeHookFailed, PhaseCheckpointingContainer, fmt.Errorf("could not resolve hooks: %w", err))
+	}
+	hooks := &Hooks{}
+	for annotation, hook := range map[string]**Hook{PreCheckpointHookAnnotation: &hooks.Pre, PostCheckpointHookAnnotation: &hooks.Post} {
+		value, found := pod.Annotations[annotation]
+		if !found {
+			continue
+		}
+		*hook = &Hook{}
+		if err := json.Unmarshal([]byte(value), *hook); err != nil {
+			return nil, NewCheckpointError(ErrorCodeHookFailed, PhaseCheckpointingContainer, fmt.Errorf("malformed %s annotation: %w", annotation, err))
+		}
+	}
+	if err := hooks.Validate(); err != nil {
+		return nil, NewCheckpointError(ErrorCodeHookFailed, PhaseCheckpointingContainer, fmt.Errorf("could not resolve hooks: %w", err))
+	}
+	return hooks, nil
+}
+
+// runHook runs hook of hookType in the checkpointed container and reports its result to the caller of Checkpointer.
+// Returns error if the hook failed and its failure policy is HookFailurePolicyAbort.
+func (params CheckpointerParams) runHook(ctx context.Context, podController internal.PodController, hookType HookType, hook *Hook) error {
+	if hook == nil {
+		return nil
+	}
+	lg := zerolog.Ctx(ctx).With().Str("hook", string(hookType)).Strs("command", hook.Command).Logger()
+
+	timeout := defaultHookTimeout
+	if hook.TimeoutSeconds > 0 {
+		timeout = time.Duration(hook.TimeoutSeconds) * time.Second
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout, stderr := &truncatingBuffer{}, &truncatingBuffer{}
+	start := time.Now()
+	err := podController.ExecInContainer(hookCtx, params.ContainerIdentifier.Container, params.ContainerIdentifier.Pod, params.ContainerIdentifier.Namespace, hook.Command, stdout, stderr)
+	result := HookResult{
+		Type:           hookType,
+		Command:        hook.Command,
+		Stdout:         string(stdout.bytes),
+		Stderr:         string(stderr.bytes),
+		DurationMillis: time.Since(start).Milliseconds(),
+	}
+	var exitErr exec.ExitError
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+		result.Error = fmt.Sprintf("hook exited with code %d", result.ExitCode)
+	case hookCtx.Err() != nil && ctx.Err() == nil:
+		result.ExitCode = -1
+		result.Error = fmt.Sprintf("hook timed out after %s", timeout)
+	default:
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+	if params.OnHookResult != nil {
+		params.OnHookResult(result)
+	}
+
+	if result.Error == "" {
+		lg.Info().Int64("durationMillis", result.DurationMillis).Msg("hook succeeded")
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if hook.OnFailure == HookFailurePolicyContinue {
+		lg.Warn().Str("error", result.Error).Msg("hook failed, continuing")
+		return nil
+	}
+	lg.Error().Str("error", result.Error).Msg("hook failed, aborting checkpoint")
+	return NewCheckpointError(ErrorCodeHookFailed, PhaseCheckpointingContainer, fmt.Errorf("%s hook failed: %s", hookType, result.Error))
+}
+
+// truncatingBuffer keeps the first maxHookOutput bytes written to it and drops the rest.
+type truncatingBuffer struct {
+	bytes []byte
+}
+
+func (b *truncatingBuffer) Write(p []byte) (int, error) {
+	if remaining := maxHookOutput - len(b.bytes); remaining > 0 {
+		b.bytes = append(b.bytes, p[:min(len(p), remaining)]...)
+	}
+	return len(p), nil
+}
@@ -42,13 +42,13 @@ func (cp *kanikoFSCheckpointer) Checkpoint(ctx context.Context, params Checkpoin
 	lg := zerolog.Ctx(ctx)
 	checkpointImageName := cp.CheckpointImagePrefix + ":" + params.CheckpointIdentifier
 
-	checkpointTarName, err := cp.CallKubeletCheckpoint(ctx, params.ContainerIdentifier.String())
+	checkpointTarName, err := params.checkpointArchive(ctx, cp.PodController, cp.KubeletController)
 	if err != nil {
 		return "", fmt.Errorf("could not checkpointer container: %s with error: %w", params.ContainerIdentifier, err)
 	}
-	defer os.Remove(checkpointTarName)
 	lg.Debug().Str("tarName", checkpointTarName).Msg("successfully created checkpointer tar")
 
+	params.reportPhase(PhaseBuildingContext)
 	filledDockerfileTemplate, err := cp.DockerfileFromTemplate(cp.CheckpointBaseImage, checkpointTarName)
 	if err != nil {
 		return "", fmt.Errorf("could not create checkpointer container: %s with error %w", params.ContainerIdentifier, err)
@@ -63,28 +63,36 @@ func (cp *kanikoFSCheckpointer) Checkpoint(ctx context.Context, params Checkpoin
 	defer os.RemoveAll(buildContextDir)
 	lg.Debug().Str("buildContextDir", buildContextDir).Msg("successfully prepared build context for Kaniko")
 
+	params.reportPhase(PhaseCreatingBuilder)
 	kanikoPodName, err := cp.CreatePod(ctx, cp.getKanikoManifest(checkpointImageName, buildContextDir), cp.CheckpointerNamespace)
 	if err != nil {
-		return "", fmt.Errorf("could not create checkpointer container: %s with error %w", params.ContainerIdentifier, err)
+		return "", NewCheckpointError(ErrorCodeBuildFailed, PhaseCreatingBuilder,
+			fmt.Errorf("could not create checkpointer container: %s with error %w", params.ContainerIdentifier, err))
 	}
 	defer cp.DeletePod(context.WithoutCancel(ctx), cp.CheckpointerNamespace, kanikoPodName)
 
+	params.reportPhase(PhasePushing)
+
 	err = cp.WaitForPodSucceeded(ctx, kanikoPodName, cp.CheckpointerNamespace, time.Second*time.Duration(cp.KanikoTimeoutSeconds))
 	if err != nil {
 		return "", fmt.Errorf("failed while waiting for Kaniko Pod to reach Succeeded phase: %w", err)
 	}
 
-	if params.DeletePod {
-		if err := cp.DeleteAndWaitForRemoval(ctx, params.ContainerIdentifier.Namespace, params.ContainerIdentifier.Pod, time.Second*10); err != nil {
-			lg.Warn().Err(err).Msg("could not delete checkpointed pod") // Do not fail if we cannot delete the Pod.
-		}
-		lg.Debug().Msg("successfully deleted checkpointed Pod")
-	}
-
 	lg.Debug().Msg("checkpointing done, about to cleanup resources")
+	// On failure, the checkpoint archive is kept, so that the image can be built from it again.
+	_ = os.Remove(checkpointTarName)
 	return checkpointImageName, nil
 }
 
+func (cp *kanikoFSCheckpointer) CheckpointContainer(ctx context.Context, params CheckpointerParams) (string, error) {
+	checkpointTarName, err := params.checkpointArchive(ctx, cp.PodController, cp.KubeletController)
+	if err != nil {
+		return "", fmt.Errorf("could not checkpoint container: %s with error %w", params.ContainerIdentifier, err)
+	}
+	zerolog.Ctx(ctx).Debug().Str("tarName", checkpointTarName).Msg("successfully created checkpointer tar")
+	return checkpointTarName, nil
+}
+
 func (cp *kanikoFSCheckpointer) getKanikoManifest(checkpointImageName, buildContextPath string) *v1.Pod {
 	hostPathType := v1.HostPathDirectory
 	pod := &v1.Pod{
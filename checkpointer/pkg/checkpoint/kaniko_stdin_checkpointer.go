@@ -47,20 +47,22 @@ func (cp *kanikoStdinCheckpointer) Checkpoint(ctx context.Context, params Checkp
 	checkpointImageName := cp.CheckpointImagePrefix + ":" + params.CheckpointIdentifier
 
 	lg.Debug().Msg("creating kaniko pod")
+	params.reportPhase(PhaseCreatingBuilder)
 	kanikoPodName, err := cp.CreatePod(ctx, cp.getKanikoManifest(checkpointImageName), cp.CheckpointerNamespace)
 	if err != nil {
-		return "", fmt.Errorf("could not create checkpointer container: %s with error %w", params.ContainerIdentifier, err)
+		return "", NewCheckpointError(ErrorCodeBuildFailed, PhaseCreatingBuilder,
+			fmt.Errorf("could not create checkpointer container: %s with error %w", params.ContainerIdentifier, err))
 	}
 	defer cp.DeletePod(context.WithoutCancel(ctx), cp.CheckpointerNamespace, kanikoPodName)
 
 	lg.Debug().Msg("calling Kubelet checkpointer")
-	checkpointTarName, err := cp.CallKubeletCheckpoint(ctx, params.ContainerIdentifier.String())
+	checkpointTarName, err := params.checkpointArchive(ctx, cp.PodController, cp.KubeletController)
 	if err != nil {
 		return "", fmt.Errorf("could not checkpointer container: %s with error %w", params.ContainerIdentifier, err)
 	}
-	defer os.Remove(checkpointTarName)
 	lg.Debug().Str("tarName", checkpointTarName).Msg("successfully created checkpointer tar")
 
+	params.reportPhase(PhaseBuildingContext)
 	filledDockerfileTemplate, err := cp.DockerfileFromTemplate(cp.CheckpointBaseImage, checkpointTarName)
 	if err != nil {
 		return "", fmt.Errorf("could not create checkpointer container: %s with error %w", params.ContainerIdentifier, err)
@@ -85,6 +87,7 @@ func (cp *kanikoStdinCheckpointer) Checkpoint(ctx context.Context, params Checkp
 	}
 	defer buildContextOpened.Close()
 
+	params.reportPhase(PhasePushing)
 	if err = cp.AttachAndStreamToContainer(ctx,
 		kanikoContainerName,
 		kanikoPodName,
@@ -95,17 +98,21 @@ func (cp *kanikoStdinCheckpointer) Checkpoint(ctx context.Context, params Checkp
 		return "", fmt.Errorf("failed to attach to pod: %w", err)
 	}
 
-	if params.DeletePod {
-		if err := cp.DeleteAndWaitForRemoval(ctx, params.ContainerIdentifier.Namespace, params.ContainerIdentifier.Pod, time.Second*10); err != nil {
-			lg.Warn().Err(err).Msg("could not delete checkpointed pod") // Do not fail if we cannot delete the Pod.
-		}
-		lg.Debug().Msg("successfully deleted checkpointed Pod")
-	}
-
 	lg.Debug().Msg("checkpointing done, about to cleanup resources")
+	// On failure, the checkpoint archive is kept, so that the image can be built from it again.
+	_ = os.Remove(checkpointTarName)
 	return checkpointImageName, nil
 }
 
+func (cp *kanikoStdinCheckpointer) CheckpointContainer(ctx context.Context, params CheckpointerParams) (string, error) {
+	checkpointTarName, err := params.checkpointArchive(ctx, cp.PodController, cp.KubeletController)
+	if err != nil {
+		return "", fmt.Errorf("could not checkpoint container: %s with error %w", params.ContainerIdentifier, err)
+	}
+	zerolog.Ctx(ctx).Debug().Str("tarName", checkpointTarName).Msg("successfully created checkpointer tar")
+	return checkpointTarName, nil
+}
+
 func (cp *kanikoStdinCheckpointer) getKanikoManifest(checkpointImageName string) *v1.Pod {
 	pod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
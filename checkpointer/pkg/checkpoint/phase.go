@@ -0,0 +1,53 @@
+package checkpoint
+
+// Phase represents the phase a checkpoint is in.
+type Phase string
+
+const (
+	// PhaseQueued means the checkpoint was accepted, but no work has been done yet.
+	PhaseQueued Phase = "Queued"
+
+	// PhaseCreatingBuilder means the Kaniko Pod, which builds and pushes the checkpoint image, is being created.
+	PhaseCreatingBuilder Phase = "CreatingBuilder"
+
+	// PhaseCheckpointingContainer means Kubelet is checkpointing the container.
+	PhaseCheckpointingContainer Phase = "CheckpointingContainer"
+
+	// PhaseBuildingContext means the build context for Kaniko is being prepared from the checkpoint archive.
+	PhaseBuildingContext Phase = "BuildingContext"
+
+	// PhasePushing means Kaniko is building and pushing the checkpoint image.
+	PhasePushing Phase = "Pushing"
+
+	// PhasePublishQueued means the container was checkpointed and its Pod stopped, but the checkpoint image waits in
+	// the background publisher queue to be built and pushed.
+	PhasePublishQueued Phase = "PublishQueued"
+
+	// PhaseVerifying means the checkpoint image is being test restored.
+	PhaseVerifying Phase = "Verifying"
+
+	// PhaseDeletingPod means the checkpointed Pod is being stopped according to StopPolicy.
+	PhaseDeletingPod Phase = "DeletingPod"
+
+	// PhaseSucceeded means the checkpoint finished successfully.
+	PhaseSucceeded Phase = "Succeeded"
+
+	// PhaseFailed means the checkpoint failed.
+	PhaseFailed Phase = "Failed"
+
+	// PhaseCancelled means the checkpoint was cancelled by a client.
+	PhaseCancelled Phase = "Cancelled"
+)
+
+// Finished reports whether the phase is a final one, after which the checkpoint does not progress anymore.
+// Empty phase is considered finished, as it belongs to checkpoints stored before phases were recorded.
+func (p Phase) Finished() bool {
+	return p == "" || p == PhaseSucceeded || p == PhaseFailed || p == PhaseCancelled
+}
+
+// reportPhase reports the phase to the caller of Checkpointer if it is interested.
+func (params CheckpointerParams) reportPhase(phase Phase) {
+	if params.OnPhase != nil {
+		params.OnPhase(phase)
+	}
+}
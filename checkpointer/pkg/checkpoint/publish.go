@@ -0,0 +1,24 @@
+package checkpoint
+
+import "fmt"
+
+// PublishMode defines when the checkpoint image is built and pushed relative to stopping the checkpointed Pod.
+type PublishMode string
+
+const (
+	// PublishImmediate builds and pushes the checkpoint image before the checkpointed Pod is stopped.
+	PublishImmediate PublishMode = "immediate"
+
+	// PublishDeferred stops the checkpointed Pod right after Kubelet created the checkpoint archive, the checkpoint
+	// image is built and pushed from the archive later in the background.
+	PublishDeferred PublishMode = "deferred"
+)
+
+// ParsePublishMode returns PublishMode represented by mode or error if mode is unknown.
+func ParsePublishMode(mode string) (PublishMode, error) {
+	switch PublishMode(mode) {
+	case PublishImmediate, PublishDeferred:
+		return PublishMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown publish mode: %s", mode)
+}
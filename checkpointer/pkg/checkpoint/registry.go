@@ -0,0 +1,117 @@
+package checkpoint
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ImageDeleter is responsible for deleting checkpoint images from the container registry.
+type ImageDeleter interface {
+
+	// DeleteImage deletes image from its registry with the same credentials Kaniko pushes the images with. Deleting
+	// an image that is not in the registry anymore succeeds. Returns error if the registry refuses to delete it.
+	DeleteImage(ctx context.Context, image string) error
+}
+
+// ImageCollector is responsible for finding and deleting checkpoint images in the container registry.
+type ImageCollector interface {
+	ImageDeleter
+
+	// ListImages returns every image in the repository of CheckpointImagePrefix, as image references with tags.
+	// Returns empty slice if the repository does not exist yet.
+	ListImages(ctx context.Context) ([]string, error)
+
+	// ImageDigest returns the digest of the manifest image points to. Returns empty string if the image is not in the
+	// registry anymore.
+	ImageDigest(ctx context.Context, image string) (string, error)
+}
+
+// NewImageDeleter constructs new ImageDeleter instance.
+func NewImageDeleter(client *kubernetes.Clientset, checkpointConfig config.CheckpointConfig) ImageDeleter {
+	return NewImageCollector(client, checkpointConfig)
+}
+
+// NewImageCollector constructs new ImageCollector instance.
+func NewImageCollector(client *kubernetes.Clientset, checkpointConfig config.CheckpointConfig) ImageCollector {
+	return &registryImages{
+		client,
+		internal.NewRegistryController(),
+		checkpointConfig,
+	}
+}
+
+// registryImages manages the checkpoint images with the same credentials Kaniko pushes the images with.
+type registryImages struct {
+	client             kubernetes.Interface
+	registryController internal.RegistryController
+	config.CheckpointConfig
+}
+
+func (d *registryImages) DeleteImage(ctx context.Context, image string) error {
+	dockerConfig, err := d.dockerConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = d.registryController.DeleteImage(ctx, image, dockerConfig)
+	if errors.Is(err, internal.ErrImageNotFound) {
+		zerolog.Ctx(ctx).Info().Str("image", image).Msg("image not found in registry, nothing to delete")
+		return nil
+	}
+	return err
+}
+
+func (d *registryImages) ListImages(ctx context.Context) ([]string, error) {
+	dockerConfig, err := d.dockerConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := d.registryController.ListTags(ctx, d.CheckpointImagePrefix, dockerConfig)
+	if errors.Is(err, internal.ErrImageNotFound) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	images := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		images = append(images, d.CheckpointImagePrefix+":"+tag)
+	}
+	return images, nil
+}
+
+func (d *registryImages) ImageDigest(ctx context.Context, image string) (string, error) {
+	dockerConfig, err := d.dockerConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := d.registryController.ManifestDigest(ctx, image, dockerConfig)
+	if errors.Is(err, internal.ErrImageNotFound) {
+		return "", nil
+	}
+	return digest, err
+}
+
+// dockerConfig reads the registry credentials from the Kaniko Secret. The Secret is read every time, so that rotated
+// credentials are picked up.
+func (d *registryImages) dockerConfig(ctx context.Context) (internal.DockerConfig, error) {
+	secret, err := d.client.CoreV1().Secrets(d.CheckpointerNamespace).Get(ctx, d.KanikoSecretName, metav1.GetOptions{})
+	if err != nil {
+		return internal.DockerConfig{}, fmt.Errorf("failed to get registry credentials: %w", err)
+	}
+	var dockerConfig internal.DockerConfig
+	if err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &dockerConfig); err != nil {
+		return internal.DockerConfig{}, fmt.Errorf("failed to parse registry credentials: %w", err)
+	}
+	return dockerConfig, nil
+}
@@ -0,0 +1,121 @@
+package checkpoint
+
+import (
+	"checkpoint-in-k8s/internal"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"time"
+)
+
+// StopPolicy defines what happens with the checkpointed Pod after successful checkpoint.
+type StopPolicy string
+
+const (
+	// StopPolicyNone leaves the checkpointed Pod running.
+	StopPolicyNone StopPolicy = "none"
+
+	// StopPolicyDelete deletes the checkpointed Pod. Pods owned by a controller are recreated by the controller.
+	StopPolicyDelete StopPolicy = "delete"
+
+	// StopPolicyScaleOwner scales the controller owning the checkpointed Pod to zero replicas. Pods without
+	// a scalable owner, or whose owner has other replicas which would be stopped as well, are deleted instead.
+	StopPolicyScaleOwner StopPolicy = "scaleOwner"
+)
+
+// ParseStopPolicy returns StopPolicy represented by policy or error if policy is unknown.
+func ParseStopPolicy(policy string) (StopPolicy, error) {
+	switch StopPolicy(policy) {
+	case StopPolicyNone, StopPolicyDelete, StopPolicyScaleOwner:
+		return StopPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown stop policy: %s", policy)
+}
+
+// ScaledOwner represents the controller owning the checkpointed Pod, which was scaled to zero replicas.
+type ScaledOwner struct {
+	// Kind is the kind of the controller, e.g.: Deployment, StatefulSet, ReplicaSet or Job.
+	Kind string `json:"kind"`
+
+	// Name is the name of the controller.
+	Name string `json:"name"`
+
+	// Namespace is the Kubernetes Namespace of the controller.
+	Namespace string `json:"namespace"`
+
+	// Replicas is the number of replicas (parallelism in case of Job) before scaling to zero.
+	Replicas int32 `json:"replicas"`
+}
+
+// PodStopper is responsible for stopping the checkpointed Pod according to StopPolicy and for starting it again.
+type PodStopper interface {
+
+	// StopPod stops the Pod of the container according to policy. If the Pod's owner was scaled to zero,
+	// returns ScaledOwner which can be used to scale the owner back up, otherwise returns nil.
+	StopPod(ctx context.Context, containerIdentifier ContainerIdentifier, policy StopPolicy) (*ScaledOwner, error)
+
+	// ScaleOwnerUp scales the owner back to its original number of replicas and sets templateAnnotations on its Pod
+	// template, so that new Pods can be restored from the checkpoint. Returns error if a call to Kubernetes API fails.
+	ScaleOwnerUp(ctx context.Context, owner ScaledOwner, templateAnnotations map[string]string) error
+}
+
+// NewPodStopper constructs new PodStopper instance.
+func NewPodStopper(client *kubernetes.Clientset, config *rest.Config) PodStopper {
+	return &podStopper{
+		internal.NewPodController(client, config),
+		internal.NewOwnerController(client),
+	}
+}
+
+type podStopper struct {
+	podController   internal.PodController
+	ownerController internal.OwnerController
+}
+
+func (ps *podStopper) StopPod(ctx context.Context, containerIdentifier ContainerIdentifier, policy StopPolicy) (*ScaledOwner, error) {
+	lg := zerolog.Ctx(ctx)
+
+	switch policy {
+	case StopPolicyNone, "":
+		return nil, nil
+	case StopPolicyScaleOwner:
+		owner, err := ps.ownerController.FindScalableOwner(ctx, containerIdentifier.Pod, containerIdentifier.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("could not find owner of checkpointed Pod: %w", err)
+		}
+		if owner == nil {
+			lg.Info().Msg("checkpointed Pod has no scalable owner, deleting the Pod instead")
+			break
+		}
+		replicas, err := ps.ownerController.OwnerReplicas(ctx, *owner)
+		if err != nil {
+			return nil, fmt.Errorf("could not get replicas of owner of checkpointed Pod: %w", err)
+		}
+		if replicas > 1 {
+			lg.Info().Str("kind", owner.Kind).Str("name", owner.Name).Int32("replicas", replicas).Msg("owner of checkpointed Pod has other replicas, deleting the Pod instead")
+			break
+		}
+		if replicas, err = ps.ownerController.ScaleOwner(ctx, *owner, 0, nil); err != nil {
+			return nil, fmt.Errorf("could not scale down owner of checkpointed Pod: %w", err)
+		}
+		lg.Debug().Str("kind", owner.Kind).Str("name", owner.Name).Msg("successfully scaled down owner of checkpointed Pod")
+		return &ScaledOwner{owner.Kind, owner.Name, owner.Namespace, replicas}, nil
+	}
+
+	if err := ps.podController.DeleteAndWaitForRemoval(ctx, containerIdentifier.Pod, containerIdentifier.Namespace, time.Second*10); err != nil {
+		return nil, fmt.Errorf("could not delete checkpointed Pod: %w", err)
+	}
+	lg.Debug().Msg("successfully deleted checkpointed Pod")
+	return nil, nil
+}
+
+func (ps *podStopper) ScaleOwnerUp(ctx context.Context, owner ScaledOwner, templateAnnotations map[string]string) error {
+	_, err := ps.ownerController.ScaleOwner(ctx,
+		internal.Owner{Kind: owner.Kind, Name: owner.Name, Namespace: owner.Namespace},
+		owner.Replicas,
+		templateAnnotations,
+	)
+	return err
+}
@@ -0,0 +1,137 @@
+package checkpoint
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"time"
+)
+
+// VerificationResult represents the outcome of a test restore of a checkpoint image.
+type VerificationResult struct {
+	// Verified is true if the checkpoint image was successfully restored.
+	Verified bool `json:"verified"`
+
+	// Reason describes why the verification failed, or how it succeeded.
+	Reason string `json:"reason,omitempty"`
+
+	// Node is the name of the Node the test restore ran on.
+	Node string `json:"node"`
+}
+
+// Verifier is responsible for verifying that a checkpoint image can be restored.
+type Verifier interface {
+
+	// Verify restores image into the sandbox Namespace on node and waits for the container to pass its readiness
+	// probe, or to stay Running for a configured period if the container has no readiness probe. The restored Pod is
+	// removed afterward. If node is empty, the Node of Checkpointer is used. Verify never fails, the outcome is
+	// described by the returned VerificationResult.
+	Verify(ctx context.Context, containerIdentifier ContainerIdentifier, image, node string) VerificationResult
+}
+
+// NewVerifier constructs new Verifier instance.
+func NewVerifier(client *kubernetes.Clientset, config *rest.Config, checkpointConfig config.CheckpointConfig) Verifier {
+	return &verifier{
+		internal.NewPodController(client, config),
+		checkpointConfig,
+	}
+}
+
+type verifier struct {
+	podController internal.PodController
+	config.CheckpointConfig
+}
+
+func (v *verifier) Verify(ctx context.Context, containerIdentifier ContainerIdentifier, image, node string) VerificationResult {
+	if node == "" {
+		node = v.CheckpointerNode
+	}
+	lg := zerolog.Ctx(ctx).With().Str("verifyNode", node).Logger()
+
+	// The readiness probe, the ports it may refer to by name and the image pull secrets are taken from the checkpointed
+	// Pod, which is still running at this point.
+	var readinessProbe *v1.Probe
+	var ports []v1.ContainerPort
+	var imagePullSecrets []v1.LocalObjectReference
+	if pod, err := v.podController.GetPod(ctx, containerIdentifier.Pod, containerIdentifier.Namespace); err == nil {
+		for _, container := range pod.Spec.Containers {
+			if container.Name == containerIdentifier.Container {
+				readinessProbe = container.ReadinessProbe
+				ports = verifyPorts(container.Ports)
+			}
+		}
+		imagePullSecrets = pod.Spec.ImagePullSecrets
+	} else {
+		lg.Info().Err(err).Msg("could not get checkpointed Pod, verifying without readiness probe")
+	}
+
+	verifyPodName, err := v.podController.CreatePod(ctx, v.getVerifyManifest(containerIdentifier, image, node, readinessProbe, ports, imagePullSecrets), v.VerifyNamespace)
+	if err != nil {
+		return VerificationResult{false, fmt.Sprintf("could not create verification Pod: %s", err), node}
+	}
+	defer v.podController.DeletePod(context.WithoutCancel(ctx), v.VerifyNamespace, verifyPodName)
+	lg.Debug().Str("verifyPod", verifyPodName).Msg("created verification Pod")
+
+	timeout := time.Second * time.Duration(v.VerifyTimeoutSeconds)
+	if readinessProbe != nil {
+		if err := v.podController.WaitForPodReady(ctx, verifyPodName, v.VerifyNamespace, timeout); err != nil {
+			return VerificationResult{false, fmt.Sprintf("restored container did not become ready: %s", err), node}
+		}
+		return VerificationResult{true, "restored container passed its readiness probe", node}
+	}
+
+	if err := v.podController.WaitForPodRunning(ctx, verifyPodName, v.VerifyNamespace, timeout); err != nil {
+		return VerificationResult{false, fmt.Sprintf("restored container did not start: %s", err), node}
+	}
+	runningPeriod := time.Second * time.Duration(v.VerifyRunningSeconds)
+	if err := v.podController.WaitForPodStaysRunning(ctx, verifyPodName, v.VerifyNamespace, runningPeriod); err != nil {
+		return VerificationResult{false, fmt.Sprintf("restored container did not keep running: %s", err), node}
+	}
+	return VerificationResult{true, fmt.Sprintf("restored container kept running for %s", runningPeriod), node}
+}
+
+func (v *verifier) getVerifyManifest(containerIdentifier ContainerIdentifier, image, node string, readinessProbe *v1.Probe, ports []v1.ContainerPort, imagePullSecrets []v1.LocalObjectReference) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "verify-",
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "checkpointer",
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: node,
+			Containers: []v1.Container{
+				{
+					// Keep the original container name, as it is recorded within the checkpoint.
+					Name:            containerIdentifier.Container,
+					Image:           image,
+					ImagePullPolicy: v1.PullAlways,
+					ReadinessProbe:  readinessProbe,
+					Ports:           ports,
+				},
+			},
+			ImagePullSecrets: imagePullSecrets,
+			RestartPolicy:    v1.RestartPolicyNever,
+		},
+	}
+}
+
+// verifyPorts returns the ports of the checkpointed container without their host ports, which are taken by the
+// checkpointed container on the same Node.
+func verifyPorts(ports []v1.ContainerPort) []v1.ContainerPort {
+	if ports == nil {
+		return nil
+	}
+	verifyPorts := make([]v1.ContainerPort, len(ports))
+	for i, port := range ports {
+		port.HostPort, port.HostIP = 0, ""
+		verifyPorts[i] = port
+	}
+	return verifyPorts
+}
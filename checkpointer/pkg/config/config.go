@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -58,16 +60,364 @@ type CheckpointConfig struct {
 	// KanikoTimeoutSeconds represent time in seconds after which Checkpointer will stop waiting for Kaniko Pod to
 	// reach a certain Pod phase.
 	KanikoTimeoutSeconds int64
+
+	// VerifyNamespace represents the sandbox Kubernetes Namespace that checkpoint images are test restored in.
+	VerifyNamespace string
+
+	// VerifyTimeoutSeconds represents time in seconds after which Checkpointer will stop waiting for the test restored
+	// container to start or become ready.
+	VerifyTimeoutSeconds int64
+
+	// VerifyRunningSeconds represents time in seconds the test restored container without readiness probe has to keep
+	// running to be considered verified.
+	VerifyRunningSeconds int64
+}
+
+// WebhookConfig represents configuration related to the restore mutating admission webhook.
+type WebhookConfig struct {
+
+	// Enabled instructs Checkpointer to serve the mutating admission webhook.
+	Enabled bool
+
+	// Port defines on what port Checkpointer will serve the webhook over TLS.
+	Port int64
+
+	// CertFile is path to a file with TLS certificate the webhook is served with.
+	CertFile string
+
+	// KeyFile is path to a file with private key related to the webhook TLS certificate.
+	KeyFile string
+
+	// ResolveTimeoutSeconds represents time in seconds after which the webhook gives up resolving a checkpoint and
+	// falls back to the original container image.
+	ResolveTimeoutSeconds int64
+
+	// RuntimeAnnotations are added to every restored Pod, e.g. the annotations the container runtime on the Nodes
+	// requires to restore containers from checkpoint images.
+	RuntimeAnnotations map[string]string
+}
+
+// CallbackConfig represents configuration related to delivery of completion callbacks.
+type CallbackConfig struct {
+
+	// StoragePath defines path to a directory where Checkpointer persists pending callback deliveries.
+	StoragePath string
+
+	// MaxAttempts represents how many times Checkpointer tries to deliver a callback before giving up.
+	MaxAttempts int64
+
+	// InitialBackoffSeconds represents time in seconds Checkpointer waits before the first retry of a delivery.
+	// The time doubles with every following retry.
+	InitialBackoffSeconds int64
+
+	// MaxBackoffSeconds caps the time in seconds Checkpointer waits between retries of a delivery.
+	MaxBackoffSeconds int64
+
+	// TimeoutSeconds represents time in seconds after which a single delivery attempt is considered failed.
+	TimeoutSeconds int64
+
+	// AllowedSchemes lists the URL schemes callbacks can be delivered over, https by default.
+	AllowedSchemes []string
+
+	// AllowedHosts lists the hosts callbacks can be delivered to, either exact host names or *.{domain} matching any
+	// subdomain of domain. Callbacks are rejected if it is empty, so that clients cannot make Checkpointer send
+	// requests to arbitrary hosts, e.g. inside the cluster.
+	AllowedHosts []string
+}
+
+// AllowsUrl returns error if callbackUrl does not use any of AllowedSchemes or its host is not in AllowedHosts.
+func (cc CallbackConfig) AllowsUrl(callbackUrl *url.URL) error {
+	if !slices.Contains(cc.AllowedSchemes, callbackUrl.Scheme) {
+		return fmt.Errorf("callbackUrl scheme %q is not allowed, allowed schemes: %s", callbackUrl.Scheme, strings.Join(cc.AllowedSchemes, ", "))
+	}
+	host := strings.ToLower(callbackUrl.Hostname())
+	for _, allowedHost := range cc.AllowedHosts {
+		if domain, found := strings.CutPrefix(allowedHost, "*."); (found && strings.HasSuffix(host, "."+domain)) || host == allowedHost {
+			return nil
+		}
+	}
+	return fmt.Errorf("callbackUrl host %q is not allowed", host)
+}
+
+// SchedulerConfig represents configuration related to limiting checkpoints running at once on the Node.
+type SchedulerConfig struct {
+
+	// MaxConcurrent represents how many checkpoints can run at once, the others wait in the queue.
+	MaxConcurrent int64
+
+	// MaxQueued represents the maximum number of checkpoints waiting in the queue, new checkpoints are rejected when
+	// it is reached.
+	MaxQueued int64
+
+	// RetryAfterSeconds represents time in seconds clients are asked to wait before requesting a checkpoint rejected
+	// because of full queue again.
+	RetryAfterSeconds int64
+
+	// MaxRequestPriority bounds the priority clients can request, from -MaxRequestPriority to MaxRequestPriority, so
+	// that they cannot overtake the checkpoints Checkpointer requests itself, e.g. of drained Pods.
+	MaxRequestPriority int64
+}
+
+// BuildRetryConfig represents configuration related to retrying failed builds of checkpoint images.
+type BuildRetryConfig struct {
+
+	// MaxAttempts represents how many times Checkpointer tries to build and push the checkpoint image from the same
+	// checkpoint archive before the checkpoint fails.
+	MaxAttempts int64
+
+	// InitialBackoffSeconds represents time in seconds Checkpointer waits before the first retry of a build.
+	// The time doubles with every following retry.
+	InitialBackoffSeconds int64
+
+	// MaxBackoffSeconds caps the time in seconds Checkpointer waits between retries of a build.
+	MaxBackoffSeconds int64
+
+	// RetainedArchiveTTLSeconds represents time in seconds after which the checkpoint archive retained by a failed
+	// checkpoint is removed, so that the archives do not fill the disk of the Node. 0 keeps them until deleted.
+	RetainedArchiveTTLSeconds int64
+}
+
+// PublishConfig represents configuration related to the background publisher of deferred checkpoint images.
+type PublishConfig struct {
+
+	// ArchiveDir defines path to a directory where Kubelet creates checkpoint archives. Its free space is checked
+	// before a deferred checkpoint is admitted.
+	ArchiveDir string
+
+	// MinFreeBytes represents how many bytes have to stay free in ArchiveDir for a deferred checkpoint to be admitted.
+	MinFreeBytes int64
+
+	// MaxQueued represents the maximum number of deferred checkpoints waiting for their image to be published.
+	MaxQueued int64
+
+	// Workers represents how many checkpoint images are built and pushed in parallel.
+	Workers int64
+}
+
+// RetentionConfig represents configuration related to the expiry of stored checkpoint results.
+type RetentionConfig struct {
+
+	// MaxAgeSeconds represents time in seconds after which a finished checkpoint result expires, 0 disables expiry by
+	// age.
+	MaxAgeSeconds int64
+
+	// MaxPerContainer represents how many finished checkpoint results are kept for a container, the older ones
+	// expire. 0 disables the limit.
+	MaxPerContainer int64
+
+	// KeepSucceeded represents how many of the most recent successful checkpoint results of a container never expire,
+	// regardless of MaxAgeSeconds and MaxPerContainer.
+	KeepSucceeded int64
+
+	// IntervalSeconds represents time in seconds between the runs of the janitor removing expired checkpoint results.
+	IntervalSeconds int64
+
+	// DryRun makes the janitor only report the checkpoint results it would remove.
+	DryRun bool
+
+	// TombstonePath defines path to a directory where Checkpointer remembers the removed checkpoint results, so that
+	// requests for them can be told apart from requests for unknown checkpoints.
+	TombstonePath string
+
+	// TombstoneTTLSeconds represents time in seconds for which the removed checkpoint results are remembered.
+	TombstoneTTLSeconds int64
+}
+
+// Enabled reports whether any retention policy is configured.
+func (rc RetentionConfig) Enabled() bool {
+	return rc.MaxAgeSeconds > 0 || rc.MaxPerContainer > 0
+}
+
+// RegistryGCConfig represents configuration related to the garbage collection of checkpoint images in the container
+// registry.
+type RegistryGCConfig struct {
+
+	// Enabled makes the Checkpointer holding the Lease delete the checkpoint images without stored checkpoint result.
+	Enabled bool
+
+	// IntervalSeconds represents time in seconds between the garbage collections.
+	IntervalSeconds int64
+
+	// DryRun makes the garbage collection only report the checkpoint images it would delete.
+	DryRun bool
+
+	// LeaseName is the name of the Lease in the Checkpointer Namespace electing the Checkpointer which collects garbage.
+	LeaseName string
+}
+
+// ControllerConfig represents configuration related to the controller of ContainerCheckpoint custom resources.
+type ControllerConfig struct {
+
+	// Enabled makes the Checkpointer checkpoint the containers requested by ContainerCheckpoint resources targeting
+	// Pods on its Node. The ContainerCheckpoint custom resource definition has to be installed.
+	Enabled bool
+
+	// ResyncSeconds represents time in seconds between reconciliations of every ContainerCheckpoint, so that the ones
+	// targeting Pods which were not scheduled yet are picked up.
+	ResyncSeconds int64
+}
+
+// ScheduleConfig represents configuration related to periodic checkpoints of Pods annotated with a cron schedule.
+type ScheduleConfig struct {
+
+	// Enabled makes the Checkpointer watch the Pods on its Node and checkpoint the ones annotated with
+	// checkpoint.k8s/schedule by their schedules.
+	Enabled bool
+}
+
+// DrainGuardConfig represents configuration related to checkpointing Pods before their Node is drained or shut down.
+type DrainGuardConfig struct {
+
+	// Enabled makes the Checkpointer checkpoint the Pods on its Node annotated with checkpoint.k8s/drain-guard once the
+	// Node is cordoned or the Checkpointer receives SIGTERM.
+	Enabled bool
+
+	// Parallelism represents how many guarded Pods are checkpointed at once.
+	Parallelism int64
+
+	// TimeoutSeconds represents time in seconds after which the guard gives up waiting for the checkpoints.
+	TimeoutSeconds int64
+
+	// Priority represents the priority of the checkpoints in the checkpoint queue.
+	Priority int64
+}
+
+// IdleConfig represents configuration related to checkpointing and deleting idle Pods.
+type IdleConfig struct {
+
+	// Enabled makes the Checkpointer checkpoint and delete the Pods on its Node annotated with
+	// checkpoint.k8s/idle-checkpoint once they stay idle for WindowSeconds.
+	Enabled bool
+
+	// IntervalSeconds represents time in seconds between readings of the resource usage from Kubelet.
+	IntervalSeconds int64
+
+	// WindowSeconds represents time in seconds a Pod has to stay idle before it is checkpointed and deleted.
+	WindowSeconds int64
+
+	// CPUThresholdMillicores represents the CPU usage of the container in millicores below which it is idle.
+	CPUThresholdMillicores int64
+
+	// NetworkThresholdBytes represents the network traffic of the Pod in bytes per second below which it is idle.
+	NetworkThresholdBytes int64
+
+	// ExclusionWindows represent the times idle Pods are never checkpointed, e.g. "Mon-Fri 09:00-17:00".
+	ExclusionWindows []string
+
+	// DryRun makes the Checkpointer only report idle Pods, not checkpoint them.
+	DryRun bool
+}
+
+// EventSinkMode defines how CloudEvents are encoded in HTTP requests.
+type EventSinkMode string
+
+const (
+	// EventSinkModeStructured sends the whole CloudEvent as JSON body, batched if batch size is greater than one.
+	EventSinkModeStructured EventSinkMode = "structured"
+
+	// EventSinkModeBinary sends the CloudEvent attributes as ce- headers and the event data as body, one per request.
+	EventSinkModeBinary EventSinkMode = "binary"
+)
+
+// EventSinkConfig represents configuration related to the cluster-wide CloudEvents sink.
+type EventSinkConfig struct {
+
+	// Url is the URL CloudEvents are sent to. Empty Url disables the sink.
+	Url string
+
+	// Mode defines the CloudEvents HTTP content mode.
+	Mode EventSinkMode
+
+	// BatchSize represents the maximum number of CloudEvents sent at once.
+	BatchSize int64
+
+	// FlushIntervalSeconds represents time in seconds after which buffered CloudEvents are sent, even if there is
+	// less than BatchSize of them.
+	FlushIntervalSeconds int64
+
+	// BufferPath defines path to a directory where Checkpointer buffers CloudEvents, which were not sent yet.
+	BufferPath string
+
+	// MaxBufferedEvents bounds the number of buffered CloudEvents, the oldest are dropped when it is reached.
+	MaxBufferedEvents int64
+
+	// TimeoutSeconds represents time in seconds after which a request to the sink is considered failed.
+	TimeoutSeconds int64
+}
+
+// StorageBackend defines where checkpoint results are stored.
+type StorageBackend string
+
+const (
+	// StorageBackendDiskv stores every checkpoint result as a file in StorageBasePath.
+	StorageBackendDiskv StorageBackend = "diskv"
+
+	// StorageBackendBolt stores checkpoint results in a single embedded bbolt database file, indexed by container and
+	// by time, so that listing does not read every result.
+	StorageBackendBolt StorageBackend = "bolt"
+
+	// StorageBackendConfigMap stores every checkpoint result as a ConfigMap in the Checkpointer Namespace, so that the
+	// results outlive the Node they were created on.
+	StorageBackendConfigMap StorageBackend = "configmap"
+)
+
+// StorageConfig represents configuration related to the storage of checkpoint results.
+type StorageConfig struct {
+
+	// Backend defines which storage checkpoint results are stored in.
+	Backend StorageBackend
+
+	// BoltPath defines path to the database file of StorageBackendBolt.
+	BoltPath string
+}
+
+// HookConfig represents configuration related to checkpoint hooks.
+type HookConfig struct {
+
+	// AllowRequestHooks allows the clients of the checkpoint API to define the hooks in the request body. The API is
+	// not authenticated, so such hooks let any client run arbitrary commands in any container; the hooks from the Pod
+	// annotations are run regardless.
+	AllowRequestHooks bool
+}
+
+// GroupConfig represents configuration related to coordinated checkpoints of groups of Pods.
+type GroupConfig struct {
+
+	// Enabled makes the Checkpointer serve group checkpoints and recover the groups interrupted by its restart.
+	Enabled bool
+
+	// DumpTimeoutSeconds represents time in seconds the group waits for Kubelet to checkpoint every member while they
+	// are frozen, before it gives up and unfreezes them.
+	DumpTimeoutSeconds int64
 }
 
 // GlobalConfig represents the whole configuration of Checkpointer.
 type GlobalConfig struct {
 	CheckpointConfig CheckpointConfig
 	KubeletConfig    KubeletConfig
+	WebhookConfig    WebhookConfig
+	CallbackConfig   CallbackConfig
+	SchedulerConfig  SchedulerConfig
+	BuildRetryConfig BuildRetryConfig
+	PublishConfig    PublishConfig
+	EventSinkConfig  EventSinkConfig
+	StorageConfig    StorageConfig
+	RetentionConfig  RetentionConfig
+	RegistryGCConfig RegistryGCConfig
+	ControllerConfig ControllerConfig
+	ScheduleConfig   ScheduleConfig
+	DrainGuardConfig DrainGuardConfig
+	IdleConfig       IdleConfig
+	GroupConfig      GroupConfig
+	HookConfig       HookConfig
 
 	// StorageBasePath defines path to a directory where Checkpointer will store checkpoint results.
 	StorageBasePath string
 
+	// PendingStoragePath defines path to a directory where Checkpointer persists checkpoints in progress, so that
+	// they can be recovered after restart.
+	PendingStoragePath string
+
 	// DockerfileTemplateFile defines path to a file with Dockerfile template used for checkpoint container image.
 	DockerfileTemplateFile string
 
@@ -139,7 +489,49 @@ func LoadGlobalConfig() (GlobalConfig, error) {
 
 	config.CheckpointConfig.CheckpointBaseImage = getOrDefault("CHECKPOINT_BASE_IMAGE", "pbaran555/checkpoint-base:1.0.0")
 	config.CheckpointConfig.KanikoSecretName = getOrDefault("KANIKO_SECRET_NAME", "kaniko-secret")
+	config.CheckpointConfig.VerifyNamespace = getOrDefault("VERIFY_NAMESPACE", "checkpoint-verify")
+	config.CheckpointConfig.VerifyTimeoutSeconds = getOrDefaultNonNegativeNumber("VERIFY_TIMEOUT", 120)
+	config.CheckpointConfig.VerifyRunningSeconds = getOrDefaultNonNegativeNumber("VERIFY_RUNNING_PERIOD", 10)
 	config.StorageBasePath = getOrDefault("STORAGE_BASE_PATH", "/checkpointer/storage")
+	config.StorageConfig.Backend = StorageBackend(getOrDefault("STORAGE_BACKEND", string(StorageBackendDiskv)))
+	if !slices.Contains([]StorageBackend{StorageBackendDiskv, StorageBackendBolt, StorageBackendConfigMap}, config.StorageConfig.Backend) {
+		log.Info().Msg(fmt.Sprintf("STORAGE_BACKEND environment variable malformed, defaulting to: %s", StorageBackendDiskv))
+		config.StorageConfig.Backend = StorageBackendDiskv
+	}
+	config.StorageConfig.BoltPath = getOrDefault("STORAGE_BOLT_PATH", config.StorageBasePath+"/bolt/checkpoints.db")
+	config.PendingStoragePath = getOrDefault("PENDING_STORAGE_PATH", config.StorageBasePath+"/pending")
+	config.CallbackConfig.StoragePath = getOrDefault("CALLBACK_STORAGE_PATH", config.StorageBasePath+"/callbacks")
+	config.CallbackConfig.MaxAttempts = getOrDefaultNonNegativeNumber("CALLBACK_MAX_ATTEMPTS", 8)
+	config.CallbackConfig.InitialBackoffSeconds = getOrDefaultNonNegativeNumber("CALLBACK_INITIAL_BACKOFF", 2)
+	config.CallbackConfig.MaxBackoffSeconds = getOrDefaultNonNegativeNumber("CALLBACK_MAX_BACKOFF", 300)
+	config.CallbackConfig.TimeoutSeconds = getOrDefaultNonNegativeNumber("CALLBACK_TIMEOUT", 10)
+	config.CallbackConfig.AllowedSchemes = strings.Split(getOrDefault("CALLBACK_ALLOWED_SCHEMES", "https"), ",")
+	if allowedHosts := os.Getenv("CALLBACK_ALLOWED_HOSTS"); allowedHosts != "" {
+		config.CallbackConfig.AllowedHosts = strings.Split(strings.ToLower(allowedHosts), ",")
+	} else {
+		log.Info().Msg("CALLBACK_ALLOWED_HOSTS environment variable not set, callbacks will be rejected")
+	}
+	config.SchedulerConfig.MaxConcurrent = max(getOrDefaultNonNegativeNumber("CHECKPOINT_MAX_CONCURRENT", 2), 1)
+	config.SchedulerConfig.MaxQueued = getOrDefaultNonNegativeNumber("CHECKPOINT_MAX_QUEUED", 32)
+	config.SchedulerConfig.RetryAfterSeconds = max(getOrDefaultNonNegativeNumber("CHECKPOINT_RETRY_AFTER", 30), 1)
+	config.SchedulerConfig.MaxRequestPriority = getOrDefaultNonNegativeNumber("CHECKPOINT_MAX_REQUEST_PRIORITY", 50)
+	config.BuildRetryConfig.MaxAttempts = max(getOrDefaultNonNegativeNumber("BUILD_RETRY_MAX_ATTEMPTS", 3), 1)
+	config.BuildRetryConfig.InitialBackoffSeconds = getOrDefaultNonNegativeNumber("BUILD_RETRY_INITIAL_BACKOFF", 5)
+	config.BuildRetryConfig.MaxBackoffSeconds = getOrDefaultNonNegativeNumber("BUILD_RETRY_MAX_BACKOFF", 60)
+	config.BuildRetryConfig.RetainedArchiveTTLSeconds = getOrDefaultNonNegativeNumber("BUILD_RETRY_ARCHIVE_TTL", 24*60*60)
+	config.PublishConfig.ArchiveDir = getOrDefault("CHECKPOINT_ARCHIVE_DIR", "/var/lib/kubelet/checkpoints")
+	config.PublishConfig.MinFreeBytes = getOrDefaultNonNegativeNumber("PUBLISH_MIN_FREE_MB", 1024) * 1024 * 1024
+	config.PublishConfig.MaxQueued = max(getOrDefaultNonNegativeNumber("PUBLISH_MAX_QUEUED", 16), 1)
+	config.PublishConfig.Workers = max(getOrDefaultNonNegativeNumber("PUBLISH_WORKERS", 1), 1)
+	if config.HookConfig.AllowRequestHooks = os.Getenv("HOOKS_ALLOW_REQUEST") == "true"; config.HookConfig.AllowRequestHooks {
+		log.Warn().Msg("HOOKS_ALLOW_REQUEST enabled, any client of the checkpoint API can run commands in checkpointed containers")
+	}
+	config.RetentionConfig.MaxAgeSeconds = getOrDefaultNonNegativeNumber("RETENTION_MAX_AGE", 0)
+	config.RetentionConfig.MaxPerContainer = getOrDefaultNonNegativeNumber("RETENTION_MAX_PER_CONTAINER", 0)
+	config.RetentionConfig.KeepSucceeded = getOrDefaultNonNegativeNumber("RETENTION_KEEP_SUCCEEDED", 1)
+	config.RetentionConfig.IntervalSeconds = max(getOrDefaultNonNegativeNumber("RETENTION_INTERVAL", 600), 1)
+	config.RetentionConfig.TombstonePath = getOrDefault("RETENTION_TOMBSTONE_PATH", config.StorageBasePath+"/expired")
+	config.RetentionConfig.TombstoneTTLSeconds = getOrDefaultNonNegativeNumber("RETENTION_TOMBSTONE_TTL", 7*24*60*60)
 	config.KubeletConfig.CertFile = getOrDefault("KUBELET_CERT_FILE", "/etc/kubernetes/tls/tls.crt")
 	config.KubeletConfig.KeyFile = getOrDefault("KUBELET_KEY_FILE", "/etc/kubernetes/tls/tls.key")
 
@@ -154,6 +546,76 @@ func LoadGlobalConfig() (GlobalConfig, error) {
 		config.CheckpointConfig.KanikoTimeoutSeconds = config.CheckpointConfig.KanikoTimeoutSeconds * 2
 		config.CheckpointConfig.KanikoBuildContextDir = getOrDefault("KANIKO_BUILD_CTX_DIR", "/tmp/checkpointer/build-contexts")
 	}
+	if config.RetentionConfig.DryRun = os.Getenv("RETENTION_DRY_RUN") == "true"; config.RetentionConfig.DryRun {
+		log.Info().Msg("RETENTION_DRY_RUN enabled, expired checkpoint results will only be reported, not removed")
+	}
+	if config.RegistryGCConfig.Enabled = os.Getenv("REGISTRY_GC_ENABLED") == "true"; config.RegistryGCConfig.Enabled {
+		log.Info().Msg("REGISTRY_GC_ENABLED enabled, make sure the checkpoint image repository is not shared with other clusters")
+		config.RegistryGCConfig.IntervalSeconds = max(getOrDefaultNonNegativeNumber("REGISTRY_GC_INTERVAL", 3600), 60)
+		config.RegistryGCConfig.DryRun = os.Getenv("REGISTRY_GC_DRY_RUN") == "true"
+		config.RegistryGCConfig.LeaseName = getOrDefault("REGISTRY_GC_LEASE_NAME", "checkpointer-registry-gc")
+	}
+	if config.ControllerConfig.Enabled = os.Getenv("CONTROLLER_ENABLED") == "true"; config.ControllerConfig.Enabled {
+		log.Info().Msg("CONTROLLER_ENABLED enabled, make sure the ContainerCheckpoint custom resource definition is installed")
+		config.ControllerConfig.ResyncSeconds = max(getOrDefaultNonNegativeNumber("CONTROLLER_RESYNC", 60), 10)
+	}
+	if config.ScheduleConfig.Enabled = os.Getenv("SCHEDULE_ENABLED") == "true"; config.ScheduleConfig.Enabled {
+		log.Info().Msg("SCHEDULE_ENABLED enabled, Checkpointer will checkpoint Pods on its Node by their schedules")
+	}
+	if config.DrainGuardConfig.Enabled = os.Getenv("DRAIN_GUARD_ENABLED") == "true"; config.DrainGuardConfig.Enabled {
+		log.Info().Msg("DRAIN_GUARD_ENABLED enabled, make sure terminationGracePeriodSeconds of Checkpointer exceeds DRAIN_GUARD_TIMEOUT")
+		config.DrainGuardConfig.Parallelism = max(getOrDefaultNonNegativeNumber("DRAIN_GUARD_PARALLELISM", 2), 1)
+		config.DrainGuardConfig.TimeoutSeconds = getOrDefaultNonNegativeNumber("DRAIN_GUARD_TIMEOUT", 300)
+		config.DrainGuardConfig.Priority = getOrDefaultNonNegativeNumber("DRAIN_GUARD_PRIORITY", 100)
+	}
+	if config.GroupConfig.Enabled = os.Getenv("GROUP_ENABLED") == "true"; config.GroupConfig.Enabled {
+		log.Info().Msg("GROUP_ENABLED enabled, Checkpointer will freeze and checkpoint groups of Pods on request")
+		config.GroupConfig.DumpTimeoutSeconds = max(getOrDefaultNonNegativeNumber("GROUP_DUMP_TIMEOUT", 120), 1)
+	}
+	if config.IdleConfig.Enabled = os.Getenv("IDLE_ENABLED") == "true"; config.IdleConfig.Enabled {
+		log.Info().Msg("IDLE_ENABLED enabled, idle Pods on the Node opted in by annotation will be checkpointed and deleted")
+		config.IdleConfig.IntervalSeconds = max(getOrDefaultNonNegativeNumber("IDLE_INTERVAL", 60), 10)
+		config.IdleConfig.WindowSeconds = getOrDefaultNonNegativeNumber("IDLE_WINDOW", 1800)
+		config.IdleConfig.CPUThresholdMillicores = getOrDefaultNonNegativeNumber("IDLE_CPU_THRESHOLD", 10)
+		config.IdleConfig.NetworkThresholdBytes = getOrDefaultNonNegativeNumber("IDLE_NETWORK_THRESHOLD", 1024)
+		if exclusionWindows := os.Getenv("IDLE_EXCLUSION_WINDOWS"); exclusionWindows != "" {
+			config.IdleConfig.ExclusionWindows = strings.Split(exclusionWindows, ",")
+		}
+		if config.IdleConfig.DryRun = os.Getenv("IDLE_DRY_RUN") == "true"; config.IdleConfig.DryRun {
+			log.Info().Msg("IDLE_DRY_RUN enabled, idle Pods will only be reported, not checkpointed")
+		}
+	}
+	if config.WebhookConfig.Enabled = os.Getenv("ENABLE_RESTORE_WEBHOOK") == "true"; config.WebhookConfig.Enabled {
+		log.Info().Msg("ENABLE_RESTORE_WEBHOOK enabled, make sure Checkpointer has the webhook certificate mounted")
+		config.WebhookConfig.Port = getOrDefaultNonNegativeNumber("RESTORE_WEBHOOK_PORT", 8443)
+		config.WebhookConfig.CertFile = getOrDefault("RESTORE_WEBHOOK_CERT_FILE", "/etc/checkpointer/webhook-tls/tls.crt")
+		config.WebhookConfig.KeyFile = getOrDefault("RESTORE_WEBHOOK_KEY_FILE", "/etc/checkpointer/webhook-tls/tls.key")
+		config.WebhookConfig.ResolveTimeoutSeconds = getOrDefaultNonNegativeNumber("RESTORE_WEBHOOK_TIMEOUT", 5)
+		if runtimeAnnotations := os.Getenv("RESTORE_WEBHOOK_ANNOTATIONS"); runtimeAnnotations != "" {
+			config.WebhookConfig.RuntimeAnnotations = make(map[string]string)
+			for _, annotation := range strings.Split(runtimeAnnotations, ",") {
+				key, value, found := strings.Cut(annotation, "=")
+				if !found || key == "" {
+					log.Info().Msg(fmt.Sprintf("RESTORE_WEBHOOK_ANNOTATIONS contains malformed annotation, skipping: %s", annotation))
+					continue
+				}
+				config.WebhookConfig.RuntimeAnnotations[key] = value
+			}
+		}
+	}
+	if config.EventSinkConfig.Url = os.Getenv("EVENT_SINK_URL"); config.EventSinkConfig.Url != "" {
+		log.Info().Msg("EVENT_SINK_URL set, Checkpointer will emit CloudEvents to: " + config.EventSinkConfig.Url)
+		config.EventSinkConfig.Mode = EventSinkMode(getOrDefault("EVENT_SINK_MODE", string(EventSinkModeStructured)))
+		if config.EventSinkConfig.Mode != EventSinkModeStructured && config.EventSinkConfig.Mode != EventSinkModeBinary {
+			log.Info().Msg(fmt.Sprintf("EVENT_SINK_MODE environment variable malformed, defaulting to: %s", EventSinkModeStructured))
+			config.EventSinkConfig.Mode = EventSinkModeStructured
+		}
+		config.EventSinkConfig.BatchSize = max(getOrDefaultNonNegativeNumber("EVENT_SINK_BATCH_SIZE", 20), 1)
+		config.EventSinkConfig.FlushIntervalSeconds = max(getOrDefaultNonNegativeNumber("EVENT_SINK_FLUSH_INTERVAL", 5), 1)
+		config.EventSinkConfig.BufferPath = getOrDefault("EVENT_SINK_BUFFER_PATH", config.StorageBasePath+"/events")
+		config.EventSinkConfig.MaxBufferedEvents = max(getOrDefaultNonNegativeNumber("EVENT_SINK_MAX_BUFFERED", 10000), 1)
+		config.EventSinkConfig.TimeoutSeconds = getOrDefaultNonNegativeNumber("EVENT_SINK_TIMEOUT", 10)
+	}
 	return config, nil
 }
 
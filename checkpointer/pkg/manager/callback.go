@@ -0,0 +1,313 @@
+package manager
+
+import (
+	"bytes"
+	"checkpoint-in-k8s/pkg/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/peterbourgon/diskv/v3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of the callback body, keyed with the callback secret,
+	// in format sha256={signature}.
+	SignatureHeader = "X-Checkpointer-Signature"
+
+	// DeliveryHeader carries the tracking handle of the delivered checkpoint.
+	DeliveryHeader = "X-Checkpointer-Delivery"
+)
+
+// CallbackStatus represents the state of a callback delivery.
+type CallbackStatus string
+
+const (
+	// CallbackStatusPending means the callback was not delivered yet, but will be attempted.
+	CallbackStatusPending CallbackStatus = "Pending"
+
+	// CallbackStatusDelivered means the callback receiver acknowledged the callback with 2xx status code.
+	CallbackStatusDelivered CallbackStatus = "Delivered"
+
+	// CallbackStatusFailed means Checkpointer gave up delivering the callback.
+	CallbackStatusFailed CallbackStatus = "Failed"
+)
+
+// CallbackDelivery represents the delivery of the final CheckpointEntry to the callback URL.
+type CallbackDelivery struct {
+	// Url is the URL the CheckpointEntry is delivered to.
+	Url string `json:"url"`
+
+	// Status is the current state of the delivery.
+	Status CallbackStatus `json:"status"`
+
+	// Attempts is the number of delivery attempts made so far.
+	Attempts int64 `json:"attempts"`
+
+	// LastAttemptTimestamp is a Unix timestamp representing the time of the last delivery attempt.
+	LastAttemptTimestamp int64 `json:"lastAttemptTimestamp,omitempty"`
+
+	// LastError describes why the last delivery attempt failed.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// CallbackDispatcher is responsible for delivering the final CheckpointEntry to callback URLs.
+type CallbackDispatcher interface {
+
+	// Dispatch persists the delivery of entry to callbackUrl and delivers it in the background, retrying with
+	// exponential backoff. The body is signed with callbackSecret if it is not empty, only the signature is persisted,
+	// never the secret. Deliveries to URLs not allowed by config.CallbackConfig fail. The delivery status is written
+	// to the CallbackDelivery of the entry stored under checkpointIdentifier.
+	Dispatch(checkpointIdentifier string, entry CheckpointEntry, callbackUrl, callbackSecret string)
+
+	// ResumePending resumes the deliveries persisted before Checkpointer restarted.
+	ResumePending()
+
+	// StoreEntry stores entry under checkpointIdentifier. The writes of entries with a callback go through it, so that
+	// they are serialized with the updates of the delivery status and neither overwrites the other.
+	StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error
+}
+
+// pendingCallback is the persisted state of a callback delivery, which is not finished yet. The callback secret is
+// not persisted, only the signature of Body.
+type pendingCallback struct {
+	CheckpointIdentifier string          `json:"checkpointIdentifier"`
+	TrackingHandle       string          `json:"trackingHandle"`
+	Url                  string          `json:"url"`
+	Signature            string          `json:"signature,omitempty"`
+	Body                 json.RawMessage `json:"body"`
+	Attempts             int64           `json:"attempts"`
+	NextAttempt          time.Time       `json:"nextAttempt"`
+}
+
+// NewCallbackDispatcher constructs new CallbackDispatcher instance persisting pending deliveries on disk.
+func NewCallbackDispatcher(callbackConfig config.CallbackConfig, checkpointStorage CheckpointStorage) CallbackDispatcher {
+	return &callbackDispatcher{
+		pendingStorage: diskv.New(diskv.Options{
+			BasePath:     callbackConfig.StoragePath,
+			CacheSizeMax: 1024 * 1024,
+		}),
+		checkpointStorage: checkpointStorage,
+		callbackConfig:    callbackConfig,
+		client:            &http.Client{Timeout: time.Second * time.Duration(callbackConfig.TimeoutSeconds)},
+		maxAttempts:       callbackConfig.MaxAttempts,
+		initialBackoff:    time.Second * time.Duration(callbackConfig.InitialBackoffSeconds),
+		maxBackoff:        time.Second * time.Duration(callbackConfig.MaxBackoffSeconds),
+	}
+}
+
+type callbackDispatcher struct {
+	// pendingStorage persists the deliveries, which are not finished yet.
+	pendingStorage *diskv.Diskv
+
+	// checkpointStorage is where the delivery status is written to.
+	checkpointStorage CheckpointStorage
+
+	// mu serializes the writes of entries with the updates of their delivery status.
+	mu sync.Mutex
+
+	// callbackConfig restricts the callback URLs deliveries are sent to.
+	callbackConfig config.CallbackConfig
+
+	client         *http.Client
+	maxAttempts    int64
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func (cd *callbackDispatcher) Dispatch(checkpointIdentifier string, entry CheckpointEntry, callbackUrl, callbackSecret string) {
+	lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Str("callbackUrl", callbackUrl).Logger()
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to marshal checkpoint entry for callback")
+		cd.updateDelivery(checkpointIdentifier, func(delivery *CallbackDelivery) {
+			delivery.Status = CallbackStatusFailed
+			delivery.LastError = err.Error()
+		}, lg)
+		return
+	}
+
+	pending := pendingCallback{
+		CheckpointIdentifier: checkpointIdentifier,
+		TrackingHandle:       entry.CheckpointIdentifier,
+		Url:                  callbackUrl,
+		Body:                 body,
+		NextAttempt:          time.Now(),
+	}
+	if callbackSecret != "" {
+		pending.Signature = Sign(body, callbackSecret)
+	}
+	cd.persistPending(pending, lg)
+	go cd.deliver(pending, lg)
+}
+
+func (cd *callbackDispatcher) ResumePending() {
+	for checkpointIdentifier := range cd.pendingStorage.Keys(nil) {
+		lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+
+		marshalled, err := cd.pendingStorage.Read(checkpointIdentifier)
+		if err != nil {
+			lg.Error().Err(err).Msg("failed to read pending callback")
+			continue
+		}
+		var pending pendingCallback
+		if err := json.Unmarshal(marshalled, &pending); err != nil {
+			lg.Error().Err(err).Msg("failed to unmarshal pending callback, dropping it")
+			_ = cd.pendingStorage.Erase(checkpointIdentifier)
+			continue
+		}
+
+		lg = lg.With().Str("callbackUrl", pending.Url).Logger()
+		// Deliveries persisted by older Checkpointers carry the secret, it is replaced by the signature.
+		var legacy struct {
+			Secret string `json:"secret"`
+		}
+		if json.Unmarshal(marshalled, &legacy) == nil && legacy.Secret != "" {
+			pending.Signature = Sign(pending.Body, legacy.Secret)
+			cd.persistPending(pending, lg)
+		}
+		lg.Info().Int64("attempts", pending.Attempts).Msg("resuming pending callback delivery")
+		go cd.deliver(pending, lg)
+	}
+}
+
+// deliver attempts to deliver pending until it is delivered, rejected, or the attempts run out.
+func (cd *callbackDispatcher) deliver(pending pendingCallback, lg zerolog.Logger) {
+	for {
+		if wait := time.Until(pending.NextAttempt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		pending.Attempts++
+		retryable, err := cd.send(pending)
+		attemptTimestamp := time.Now().Unix()
+
+		if err == nil {
+			lg.Info().Int64("attempts", pending.Attempts).Msg("callback delivered")
+			cd.finishDelivery(pending, CallbackStatusDelivered, attemptTimestamp, "", lg)
+			return
+		}
+		if !retryable || pending.Attempts >= cd.maxAttempts {
+			lg.Warn().Err(err).Int64("attempts", pending.Attempts).Msg("giving up callback delivery")
+			cd.finishDelivery(pending, CallbackStatusFailed, attemptTimestamp, err.Error(), lg)
+			return
+		}
+
+		backoff := cd.backoff(pending.Attempts)
+		lg.Info().Err(err).Int64("attempts", pending.Attempts).Dur("backoff", backoff).Msg("callback delivery failed, retrying")
+		pending.NextAttempt = time.Now().Add(backoff)
+		cd.persistPending(pending, lg)
+		cd.updateDelivery(pending.CheckpointIdentifier, func(delivery *CallbackDelivery) {
+			delivery.Attempts = pending.Attempts
+			delivery.LastAttemptTimestamp = attemptTimestamp
+			delivery.LastError = err.Error()
+		}, lg)
+	}
+}
+
+// send makes a single delivery attempt. Returns error if the attempt failed and whether it makes sense to retry.
+func (cd *callbackDispatcher) send(pending pendingCallback) (bool, error) {
+	callbackUrl, err := url.Parse(pending.Url)
+	if err != nil {
+		return false, fmt.Errorf("malformed callback URL: %w", err)
+	}
+	if err := cd.callbackConfig.AllowsUrl(callbackUrl); err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, pending.Url, bytes.NewReader(pending.Body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, pending.TrackingHandle)
+	if pending.Signature != "" {
+		req.Header.Set(SignatureHeader, "sha256="+pending.Signature)
+	}
+
+	resp, err := cd.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to send callback: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Client errors will not go away by retrying, except for timeouts and rate limiting.
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("callback receiver responded with status code %d", resp.StatusCode)
+}
+
+// backoff returns how long to wait after the given number of failed attempts.
+func (cd *callbackDispatcher) backoff(attempts int64) time.Duration {
+	return exponentialBackoff(cd.initialBackoff, cd.maxBackoff, attempts)
+}
+
+// finishDelivery writes the final delivery status to the entry and forgets the pending delivery.
+func (cd *callbackDispatcher) finishDelivery(pending pendingCallback, status CallbackStatus, attemptTimestamp int64, lastError string, lg zerolog.Logger) {
+	cd.updateDelivery(pending.CheckpointIdentifier, func(delivery *CallbackDelivery) {
+		delivery.Status = status
+		delivery.Attempts = pending.Attempts
+		delivery.LastAttemptTimestamp = attemptTimestamp
+		delivery.LastError = lastError
+	}, lg)
+	if err := cd.pendingStorage.Erase(pending.CheckpointIdentifier); err != nil {
+		lg.Warn().Err(err).Msg("failed to erase finished callback delivery")
+	}
+}
+
+func (cd *callbackDispatcher) persistPending(pending pendingCallback, lg zerolog.Logger) {
+	marshalled, err := json.Marshal(pending)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to marshal pending callback")
+		return
+	}
+	if err := cd.pendingStorage.Write(pending.CheckpointIdentifier, marshalled); err != nil {
+		lg.Error().Err(err).Msg("failed to persist pending callback, delivery will not survive restart")
+	}
+}
+
+func (cd *callbackDispatcher) StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	return cd.checkpointStorage.StoreEntry(checkpointIdentifier, entry)
+}
+
+// updateDelivery applies update to the CallbackDelivery of the entry stored under checkpointIdentifier. The entry is
+// left alone while it is in progress, as it is being retried and the delivery belongs to the previous attempt.
+func (cd *callbackDispatcher) updateDelivery(checkpointIdentifier string, update func(delivery *CallbackDelivery), lg zerolog.Logger) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	entry, err := cd.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil || entry == nil {
+		lg.Warn().Err(err).Msg("failed to read checkpoint entry to update callback delivery")
+		return
+	}
+	if entry.InProgress() {
+		lg.Info().Msg("checkpoint is retried, not updating callback delivery of its previous attempt")
+		return
+	}
+	if entry.Callback == nil {
+		entry.Callback = &CallbackDelivery{}
+	}
+	update(entry.Callback)
+	if err := cd.checkpointStorage.StoreEntry(checkpointIdentifier, *entry); err != nil {
+		lg.Warn().Err(err).Msg("failed to store callback delivery status")
+	}
+}
+
+// Sign returns hex encoded HMAC-SHA256 of body keyed with secret, which receivers can use to verify callbacks.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,238 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/config"
+	"encoding/json"
+	"github.com/peterbourgon/diskv/v3"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncStorage is mockStorage safe for use by the dispatcher goroutines.
+type syncStorage struct {
+	mu      sync.Mutex
+	storage map[string]CheckpointEntry
+}
+
+func (s *syncStorage) StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storage[checkpointIdentifier] = entry
+	return nil
+}
+
+func (s *syncStorage) ReadEntry(checkpointIdentifier string) (*CheckpointEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.storage[checkpointIdentifier]
+	if !found {
+		return nil, nil
+	}
+	if entry.Callback != nil {
+		callback := *entry.Callback
+		entry.Callback = &callback
+	}
+	return &entry, nil
+}
+
+func (s *syncStorage) ListEntries(filter EntryFilter) ([]CheckpointEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []CheckpointEntry
+	for _, entry := range s.storage {
+		entries = append(entries, entry)
+	}
+	return filterEntries(entries, filter), nil
+}
+
+func (s *syncStorage) DeleteEntry(checkpointIdentifier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.storage, checkpointIdentifier)
+	return nil
+}
+
+func newTestCallbackDispatcher(t *testing.T, storage CheckpointStorage) *callbackDispatcher {
+	return &callbackDispatcher{
+		pendingStorage:    diskv.New(diskv.Options{BasePath: t.TempDir()}),
+		checkpointStorage: storage,
+		callbackConfig:    config.CallbackConfig{AllowedSchemes: []string{"http"}, AllowedHosts: []string{"127.0.0.1"}},
+		client:            &http.Client{Timeout: time.Second},
+		maxAttempts:       3,
+		initialBackoff:    time.Millisecond,
+		maxBackoff:        time.Millisecond * 10,
+	}
+}
+
+// waitForCallbackStatus waits until the callback delivery of the entry under checkpointIdentifier leaves Pending.
+func waitForCallbackStatus(t *testing.T, storage CheckpointStorage, checkpointIdentifier string) *CallbackDelivery {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		entry, _ := storage.ReadEntry(checkpointIdentifier)
+		if entry.Callback != nil && entry.Callback.Status != CallbackStatusPending {
+			return entry.Callback
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("callback was not delivered in time")
+	return nil
+}
+
+func Test_callbackDispatcher_Dispatch(t *testing.T) {
+	var attempts int
+	var receivedSignature string
+	var receivedEntry CheckpointEntry
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		receivedSignature = req.Header.Get(SignatureHeader)
+		if receivedSignature != "sha256="+Sign(body, "secret") {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.Unmarshal(body, &receivedEntry)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	entry := CheckpointEntry{
+		CheckpointIdentifier: "node:id",
+		ContainerImageName:   "quay.io/checkpointed",
+		Callback:             &CallbackDelivery{Url: server.URL, Status: CallbackStatusPending},
+	}
+	storage := &syncStorage{storage: map[string]CheckpointEntry{"id": entry}}
+	dispatcher := newTestCallbackDispatcher(t, storage)
+
+	dispatcher.Dispatch("id", entry, server.URL, "secret")
+
+	delivery := waitForCallbackStatus(t, storage, "id")
+	if delivery.Status != CallbackStatusDelivered {
+		t.Fatalf("callback should be delivered, got: %s, %s", delivery.Status, delivery.LastError)
+	}
+	if delivery.Attempts != 2 {
+		t.Fatalf("callback should be delivered on second attempt, got: %d", delivery.Attempts)
+	}
+	if receivedEntry.ContainerImageName != "quay.io/checkpointed" {
+		t.Fatalf("callback receiver got malformed checkpoint entry")
+	}
+}
+
+func Test_callbackDispatcher_Dispatch_Rejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	entry := CheckpointEntry{CheckpointIdentifier: "node:id"}
+	storage := &syncStorage{storage: map[string]CheckpointEntry{"id": entry}}
+	dispatcher := newTestCallbackDispatcher(t, storage)
+
+	dispatcher.Dispatch("id", entry, server.URL, "")
+
+	delivery := waitForCallbackStatus(t, storage, "id")
+	if delivery.Status != CallbackStatusFailed || delivery.Attempts != 1 {
+		t.Fatalf("rejected callback should fail without retry, got: %s after %d attempts", delivery.Status, delivery.Attempts)
+	}
+}
+
+func Test_callbackDispatcher_Dispatch_NotAllowed(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+	}))
+	defer server.Close()
+
+	entry := CheckpointEntry{CheckpointIdentifier: "node:id"}
+	storage := &syncStorage{storage: map[string]CheckpointEntry{"id": entry}}
+	dispatcher := newTestCallbackDispatcher(t, storage)
+	dispatcher.callbackConfig.AllowedHosts = []string{"*.example.com"}
+
+	dispatcher.Dispatch("id", entry, server.URL, "")
+
+	delivery := waitForCallbackStatus(t, storage, "id")
+	if delivery.Status != CallbackStatusFailed || attempts != 0 {
+		t.Fatalf("callback to host which is not allowed should fail without request, got: %s after %d requests", delivery.Status, attempts)
+	}
+}
+
+func Test_callbackDispatcher_ResumePending(t *testing.T) {
+	delivered := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		delivered <- req.Header.Get(DeliveryHeader)
+	}))
+	defer server.Close()
+
+	storage := &syncStorage{storage: map[string]CheckpointEntry{"id": {CheckpointIdentifier: "node:id"}}}
+	dispatcher := newTestCallbackDispatcher(t, storage)
+	dispatcher.persistPending(pendingCallback{
+		CheckpointIdentifier: "id",
+		TrackingHandle:       "node:id",
+		Url:                  server.URL,
+		Body:                 json.RawMessage(`{}`),
+		Attempts:             1,
+	}, zerolog.Nop())
+
+	dispatcher.ResumePending()
+
+	if handle := <-delivered; handle != "node:id" {
+		t.Fatalf("resumed callback has wrong delivery header: %s", handle)
+	}
+	delivery := waitForCallbackStatus(t, storage, "id")
+	if delivery.Status != CallbackStatusDelivered || delivery.Attempts != 2 {
+		t.Fatalf("resumed callback should be delivered on second attempt, got: %s after %d attempts", delivery.Status, delivery.Attempts)
+	}
+}
+
+func Test_callbackDispatcher_ResumePending_LegacySecret(t *testing.T) {
+	signatures := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		signatures <- req.Header.Get(SignatureHeader)
+	}))
+	defer server.Close()
+
+	storage := &syncStorage{storage: map[string]CheckpointEntry{"id": {CheckpointIdentifier: "node:id"}}}
+	dispatcher := newTestCallbackDispatcher(t, storage)
+	legacy, _ := json.Marshal(map[string]any{"checkpointIdentifier": "id", "url": server.URL, "secret": "secret", "body": json.RawMessage(`{}`)})
+	if err := dispatcher.pendingStorage.Write("id", legacy); err != nil {
+		t.Fatalf("failed to persist legacy pending callback: %v", err)
+	}
+
+	dispatcher.ResumePending()
+
+	if signature := <-signatures; signature != "sha256="+Sign([]byte(`{}`), "secret") {
+		t.Fatalf("resumed legacy callback should be signed with its secret, got: %s", signature)
+	}
+	waitForCallbackStatus(t, storage, "id")
+}
+
+func Test_callbackDispatcher_Dispatch_SecretNotPersisted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	entry := CheckpointEntry{CheckpointIdentifier: "node:id"}
+	storage := &syncStorage{storage: map[string]CheckpointEntry{"id": entry}}
+	dispatcher := newTestCallbackDispatcher(t, storage)
+	dispatcher.initialBackoff, dispatcher.maxBackoff = time.Minute, time.Minute
+
+	dispatcher.Dispatch("id", entry, server.URL, "callback-secret")
+
+	persisted, err := dispatcher.pendingStorage.Read("id")
+	if err != nil {
+		t.Fatalf("pending callback should be persisted: %v", err)
+	}
+	if strings.Contains(string(persisted), "callback-secret") || !strings.Contains(string(persisted), `"signature"`) {
+		t.Fatalf("pending callback should persist the signature instead of the secret, got: %s", persisted)
+	}
+}
@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ContainerCheckpointResource identifies the ContainerCheckpoint custom resource, see
+// k8s-manifests/containercheckpoint-crd.yaml.
+var ContainerCheckpointResource = schema.GroupVersionResource{Group: "checkpoint.k8s", Version: "v1alpha1", Resource: "containercheckpoints"}
+
+// ContainerCheckpoint requests a checkpoint of a container declaratively. It is reconciled by the Checkpointer on the
+// Node of the target Pod, which writes the progress of the checkpoint to its status.
+type ContainerCheckpoint struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ContainerCheckpointSpec   `json:"spec"`
+	Status ContainerCheckpointStatus `json:"status,omitempty"`
+}
+
+// ContainerCheckpointSpec represents the requested checkpoint. It is only read once the checkpoint begins, later
+// changes are ignored.
+type ContainerCheckpointSpec struct {
+	// Target is the container to checkpoint, in the Namespace of the ContainerCheckpoint.
+	Target ContainerCheckpointTarget `json:"target"`
+
+	// DeletePod deletes the Pod after checkpoint, same as checkpoint.StopPolicyDelete. Strategy takes precedence.
+	DeletePod bool `json:"deletePod,omitempty"`
+
+	// Strategy is the checkpoint.StopPolicy applied to the Pod after checkpoint.
+	Strategy checkpoint.StopPolicy `json:"strategy,omitempty"`
+
+	// Tags are recorded as the labels of the checkpoint, so that checkpoints can be listed by them.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Slot is the name of the slot whose history the checkpoint joins once it succeeds, see SlotHistory.
+	Slot string `json:"slot,omitempty"`
+}
+
+// ContainerCheckpointTarget identifies the checkpointed container within the Namespace of the ContainerCheckpoint.
+type ContainerCheckpointTarget struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+}
+
+// ContainerCheckpointStatus represents the progress of the requested checkpoint.
+type ContainerCheckpointStatus struct {
+	// Node is the Node of the Checkpointer which reconciles the ContainerCheckpoint.
+	Node string `json:"node,omitempty"`
+
+	// CheckpointIdentifier is the tracking handle of the checkpoint, which can be used with the HTTP API as well.
+	CheckpointIdentifier string `json:"checkpointIdentifier,omitempty"`
+
+	// Phase is the current phase of the checkpoint.
+	Phase checkpoint.Phase `json:"phase,omitempty"`
+
+	// Image is the pushed checkpoint image.
+	Image string `json:"image,omitempty"`
+
+	// Digest is the digest of Image, so that the exact checkpoint image can be referenced even if the tag is moved.
+	Digest string `json:"digest,omitempty"`
+
+	// Error is the error that might have occurred during checkpointing.
+	Error *checkpoint.CheckpointError `json:"error,omitempty"`
+
+	// BeginTimestamp is a Unix timestamp representing the time checkpointing was initiated.
+	BeginTimestamp int64 `json:"beginTimestamp,omitempty"`
+
+	// EndTimestamp is a Unix timestamp representing the time checkpointing was finished.
+	EndTimestamp int64 `json:"endTimestamp,omitempty"`
+}
+
+// finished reports whether the checkpoint requested by the ContainerCheckpoint has finished. Unlike
+// checkpoint.Phase.Finished, the checkpoint without phase has not begun yet.
+func (status ContainerCheckpointStatus) finished() bool {
+	return status.Phase != "" && status.Phase.Finished()
+}
+
+// containerIdentifier returns the checkpointed container.
+func (cc *ContainerCheckpoint) containerIdentifier() checkpoint.ContainerIdentifier {
+	return checkpoint.ContainerIdentifier{Namespace: cc.Namespace, Pod: cc.Spec.Target.Pod, Container: cc.Spec.Target.Container}
+}
+
+// stopPolicy returns the requested checkpoint.StopPolicy. If Strategy is not set, DeletePod decides between
+// checkpoint.StopPolicyDelete and checkpoint.StopPolicyNone.
+func (cc *ContainerCheckpoint) stopPolicy() (checkpoint.StopPolicy, error) {
+	if cc.Spec.Strategy == "" {
+		if cc.Spec.DeletePod {
+			return checkpoint.StopPolicyDelete, nil
+		}
+		return checkpoint.StopPolicyNone, nil
+	}
+	return checkpoint.ParseStopPolicy(string(cc.Spec.Strategy))
+}
+
+// containerCheckpointFrom converts the unstructured object of the dynamic client to ContainerCheckpoint.
+func containerCheckpointFrom(obj *unstructured.Unstructured) (*ContainerCheckpoint, error) {
+	marshalled, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ContainerCheckpoint %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+	cc := &ContainerCheckpoint{}
+	if err := json.Unmarshal(marshalled, cc); err != nil {
+		return nil, fmt.Errorf("malformed ContainerCheckpoint %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return cc, nil
+}
@@ -0,0 +1,395 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errClaimed is returned when updating the status of ContainerCheckpoint which was already claimed by a Checkpointer.
+var errClaimed = errors.New("ContainerCheckpoint already claimed")
+
+// ImageDigester is responsible for resolving the digests of checkpoint images.
+type ImageDigester interface {
+
+	// ImageDigest returns the digest of the manifest image points to. Returns empty string if the image is not in the
+	// registry.
+	ImageDigest(ctx context.Context, image string) (string, error)
+}
+
+// ContainerCheckpointController reconciles the ContainerCheckpoint resources targeting Pods on the Node of this
+// Checkpointer. It claims every such resource by writing the Node to its status, checkpoints the container through
+// CheckpointManager and follows the checkpoint, writing its phases and result to the status. The checkpoint
+// identifier is the UID of the resource, so that a checkpoint interrupted by Checkpointer restart is not repeated,
+// but resumed or replayed by the idempotency of CheckpointManager. Deleting the resource cancels its checkpoint.
+type ContainerCheckpointController struct {
+	config.ControllerConfig
+	manager CheckpointManager
+	client  kubernetes.Interface
+	dynamic dynamic.Interface
+	digests ImageDigester
+	node    string
+	queue   workqueue.TypedRateLimitingInterface[string]
+
+	// mu guards following.
+	mu sync.Mutex
+
+	// following holds the keys of the resources whose checkpoints are followed.
+	following map[string]bool
+}
+
+// NewContainerCheckpointController constructs ContainerCheckpointController of the Checkpointer of checkpointerNode.
+// The digests can be nil, in which case the digests of checkpoint images are not written to the status.
+func NewContainerCheckpointController(controllerConfig config.ControllerConfig, checkpointManager CheckpointManager, client kubernetes.Interface, dynamicClient dynamic.Interface, digests ImageDigester, checkpointerNode string) *ContainerCheckpointController {
+	return &ContainerCheckpointController{
+		ControllerConfig: controllerConfig,
+		manager:          checkpointManager,
+		client:           client,
+		dynamic:          dynamicClient,
+		digests:          digests,
+		node:             checkpointerNode,
+		queue:            workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+		following:        make(map[string]bool),
+	}
+}
+
+// Run watches the ContainerCheckpoint resources and reconciles them until ctx is done.
+func (c *ContainerCheckpointController) Run(ctx context.Context) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.dynamic, time.Duration(c.ResyncSeconds)*time.Second)
+	informer := factory.ForResource(ContainerCheckpointResource).Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+		DeleteFunc: c.cancel,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to watch ContainerCheckpoint resources")
+		return
+	}
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		log.Error().Msg("failed to sync ContainerCheckpoint resources")
+		return
+	}
+	log.Info().Msg("reconciling ContainerCheckpoint resources")
+
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNextItem(ctx, informer.GetIndexer()) {
+	}
+}
+
+func (c *ContainerCheckpointController) enqueue(obj interface{}) {
+	if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+		c.queue.Add(key)
+	}
+}
+
+// processNextItem reconciles the next resource from the queue, requeueing it with backoff if it fails. Returns false
+// once the queue is shut down.
+func (c *ContainerCheckpointController) processNextItem(ctx context.Context, indexer cache.Indexer) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	obj, exists, err := indexer.GetByKey(key)
+	if err == nil && exists {
+		err = c.reconcile(ctx, obj.(*unstructured.Unstructured))
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("containerCheckpoint", key).Msg("failed to reconcile ContainerCheckpoint, retrying")
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile claims the ContainerCheckpoint if its target Pod runs on this Node and begins or resumes its checkpoint.
+// The resources which are finished, claimed by other Checkpointer or already followed are skipped.
+func (c *ContainerCheckpointController) reconcile(ctx context.Context, obj *unstructured.Unstructured) error {
+	cc, err := containerCheckpointFrom(obj)
+	if err != nil {
+		log.Warn().Err(err).Msg("skipping malformed ContainerCheckpoint")
+		return nil
+	}
+	key := cc.Namespace + "/" + cc.Name
+	if cc.Status.finished() || (cc.Status.Node != "" && cc.Status.Node != c.node) || c.isFollowing(key) {
+		return nil
+	}
+	lg := log.With().Str("containerCheckpoint", key).Str("containerIdentifier", cc.containerIdentifier().String()).Logger()
+
+	if cc.Status.Node == "" {
+		pod, err := c.client.CoreV1().Pods(cc.Namespace).Get(ctx, cc.Spec.Target.Pod, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// The Pod might not be created yet, so the resource is requeued with backoff instead of failing.
+			return fmt.Errorf("target Pod %s not found", cc.Spec.Target.Pod)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get target Pod: %w", err)
+		}
+		if pod.Spec.NodeName != c.node {
+			return nil
+		}
+
+		checkpointIdentifier := string(cc.UID)
+		cc, err = c.updateStatus(ctx, cc.Namespace, cc.Name, func(status *ContainerCheckpointStatus) error {
+			if status.Node != "" || status.Phase != "" {
+				return errClaimed
+			}
+			status.Node = c.node
+			status.CheckpointIdentifier = c.node + ":" + checkpointIdentifier
+			status.Phase = checkpoint.PhaseQueued
+			status.BeginTimestamp = time.Now().Unix()
+			return nil
+		})
+		if errors.Is(err, errClaimed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lg.Info().Str("checkpointIdentifier", cc.Status.CheckpointIdentifier).Msg("claimed ContainerCheckpoint")
+	}
+
+	return c.checkpoint(lg.WithContext(ctx), cc)
+}
+
+// checkpoint begins the checkpoint requested by the claimed ContainerCheckpoint, or replays it if it already began,
+// and follows it. Returns error if the checkpoint should be requested again later, e.g. when the queue is full.
+func (c *ContainerCheckpointController) checkpoint(ctx context.Context, cc *ContainerCheckpoint) error {
+	lg := zerolog.Ctx(ctx)
+	stopPolicy, err := cc.stopPolicy()
+	if err != nil {
+		return c.fail(ctx, cc, checkpoint.NewCheckpointError(checkpoint.ErrorCodeInternal, "", err))
+	}
+
+	checkpointIdentifier := strings.TrimPrefix(cc.Status.CheckpointIdentifier, c.node+":")
+	_, err = c.manager.Checkpoint(ctx, true, checkpoint.CheckpointerParams{
+		ContainerIdentifier:  cc.containerIdentifier(),
+		StopPolicy:           stopPolicy,
+		CheckpointIdentifier: checkpointIdentifier,
+		Labels:               cc.Spec.Tags,
+		Slot:                 cc.Spec.Slot,
+	})
+
+	var duplicateErr *DuplicateCheckpointError
+	var queueFullErr *QueueFullError
+	switch {
+	case errors.As(err, &duplicateErr) && !duplicateErr.Joinable:
+		// The container is already being checkpointed with different parameters, e.g. another stop policy, so the
+		// checkpoint is requested again once that one finishes.
+		lg.Info().Err(err).Msg("container being checkpointed with different parameters, requesting again later")
+		return err
+	case errors.As(err, &duplicateErr):
+		// The container is already being checkpointed with the same parameters, so the resource follows that
+		// checkpoint, like an asynchronous HTTP request joins it.
+		checkpointIdentifier = duplicateErr.CheckpointIdentifier
+		lg.Info().Str("checkpointIdentifier", checkpointIdentifier).Msg("joining checkpoint in progress")
+		_, err = c.updateStatus(ctx, cc.Namespace, cc.Name, func(status *ContainerCheckpointStatus) error {
+			status.CheckpointIdentifier = c.node + ":" + checkpointIdentifier
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case errors.As(err, &queueFullErr), errors.Is(err, ErrPublishQueueFull), errors.Is(err, ErrInsufficientStorage):
+		lg.Info().Err(err).Msg("checkpoint not admitted, requesting again later")
+		return err
+	case err != nil:
+		lg.Error().Err(err).Msg("checkpointing failed")
+		return c.fail(ctx, cc, checkpoint.AsCheckpointError(err, ""))
+	}
+
+	c.follow(ctx, cc.Namespace+"/"+cc.Name, checkpointIdentifier)
+	return nil
+}
+
+// follow writes the phases and the result of the checkpoint under checkpointIdentifier to the status of the
+// ContainerCheckpoint under key in the background. Once the checkpoint is not followed anymore, e.g. because the
+// result could not be written, the resource is reconciled again on the next resync.
+func (c *ContainerCheckpointController) follow(ctx context.Context, key, checkpointIdentifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.following[key] {
+		return
+	}
+	c.following[key] = true
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			delete(c.following, key)
+		}()
+		lg := zerolog.Ctx(ctx).With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+		namespace, name, _ := strings.Cut(key, "/")
+
+		events, err := c.manager.CheckpointEvents(ctx, checkpointIdentifier)
+		if err != nil {
+			lg.Error().Err(err).Msg("failed to follow checkpoint")
+			return
+		}
+		var result *CheckpointEntry
+		for event := range events {
+			switch event.Type {
+			case EventTypePhase:
+				if !event.Phase.Finished() {
+					c.writePhase(ctx, namespace, name, event.Phase, lg)
+				}
+			case EventTypeResult:
+				result = event.Entry
+			}
+		}
+
+		// Events are dropped for subscribers which do not keep up, but the result can always be read from storage.
+		if result == nil && ctx.Err() == nil {
+			if result, err = c.manager.CheckpointResult(ctx, checkpointIdentifier, 0); err != nil {
+				lg.Error().Err(err).Msg("failed to read checkpoint result")
+				return
+			}
+		}
+		if result == nil || result.InProgress() {
+			return
+		}
+		if err := c.writeResult(ctx, namespace, name, result); err != nil {
+			lg.Error().Err(err).Msg("failed to write checkpoint result to ContainerCheckpoint")
+			return
+		}
+		lg.Info().Str("phase", string(result.Phase)).Msg("ContainerCheckpoint finished")
+	}()
+}
+
+func (c *ContainerCheckpointController) isFollowing(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.following[key]
+}
+
+func (c *ContainerCheckpointController) writePhase(ctx context.Context, namespace, name string, phase checkpoint.Phase, lg zerolog.Logger) {
+	_, err := c.updateStatus(ctx, namespace, name, func(status *ContainerCheckpointStatus) error {
+		status.Phase = phase
+		return nil
+	})
+	if err != nil {
+		lg.Warn().Err(err).Str("phase", string(phase)).Msg("failed to write phase to ContainerCheckpoint")
+	}
+}
+
+// writeResult writes the finished checkpoint entry to the status, together with the digest of its image.
+func (c *ContainerCheckpointController) writeResult(ctx context.Context, namespace, name string, entry *CheckpointEntry) error {
+	digest := ""
+	if entry.Phase == checkpoint.PhaseSucceeded && entry.ContainerImageName != "" && c.digests != nil {
+		var err error
+		if digest, err = c.digests.ImageDigest(ctx, entry.ContainerImageName); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("image", entry.ContainerImageName).Msg("failed to get digest of checkpoint image")
+		}
+	}
+	_, err := c.updateStatus(ctx, namespace, name, func(status *ContainerCheckpointStatus) error {
+		status.Phase = entry.Phase
+		status.Image = entry.ContainerImageName
+		status.Digest = digest
+		status.Error = entry.Error
+		status.BeginTimestamp = entry.BeginTimestamp
+		status.EndTimestamp = entry.EndTimestamp
+		return nil
+	})
+	return err
+}
+
+// fail writes the Failed phase with checkpointErr to the status of the ContainerCheckpoint, unless another Checkpointer
+// claimed it in the meantime, in which case errClaimed is returned.
+func (c *ContainerCheckpointController) fail(ctx context.Context, cc *ContainerCheckpoint, checkpointErr *checkpoint.CheckpointError) error {
+	_, err := c.updateStatus(ctx, cc.Namespace, cc.Name, func(status *ContainerCheckpointStatus) error {
+		if (status.Node != "" && status.Node != c.node) || status.finished() {
+			return errClaimed
+		}
+		status.Phase = checkpoint.PhaseFailed
+		status.Error = checkpointErr
+		status.EndTimestamp = time.Now().Unix()
+		return nil
+	})
+	return err
+}
+
+// updateStatus applies update to the current status of the ContainerCheckpoint and writes it, retrying on conflict.
+// Returns the updated ContainerCheckpoint or the error returned by update.
+func (c *ContainerCheckpointController) updateStatus(ctx context.Context, namespace, name string, update func(status *ContainerCheckpointStatus) error) (*ContainerCheckpoint, error) {
+	resources := c.dynamic.Resource(ContainerCheckpointResource).Namespace(namespace)
+	var cc *ContainerCheckpoint
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := resources.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if cc, err = containerCheckpointFrom(obj); err != nil {
+			return err
+		}
+		if err := update(&cc.Status); err != nil {
+			return err
+		}
+		marshalled, err := json.Marshal(cc.Status)
+		if err != nil {
+			return err
+		}
+		var status map[string]interface{}
+		if err := json.Unmarshal(marshalled, &status); err != nil {
+			return err
+		}
+		obj.Object["status"] = status
+		_, err = resources.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update status of ContainerCheckpoint %s/%s: %w", namespace, name, err)
+	}
+	return cc, nil
+}
+
+// cancel cancels the checkpoint of the deleted ContainerCheckpoint if it is still in progress. Checkpoints joined by
+// the resource are left running, as they were requested by someone else.
+func (c *ContainerCheckpointController) cancel(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	cc, err := containerCheckpointFrom(unstructuredObj)
+	if err != nil || cc.Status.Node != c.node || cc.Status.finished() || cc.Status.CheckpointIdentifier != c.node+":"+string(cc.UID) {
+		return
+	}
+
+	go func() {
+		lg := log.With().Str("containerCheckpoint", cc.Namespace+"/"+cc.Name).Logger()
+		_, err := c.manager.CancelCheckpoint(context.Background(), string(cc.UID))
+		if err != nil && !errors.Is(err, ErrNotCancellable) && !errors.Is(err, ErrEntryNotFound) {
+			lg.Warn().Err(err).Msg("failed to cancel checkpoint of deleted ContainerCheckpoint")
+			return
+		}
+		lg.Info().Msg("cancelled checkpoint of deleted ContainerCheckpoint")
+	}()
+}
@@ -0,0 +1,175 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func newTestContainerCheckpoint(pod string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "checkpoint.k8s/v1alpha1",
+		"kind":       "ContainerCheckpoint",
+		"metadata":   map[string]interface{}{"name": "cc", "namespace": "ns", "uid": "3f5e2a4c-0b1d-4c8e-9a7f-6d2b1e0c9f8a"},
+		"spec": map[string]interface{}{
+			"target": map[string]interface{}{"pod": pod, "container": "ctrn"},
+			"tags":   map[string]interface{}{"app": "notebook"},
+		},
+	}}
+}
+
+func newTestContainerCheckpointController(obj *unstructured.Unstructured, pods ...*v1.Pod) (*ContainerCheckpointController, *syncStorage) {
+	storage := &syncStorage{storage: make(map[string]CheckpointEntry)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     storage,
+	}
+	client := fake.NewSimpleClientset()
+	for _, pod := range pods {
+		_, _ = client.CoreV1().Pods(pod.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{ContainerCheckpointResource: "ContainerCheckpointList"},
+		obj,
+	)
+	digests := &mockImageCollector{digests: map[string]string{"quay.io/checkpointed": "sha256:abcd"}}
+	return NewContainerCheckpointController(config.ControllerConfig{}, manager, client, dynamicClient, digests, "node"), storage
+}
+
+func readTestContainerCheckpoint(t *testing.T, c *ContainerCheckpointController) *ContainerCheckpoint {
+	obj, err := c.dynamic.Resource(ContainerCheckpointResource).Namespace("ns").Get(context.TODO(), "cc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ContainerCheckpoint: %v", err)
+	}
+	cc, err := containerCheckpointFrom(obj)
+	if err != nil {
+		t.Fatalf("failed to convert ContainerCheckpoint: %v", err)
+	}
+	return cc
+}
+
+// awaitTestContainerCheckpoint returns the ContainerCheckpoint once a finished status is written to it.
+func awaitTestContainerCheckpoint(t *testing.T, w watch.Interface) *ContainerCheckpoint {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-w.ResultChan():
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			if cc, err := containerCheckpointFrom(obj); err == nil && cc.Status.finished() {
+				return cc
+			}
+		case <-timeout:
+			t.Fatal("ContainerCheckpoint did not finish in time")
+		}
+	}
+}
+
+func Test_ContainerCheckpointController_reconcile(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns"}, Spec: v1.PodSpec{NodeName: "node"}}
+	obj := newTestContainerCheckpoint("pod")
+	c, storage := newTestContainerCheckpointController(obj, pod)
+	w, err := c.dynamic.Resource(ContainerCheckpointResource).Namespace("ns").Watch(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to watch ContainerCheckpoint: %v", err)
+	}
+	defer w.Stop()
+
+	if err := c.reconcile(context.TODO(), obj); err != nil {
+		t.Fatalf("reconcile returned unexpected error: %v", err)
+	}
+
+	status := awaitTestContainerCheckpoint(t, w).Status
+	if status.Phase != checkpoint.PhaseSucceeded || status.Node != "node" || status.CheckpointIdentifier != "node:3f5e2a4c-0b1d-4c8e-9a7f-6d2b1e0c9f8a" {
+		t.Fatalf("ContainerCheckpoint should be claimed and succeed, got: %+v", status)
+	}
+	if status.Image != "quay.io/checkpointed" || status.Digest != "sha256:abcd" || status.EndTimestamp == 0 {
+		t.Fatalf("status should carry the checkpoint image and its digest, got: %+v", status)
+	}
+	entry, _ := storage.ReadEntry("3f5e2a4c-0b1d-4c8e-9a7f-6d2b1e0c9f8a")
+	if entry == nil || entry.Labels["app"] != "notebook" || entry.ContainerIdentifier.Pod != "pod" {
+		t.Fatalf("checkpoint should be requested with the target and tags of the spec, got: %+v", entry)
+	}
+
+	// Reconciling the finished resource again does not checkpoint again.
+	_ = storage.DeleteEntry("3f5e2a4c-0b1d-4c8e-9a7f-6d2b1e0c9f8a")
+	obj, _ = c.dynamic.Resource(ContainerCheckpointResource).Namespace("ns").Get(context.TODO(), "cc", metav1.GetOptions{})
+	if err := c.reconcile(context.TODO(), obj); err != nil {
+		t.Fatalf("reconcile returned unexpected error: %v", err)
+	}
+	if entry, _ := storage.ReadEntry("3f5e2a4c-0b1d-4c8e-9a7f-6d2b1e0c9f8a"); entry != nil {
+		t.Fatalf("finished ContainerCheckpoint should not be checkpointed again, got: %+v", entry)
+	}
+}
+
+func Test_ContainerCheckpointController_reconcile_OtherNode(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns"}, Spec: v1.PodSpec{NodeName: "other-node"}}
+	obj := newTestContainerCheckpoint("pod")
+	c, storage := newTestContainerCheckpointController(obj, pod)
+
+	if err := c.reconcile(context.TODO(), obj); err != nil {
+		t.Fatalf("reconcile returned unexpected error: %v", err)
+	}
+	if entries, _ := storage.ListEntries(EntryFilter{}); len(entries) != 0 {
+		t.Fatalf("checkpoint of Pod on other Node should not be requested, got: %+v", entries)
+	}
+	if status := readTestContainerCheckpoint(t, c).Status; status.Node != "" || status.Phase != "" {
+		t.Fatalf("ContainerCheckpoint targeting Pod on other Node should be left to its Checkpointer, got: %+v", status)
+	}
+}
+
+func Test_ContainerCheckpointController_reconcile_PodNotFound(t *testing.T) {
+	obj := newTestContainerCheckpoint("missing")
+	c, _ := newTestContainerCheckpointController(obj)
+
+	if err := c.reconcile(context.TODO(), obj); err == nil {
+		t.Fatalf("ContainerCheckpoint targeting missing Pod should be requeued")
+	}
+	if status := readTestContainerCheckpoint(t, c).Status; status.Node != "" || status.Phase != "" {
+		t.Fatalf("ContainerCheckpoint targeting missing Pod should not be failed, got: %+v", status)
+	}
+}
+
+func Test_ContainerCheckpointController_reconcile_Duplicate(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns"}, Spec: v1.PodSpec{NodeName: "node"}}
+	obj := newTestContainerCheckpoint("pod")
+	c, _ := newTestContainerCheckpointController(obj, pod)
+	manager := c.manager.(*checkpointManager)
+	manager.checkpointer = blockingCheckpointer{}
+	_, err := manager.Checkpoint(context.TODO(), true, checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: "other",
+	})
+	if err != nil {
+		t.Fatalf("Checkpoint returned unexpected error: %v", err)
+	}
+	defer manager.CancelCheckpoint(context.TODO(), "other")
+
+	if err := c.reconcile(context.TODO(), obj); err == nil {
+		t.Fatalf("ContainerCheckpoint should be requeued while checkpoint with different parameters is in progress")
+	}
+	status := readTestContainerCheckpoint(t, c).Status
+	if status.Phase != checkpoint.PhaseQueued || status.CheckpointIdentifier != "node:3f5e2a4c-0b1d-4c8e-9a7f-6d2b1e0c9f8a" {
+		t.Fatalf("ContainerCheckpoint should not join checkpoint with different parameters, got: %+v", status)
+	}
+}
@@ -2,8 +2,17 @@ package manager
 
 import (
 	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -12,76 +21,409 @@ type checkpointManager struct {
 	// checkpointsInProgress is map of currently ongoing checkpoint goroutines.
 	checkpointsInProgress *checkpointsInProgress
 
+	// events publishes progress of checkpoints to subscribers.
+	events *checkpointEvents
+
 	// checkpointer is the checkpoint strategy this manager will use.
 	checkpointer checkpoint.Checkpointer
 
-	// checkpointStorage is where manager stores result of asynchronous checkpoints
+	// podStopper stops the checkpointed Pods according to the requested StopPolicy.
+	podStopper checkpoint.PodStopper
+
+	// verifier test restores the checkpoint images if verification is requested.
+	verifier checkpoint.Verifier
+
+	// imageDeleter deletes the images of deleted checkpoints from the container registry.
+	imageDeleter checkpoint.ImageDeleter
+
+	// checkpointStorage is where manager stores result of checkpoints
 	checkpointStorage CheckpointStorage
+
+	// callbackDispatcher delivers results of asynchronous checkpoints to the requested callback URLs.
+	callbackDispatcher CallbackDispatcher
+
+	// pendingStorage persists checkpoints in progress, so that they can be recovered after restart.
+	pendingStorage PendingCheckpointStorage
+
+	// eventSink emits lifecycle of every checkpoint to the cluster-wide event pipeline. Nil if not configured.
+	eventSink EventSink
+
+	// scheduler limits how many checkpoints run at once and makes the others wait in the queue.
+	scheduler *scheduler
+
+	// buildRetry configures how failed builds of checkpoint images are retried from the checkpoint archive.
+	buildRetry config.BuildRetryConfig
+
+	// publishQueue publishes the images of deferred checkpoints in the background.
+	publishQueue *publishQueue
+
+	// retention removes the expired checkpoint results. Nil if no retention policy is configured.
+	retention *retention
+
+	// checkpointerNode is the name of the Node this manager is running on, used to build tracking handles.
+	checkpointerNode string
 }
 
 func (cm checkpointManager) Checkpoint(ctx context.Context, async bool, checkpointerParams checkpoint.CheckpointerParams) (*CheckpointEntry, error) {
+	lg := log.With().Str("containerIdentifier", checkpointerParams.ContainerIdentifier.String()).Logger()
+	checkpointerParams.CallbackSigned = checkpointerParams.CallbackSecret != ""
+
+	cm.scheduler.admission.Lock()
+	existing, err := cm.existingCheckpoint(checkpointerParams, lg)
+	if err != nil || existing != nil {
+		cm.scheduler.admission.Unlock()
+		lg.Info().Err(err).Str("checkpointIdentifier", checkpointerParams.CheckpointIdentifier).Msg("checkpoint requested repeatedly")
+		return existing, err
+	}
+	ticket, err := cm.scheduler.enqueue(checkpointerParams.CheckpointIdentifier, checkpointerParams.ContainerIdentifier, checkpointerParams.Priority)
+	cm.scheduler.admission.Unlock()
+	if err != nil {
+		lg.Info().Err(err).Msg("checkpoint not scheduled")
+		var duplicateErr *DuplicateCheckpointError
+		if errors.As(err, &duplicateErr) {
+			duplicateErr.Joinable = cm.joinable(duplicateErr.CheckpointIdentifier, checkpointerParams)
+		}
+		return nil, err
+	}
+	// The checkpointIdentifier of an expired checkpoint can be used again.
+	cm.retention.forget(checkpointerParams.CheckpointIdentifier)
+
+	if checkpointerParams.Publish == checkpoint.PublishDeferred {
+		return cm.doCheckpointDeferred(ctx, checkpointerParams, ticket)
+	}
 	if !async {
-		return cm.doCheckpoint(ctx, checkpointerParams)
+		return cm.doCheckpoint(ctx, checkpointerParams, ticket)
 	}
 
+	// The Queued entry is stored before the goroutine starts, so that the checkpointIdentifier is known right away.
+	progress := cm.newCheckpointProgress(checkpointerParams, true, lg)
+	progress.ticket = ticket
 	doneChan := make(chan struct{})
-	cm.checkpointsInProgress.Put(checkpointerParams.CheckpointIdentifier, doneChan)
-	go cm.doCheckpointAsync(checkpointerParams, doneChan)
+	checkpointCtx, cancel := context.WithCancelCause(context.Background())
+	cm.checkpointsInProgress.Put(checkpointerParams.CheckpointIdentifier, doneChan, cancel)
+	go cm.doCheckpointAsync(checkpointCtx, checkpointerParams, progress, doneChan)
 	return nil, nil
 }
 
-func (cm checkpointManager) doCheckpoint(ctx context.Context, checkpointerParams checkpoint.CheckpointerParams) (*CheckpointEntry, error) {
+func (cm checkpointManager) doCheckpoint(ctx context.Context, checkpointerParams checkpoint.CheckpointerParams, ticket *schedulerTicket) (*CheckpointEntry, error) {
 	lg := log.With().Bool("async", false).Logger()
 
-	beginTimestamp := time.Now().Unix()
-	checkpointImageName, checkpointErr := cm.checkpointer.Checkpoint(lg.WithContext(ctx), checkpointerParams)
-
+	progress := cm.newCheckpointProgress(checkpointerParams, false, lg)
+	progress.ticket = ticket
+	entry, checkpointErr := cm.runCheckpoint(lg.WithContext(ctx), checkpointerParams, progress)
 	if checkpointErr != nil {
 		lg.Error().Err(checkpointErr).Msg("checkpointer failed")
 		return nil, checkpointErr
 	}
+	return &entry, nil
+}
+
+// doCheckpointDeferred checkpoints the container and stops its Pod, then queues the checkpoint to publish its image
+// in the background. The checkpoint is persisted as asynchronous, so that its image is published even after restart.
+// The scheduler ticket is released once the Pod is stopped, publishing is limited by the publisher queue instead.
+func (cm checkpointManager) doCheckpointDeferred(ctx context.Context, checkpointParams checkpoint.CheckpointerParams, ticket *schedulerTicket) (*CheckpointEntry, error) {
+	lg := log.With().Str("containerIdentifier", checkpointParams.ContainerIdentifier.String()).Str("publish", string(checkpointParams.Publish)).Logger()
+
+	if err := cm.publishQueue.admit(); err != nil {
+		cm.scheduler.release(ticket)
+		lg.Warn().Err(err).Msg("deferred checkpoint not admitted")
+		return nil, err
+	}
 
-	return &CheckpointEntry{
-		ContainerIdentifier: checkpointerParams.ContainerIdentifier,
-		BeginTimestamp:      beginTimestamp,
-		EndTimestamp:        time.Now().Unix(),
-		ContainerImageName:  checkpointImageName,
-	}, nil
+	progress := cm.newCheckpointProgress(checkpointParams, true, lg)
+	checkpointParams.OnPhase = progress.reportPhase
+	checkpointParams.OnCheckpointArchive = progress.recordArchive
+	checkpointParams.OnHookResult = progress.recordHook
+	ctx = progress.logger(lg).WithContext(ctx)
+
+	checkpointArchive, err := cm.captureDeferred(ctx, checkpointParams, progress, ticket)
+	if err != nil {
+		cm.publishQueue.release()
+		lg.Error().Err(err).Msg("checkpointer failed")
+		_, checkpointErr := progress.reportFailed(err)
+		progress.finish()
+		return nil, checkpointErr
+	}
+
+	// The Pod is stopped already, so it must not be stopped again once the image is published.
+	progress.pending.Params.CheckpointArchive = checkpointArchive
+	progress.pending.Params.StopPolicy = checkpoint.StopPolicyNone
+	progress.storePending()
+	progress.reportPhase(checkpoint.PhasePublishQueued)
+	entry := progress.entry
+	cm.enqueuePublish(progress)
+	return &entry, nil
 }
 
-func (cm checkpointManager) doCheckpointAsync(checkpointParams checkpoint.CheckpointerParams, doneChan chan struct{}) {
-	lg := log.With().Str("containerIdentifier", checkpointParams.ContainerIdentifier.String()).Logger()
+// existingCheckpoint returns the CheckpointEntry already stored under the checkpointIdentifier of checkpointParams.
+// Returns ErrIdempotencyConflict if the checkpoint was requested with different parameters, ErrCheckpointInProgress if
+// the checkpoint is being deleted or nil pointer if there is no such checkpoint. A failed checkpoint is not replayed, nil pointer is returned, so that the container is
+// checkpointed again, and the checkpoint archive it retained is removed.
+func (cm checkpointManager) existingCheckpoint(checkpointParams checkpoint.CheckpointerParams, lg zerolog.Logger) (*CheckpointEntry, error) {
+	if cm.checkpointsInProgress.Deleting(checkpointParams.CheckpointIdentifier) {
+		return nil, ErrCheckpointInProgress
+	}
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointParams.CheckpointIdentifier)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if entry.RequestFingerprint != requestFingerprint(checkpointParams) {
+		return nil, ErrIdempotencyConflict
+	}
+	if entry.Phase == checkpoint.PhaseFailed {
+		// The retry of the failed checkpoint might be running already.
+		if cm.checkpointsInProgress.Get(checkpointParams.CheckpointIdentifier) != nil {
+			return entry, nil
+		}
+		if entry.ArchiveRetained {
+			cm.removeRetainedArchive(checkpointParams.CheckpointIdentifier, lg)
+		}
+		return nil, nil
+	}
+	if entry.Phase == checkpoint.PhaseQueued {
+		entry.QueuePosition = cm.scheduler.position(checkpointParams.CheckpointIdentifier)
+	}
+	return entry, nil
+}
 
-	beginTimestamp := time.Now().Unix()
-	checkpointImageName, checkpointErr := cm.checkpointer.Checkpoint(lg.WithContext(context.Background()), checkpointParams)
-	if checkpointErr != nil {
-		lg.Error().Err(checkpointErr).Msg("async checkpointer failed")
+// joinable reports whether the checkpoint in progress under checkpointIdentifier was requested with the same
+// parameters as checkpointParams.
+func (cm checkpointManager) joinable(checkpointIdentifier string, checkpointParams checkpoint.CheckpointerParams) bool {
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil || entry == nil {
+		return false
 	}
+	return entry.RequestFingerprint == requestFingerprint(checkpointParams)
+}
 
-	entry := CheckpointEntry{
+// requestFingerprint returns the hash of checkpointParams which define the outcome of the checkpoint. Priority and
+// the callback secret are left out, as they do not change what is checkpointed.
+func requestFingerprint(checkpointParams checkpoint.CheckpointerParams) string {
+	request, _ := json.Marshal(checkpoint.CheckpointerParams{
 		ContainerIdentifier: checkpointParams.ContainerIdentifier,
-		BeginTimestamp:      beginTimestamp,
-		EndTimestamp:        time.Now().Unix(),
-		ContainerImageName:  checkpointImageName,
-		Error:               checkpointErr,
+		StopPolicy:          checkpointParams.StopPolicy,
+		Publish:             checkpointParams.Publish,
+		Verify:              checkpointParams.Verify,
+		VerifyNode:          checkpointParams.VerifyNode,
+		CallbackUrl:         checkpointParams.CallbackUrl,
+		Labels:              checkpointParams.Labels,
+		Slot:                checkpointParams.Slot,
+		Hooks:               checkpointParams.Hooks,
+	})
+	hash := sha256.Sum256(request)
+	return hex.EncodeToString(hash[:])
+}
+
+// captureDeferred waits for the scheduler, checkpoints the container and stops its Pod. Returns the path to the
+// checkpoint archive or error if the container could not be checkpointed.
+func (cm checkpointManager) captureDeferred(ctx context.Context, checkpointParams checkpoint.CheckpointerParams, progress *checkpointProgress, ticket *schedulerTicket) (string, error) {
+	defer cm.scheduler.release(ticket)
+	if err := cm.scheduler.wait(ctx, ticket); err != nil {
+		return "", err
 	}
 
-	if err := cm.checkpointStorage.StoreEntry(checkpointParams.CheckpointIdentifier, entry); err != nil {
-		lg.Error().Err(err).Msg("failed to store async checkpoint result, this is a PROBLEM")
+	checkpointArchive, err := cm.checkpointer.CheckpointContainer(ctx, checkpointParams)
+	if err != nil {
+		return "", err
+	}
+
+	if checkpointParams.StopPolicy != "" && checkpointParams.StopPolicy != checkpoint.StopPolicyNone {
+		progress.reportPhase(checkpoint.PhaseDeletingPod)
+		progress.entry.ScaledOwner, progress.entry.StopError = cm.stopPod(ctx, checkpointParams)
+	}
+	return checkpointArchive, nil
+}
+
+// enqueuePublish queues the admitted checkpoint to publish its image from the checkpoint archive. The checkpoint can
+// be waited for and cancelled as any other asynchronous checkpoint.
+func (cm checkpointManager) enqueuePublish(progress *checkpointProgress) {
+	checkpointParams := progress.pending.Params
+	doneChan := make(chan struct{})
+	checkpointCtx, cancel := context.WithCancelCause(context.Background())
+	cm.checkpointsInProgress.Put(checkpointParams.CheckpointIdentifier, doneChan, cancel)
+	cm.publishQueue.enqueue(func() {
+		cm.doCheckpointAsync(checkpointCtx, checkpointParams, progress, doneChan)
+	})
+}
+
+// doCheckpointAsync runs the checkpoint within ctx, which is cancelled through CancelCheckpoint.
+func (cm checkpointManager) doCheckpointAsync(ctx context.Context, checkpointParams checkpoint.CheckpointerParams, progress *checkpointProgress, doneChan chan struct{}) {
+	lg := log.With().Str("containerIdentifier", checkpointParams.ContainerIdentifier.String()).Logger()
+
+	entry, checkpointErr := cm.runCheckpoint(lg.WithContext(ctx), checkpointParams, progress)
+	if checkpointErr != nil {
+		lg.Error().Err(checkpointErr).Msg("async checkpointer failed")
 	}
+	cm.dispatchCallback(checkpointParams, entry, lg)
 
 	lg.Info().Msg("async checkpoint done, closing channel")
 	cm.checkpointsInProgress.Delete(checkpointParams.CheckpointIdentifier)
 	close(doneChan)
 }
 
-func (cm checkpointManager) CheckpointResult(checkpointIdentifier string) (*CheckpointEntry, error) {
+// dispatchCallback delivers entry to the callback of checkpointParams, if there is one. The callback secret is not
+// persisted, so the signed callback of a checkpoint recovered from PendingCheckpointStorage is dropped and its delivery
+// marked as failed, rather than delivered unsigned.
+func (cm checkpointManager) dispatchCallback(checkpointParams checkpoint.CheckpointerParams, entry CheckpointEntry, lg zerolog.Logger) {
+	if checkpointParams.CallbackUrl == "" {
+		return
+	}
+	if checkpointParams.CallbackSigned && checkpointParams.CallbackSecret == "" {
+		lg.Warn().Str("callbackUrl", checkpointParams.CallbackUrl).Msg("callback secret was lost on recovery, dropping signed callback")
+		entry.Callback = &CallbackDelivery{Url: checkpointParams.CallbackUrl, Status: CallbackStatusFailed, LastError: errCallbackSecretLost.Error()}
+		if err := cm.entryWriter().StoreEntry(checkpointParams.CheckpointIdentifier, entry); err != nil {
+			lg.Error().Err(err).Msg("failed to store dropped callback delivery")
+		}
+		return
+	}
+	cm.callbackDispatcher.Dispatch(checkpointParams.CheckpointIdentifier, entry, checkpointParams.CallbackUrl, checkpointParams.CallbackSecret)
+}
+
+// runCheckpoint checkpoints the container, verifies the checkpoint image and stops the checkpointed Pod, while
+// progress records every phase into storage. Returns the final CheckpointEntry and error if checkpointing failed.
+func (cm checkpointManager) runCheckpoint(ctx context.Context, checkpointParams checkpoint.CheckpointerParams, progress *checkpointProgress) (CheckpointEntry, error) {
+	defer progress.finish()
+	// Once the image is being pushed, the checkpoint is finished rather than cancelled, so that it does not leave the
+	// image behind without stopping the Pod.
+	checkpointParams.OnPhase = func(phase checkpoint.Phase) {
+		if phase == checkpoint.PhasePushing {
+			cm.checkpointsInProgress.MarkPublishing(checkpointParams.CheckpointIdentifier)
+		}
+		progress.reportPhase(phase)
+	}
+	checkpointParams.OnCheckpointArchive = progress.recordArchive
+	checkpointParams.OnHookResult = progress.recordHook
+	ctx = progress.logger(*zerolog.Ctx(ctx)).WithContext(ctx)
+
+	// Checkpoint waiting in the publisher queue might have been cancelled meanwhile.
+	if cancelled(ctx) {
+		progress.removeArchive()
+		return progress.reportCancelled()
+	}
+
+	if progress.ticket != nil {
+		defer cm.scheduler.release(progress.ticket)
+		if err := cm.scheduler.wait(ctx, progress.ticket); err != nil {
+			if cancelled(ctx) {
+				return progress.reportCancelled()
+			}
+			return progress.reportFailed(err)
+		}
+	}
+
+	// Checkpoint resumed after restart might have its image pushed already.
+	checkpointImageName := progress.entry.ContainerImageName
+	if checkpointImageName != "" {
+		cm.checkpointsInProgress.MarkPublishing(checkpointParams.CheckpointIdentifier)
+	} else {
+		var checkpointErr error
+		checkpointImageName, checkpointErr = cm.checkpointWithRetry(ctx, checkpointParams, progress)
+		if cancelled(ctx) {
+			progress.removeArchive()
+			return progress.reportCancelled()
+		}
+		if checkpointErr != nil {
+			return progress.reportFailed(checkpointErr)
+		}
+		progress.entry.ContainerImageName = checkpointImageName
+	}
+
+	if checkpointParams.Verify {
+		progress.reportPhase(checkpoint.PhaseVerifying)
+		progress.entry.Verification = cm.verify(ctx, checkpointParams, checkpointImageName)
+	}
+
+	// The checkpoint cancelled right before its push started might have pushed the image anyway, it is deleted, so that
+	// the cancelled checkpoint leaves nothing behind.
+	if cancelled(ctx) {
+		cm.deleteCancelledImage(checkpointImageName, *zerolog.Ctx(ctx))
+		return progress.reportCancelled()
+	}
+
+	if checkpointParams.StopPolicy != "" && checkpointParams.StopPolicy != checkpoint.StopPolicyNone {
+		progress.reportPhase(checkpoint.PhaseDeletingPod)
+		progress.entry.ScaledOwner, progress.entry.StopError = cm.stopPod(ctx, checkpointParams)
+	}
+
+	progress.entry.EndTimestamp = time.Now().Unix()
+	progress.reportPhase(checkpoint.PhaseSucceeded)
+	cm.storeLatestEntry(progress.entry, *zerolog.Ctx(ctx))
+	return progress.entry, nil
+}
+
+// removeRetainedArchive removes the checkpoint archive retained by the failed checkpoint under checkpointIdentifier
+// and forgets its PendingCheckpoint.
+func (cm checkpointManager) removeRetainedArchive(checkpointIdentifier string, lg zerolog.Logger) {
+	pending, err := cm.pendingStorage.ReadPending(checkpointIdentifier)
+	if err != nil {
+		lg.Warn().Err(err).Msg("failed to read pending checkpoint, retained checkpoint archive might be left behind")
+	} else if pending != nil && pending.Params.CheckpointArchive != "" {
+		_ = os.Remove(pending.Params.CheckpointArchive)
+	}
+	if err := cm.pendingStorage.ErasePending(checkpointIdentifier); err != nil {
+		lg.Warn().Err(err).Msg("failed to erase pending checkpoint")
+	}
+}
+
+// deleteCancelledImage deletes the image pushed by the cancelled checkpoint. Failing to delete it only leaves the image
+// to the registry garbage collection.
+func (cm checkpointManager) deleteCancelledImage(image string, lg zerolog.Logger) {
+	if err := cm.imageDeleter.DeleteImage(context.Background(), image); err != nil {
+		lg.Error().Err(err).Str("image", image).Msg("failed to delete image of cancelled checkpoint")
+		return
+	}
+	lg.Info().Str("image", image).Msg("deleted image of cancelled checkpoint")
+}
+
+// checkpointWithRetry runs the checkpointer. If it fails with a retryable error after Kubelet created the checkpoint
+// archive, the image is built from the archive again with exponential backoff, so that the container is not
+// checkpointed again.
+func (cm checkpointManager) checkpointWithRetry(ctx context.Context, checkpointParams checkpoint.CheckpointerParams, progress *checkpointProgress) (string, error) {
+	lg := zerolog.Ctx(ctx)
+	for attempts := int64(1); ; attempts++ {
+		progress.entry.Attempts++
+		checkpointImageName, err := cm.checkpointer.Checkpoint(ctx, checkpointParams)
+		if err == nil || cancelled(ctx) {
+			return checkpointImageName, err
+		}
+
+		checkpointErr := checkpoint.AsCheckpointError(err, progress.entry.Phase)
+		checkpointParams.CheckpointArchive = progress.pending.Params.CheckpointArchive
+		if !checkpointErr.Retryable || attempts >= cm.buildRetry.MaxAttempts || !archiveExists(checkpointParams.CheckpointArchive) {
+			return "", checkpointErr
+		}
+
+		backoff := exponentialBackoff(
+			time.Second*time.Duration(cm.buildRetry.InitialBackoffSeconds),
+			time.Second*time.Duration(cm.buildRetry.MaxBackoffSeconds),
+			attempts,
+		)
+		lg.Warn().Err(err).Int64("attempts", attempts).Dur("backoff", backoff).Msg("checkpoint image build failed, retrying from checkpoint archive")
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", checkpointErr
+		}
+	}
+}
+
+func (cm checkpointManager) CheckpointResult(ctx context.Context, checkpointIdentifier string, wait time.Duration) (*CheckpointEntry, error) {
 	lg := log.With().
 		Str("checkpointIdentifier", checkpointIdentifier).
 		Logger()
 
-	if doneChan := cm.checkpointsInProgress.Get(checkpointIdentifier); doneChan != nil {
-		_ = <-doneChan
+	if doneChan := cm.checkpointsInProgress.Get(checkpointIdentifier); doneChan != nil && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-doneChan:
+		case <-timer.C:
+			lg.Debug().Msg("checkpoint still in progress after waiting")
+		case <-ctx.Done():
+		}
 	}
 
 	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
@@ -89,5 +431,360 @@ func (cm checkpointManager) CheckpointResult(checkpointIdentifier string) (*Chec
 		lg.Error().Err(err).Msg("failed to read checkpoint result")
 		return nil, err
 	}
+	if entry == nil && cm.retention.expired(checkpointIdentifier) {
+		return nil, ErrCheckpointExpired
+	}
+	if entry != nil && entry.Phase == checkpoint.PhaseQueued {
+		entry.QueuePosition = cm.scheduler.position(checkpointIdentifier)
+	}
 	return entry, nil
 }
+
+func (cm checkpointManager) CheckpointEvents(ctx context.Context, checkpointIdentifier string) (<-chan CheckpointEvent, error) {
+	lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+
+	// Subscribe before reading the entry, so that no event published after the read can be missed.
+	subscriber, unsubscribe := cm.events.Subscribe(checkpointIdentifier)
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil {
+		unsubscribe()
+		lg.Error().Err(err).Msg("failed to read checkpoint result")
+		return nil, err
+	}
+	if entry == nil {
+		unsubscribe()
+		return nil, cm.entryNotFound(checkpointIdentifier)
+	}
+
+	events := make(chan CheckpointEvent)
+	go func() {
+		defer close(events)
+		defer unsubscribe()
+
+		send := func(event CheckpointEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// Replay the phases the checkpoint went through so far. The phases published between subscribing and reading
+		// the entry are among them, so each replayed transition skips one matching event.
+		replayed := make(map[PhaseTransition]int, len(entry.PhaseTransitions))
+		for _, transition := range entry.PhaseTransitions {
+			replayed[transition]++
+			if !send(CheckpointEvent{Type: EventTypePhase, Timestamp: transition.Timestamp, Phase: transition.Phase}) {
+				return
+			}
+		}
+		if !entry.InProgress() {
+			send(CheckpointEvent{Type: EventTypeResult, Timestamp: entry.EndTimestamp, Entry: entry})
+			return
+		}
+
+		for {
+			select {
+			case event, open := <-subscriber:
+				if !open {
+					// The result might have been dropped, if this subscriber did not keep up.
+					if finalEntry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier); err == nil && finalEntry != nil {
+						send(CheckpointEvent{Type: EventTypeResult, Timestamp: finalEntry.EndTimestamp, Entry: finalEntry})
+					}
+					return
+				}
+				if transition := (PhaseTransition{event.Phase, event.Timestamp}); event.Type == EventTypePhase && replayed[transition] > 0 {
+					replayed[transition]--
+					continue
+				}
+				if !send(event) || event.Type == EventTypeResult {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (cm checkpointManager) CancelCheckpoint(ctx context.Context, checkpointIdentifier string) (*CheckpointEntry, error) {
+	lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+
+	doneChan, err := cm.checkpointsInProgress.Cancel(checkpointIdentifier)
+	if errors.Is(err, ErrCheckpointInProgress) {
+		lg.Info().Msg("checkpoint is being deleted, not cancelling it")
+		return nil, err
+	}
+	if err != nil {
+		lg.Info().Msg("checkpoint is publishing its image, not cancelling it")
+		entry, readErr := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+		if readErr != nil || entry == nil {
+			return nil, err
+		}
+		return entry, err
+	}
+	if doneChan == nil {
+		entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+		if err != nil {
+			lg.Error().Err(err).Msg("failed to read checkpoint result")
+			return nil, err
+		}
+		if entry == nil {
+			return nil, cm.entryNotFound(checkpointIdentifier)
+		}
+		return entry, ErrNotCancellable
+	}
+
+	lg.Info().Msg("cancelled checkpoint, waiting for cleanup")
+	select {
+	case <-doneChan:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to read checkpoint result")
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (cm checkpointManager) RetryCheckpoint(ctx context.Context, checkpointIdentifier string) (*CheckpointEntry, error) {
+	lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+
+	// Reserving the checkpoint first makes sure that concurrent retries do not run it twice.
+	doneChan := make(chan struct{})
+	checkpointCtx, cancel := context.WithCancelCause(context.Background())
+	if !cm.checkpointsInProgress.PutIfAbsent(checkpointIdentifier, doneChan, cancel) {
+		cancel(nil)
+		if cm.checkpointsInProgress.Deleting(checkpointIdentifier) {
+			return nil, ErrCheckpointInProgress
+		}
+		return nil, ErrNotRetryable
+	}
+	release := func() {
+		cm.checkpointsInProgress.Delete(checkpointIdentifier)
+		cancel(nil)
+	}
+
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil {
+		release()
+		lg.Error().Err(err).Msg("failed to read checkpoint result")
+		return nil, err
+	}
+	if entry == nil {
+		release()
+		return nil, cm.entryNotFound(checkpointIdentifier)
+	}
+	pending, err := cm.pendingStorage.ReadPending(checkpointIdentifier)
+	if err != nil {
+		release()
+		lg.Error().Err(err).Msg("failed to read pending checkpoint")
+		return nil, err
+	}
+	if entry.Phase != checkpoint.PhaseFailed || !entry.ArchiveRetained || pending == nil || !archiveExists(pending.Params.CheckpointArchive) {
+		release()
+		return entry, ErrNotRetryable
+	}
+	ticket, err := cm.scheduler.enqueue(checkpointIdentifier, entry.ContainerIdentifier, pending.Params.Priority)
+	if err != nil {
+		release()
+		lg.Info().Err(err).Msg("checkpoint retry not scheduled")
+		return nil, err
+	}
+
+	lg.Info().Int64("attempts", entry.Attempts).Msg("retrying failed checkpoint from retained checkpoint archive")
+	entry.Error = nil
+	entry.EndTimestamp = 0
+	entry.ArchiveRetained = false
+	if pending.Params.CallbackUrl != "" {
+		entry.Callback = &CallbackDelivery{Url: pending.Params.CallbackUrl, Status: CallbackStatusPending}
+	}
+	pending.Async = true
+
+	progress := cm.resumeCheckpointProgress(*entry, *pending, lg)
+	progress.ticket = ticket
+	progress.storePending()
+	progress.reportPhase(checkpoint.PhaseQueued)
+	queuedEntry := progress.entry
+	go cm.doCheckpointAsync(checkpointCtx, pending.Params, progress, doneChan)
+	return &queuedEntry, nil
+}
+
+func (cm checkpointManager) LatestCheckpointResult(containerIdentifier checkpoint.ContainerIdentifier) (*CheckpointEntry, error) {
+	entry, err := cm.checkpointStorage.ReadEntry(latestEntryKey(containerIdentifier))
+	if err != nil {
+		log.Error().Err(err).Str("containerIdentifier", containerIdentifier.String()).Msg("failed to read latest checkpoint result")
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (cm checkpointManager) ListCheckpoints(filter EntryFilter) (*CheckpointList, error) {
+	limit := filter.Limit
+	if limit > 0 {
+		// One more entry tells whether there is a next page.
+		filter.Limit++
+	}
+	entries, err := cm.checkpointStorage.ListEntries(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list checkpoint results")
+		return nil, err
+	}
+
+	list := &CheckpointList{Items: entries}
+	if limit > 0 && len(entries) > limit {
+		list.Items = entries[:limit]
+		list.Continue = EntryCursorOf(list.Items[limit-1]).String()
+	}
+	for i := range list.Items {
+		if list.Items[i].Phase == checkpoint.PhaseQueued {
+			_, checkpointIdentifier, _ := strings.Cut(list.Items[i].CheckpointIdentifier, ":")
+			list.Items[i].QueuePosition = cm.scheduler.position(checkpointIdentifier)
+		}
+	}
+	return list, nil
+}
+
+func (cm checkpointManager) DeleteCheckpoint(ctx context.Context, checkpointIdentifier string, deleteImage bool) (*CheckpointEntry, error) {
+	lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+	ctx = lg.WithContext(ctx)
+
+	// Reserving the checkpoint makes sure that it is neither cancelled, retried nor replayed while being deleted.
+	doneChan := make(chan struct{})
+	if !cm.checkpointsInProgress.ReserveDeletion(checkpointIdentifier, doneChan) {
+		return nil, ErrCheckpointInProgress
+	}
+	defer func() {
+		cm.checkpointsInProgress.Delete(checkpointIdentifier)
+		close(doneChan)
+	}()
+
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to read checkpoint result")
+		return nil, err
+	}
+	if entry == nil {
+		return nil, cm.entryNotFound(checkpointIdentifier)
+	}
+	if entry.InProgress() {
+		return entry, ErrCheckpointInProgress
+	}
+
+	if deleteImage && entry.ContainerImageName != "" {
+		if err := cm.imageDeleter.DeleteImage(ctx, entry.ContainerImageName); err != nil {
+			lg.Error().Err(err).Str("image", entry.ContainerImageName).Msg("failed to delete checkpoint image")
+			return entry, fmt.Errorf("%w: %w", ErrImageNotDeleted, err)
+		}
+		lg.Info().Str("image", entry.ContainerImageName).Msg("deleted checkpoint image")
+	}
+
+	if entry.ArchiveRetained {
+		cm.removeRetainedArchive(checkpointIdentifier, lg)
+	}
+
+	// The latest checkpoint of the container must not point to a deleted checkpoint.
+	latestKey := latestEntryKey(entry.ContainerIdentifier)
+	if latest, err := cm.checkpointStorage.ReadEntry(latestKey); err == nil && latest != nil && latest.CheckpointIdentifier == entry.CheckpointIdentifier {
+		if err := cm.checkpointStorage.DeleteEntry(latestKey); err != nil {
+			lg.Warn().Err(err).Msg("failed to delete latest checkpoint result")
+		}
+	}
+
+	if err := cm.checkpointStorage.DeleteEntry(checkpointIdentifier); err != nil {
+		lg.Error().Err(err).Msg("failed to delete checkpoint result")
+		return nil, err
+	}
+	lg.Info().Msg("deleted checkpoint")
+	return entry, nil
+}
+
+func (cm checkpointManager) ScaleOwnerUp(ctx context.Context, checkpointIdentifier string, templateAnnotations map[string]string) (*CheckpointEntry, error) {
+	lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+
+	entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to read checkpoint result")
+		return nil, err
+	}
+	if entry == nil {
+		return nil, cm.entryNotFound(checkpointIdentifier)
+	}
+	if entry.ScaledOwner == nil {
+		return entry, ErrNoScaledOwner
+	}
+
+	if err := cm.podStopper.ScaleOwnerUp(lg.WithContext(ctx), *entry.ScaledOwner, templateAnnotations); err != nil {
+		lg.Error().Err(err).Msg("failed to scale up owner of checkpointed Pod")
+		return entry, err
+	}
+	lg.Info().Str("kind", entry.ScaledOwner.Kind).Str("name", entry.ScaledOwner.Name).Msg("scaled up owner of checkpointed Pod")
+	return entry, nil
+}
+
+// verify test restores the checkpoint image, before the checkpointed Pod is stopped.
+func (cm checkpointManager) verify(ctx context.Context, checkpointParams checkpoint.CheckpointerParams, checkpointImageName string) *checkpoint.VerificationResult {
+	result := cm.verifier.Verify(ctx, checkpointParams.ContainerIdentifier, checkpointImageName, checkpointParams.VerifyNode)
+	zerolog.Ctx(ctx).Info().Bool("verified", result.Verified).Str("reason", result.Reason).Msg("checkpoint verification done")
+	return &result
+}
+
+// stopPod stops the checkpointed Pod according to the requested StopPolicy. Failing to stop the Pod does not fail the
+// checkpoint, as the checkpoint image is already pushed, the error is only returned to be recorded.
+func (cm checkpointManager) stopPod(ctx context.Context, checkpointParams checkpoint.CheckpointerParams) (*checkpoint.ScaledOwner, *checkpoint.CheckpointError) {
+	scaledOwner, err := cm.podStopper.StopPod(ctx, checkpointParams.ContainerIdentifier, checkpointParams.StopPolicy)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("could not stop checkpointed pod")
+		return scaledOwner, checkpoint.NewCheckpointError(checkpoint.ErrorCodePodDeleteFailed, checkpoint.PhaseDeletingPod, err)
+	}
+	return scaledOwner, nil
+}
+
+// exponentialBackoff returns how long to wait after the given number of failed attempts, starting at initialBackoff
+// and doubling up to maxBackoff.
+func exponentialBackoff(initialBackoff, maxBackoff time.Duration, attempts int64) time.Duration {
+	backoff := initialBackoff
+	for i := int64(1); i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// cancelled reports whether ctx was cancelled through CancelCheckpoint.
+func cancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrCheckpointCancelled)
+}
+
+// trackingHandle returns the checkpointIdentifier prefixed with the Node name, which is how clients and other
+// Checkpointers refer to the checkpoint.
+func (cm checkpointManager) trackingHandle(checkpointIdentifier string) string {
+	return cm.checkpointerNode + ":" + checkpointIdentifier
+}
+
+// storeLatestEntry stores the entry as the latest successful checkpoint of its container. Failing to do so does not
+// fail the checkpoint itself, the container just cannot be restored through the latest checkpoint lookup.
+func (cm checkpointManager) storeLatestEntry(entry CheckpointEntry, lg zerolog.Logger) {
+	if err := cm.checkpointStorage.StoreEntry(latestEntryKey(entry.ContainerIdentifier), entry); err != nil {
+		lg.Warn().Err(err).Msg("failed to store latest checkpoint result")
+	}
+}
+
+// entryNotFound returns ErrCheckpointExpired if the checkpoint under checkpointIdentifier was removed by retention
+// policy, ErrEntryNotFound otherwise.
+func (cm checkpointManager) entryNotFound(checkpointIdentifier string) error {
+	if cm.retention.expired(checkpointIdentifier) {
+		return ErrCheckpointExpired
+	}
+	return ErrEntryNotFound
+}
+
+// latestEntryKey returns the storage key of the latest successful checkpoint of a container. Kubernetes object names
+// cannot contain underscore, so the key cannot collide with another container or with a checkpointIdentifier.
+func latestEntryKey(containerIdentifier checkpoint.ContainerIdentifier) string {
+	return latestEntryKeyPrefix + containerIdentifier.Namespace + "_" + containerIdentifier.Pod + "_" + containerIdentifier.Container
+}
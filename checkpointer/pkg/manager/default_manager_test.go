@@ -1,18 +1,175 @@
 package manager
 
 import (
+	"checkpoint-in-k8s/internal"
 	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
 	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type mockCheckpointer struct {
 }
 
-func (m mockCheckpointer) Checkpoint(context.Context, checkpoint.CheckpointerParams) (string, error) {
+func (m mockCheckpointer) Checkpoint(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	if params.OnPhase != nil {
+		params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+	}
+	return "quay.io/checkpointed", nil
+}
+
+func (m mockCheckpointer) CheckpointContainer(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+	return "/var/lib/kubelet/checkpoints/checkpoint.tar", nil
+}
+
+// blockingCheckpointer blocks until the checkpoint is cancelled.
+type blockingCheckpointer struct {
+}
+
+func (m blockingCheckpointer) Checkpoint(ctx context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (m blockingCheckpointer) CheckpointContainer(ctx context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	return m.Checkpoint(ctx, params)
+}
+
+// pushingCheckpointer pushes the checkpoint image once pushed is closed.
+type pushingCheckpointer struct {
+	pushed chan struct{}
+}
+
+func (m pushingCheckpointer) Checkpoint(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	params.OnPhase(checkpoint.PhasePushing)
+	<-m.pushed
+	return "quay.io/checkpointed", nil
+}
+
+func (m pushingCheckpointer) CheckpointContainer(ctx context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	return m.Checkpoint(ctx, params)
+}
+
+// failingCheckpointer fails as if Kubelet could not find the container.
+type failingCheckpointer struct {
+}
+
+func (m failingCheckpointer) Checkpoint(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+	return "", fmt.Errorf("could not checkpoint container: %w", internal.ErrContainerNotFound)
+}
+
+func (m failingCheckpointer) CheckpointContainer(ctx context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	return m.Checkpoint(ctx, params)
+}
+
+// hookCheckpointer fails as if the pre hook with the abort failure policy failed, after running the post hook.
+type hookCheckpointer struct {
+}
+
+func (m hookCheckpointer) Checkpoint(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+	params.OnHookResult(checkpoint.HookResult{Type: checkpoint.HookTypePre, Command: params.Hooks.Pre.Command, ExitCode: 1, Stderr: "flush failed", Error: "hook exited with code 1"})
+	params.OnHookResult(checkpoint.HookResult{Type: checkpoint.HookTypePost, Command: params.Hooks.Post.Command})
+	return "", checkpoint.NewCheckpointError(checkpoint.ErrorCodeHookFailed, checkpoint.PhaseCheckpointingContainer, errors.New("pre hook failed: hook exited with code 1"))
+}
+
+func (m hookCheckpointer) CheckpointContainer(ctx context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	return m.Checkpoint(ctx, params)
+}
+
+// flakyCheckpointer fails to push the image the given number of times, after Kubelet created the checkpoint archive.
+type flakyCheckpointer struct {
+	mu       sync.Mutex
+	failures int
+	archive  string
+	archives []string
+}
+
+func (m *flakyCheckpointer) Checkpoint(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.archives = append(m.archives, params.CheckpointArchive)
+	if params.CheckpointArchive == "" {
+		params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+		params.OnCheckpointArchive(m.archive)
+	}
+	params.OnPhase(checkpoint.PhasePushing)
+	if m.failures > 0 {
+		m.failures--
+		return "", errors.New("registry unavailable")
+	}
 	return "quay.io/checkpointed", nil
 }
 
+func (m *flakyCheckpointer) CheckpointContainer(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	params.OnPhase(checkpoint.PhaseCheckpointingContainer)
+	params.OnCheckpointArchive(m.archive)
+	return m.archive, nil
+}
+
+type mockPodStopper struct {
+	scaledUp *checkpoint.ScaledOwner
+	stopped  bool
+}
+
+func (m *mockPodStopper) StopPod(_ context.Context, containerIdentifier checkpoint.ContainerIdentifier, policy checkpoint.StopPolicy) (*checkpoint.ScaledOwner, error) {
+	m.stopped = true
+	if policy != checkpoint.StopPolicyScaleOwner {
+		return nil, nil
+	}
+	return &checkpoint.ScaledOwner{Kind: "Deployment", Name: "owner", Namespace: containerIdentifier.Namespace, Replicas: 2}, nil
+}
+
+func (m *mockPodStopper) ScaleOwnerUp(_ context.Context, owner checkpoint.ScaledOwner, _ map[string]string) error {
+	m.scaledUp = &owner
+	return nil
+}
+
+type mockVerifier struct {
+}
+
+func (m mockVerifier) Verify(_ context.Context, _ checkpoint.ContainerIdentifier, image, node string) checkpoint.VerificationResult {
+	return checkpoint.VerificationResult{Verified: image == "quay.io/checkpointed", Node: node}
+}
+
+type mockImageDeleter struct {
+	deleted []string
+	err     error
+}
+
+func (m *mockImageDeleter) DeleteImage(_ context.Context, image string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.deleted = append(m.deleted, image)
+	return nil
+}
+
+// blockingImageDeleter blocks DeleteImage until release is closed, started is closed once DeleteImage is called.
+type blockingImageDeleter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingImageDeleter) DeleteImage(_ context.Context, _ string) error {
+	close(m.started)
+	<-m.release
+	return nil
+}
+
 type mockStorage struct {
 	storage map[string]*CheckpointEntry
 }
@@ -27,19 +184,74 @@ func (m mockStorage) ReadEntry(checkpointIdentifier string) (*CheckpointEntry, e
 	return entry, nil
 }
 
+func (m mockStorage) ListEntries(filter EntryFilter) ([]CheckpointEntry, error) {
+	var entries []CheckpointEntry
+	for checkpointIdentifier, entry := range m.storage {
+		if !strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix) {
+			entries = append(entries, *entry)
+		}
+	}
+	return filterEntries(entries, filter), nil
+}
+
+func (m mockStorage) DeleteEntry(checkpointIdentifier string) error {
+	delete(m.storage, checkpointIdentifier)
+	return nil
+}
+
+type mockPendingStorage struct {
+	mu      sync.Mutex
+	storage map[string]PendingCheckpoint
+}
+
+func (m *mockPendingStorage) StorePending(checkpointIdentifier string, pending PendingCheckpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storage[checkpointIdentifier] = pending
+	return nil
+}
+
+func (m *mockPendingStorage) ErasePending(checkpointIdentifier string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.storage, checkpointIdentifier)
+	return nil
+}
+
+func (m *mockPendingStorage) ReadPending(checkpointIdentifier string) (*PendingCheckpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending, found := m.storage[checkpointIdentifier]
+	if !found {
+		return nil, nil
+	}
+	return &pending, nil
+}
+
+func (m *mockPendingStorage) ReadAllPending() (map[string]PendingCheckpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.storage), nil
+}
+
 func Test_checkpointManager_doCheckpoint(t *testing.T) {
 	manager := &checkpointManager{
-		checkpointsInProgress: &checkpointsInProgress{doneMap: make(map[string]chan struct{})},
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
 		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
 		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
 	}
 	params := checkpoint.CheckpointerParams{
 		ContainerIdentifier:  checkpoint.ContainerIdentifier{},
-		DeletePod:            false,
+		StopPolicy:           checkpoint.StopPolicyNone,
 		CheckpointIdentifier: "id",
 	}
 
-	entry, _ := manager.doCheckpoint(context.TODO(), params)
+	entry, _ := manager.doCheckpoint(context.TODO(), params, nil)
 	if entry.ContainerImageName != "quay.io/checkpointed" {
 		t.Fatalf("ContainerImageName is malformed")
 	}
@@ -48,12 +260,17 @@ func Test_checkpointManager_doCheckpoint(t *testing.T) {
 func Test_checkpointManager_CheckpointResult(t *testing.T) {
 	entry := &CheckpointEntry{}
 	manager := &checkpointManager{
-		checkpointsInProgress: &checkpointsInProgress{doneMap: make(map[string]chan struct{})},
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
 		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
 		checkpointStorage:     mockStorage{map[string]*CheckpointEntry{"test": entry}},
 	}
 
-	result, err := manager.CheckpointResult("test")
+	result, err := manager.CheckpointResult(context.TODO(), "test", 0)
 	if err != nil {
 		t.Fatalf("CheckpointResult return unexpected error: %v", err)
 	}
@@ -64,18 +281,23 @@ func Test_checkpointManager_CheckpointResult(t *testing.T) {
 
 func Test_checkpointManager_doCheckpointAsync(t *testing.T) {
 	manager := &checkpointManager{
-		checkpointsInProgress: &checkpointsInProgress{doneMap: make(map[string]chan struct{})},
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
 		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
 		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
 	}
 	params := checkpoint.CheckpointerParams{
 		ContainerIdentifier:  checkpoint.ContainerIdentifier{},
-		DeletePod:            false,
+		StopPolicy:           checkpoint.StopPolicyNone,
 		CheckpointIdentifier: "id",
 	}
 
 	channel := make(chan struct{})
-	manager.doCheckpointAsync(params, channel)
+	manager.doCheckpointAsync(context.Background(), params, manager.newCheckpointProgress(params, true, zerolog.Nop()), channel)
 
 	select {
 	case <-channel:
@@ -95,4 +317,789 @@ func Test_checkpointManager_doCheckpointAsync(t *testing.T) {
 	if entry.ContainerImageName != "quay.io/checkpointed" {
 		t.Fatalf("ContainerImageName is malformed")
 	}
+
+	if entry.Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("async checkpoint should end in Succeeded phase, got: %s", entry.Phase)
+	}
+}
+
+func Test_checkpointManager_Checkpoint_Phases(t *testing.T) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     storage,
+	}
+	params := checkpoint.CheckpointerParams{
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: "id",
+		Verify:               true,
+	}
+
+	entry, err := manager.Checkpoint(context.TODO(), false, params)
+	if err != nil {
+		t.Fatalf("Checkpoint return unexpected error: %v", err)
+	}
+
+	expectedPhases := []checkpoint.Phase{
+		checkpoint.PhaseQueued,
+		checkpoint.PhaseCheckpointingContainer,
+		checkpoint.PhaseVerifying,
+		checkpoint.PhaseDeletingPod,
+		checkpoint.PhaseSucceeded,
+	}
+	if len(entry.PhaseTransitions) != len(expectedPhases) {
+		t.Fatalf("checkpoint went through wrong phases: %v", entry.PhaseTransitions)
+	}
+	for i, transition := range entry.PhaseTransitions {
+		if transition.Phase != expectedPhases[i] {
+			t.Fatalf("checkpoint went through wrong phases: %v", entry.PhaseTransitions)
+		}
+	}
+	if storage.storage["id"].Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("stored checkpoint entry should be in Succeeded phase")
+	}
+}
+
+func Test_checkpointManager_CheckpointResult_InProgress(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+	params := checkpoint.CheckpointerParams{CheckpointIdentifier: "id"}
+	manager.newCheckpointProgress(params, true, zerolog.Nop())
+	manager.checkpointsInProgress.Put("id", make(chan struct{}), nil)
+
+	entry, err := manager.CheckpointResult(context.TODO(), "id", time.Millisecond)
+	if err != nil {
+		t.Fatalf("CheckpointResult return unexpected error: %v", err)
+	}
+	if entry == nil || !entry.InProgress() || entry.Phase != checkpoint.PhaseQueued {
+		t.Fatalf("CheckpointResult should return the entry in Queued phase")
+	}
+}
+
+func Test_checkpointManager_LatestCheckpointResult(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+
+	latest, err := manager.LatestCheckpointResult(containerIdentifier)
+	if err != nil {
+		t.Fatalf("LatestCheckpointResult return unexpected error: %v", err)
+	}
+	if latest != nil {
+		t.Fatalf("there should be no latest checkpoint before checkpointing")
+	}
+
+	_, _ = manager.doCheckpoint(context.TODO(), checkpoint.CheckpointerParams{
+		ContainerIdentifier:  containerIdentifier,
+		CheckpointIdentifier: "id",
+	}, nil)
+
+	latest, err = manager.LatestCheckpointResult(containerIdentifier)
+	if err != nil {
+		t.Fatalf("LatestCheckpointResult return unexpected error: %v", err)
+	}
+	if latest == nil || latest.ContainerImageName != "quay.io/checkpointed" {
+		t.Fatalf("LatestCheckpointResult returned wrong result")
+	}
+}
+
+func Test_checkpointManager_ScaleOwnerUp(t *testing.T) {
+	podStopper := &mockPodStopper{}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            podStopper,
+		verifier:              mockVerifier{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+
+	if _, err := manager.ScaleOwnerUp(context.TODO(), "id", nil); !errors.Is(err, ErrEntryNotFound) {
+		t.Fatalf("ScaleOwnerUp should fail with ErrEntryNotFound, got: %v", err)
+	}
+
+	entry, _ := manager.doCheckpoint(context.TODO(), checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		StopPolicy:           checkpoint.StopPolicyScaleOwner,
+		CheckpointIdentifier: "id",
+	}, nil)
+	if entry.ScaledOwner == nil || entry.ScaledOwner.Replicas != 2 {
+		t.Fatalf("checkpoint entry should record the scaled owner")
+	}
+
+	if _, err := manager.ScaleOwnerUp(context.TODO(), "id", nil); err != nil {
+		t.Fatalf("ScaleOwnerUp return unexpected error: %v", err)
+	}
+	if podStopper.scaledUp == nil || *podStopper.scaledUp != *entry.ScaledOwner {
+		t.Fatalf("ScaleOwnerUp did not scale up the recorded owner")
+	}
+}
+
+func Test_checkpointManager_ScaleOwnerUp_NoOwner(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+
+	_, _ = manager.doCheckpoint(context.TODO(), checkpoint.CheckpointerParams{
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: "id",
+	}, nil)
+
+	if _, err := manager.ScaleOwnerUp(context.TODO(), "id", nil); !errors.Is(err, ErrNoScaledOwner) {
+		t.Fatalf("ScaleOwnerUp should fail with ErrNoScaledOwner, got: %v", err)
+	}
+}
+
+func Test_checkpointManager_doCheckpoint_Verify(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+
+	entry, _ := manager.doCheckpoint(context.TODO(), checkpoint.CheckpointerParams{CheckpointIdentifier: "id"}, nil)
+	if entry.Verification != nil {
+		t.Fatalf("checkpoint should not be verified unless requested")
+	}
+
+	entry, _ = manager.doCheckpoint(context.TODO(), checkpoint.CheckpointerParams{
+		CheckpointIdentifier: "id",
+		Verify:               true,
+		VerifyNode:           "node",
+	}, nil)
+	if entry.Verification == nil || !entry.Verification.Verified || entry.Verification.Node != "node" {
+		t.Fatalf("checkpoint entry should record successful verification")
+	}
+}
+
+func Test_checkpointManager_Checkpoint_Idempotent(t *testing.T) {
+	checkpointer := &flakyCheckpointer{}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          checkpointer,
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+	params := checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: "client-key",
+	}
+
+	first, err := manager.Checkpoint(context.TODO(), false, params)
+	if err != nil {
+		t.Fatalf("Checkpoint returned unexpected error: %v", err)
+	}
+
+	// Priority does not change the outcome of the checkpoint.
+	params.Priority = 5
+	repeated, err := manager.Checkpoint(context.TODO(), true, params)
+	if err != nil {
+		t.Fatalf("repeated Checkpoint returned unexpected error: %v", err)
+	}
+	if repeated == nil || repeated.Phase != checkpoint.PhaseSucceeded || repeated.ContainerImageName != first.ContainerImageName {
+		t.Fatalf("repeated Checkpoint should return the existing result, got: %+v", repeated)
+	}
+	if len(checkpointer.archives) != 1 {
+		t.Fatalf("container should be checkpointed once, got %d times", len(checkpointer.archives))
+	}
+
+	params.StopPolicy = checkpoint.StopPolicyNone
+	if _, err := manager.Checkpoint(context.TODO(), false, params); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("Checkpoint with different parameters should fail with ErrIdempotencyConflict, got: %v", err)
+	}
+}
+
+func Test_requestFingerprint_labels(t *testing.T) {
+	params := checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		CheckpointIdentifier: "id",
+		Labels:               map[string]string{"app": "notebook"},
+	}
+	other := params
+	other.Labels = map[string]string{"app": "other"}
+	if requestFingerprint(params) == requestFingerprint(other) {
+		t.Fatalf("checkpoints requested with different labels should not be idempotent replays")
+	}
+	same := params
+	same.Labels = map[string]string{"app": "notebook"}
+	same.Priority = 10
+	if requestFingerprint(params) != requestFingerprint(same) {
+		t.Fatalf("checkpoints requested with the same labels and different priority should be idempotent replays")
+	}
+}
+
+func Test_checkpointManager_Checkpoint_IdempotentFailed(t *testing.T) {
+	checkpointer := &flakyCheckpointer{failures: 1}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     &syncStorage{storage: make(map[string]CheckpointEntry)},
+		checkpointerNode:      "node",
+	}
+	manager.checkpointer = checkpointer
+	params := checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		StopPolicy:           checkpoint.StopPolicyNone,
+		CheckpointIdentifier: "client-key",
+	}
+
+	if _, err := manager.Checkpoint(context.TODO(), false, params); err == nil {
+		t.Fatalf("first Checkpoint should fail")
+	}
+	repeated, err := manager.Checkpoint(context.TODO(), false, params)
+	if err != nil {
+		t.Fatalf("repeated Checkpoint returned unexpected error: %v", err)
+	}
+	if repeated == nil || repeated.Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("repeated Checkpoint should checkpoint the container again, got: %+v", repeated)
+	}
+	if len(checkpointer.archives) != 2 {
+		t.Fatalf("container should be checkpointed twice, got %d times", len(checkpointer.archives))
+	}
+}
+
+func Test_checkpointManager_Checkpoint_Duplicate(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     &syncStorage{storage: make(map[string]CheckpointEntry)},
+		checkpointerNode:      "node",
+	}
+	manager.checkpointer = blockingCheckpointer{}
+	params := checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: "first",
+	}
+	if _, err := manager.Checkpoint(context.TODO(), true, params); err != nil {
+		t.Fatalf("Checkpoint returned unexpected error: %v", err)
+	}
+	defer manager.CancelCheckpoint(context.TODO(), "first")
+
+	var duplicateErr *DuplicateCheckpointError
+	params.CheckpointIdentifier, params.Priority = "same", 5
+	if _, err := manager.Checkpoint(context.TODO(), true, params); !errors.As(err, &duplicateErr) || !duplicateErr.Joinable || duplicateErr.CheckpointIdentifier != "first" {
+		t.Fatalf("checkpoint with the same parameters should be joinable, got: %v", err)
+	}
+	params.CheckpointIdentifier, params.StopPolicy = "different", checkpoint.StopPolicyNone
+	if _, err := manager.Checkpoint(context.TODO(), true, params); !errors.As(err, &duplicateErr) || duplicateErr.Joinable {
+		t.Fatalf("checkpoint with different parameters should not be joinable, got: %v", err)
+	}
+}
+
+func Test_checkpointManager_CheckpointEvents(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+	}
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyNone, CheckpointIdentifier: "id"}
+	progress := manager.newCheckpointProgress(params, true, zerolog.Nop())
+
+	events, err := manager.CheckpointEvents(context.TODO(), "id")
+	if err != nil {
+		t.Fatalf("CheckpointEvents return unexpected error: %v", err)
+	}
+	manager.doCheckpointAsync(context.Background(), params, progress, make(chan struct{}))
+
+	var phases []checkpoint.Phase
+	var result *CheckpointEntry
+	for event := range events {
+		switch event.Type {
+		case EventTypePhase:
+			phases = append(phases, event.Phase)
+		case EventTypeResult:
+			result = event.Entry
+		}
+	}
+
+	expectedPhases := []checkpoint.Phase{checkpoint.PhaseQueued, checkpoint.PhaseCheckpointingContainer, checkpoint.PhaseSucceeded}
+	if len(phases) != len(expectedPhases) {
+		t.Fatalf("received wrong phases: %v", phases)
+	}
+	for i, phase := range expectedPhases {
+		if phases[i] != phase {
+			t.Fatalf("received wrong phases: %v", phases)
+		}
+	}
+	if result == nil || result.ContainerImageName != "quay.io/checkpointed" {
+		t.Fatalf("last event should carry the final checkpoint entry")
+	}
+}
+
+// publishingStorage publishes the phases of the entry the checkpoint entered right before it is read.
+type publishingStorage struct {
+	*syncStorage
+	events *checkpointEvents
+}
+
+func (s publishingStorage) ReadEntry(checkpointIdentifier string) (*CheckpointEntry, error) {
+	entry, err := s.syncStorage.ReadEntry(checkpointIdentifier)
+	for _, transition := range entry.PhaseTransitions[1:] {
+		s.events.Publish(checkpointIdentifier, CheckpointEvent{Type: EventTypePhase, Timestamp: transition.Timestamp, Phase: transition.Phase})
+	}
+	return entry, err
+}
+
+func Test_checkpointManager_CheckpointEvents_Replay(t *testing.T) {
+	storage := &syncStorage{storage: make(map[string]CheckpointEntry)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     storage,
+		checkpointerNode:      "node",
+	}
+	storage.storage["id"] = CheckpointEntry{Phase: checkpoint.PhaseBuildingContext, PhaseTransitions: []PhaseTransition{
+		{checkpoint.PhaseQueued, 1},
+		{checkpoint.PhaseCheckpointingContainer, 2},
+		{checkpoint.PhaseBuildingContext, 3},
+	}}
+	manager.checkpointStorage = publishingStorage{storage, manager.events}
+
+	events, err := manager.CheckpointEvents(context.TODO(), "id")
+	if err != nil {
+		t.Fatalf("CheckpointEvents return unexpected error: %v", err)
+	}
+	manager.events.Publish("id", CheckpointEvent{Type: EventTypePhase, Timestamp: 4, Phase: checkpoint.PhasePushing})
+	manager.events.Close("id")
+
+	var phases []checkpoint.Phase
+	for event := range events {
+		if event.Type == EventTypePhase {
+			phases = append(phases, event.Phase)
+		}
+	}
+	expectedPhases := []checkpoint.Phase{checkpoint.PhaseQueued, checkpoint.PhaseCheckpointingContainer, checkpoint.PhaseBuildingContext, checkpoint.PhasePushing}
+	if !slices.Equal(phases, expectedPhases) {
+		t.Fatalf("every phase should be received once, got: %v", phases)
+	}
+}
+
+func Test_checkpointManager_CheckpointEvents_Finished(t *testing.T) {
+	entry := &CheckpointEntry{Phase: checkpoint.PhaseSucceeded, ContainerImageName: "quay.io/checkpointed"}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointStorage:     mockStorage{map[string]*CheckpointEntry{"id": entry}},
+	}
+
+	if _, err := manager.CheckpointEvents(context.TODO(), "unknown"); !errors.Is(err, ErrEntryNotFound) {
+		t.Fatalf("CheckpointEvents should return ErrEntryNotFound, got: %v", err)
+	}
+
+	events, err := manager.CheckpointEvents(context.TODO(), "id")
+	if err != nil {
+		t.Fatalf("CheckpointEvents return unexpected error: %v", err)
+	}
+	event := <-events
+	if event.Type != EventTypeResult || event.Entry != entry {
+		t.Fatalf("finished checkpoint should only send its result")
+	}
+	if _, open := <-events; open {
+		t.Fatalf("events channel should be closed after the result")
+	}
+}
+
+func Test_checkpointManager_CancelCheckpoint(t *testing.T) {
+	podStopper := &mockPodStopper{}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          blockingCheckpointer{},
+		podStopper:            podStopper,
+		checkpointStorage:     &syncStorage{storage: make(map[string]CheckpointEntry)},
+	}
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyDelete, CheckpointIdentifier: "id"}
+
+	if _, err := manager.Checkpoint(context.TODO(), true, params); err != nil {
+		t.Fatalf("Checkpoint returned unexpected error: %v", err)
+	}
+
+	entry, err := manager.CancelCheckpoint(context.TODO(), "id")
+	if err != nil {
+		t.Fatalf("CancelCheckpoint returned unexpected error: %v", err)
+	}
+	if entry.Phase != checkpoint.PhaseCancelled || entry.EndTimestamp == 0 {
+		t.Fatalf("cancelled checkpoint should end in Cancelled phase, got: %s", entry.Phase)
+	}
+	if podStopper.stopped {
+		t.Fatalf("cancelled checkpoint should not stop the Pod")
+	}
+	if manager.checkpointsInProgress.Get("id") != nil {
+		t.Fatalf("cancelled checkpoint should not be in progress")
+	}
+
+	if _, err := manager.CancelCheckpoint(context.TODO(), "id"); !errors.Is(err, ErrNotCancellable) {
+		t.Fatalf("finished checkpoint should not be cancellable, got: %v", err)
+	}
+	if _, err := manager.CancelCheckpoint(context.TODO(), "unknown"); !errors.Is(err, ErrEntryNotFound) {
+		t.Fatalf("CancelCheckpoint should return ErrEntryNotFound, got: %v", err)
+	}
+}
+
+func Test_checkpointManager_CancelCheckpoint_Publishing(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     &syncStorage{storage: make(map[string]CheckpointEntry)},
+		checkpointerNode:      "node",
+	}
+	pushed := make(chan struct{})
+	manager.checkpointer = pushingCheckpointer{pushed}
+	podStopper := manager.podStopper.(*mockPodStopper)
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyDelete, CheckpointIdentifier: "id"}
+
+	if _, err := manager.Checkpoint(context.TODO(), true, params); err != nil {
+		t.Fatalf("Checkpoint returned unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for entry, _ := manager.checkpointStorage.ReadEntry("id"); entry.Phase != checkpoint.PhasePushing; entry, _ = manager.checkpointStorage.ReadEntry("id") {
+		if time.Now().After(deadline) {
+			t.Fatal("checkpoint did not start pushing in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	entry, err := manager.CancelCheckpoint(context.TODO(), "id")
+	if !errors.Is(err, ErrNotCancellable) || entry == nil || entry.Phase != checkpoint.PhasePushing {
+		t.Fatalf("checkpoint pushing its image should not be cancellable, got: %v, %+v", err, entry)
+	}
+
+	close(pushed)
+	entry, err = manager.CheckpointResult(context.TODO(), "id", 5*time.Second)
+	if err != nil || entry.Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("checkpoint should succeed once its image is pushed, got: %v, %+v", err, entry)
+	}
+	if !podStopper.stopped {
+		t.Fatal("stop policy of the checkpoint should be applied once its image is pushed")
+	}
+}
+
+func Test_checkpointManager_doCheckpoint_Failed(t *testing.T) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          failingCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		checkpointStorage:     storage,
+	}
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyDelete, CheckpointIdentifier: "id"}
+
+	_, err := manager.doCheckpoint(context.TODO(), params, nil)
+	var checkpointErr *checkpoint.CheckpointError
+	if !errors.As(err, &checkpointErr) || !errors.Is(err, internal.ErrContainerNotFound) {
+		t.Fatalf("doCheckpoint should return CheckpointError wrapping the cause, got: %v", err)
+	}
+	if checkpointErr.Code != checkpoint.ErrorCodeContainerNotFound || checkpointErr.Phase != checkpoint.PhaseCheckpointingContainer || checkpointErr.Retryable {
+		t.Fatalf("checkpoint error is malformed: %+v", checkpointErr)
+	}
+
+	entry := storage.storage["id"]
+	if entry.Phase != checkpoint.PhaseFailed || entry.Error == nil || entry.Error.Code != checkpoint.ErrorCodeContainerNotFound {
+		t.Fatalf("stored entry should fail with %s code, got: %+v", checkpoint.ErrorCodeContainerNotFound, entry.Error)
+	}
+}
+
+func Test_checkpointManager_doCheckpoint_HookFailed(t *testing.T) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	podStopper := &mockPodStopper{}
+	manager := checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          hookCheckpointer{},
+		podStopper:            podStopper,
+		checkpointStorage:     storage,
+	}
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyDelete, CheckpointIdentifier: "id", Hooks: &checkpoint.Hooks{
+		Pre:  &checkpoint.Hook{Command: []string{"flush"}},
+		Post: &checkpoint.Hook{Command: []string{"resume"}},
+	}}
+
+	_, err := manager.doCheckpoint(context.TODO(), params, nil)
+	var checkpointErr *checkpoint.CheckpointError
+	if !errors.As(err, &checkpointErr) || checkpointErr.Code != checkpoint.ErrorCodeHookFailed || checkpointErr.Retryable {
+		t.Fatalf("doCheckpoint should fail with %s code, got: %v", checkpoint.ErrorCodeHookFailed, err)
+	}
+	if podStopper.stopped {
+		t.Fatal("Pod should not be stopped when checkpoint hook failed")
+	}
+
+	entry := storage.storage["id"]
+	if entry.Phase != checkpoint.PhaseFailed || len(entry.Hooks) != 2 {
+		t.Fatalf("stored entry should fail with both hook results, got: %+v", entry)
+	}
+	if pre, post := entry.Hooks[0], entry.Hooks[1]; pre.Type != checkpoint.HookTypePre || pre.ExitCode != 1 || pre.Stderr != "flush failed" || post.Type != checkpoint.HookTypePost || post.Error != "" {
+		t.Fatalf("hook results are malformed: %+v", entry.Hooks)
+	}
+}
+
+func Test_checkpointManager_doCheckpoint_RetryBuild(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "checkpoint.tar")
+	if err := os.WriteFile(archive, nil, 0644); err != nil {
+		t.Fatalf("failed to create checkpoint archive: %v", err)
+	}
+	checkpointer := &flakyCheckpointer{failures: 1, archive: archive}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          checkpointer,
+		podStopper:            &mockPodStopper{},
+		checkpointStorage:     mockStorage{make(map[string]*CheckpointEntry)},
+		buildRetry:            config.BuildRetryConfig{MaxAttempts: 3},
+	}
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyNone, CheckpointIdentifier: "id"}
+
+	entry, err := manager.doCheckpoint(context.TODO(), params, nil)
+	if err != nil {
+		t.Fatalf("doCheckpoint should succeed on retry, got: %v", err)
+	}
+	if entry.Attempts != 2 {
+		t.Fatalf("checkpoint should succeed on second attempt, got: %d", entry.Attempts)
+	}
+	if len(checkpointer.archives) != 2 || checkpointer.archives[1] != archive {
+		t.Fatalf("retry should build from the checkpoint archive, got: %v", checkpointer.archives)
+	}
+}
+
+func Test_checkpointManager_RetryCheckpoint(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "checkpoint.tar")
+	if err := os.WriteFile(archive, nil, 0644); err != nil {
+		t.Fatalf("failed to create checkpoint archive: %v", err)
+	}
+	checkpointer := &flakyCheckpointer{failures: 1, archive: archive}
+	pendingStorage := &mockPendingStorage{storage: make(map[string]PendingCheckpoint)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        pendingStorage,
+		checkpointer:          checkpointer,
+		podStopper:            &mockPodStopper{},
+		checkpointStorage:     &syncStorage{storage: make(map[string]CheckpointEntry)},
+		buildRetry:            config.BuildRetryConfig{MaxAttempts: 1},
+	}
+	params := checkpoint.CheckpointerParams{StopPolicy: checkpoint.StopPolicyNone, CheckpointIdentifier: "id"}
+
+	if _, err := manager.doCheckpoint(context.TODO(), params, nil); err == nil {
+		t.Fatalf("doCheckpoint should fail without retry")
+	}
+	failedEntry, _ := manager.CheckpointResult(context.TODO(), "id", 0)
+	if !failedEntry.ArchiveRetained || failedEntry.Error.Code != checkpoint.ErrorCodePushFailed {
+		t.Fatalf("failed checkpoint should retain checkpoint archive, got: %+v", failedEntry)
+	}
+	if pending, _ := pendingStorage.ReadPending("id"); pending == nil || pending.Params.CheckpointArchive != archive {
+		t.Fatalf("failed checkpoint should keep its pending checkpoint for retry")
+	}
+
+	queuedEntry, err := manager.RetryCheckpoint(context.TODO(), "id")
+	if err != nil {
+		t.Fatalf("RetryCheckpoint returned unexpected error: %v", err)
+	}
+	if queuedEntry.Phase != checkpoint.PhaseQueued || queuedEntry.Error != nil {
+		t.Fatalf("retried checkpoint should be queued, got: %s", queuedEntry.Phase)
+	}
+
+	entry, _ := manager.CheckpointResult(context.TODO(), "id", time.Second*5)
+	if entry.Phase != checkpoint.PhaseSucceeded || entry.ContainerImageName != "quay.io/checkpointed" || entry.Attempts != 2 {
+		t.Fatalf("retried checkpoint should succeed, got phase: %s after %d attempts", entry.Phase, entry.Attempts)
+	}
+	if checkpointer.archives[1] != archive {
+		t.Fatalf("retry should build from the retained checkpoint archive, got: %v", checkpointer.archives)
+	}
+	if _, err := manager.RetryCheckpoint(context.TODO(), "id"); !errors.Is(err, ErrNotRetryable) {
+		t.Fatalf("succeeded checkpoint should not be retryable, got: %v", err)
+	}
+}
+
+func Test_checkpointManager_ListCheckpoints(t *testing.T) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	for i, id := range []string{"a", "b", "c"} {
+		storage.storage[id] = &CheckpointEntry{CheckpointIdentifier: "node:" + id, BeginTimestamp: int64(i), Phase: checkpoint.PhaseSucceeded}
+	}
+	manager := &checkpointManager{
+		scheduler:         newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		checkpointStorage: storage,
+	}
+
+	list, err := manager.ListCheckpoints(EntryFilter{Limit: 2})
+	if err != nil {
+		t.Fatalf("ListCheckpoints returned unexpected error: %v", err)
+	}
+	if len(list.Items) != 2 || list.Items[0].CheckpointIdentifier != "node:c" || list.Continue == "" {
+		t.Fatalf("first page should hold the two newest checkpoints and continue token, got: %+v", list)
+	}
+
+	cursor, _ := ParseEntryCursor(list.Continue)
+	list, _ = manager.ListCheckpoints(EntryFilter{Limit: 2, After: cursor})
+	if len(list.Items) != 1 || list.Items[0].CheckpointIdentifier != "node:a" || list.Continue != "" {
+		t.Fatalf("last page should hold the oldest checkpoint without continue token, got: %+v", list)
+	}
+}
+
+func Test_checkpointManager_DeleteCheckpoint(t *testing.T) {
+	imageDeleter := &mockImageDeleter{}
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+	entry := &CheckpointEntry{CheckpointIdentifier: "node:id", ContainerIdentifier: containerIdentifier, ContainerImageName: "quay.io/checkpointed:id", Phase: checkpoint.PhaseSucceeded}
+	storage := mockStorage{map[string]*CheckpointEntry{
+		"id":                                entry,
+		latestEntryKey(containerIdentifier): entry,
+		"running":                           {CheckpointIdentifier: "node:running", Phase: checkpoint.PhasePushing},
+	}}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		imageDeleter:          imageDeleter,
+		checkpointStorage:     storage,
+	}
+
+	if _, err := manager.DeleteCheckpoint(context.TODO(), "running", false); !errors.Is(err, ErrCheckpointInProgress) {
+		t.Fatalf("DeleteCheckpoint should fail with ErrCheckpointInProgress, got: %v", err)
+	}
+
+	imageDeleter.err = errors.New("registry unavailable")
+	if _, err := manager.DeleteCheckpoint(context.TODO(), "id", true); !errors.Is(err, ErrImageNotDeleted) {
+		t.Fatalf("DeleteCheckpoint should fail with ErrImageNotDeleted, got: %v", err)
+	}
+	if storage.storage["id"] == nil {
+		t.Fatalf("entry should be kept if the image could not be deleted")
+	}
+
+	imageDeleter.err = nil
+	if _, err := manager.DeleteCheckpoint(context.TODO(), "id", true); err != nil {
+		t.Fatalf("DeleteCheckpoint returned unexpected error: %v", err)
+	}
+	if storage.storage["id"] != nil || storage.storage[latestEntryKey(containerIdentifier)] != nil {
+		t.Fatalf("DeleteCheckpoint should delete the entry and the latest checkpoint pointing to it")
+	}
+	if len(imageDeleter.deleted) != 1 || imageDeleter.deleted[0] != "quay.io/checkpointed:id" {
+		t.Fatalf("DeleteCheckpoint should delete the checkpoint image, got: %v", imageDeleter.deleted)
+	}
+
+	if _, err := manager.DeleteCheckpoint(context.TODO(), "id", false); !errors.Is(err, ErrEntryNotFound) {
+		t.Fatalf("DeleteCheckpoint should fail with ErrEntryNotFound, got: %v", err)
+	}
+}
+
+func Test_checkpointManager_DeleteCheckpoint_Racing(t *testing.T) {
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+	params := checkpoint.CheckpointerParams{ContainerIdentifier: containerIdentifier, CheckpointIdentifier: "id"}
+	imageDeleter := &blockingImageDeleter{started: make(chan struct{}), release: make(chan struct{})}
+	storage := mockStorage{map[string]*CheckpointEntry{"id": {
+		CheckpointIdentifier: "node:id",
+		RequestFingerprint:   requestFingerprint(params),
+		ContainerIdentifier:  containerIdentifier,
+		ContainerImageName:   "quay.io/checkpointed:id",
+		Phase:                checkpoint.PhaseFailed,
+		ArchiveRetained:      true,
+	}}}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: map[string]PendingCheckpoint{"id": {Params: params}}},
+		imageDeleter:          imageDeleter,
+		checkpointStorage:     storage,
+	}
+
+	deleted := make(chan error)
+	go func() {
+		_, err := manager.DeleteCheckpoint(context.TODO(), "id", true)
+		deleted <- err
+	}()
+	<-imageDeleter.started
+
+	if _, err := manager.CancelCheckpoint(context.TODO(), "id"); !errors.Is(err, ErrCheckpointInProgress) {
+		t.Fatalf("CancelCheckpoint racing DeleteCheckpoint should fail with ErrCheckpointInProgress, got: %v", err)
+	}
+	if _, err := manager.RetryCheckpoint(context.TODO(), "id"); !errors.Is(err, ErrCheckpointInProgress) {
+		t.Fatalf("RetryCheckpoint racing DeleteCheckpoint should fail with ErrCheckpointInProgress, got: %v", err)
+	}
+	if _, err := manager.Checkpoint(context.TODO(), true, params); !errors.Is(err, ErrCheckpointInProgress) {
+		t.Fatalf("repeated Checkpoint racing DeleteCheckpoint should fail with ErrCheckpointInProgress, got: %v", err)
+	}
+	if _, err := manager.DeleteCheckpoint(context.TODO(), "id", false); !errors.Is(err, ErrCheckpointInProgress) {
+		t.Fatalf("DeleteCheckpoint racing DeleteCheckpoint should fail with ErrCheckpointInProgress, got: %v", err)
+	}
+
+	close(imageDeleter.release)
+	if err := <-deleted; err != nil {
+		t.Fatalf("DeleteCheckpoint returned unexpected error: %v", err)
+	}
+	if _, err := manager.RetryCheckpoint(context.TODO(), "id"); !errors.Is(err, ErrEntryNotFound) {
+		t.Fatalf("RetryCheckpoint of deleted checkpoint should fail with ErrEntryNotFound, got: %v", err)
+	}
 }
@@ -0,0 +1,430 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+	"time"
+)
+
+const (
+	// DrainGuardAnnotation opts the Pod into checkpointing before its Node is drained or shut down, its value is
+	// "true".
+	DrainGuardAnnotation = "checkpoint.k8s/drain-guard"
+
+	// DrainGuardContainerAnnotation selects the checkpointed container of the guarded Pod, the first container of the
+	// Pod by default.
+	DrainGuardContainerAnnotation = "checkpoint.k8s/drain-guard-container"
+
+	// DrainGuardSlotAnnotation selects the slot the checkpoint of the guarded Pod joins, "<namespace>.<pod>" by
+	// default.
+	DrainGuardSlotAnnotation = "checkpoint.k8s/drain-guard-slot"
+
+	// DrainLabel marks the checkpoints of guarded Pods, its value is the DrainReason.
+	DrainLabel = "checkpoint.k8s/drain"
+
+	// DrainHoldLabel marks the guarded Pods whose eviction waits for their checkpoint, its value is the Node.
+	DrainHoldLabel = "checkpoint.k8s/drain-hold"
+
+	// unschedulableTaint is the taint of cordoned Nodes.
+	unschedulableTaint = "node.kubernetes.io/unschedulable"
+)
+
+// DrainReason describes why the guarded Pods are checkpointed.
+type DrainReason string
+
+const (
+	// DrainReasonCordon means the Node was cordoned, usually at the beginning of a drain.
+	DrainReasonCordon DrainReason = "cordon"
+
+	// DrainReasonShutdown means the Checkpointer received SIGTERM, e.g. on graceful Node shutdown.
+	DrainReasonShutdown DrainReason = "shutdown"
+)
+
+// queueFullBackoff is the time the guard waits before requesting a checkpoint rejected because of full queue again.
+const queueFullBackoff = time.Second
+
+// DrainGuard checkpoints the Pods annotated with DrainGuardAnnotation on the Node of this Checkpointer once the Node
+// is cordoned or the Checkpointer is shut down, so that they can be restored elsewhere from their slots. While a Pod
+// is being checkpointed, a PodDisruptionBudget holds its eviction.
+type DrainGuard struct {
+	config  config.DrainGuardConfig
+	manager CheckpointManager
+	client  kubernetes.Interface
+	node    string
+
+	// mu guards draining, drains, drained, guarded, holds and nodeUID.
+	mu sync.Mutex
+
+	// draining is true while the Node is cordoned.
+	draining bool
+
+	// drains counts the drains started by cordoning the Node which did not finish yet, drained is closed once there
+	// are none.
+	drains  int
+	drained chan struct{}
+
+	// guarded holds the UIDs of the Pods checkpointed since the Node was cordoned, so that they are checkpointed once
+	// per drain.
+	guarded map[types.UID]bool
+
+	// holds counts the Pods held by the PodDisruptionBudget of every Namespace.
+	holds map[string]int
+
+	// nodeUID is the UID of the Node, which owns the PodDisruptionBudgets, so that they are removed with the Node.
+	nodeUID types.UID
+}
+
+// NewDrainGuard constructs DrainGuard of the Checkpointer of checkpointerNode.
+func NewDrainGuard(drainGuardConfig config.DrainGuardConfig, checkpointManager CheckpointManager, client kubernetes.Interface, checkpointerNode string) *DrainGuard {
+	return &DrainGuard{
+		config:  drainGuardConfig,
+		manager: checkpointManager,
+		client:  client,
+		node:    checkpointerNode,
+		guarded: make(map[types.UID]bool),
+		holds:   make(map[string]int),
+	}
+}
+
+// Run watches the Node and checkpoints the guarded Pods once it is cordoned, until ctx is done. The holds left behind
+// by the previous Checkpointer of the Node, e.g. after it crashed while draining, are released first.
+func (g *DrainGuard) Run(ctx context.Context) {
+	g.releaseStale(ctx)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(g.client, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", g.node).String()
+	}))
+	_, err := factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { g.observe(ctx, obj.(*v1.Node)) },
+		UpdateFunc: func(_, obj interface{}) { g.observe(ctx, obj.(*v1.Node)) },
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to watch Node for drain")
+		return
+	}
+
+	factory.Start(ctx.Done())
+	log.Info().Msg("guarding Pods against drain")
+	<-ctx.Done()
+}
+
+// observe starts checkpointing the guarded Pods once the Node becomes unschedulable. Once the Node is schedulable
+// again, the Pods are guarded against the next drain.
+func (g *DrainGuard) observe(ctx context.Context, node *v1.Node) {
+	unschedulable := isUnschedulable(node)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nodeUID = node.UID
+	switch {
+	case unschedulable && !g.draining:
+		g.draining = true
+		log.Info().Msg("Node cordoned, checkpointing guarded Pods")
+		if g.drains++; g.drains == 1 {
+			g.drained = make(chan struct{})
+		}
+		go func() {
+			defer g.finishDrain()
+			drainCtx, cancel := context.WithTimeout(ctx, time.Duration(g.config.TimeoutSeconds)*time.Second)
+			defer cancel()
+			g.Drain(drainCtx, DrainReasonCordon)
+		}()
+	case !unschedulable && g.draining:
+		g.draining = false
+		g.guarded = make(map[types.UID]bool)
+		log.Info().Msg("Node uncordoned, guarding Pods against next drain")
+	}
+}
+
+// finishDrain records that a drain started by cordoning the Node finished.
+func (g *DrainGuard) finishDrain() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.drains--; g.drains == 0 {
+		close(g.drained)
+	}
+}
+
+// Wait waits until the drains started by cordoning the Node finish or ctx is done, so that the Checkpointer does not
+// exit while their checkpoints are in progress.
+func (g *DrainGuard) Wait(ctx context.Context) {
+	g.mu.Lock()
+	if g.drains == 0 {
+		g.mu.Unlock()
+		return
+	}
+	drained := g.drained
+	g.mu.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Warn().Msg("guarded Pods still being checkpointed")
+	}
+}
+
+// Drain checkpoints the guarded Pods on the Node not yet checkpointed since the Node was cordoned, at most
+// config.DrainGuardConfig.Parallelism at once, and waits for the checkpoints until ctx is done.
+func (g *DrainGuard) Drain(ctx context.Context, reason DrainReason) {
+	lg := log.With().Str("reason", string(reason)).Logger()
+	ctx = lg.WithContext(ctx)
+
+	pods, err := g.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", g.node).String(),
+	})
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list guarded Pods")
+		return
+	}
+
+	var guarded []v1.Pod
+	g.mu.Lock()
+	for _, pod := range pods.Items {
+		if pod.Annotations[DrainGuardAnnotation] != "true" || pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning || len(pod.Spec.Containers) == 0 || g.guarded[pod.UID] {
+			continue
+		}
+		g.guarded[pod.UID] = true
+		guarded = append(guarded, pod)
+	}
+	g.mu.Unlock()
+	if len(guarded) == 0 {
+		lg.Info().Msg("no guarded Pods to checkpoint")
+		return
+	}
+
+	var wg sync.WaitGroup
+	var succeeded int
+	var resultMu sync.Mutex
+	slots := make(chan struct{}, g.config.Parallelism)
+	for _, pod := range guarded {
+		g.hold(ctx, pod)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer g.release(context.WithoutCancel(ctx), pod)
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+
+			if entry := g.guardPod(ctx, pod, reason); entry != nil && entry.Phase == checkpoint.PhaseSucceeded {
+				resultMu.Lock()
+				defer resultMu.Unlock()
+				succeeded++
+			}
+		}()
+	}
+	wg.Wait()
+	lg.Info().Int("succeeded", succeeded).Int("failed", len(guarded)-succeeded).Msg("checkpointed guarded Pods")
+}
+
+// guardPod checkpoints the guarded pod without stopping it and waits for the result. The checkpoint joins the slot of
+// the Pod. Returns nil pointer if the checkpoint could not be requested or its result is unknown.
+func (g *DrainGuard) guardPod(ctx context.Context, pod v1.Pod, reason DrainReason) *CheckpointEntry {
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: pod.Namespace, Pod: pod.Name, Container: pod.Annotations[DrainGuardContainerAnnotation]}
+	if containerIdentifier.Container == "" {
+		containerIdentifier.Container = pod.Spec.Containers[0].Name
+	}
+	slot := pod.Annotations[DrainGuardSlotAnnotation]
+	if slot == "" {
+		slot = pod.Namespace + "." + pod.Name
+	}
+	lg := zerolog.Ctx(ctx).With().Str("containerIdentifier", containerIdentifier.String()).Str("slot", slot).Logger()
+	ctx = lg.WithContext(ctx)
+
+	checkpointIdentifier, err := newCheckpointIdentifier()
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to generate checkpoint identifier")
+		return nil
+	}
+	params := checkpoint.CheckpointerParams{
+		ContainerIdentifier:  containerIdentifier,
+		StopPolicy:           checkpoint.StopPolicyNone,
+		CheckpointIdentifier: checkpointIdentifier,
+		Labels:               map[string]string{DrainLabel: string(reason)},
+		Slot:                 slot,
+		Priority:             g.config.Priority,
+	}
+	for {
+		_, err = g.manager.Checkpoint(ctx, true, params)
+		var queueFullErr *QueueFullError
+		if !errors.As(err, &queueFullErr) {
+			break
+		}
+		select {
+		case <-time.After(queueFullBackoff):
+		case <-ctx.Done():
+			lg.Error().Msg("checkpoint queue still full, guarded Pod not checkpointed")
+			return nil
+		}
+	}
+	var duplicateErr *DuplicateCheckpointError
+	if errors.As(err, &duplicateErr) {
+		// The checkpoint in progress does not join the slot, but it still preserves the work of the Pod.
+		lg.Info().Str("checkpointIdentifier", duplicateErr.CheckpointIdentifier).Msg("container already being checkpointed, waiting for it")
+		checkpointIdentifier = duplicateErr.CheckpointIdentifier
+	} else if err != nil {
+		lg.Error().Err(err).Msg("failed to checkpoint guarded Pod")
+		return nil
+	}
+
+	entry := awaitCheckpointResult(ctx, g.manager, checkpointIdentifier, checkpointResultTimeout)
+	switch {
+	case entry == nil:
+		lg.Error().Str("checkpointIdentifier", checkpointIdentifier).Msg("checkpoint of guarded Pod did not finish in time")
+	case entry.Phase != checkpoint.PhaseSucceeded:
+		lg.Error().Interface("error", entry.Error).Str("checkpointIdentifier", checkpointIdentifier).Msg("checkpoint of guarded Pod failed")
+	default:
+		lg.Info().Str("checkpointIdentifier", checkpointIdentifier).Str("image", entry.ContainerImageName).Msg("checkpointed guarded Pod")
+	}
+	return entry
+}
+
+// hold makes the eviction of pod wait for its checkpoint, by labeling it with DrainHoldLabel selected by a
+// PodDisruptionBudget which allows no disruption. The budget is created before the Pod is labeled, so that a labeled
+// Pod is never left unprotected; the API server refuses evictions until the new budget is processed. Evictions
+// requested before the Pod is held are not stopped. Failing to hold the Pod does not stop its checkpoint.
+func (g *DrainGuard) hold(ctx context.Context, pod v1.Pod) {
+	lg := zerolog.Ctx(ctx).With().Str("namespace", pod.Namespace).Str("pod", pod.Name).Logger()
+
+	g.mu.Lock()
+	if g.holds[pod.Namespace]++; g.holds[pod.Namespace] == 1 {
+		maxUnavailable := intstr.FromInt32(0)
+		_, err := g.client.PolicyV1().PodDisruptionBudgets(pod.Namespace).Create(ctx, &policyv1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: g.holdName(), OwnerReferences: g.nodeOwnerReferences(ctx)},
+			Spec: policyv1.PodDisruptionBudgetSpec{
+				MaxUnavailable: &maxUnavailable,
+				Selector:       &metav1.LabelSelector{MatchLabels: map[string]string{DrainHoldLabel: g.node}},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil && !k8serrors.IsAlreadyExists(err) {
+			lg.Warn().Err(err).Msg("failed to create PodDisruptionBudget holding guarded Pods")
+		}
+	}
+	g.mu.Unlock()
+
+	if err := g.labelHold(ctx, pod, &g.node); err != nil {
+		lg.Warn().Err(err).Msg("failed to hold eviction of guarded Pod")
+	}
+}
+
+// nodeOwnerReferences returns the owner references to the Node, or none if the Node cannot be read. It is called
+// with mu held.
+func (g *DrainGuard) nodeOwnerReferences(ctx context.Context) []metav1.OwnerReference {
+	if g.nodeUID == "" {
+		node, err := g.client.CoreV1().Nodes().Get(ctx, g.node, metav1.GetOptions{})
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to read Node, PodDisruptionBudget will not be owned by it")
+			return nil
+		}
+		g.nodeUID = node.UID
+	}
+	return []metav1.OwnerReference{{APIVersion: "v1", Kind: "Node", Name: g.node, UID: g.nodeUID}}
+}
+
+// releaseStale releases the Pods held on the Node and deletes the PodDisruptionBudgets holding them, which were left
+// behind by the previous Checkpointer of the Node.
+func (g *DrainGuard) releaseStale(ctx context.Context) {
+	pods, err := g.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{DrainHoldLabel: g.node}).String(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list Pods held by previous drain")
+	} else {
+		for _, pod := range pods.Items {
+			if err := g.labelHold(ctx, pod, nil); err != nil && !k8serrors.IsNotFound(err) {
+				log.Warn().Err(err).Str("namespace", pod.Namespace).Str("pod", pod.Name).Msg("failed to release Pod held by previous drain")
+			}
+		}
+	}
+
+	budgets, err := g.client.PolicyV1().PodDisruptionBudgets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", g.holdName()).String(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list PodDisruptionBudgets of previous drain")
+		return
+	}
+	for _, budget := range budgets.Items {
+		if budget.Name != g.holdName() {
+			continue
+		}
+		err := g.client.PolicyV1().PodDisruptionBudgets(budget.Namespace).Delete(ctx, budget.Name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			log.Warn().Err(err).Str("namespace", budget.Namespace).Msg("failed to delete PodDisruptionBudget of previous drain")
+		}
+	}
+}
+
+// release lets pod be evicted. The PodDisruptionBudget of its Namespace is deleted with the last held Pod.
+func (g *DrainGuard) release(ctx context.Context, pod v1.Pod) {
+	lg := zerolog.Ctx(ctx).With().Str("namespace", pod.Namespace).Str("pod", pod.Name).Logger()
+	if err := g.labelHold(ctx, pod, nil); err != nil && !k8serrors.IsNotFound(err) {
+		lg.Warn().Err(err).Msg("failed to release eviction of guarded Pod")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.holds[pod.Namespace] == 0 {
+		return
+	}
+	if g.holds[pod.Namespace]--; g.holds[pod.Namespace] > 0 {
+		return
+	}
+	delete(g.holds, pod.Namespace)
+	err := g.client.PolicyV1().PodDisruptionBudgets(pod.Namespace).Delete(ctx, g.holdName(), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		lg.Warn().Err(err).Msg("failed to delete PodDisruptionBudget holding guarded Pods")
+	}
+}
+
+// labelHold sets DrainHoldLabel of pod to node, or removes it if node is nil.
+func (g *DrainGuard) labelHold(ctx context.Context, pod v1.Pod, node *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]*string{DrainHoldLabel: node},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = g.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// holdName returns the name of the PodDisruptionBudget holding the guarded Pods on the Node.
+func (g *DrainGuard) holdName() string {
+	return "checkpointer-drain-guard-" + g.node
+}
+
+// isUnschedulable reports whether node is cordoned.
+func isUnschedulable(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == unschedulableTaint {
+			return true
+		}
+	}
+	return false
+}
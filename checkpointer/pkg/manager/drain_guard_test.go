@@ -0,0 +1,140 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"time"
+)
+
+func newTestGuardedPod(name string, annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns", UID: types.UID("uid-" + name), Annotations: annotations},
+		Spec:       v1.PodSpec{NodeName: "node", Containers: []v1.Container{{Name: "ctrn"}}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+func newTestDrainGuard(objects ...runtime.Object) (*DrainGuard, *fake.Clientset, mockStorage) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     storage,
+		checkpointerNode:      "node",
+	}
+	client := fake.NewSimpleClientset(objects...)
+	drainGuardConfig := config.DrainGuardConfig{Enabled: true, Parallelism: 1, TimeoutSeconds: 5, Priority: 100}
+	return NewDrainGuard(drainGuardConfig, manager, client, "node"), client, storage
+}
+
+func Test_DrainGuard_Drain(t *testing.T) {
+	guarded := newTestGuardedPod("guarded", map[string]string{DrainGuardAnnotation: "true"})
+	slotted := newTestGuardedPod("slotted", map[string]string{DrainGuardAnnotation: "true", DrainGuardSlotAnnotation: "notebook"})
+	unguarded := newTestGuardedPod("unguarded", nil)
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", UID: "uid-node"}}
+	g, client, storage := newTestDrainGuard(guarded, slotted, unguarded, node)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	g.Drain(ctx, DrainReasonCordon)
+
+	slots := make(map[string]*CheckpointEntry)
+	for id, entry := range storage.storage {
+		if id == entry.CheckpointIdentifier[len("node:"):] {
+			slots[entry.Slot] = entry
+		}
+	}
+	if len(slots) != 2 || slots["ns.guarded"] == nil || slots["notebook"] == nil {
+		t.Fatalf("guarded Pods should be checkpointed into their slots, got: %v", slots)
+	}
+	for _, entry := range slots {
+		if entry.Phase != checkpoint.PhaseSucceeded || entry.Labels[DrainLabel] != string(DrainReasonCordon) || entry.StopPolicy != checkpoint.StopPolicyNone {
+			t.Fatalf("checkpoint of guarded Pod should succeed without stopping it, got: %+v", entry)
+		}
+	}
+
+	created, deleted := 0, 0
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "poddisruptionbudgets" {
+			switch action.GetVerb() {
+			case "create":
+				created++
+				budget := action.(k8stesting.CreateAction).GetObject().(*policyv1.PodDisruptionBudget)
+				if len(budget.OwnerReferences) != 1 || budget.OwnerReferences[0].UID != "uid-node" {
+					t.Fatalf("PodDisruptionBudget should be owned by the Node, got: %+v", budget.OwnerReferences)
+				}
+			case "delete":
+				deleted++
+			}
+		}
+	}
+	if created != 1 || deleted != 1 {
+		t.Fatalf("PodDisruptionBudget should hold the guarded Pods until they are checkpointed, created: %d, deleted: %d", created, deleted)
+	}
+	for _, name := range []string{"guarded", "slotted"} {
+		if pod, _ := client.CoreV1().Pods("ns").Get(context.TODO(), name, metav1.GetOptions{}); pod.Labels[DrainHoldLabel] != "" {
+			t.Fatalf("guarded Pod %s should be released once checkpointed, got labels: %v", name, pod.Labels)
+		}
+	}
+
+	// Pods are checkpointed once per drain, e.g. not again on shutdown of the cordoned Node.
+	checkpoints := len(storage.storage)
+	g.Drain(ctx, DrainReasonShutdown)
+	if len(storage.storage) != checkpoints {
+		t.Fatalf("guarded Pods should not be checkpointed twice in the same drain, got: %v", storage.storage)
+	}
+}
+
+func Test_DrainGuard_observe(t *testing.T) {
+	g, _, _ := newTestDrainGuard()
+	g.guarded["uid"] = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	g.observe(ctx, &v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{{Key: unschedulableTaint, Effect: v1.TaintEffectNoSchedule}}}})
+	if !g.draining || !g.guarded["uid"] {
+		t.Fatal("tainted Node should be drained")
+	}
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	g.Wait(waitCtx)
+	if waitCtx.Err() != nil || g.drains != 0 {
+		t.Fatal("Wait should return once the drain finishes")
+	}
+
+	g.observe(ctx, &v1.Node{})
+	if g.draining || len(g.guarded) != 0 {
+		t.Fatal("Pods on uncordoned Node should be guarded against next drain")
+	}
+}
+
+func Test_DrainGuard_releaseStale(t *testing.T) {
+	held := newTestGuardedPod("held", map[string]string{DrainGuardAnnotation: "true"})
+	held.Labels = map[string]string{DrainHoldLabel: "node"}
+	stale := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: "checkpointer-drain-guard-node", Namespace: "ns"}}
+	other := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "ns"}}
+	g, client, _ := newTestDrainGuard(held, stale, other)
+
+	g.releaseStale(context.TODO())
+	if pod, _ := client.CoreV1().Pods("ns").Get(context.TODO(), "held", metav1.GetOptions{}); pod.Labels[DrainHoldLabel] != "" {
+		t.Fatalf("Pod held by previous drain should be released, got labels: %v", pod.Labels)
+	}
+	budgets, _ := client.PolicyV1().PodDisruptionBudgets("ns").List(context.TODO(), metav1.ListOptions{})
+	if len(budgets.Items) != 1 || budgets.Items[0].Name != "other" {
+		t.Fatalf("only PodDisruptionBudget of previous drain should be deleted, got: %+v", budgets.Items)
+	}
+}
@@ -0,0 +1,306 @@
+package manager
+
+import (
+	"bytes"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/diskv/v3"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// CloudEventTypeStarted is emitted when a checkpoint is accepted.
+	CloudEventTypeStarted = "io.checkpointer.checkpoint.started"
+
+	// CloudEventTypePhaseChanged is emitted when a checkpoint enters a new phase.
+	CloudEventTypePhaseChanged = "io.checkpointer.checkpoint.phase.changed"
+
+	// CloudEventTypeSucceeded is emitted when a checkpoint succeeds.
+	CloudEventTypeSucceeded = "io.checkpointer.checkpoint.succeeded"
+
+	// CloudEventTypeFailed is emitted when a checkpoint fails.
+	CloudEventTypeFailed = "io.checkpointer.checkpoint.failed"
+
+	// CloudEventTypeCancelled is emitted when a checkpoint is cancelled.
+	CloudEventTypeCancelled = "io.checkpointer.checkpoint.cancelled"
+)
+
+// errEventsRejected means the event sink rejected the events, so there is no point in sending them again.
+var errEventsRejected = errors.New("event sink rejected CloudEvents")
+
+// CloudEvent represents a CloudEvents 1.0 event in the JSON format, carrying CheckpointEntry as data.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// EventSink is responsible for emitting checkpoint lifecycle events to a cluster-wide event pipeline.
+type EventSink interface {
+
+	// Emit records the entry entering its current phase. The event is buffered and sent in the background, Emit
+	// never blocks on the sink.
+	Emit(entry CheckpointEntry)
+}
+
+// NewEventSink constructs new EventSink instance sending CloudEvents over HTTP according to eventSinkConfig. Returns
+// nil if the sink is not configured.
+func NewEventSink(eventSinkConfig config.EventSinkConfig, checkpointerNode string) EventSink {
+	if eventSinkConfig.Url == "" {
+		return nil
+	}
+	sink := newCloudEventSink(eventSinkConfig, checkpointerNode)
+	go sink.run(time.Second * time.Duration(eventSinkConfig.FlushIntervalSeconds))
+	return sink
+}
+
+// cloudEventSink buffers CloudEvents on disk under keys ordered by their sequence number and sends them in batches.
+type cloudEventSink struct {
+	config.EventSinkConfig
+
+	// source is the CloudEvents source attribute identifying this Checkpointer.
+	source string
+
+	buffer *diskv.Diskv
+	client *http.Client
+
+	// mu guards keys and sequence.
+	mu sync.Mutex
+
+	// keys are the buffered events ordered from the oldest.
+	keys     []string
+	sequence uint64
+
+	// full signals that there is at least BatchSize of buffered events.
+	full chan struct{}
+
+	// flushMu makes sure that only one flush runs at a time.
+	flushMu sync.Mutex
+}
+
+func newCloudEventSink(eventSinkConfig config.EventSinkConfig, checkpointerNode string) *cloudEventSink {
+	sink := &cloudEventSink{
+		EventSinkConfig: eventSinkConfig,
+		source:          "/checkpointer/" + checkpointerNode,
+		buffer: diskv.New(diskv.Options{
+			BasePath:     eventSinkConfig.BufferPath,
+			CacheSizeMax: 1024 * 1024,
+		}),
+		client: &http.Client{Timeout: time.Second * time.Duration(eventSinkConfig.TimeoutSeconds)},
+		full:   make(chan struct{}, 1),
+	}
+
+	// Events buffered before restart are sent first.
+	for key := range sink.buffer.Keys(nil) {
+		sink.keys = append(sink.keys, key)
+	}
+	slices.Sort(sink.keys)
+	if len(sink.keys) > 0 {
+		last, _ := strconv.ParseUint(sink.keys[len(sink.keys)-1], 10, 64)
+		sink.sequence = last + 1
+		log.Info().Int("bufferedEvents", len(sink.keys)).Msg("found CloudEvents buffered before restart")
+	}
+	return sink
+}
+
+func (s *cloudEventSink) Emit(entry CheckpointEntry) {
+	lg := log.With().Str("checkpointIdentifier", entry.CheckpointIdentifier).Logger()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to marshal checkpoint entry for CloudEvent")
+		return
+	}
+	marshalled, err := json.Marshal(CloudEvent{
+		SpecVersion:     "1.0",
+		Id:              string(uuid.NewUUID()),
+		Source:          s.source,
+		Type:            cloudEventType(entry.Phase),
+		Subject:         entry.CheckpointIdentifier,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to marshal CloudEvent")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(len(s.keys)) >= s.MaxBufferedEvents {
+		dropped := s.keys[0]
+		s.keys = s.keys[1:]
+		if err := s.buffer.Erase(dropped); err != nil {
+			lg.Warn().Err(err).Msg("failed to erase dropped CloudEvent")
+		}
+		lg.Warn().Msg("CloudEvent buffer is full, dropped the oldest event")
+	}
+
+	// Zero padded sequence number keeps the keys sorted in the order of emitting.
+	key := fmt.Sprintf("%020d", s.sequence)
+	s.sequence++
+	if err := s.buffer.Write(key, marshalled); err != nil {
+		lg.Error().Err(err).Msg("failed to buffer CloudEvent, dropping it")
+		return
+	}
+	s.keys = append(s.keys, key)
+
+	if int64(len(s.keys)) >= s.BatchSize {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run flushes the buffer every flushInterval or whenever a full batch is buffered.
+func (s *cloudEventSink) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.full:
+		}
+		if err := s.flush(); err != nil {
+			// The events stay buffered, so they are sent on the next tick.
+			log.Warn().Err(err).Msg("failed to send CloudEvents")
+		}
+	}
+}
+
+// flush sends buffered events in batches until the buffer is empty. Returns error on the first batch that could not
+// be sent, the batch stays buffered.
+func (s *cloudEventSink) flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	for {
+		s.mu.Lock()
+		batchKeys := slices.Clone(s.keys[:min(int64(len(s.keys)), s.BatchSize)])
+		s.mu.Unlock()
+		if len(batchKeys) == 0 {
+			return nil
+		}
+
+		batch := make([]json.RawMessage, 0, len(batchKeys))
+		for _, key := range batchKeys {
+			marshalled, err := s.buffer.Read(key)
+			if err != nil {
+				// The event was dropped from full buffer in the meantime.
+				continue
+			}
+			batch = append(batch, marshalled)
+		}
+
+		if len(batch) == 0 {
+			// All events of the batch were dropped from full buffer in the meantime.
+		} else if err := s.send(batch); errors.Is(err, errEventsRejected) {
+			log.Warn().Err(err).Int("events", len(batch)).Msg("dropping CloudEvents rejected by event sink")
+		} else if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		for _, key := range batchKeys {
+			_ = s.buffer.Erase(key)
+		}
+		s.keys = slices.DeleteFunc(s.keys, func(key string) bool { return slices.Contains(batchKeys, key) })
+		s.mu.Unlock()
+	}
+}
+
+// send sends the batch according to the configured mode.
+func (s *cloudEventSink) send(batch []json.RawMessage) error {
+	if s.Mode == config.EventSinkModeBinary {
+		for _, marshalled := range batch {
+			if err := s.sendBinary(marshalled); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(batch) == 1 {
+		return s.post(batch[0], map[string]string{"Content-Type": "application/cloudevents+json"})
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CloudEvents batch: %w", err)
+	}
+	return s.post(body, map[string]string{"Content-Type": "application/cloudevents-batch+json"})
+}
+
+// sendBinary sends a single event with its attributes as ce- headers and its data as body.
+func (s *cloudEventSink) sendBinary(marshalled json.RawMessage) error {
+	var event CloudEvent
+	if err := json.Unmarshal(marshalled, &event); err != nil {
+		return fmt.Errorf("failed to unmarshal buffered CloudEvent: %w", err)
+	}
+	return s.post(event.Data, map[string]string{
+		"Content-Type":   event.DataContentType,
+		"ce-specversion": event.SpecVersion,
+		"ce-id":          event.Id,
+		"ce-source":      event.Source,
+		"ce-type":        event.Type,
+		"ce-subject":     event.Subject,
+		"ce-time":        event.Time.Format(time.RFC3339Nano),
+	})
+}
+
+func (s *cloudEventSink) post(body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create CloudEvents request: %w", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send CloudEvents: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	// Client errors will not go away by retrying, except for timeouts and rate limiting.
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status code %d", errEventsRejected, resp.StatusCode)
+	}
+	return fmt.Errorf("event sink responded with status code %d", resp.StatusCode)
+}
+
+// cloudEventType returns the CloudEvents type of checkpoint entering phase.
+func cloudEventType(phase checkpoint.Phase) string {
+	switch phase {
+	case checkpoint.PhaseQueued:
+		return CloudEventTypeStarted
+	case checkpoint.PhaseSucceeded:
+		return CloudEventTypeSucceeded
+	case checkpoint.PhaseFailed:
+		return CloudEventTypeFailed
+	case checkpoint.PhaseCancelled:
+		return CloudEventTypeCancelled
+	}
+	return CloudEventTypePhaseChanged
+}
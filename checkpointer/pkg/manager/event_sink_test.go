@@ -0,0 +1,124 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestEventSink(t *testing.T, url string, mode config.EventSinkMode, batchSize, maxBuffered int64) *cloudEventSink {
+	return newCloudEventSink(config.EventSinkConfig{
+		Url:               url,
+		Mode:              mode,
+		BatchSize:         batchSize,
+		BufferPath:        t.TempDir(),
+		MaxBufferedEvents: maxBuffered,
+		TimeoutSeconds:    1,
+	}, "node")
+}
+
+func Test_cloudEventSink_Structured(t *testing.T) {
+	var contentTypes []string
+	var batches [][]CloudEvent
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var batch []CloudEvent
+		if err := json.Unmarshal(body, &batch); err != nil {
+			var event CloudEvent
+			_ = json.Unmarshal(body, &event)
+			batch = []CloudEvent{event}
+		}
+		contentTypes = append(contentTypes, req.Header.Get("Content-Type"))
+		batches = append(batches, batch)
+	}))
+	defer server.Close()
+
+	sink := newTestEventSink(t, server.URL, config.EventSinkModeStructured, 2, 10)
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:id", Phase: checkpoint.PhaseQueued})
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:id", Phase: checkpoint.PhasePushing})
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:id", Phase: checkpoint.PhaseSucceeded})
+
+	if err := sink.flush(); err != nil {
+		t.Fatalf("flush returned unexpected error: %v", err)
+	}
+
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("events should be sent in batches of two")
+	}
+	if contentTypes[0] != "application/cloudevents-batch+json" || contentTypes[1] != "application/cloudevents+json" {
+		t.Fatalf("wrong content types: %v", contentTypes)
+	}
+	expectedTypes := []string{CloudEventTypeStarted, CloudEventTypePhaseChanged, CloudEventTypeSucceeded}
+	for i, event := range append(batches[0], batches[1]...) {
+		if event.SpecVersion != "1.0" || event.Type != expectedTypes[i] || event.Subject != "node:id" || event.Source != "/checkpointer/node" {
+			t.Fatalf("malformed CloudEvent: %+v", event)
+		}
+	}
+	if len(sink.keys) != 0 {
+		t.Fatalf("sent events should be removed from buffer")
+	}
+}
+
+func Test_cloudEventSink_Binary(t *testing.T) {
+	var headers http.Header
+	var entry CheckpointEntry
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers = req.Header
+		body, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(body, &entry)
+	}))
+	defer server.Close()
+
+	sink := newTestEventSink(t, server.URL, config.EventSinkModeBinary, 10, 10)
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:id", Phase: checkpoint.PhaseFailed})
+
+	if err := sink.flush(); err != nil {
+		t.Fatalf("flush returned unexpected error: %v", err)
+	}
+
+	if headers.Get("ce-specversion") != "1.0" || headers.Get("ce-type") != CloudEventTypeFailed || headers.Get("ce-id") == "" {
+		t.Fatalf("CloudEvent attributes should be sent as headers, got: %v", headers)
+	}
+	if headers.Get("Content-Type") != "application/json" || entry.CheckpointIdentifier != "node:id" {
+		t.Fatalf("checkpoint entry should be sent as body")
+	}
+}
+
+func Test_cloudEventSink_BoundedBuffer(t *testing.T) {
+	failing := true
+	var received []CloudEvent
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if failing {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	bufferPath := t.TempDir()
+	sinkConfig := config.EventSinkConfig{Url: server.URL, Mode: config.EventSinkModeStructured, BatchSize: 10, BufferPath: bufferPath, MaxBufferedEvents: 2, TimeoutSeconds: 1}
+	sink := newCloudEventSink(sinkConfig, "node")
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:dropped", Phase: checkpoint.PhaseQueued})
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:first", Phase: checkpoint.PhaseQueued})
+	sink.Emit(CheckpointEntry{CheckpointIdentifier: "node:second", Phase: checkpoint.PhaseQueued})
+
+	if err := sink.flush(); err == nil {
+		t.Fatalf("flush should fail when the sink is unavailable")
+	}
+
+	// Buffered events survive restart.
+	failing = false
+	restarted := newCloudEventSink(sinkConfig, "node")
+	if err := restarted.flush(); err != nil {
+		t.Fatalf("flush returned unexpected error: %v", err)
+	}
+	if len(received) != 2 || received[0].Subject != "node:first" || received[1].Subject != "node:second" {
+		t.Fatalf("only the two newest events should be sent in order, got: %+v", received)
+	}
+}
@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"github.com/rs/zerolog"
+	"sync"
+	"time"
+)
+
+// EventType is the type of CheckpointEvent.
+type EventType string
+
+const (
+	// EventTypePhase means the checkpoint entered a new phase.
+	EventTypePhase EventType = "phase"
+
+	// EventTypeLog carries a log line written while checkpointing.
+	EventTypeLog EventType = "log"
+
+	// EventTypeResult carries the final CheckpointEntry. It is always the last event of a checkpoint.
+	EventTypeResult EventType = "result"
+)
+
+// subscriberBufferSize is the number of events buffered for every subscriber. Events for subscribers which do not
+// keep up are dropped, except for the final result which can always be read from storage.
+const subscriberBufferSize = 64
+
+// CheckpointEvent represents something that happened to a checkpoint while it was in progress.
+type CheckpointEvent struct {
+	// Type is the type of the event.
+	Type EventType `json:"type"`
+
+	// Timestamp is a Unix timestamp representing the time the event occurred.
+	Timestamp int64 `json:"timestamp"`
+
+	// Phase is the phase the checkpoint entered, set for EventTypePhase.
+	Phase checkpoint.Phase `json:"phase,omitempty"`
+
+	// Level is the level of the log line, set for EventTypeLog.
+	Level string `json:"level,omitempty"`
+
+	// Message is the log line, set for EventTypeLog.
+	Message string `json:"message,omitempty"`
+
+	// Entry is the CheckpointEntry, set for EventTypeResult.
+	Entry *CheckpointEntry `json:"entry,omitempty"`
+}
+
+// checkpointEvents is an in memory pub/sub, where the topic is the checkpointIdentifier. Subscribers receive events
+// published after they subscribed, until the checkpoint finishes and the topic is closed.
+type checkpointEvents struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan CheckpointEvent]struct{}
+}
+
+func newCheckpointEvents() *checkpointEvents {
+	return &checkpointEvents{subscribers: make(map[string]map[chan CheckpointEvent]struct{})}
+}
+
+// Subscribe returns channel receiving events of checkpointIdentifier and function which unsubscribes the channel.
+// The channel is closed when the checkpoint finishes or on unsubscribe.
+func (ce *checkpointEvents) Subscribe(checkpointIdentifier string) (chan CheckpointEvent, func()) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+
+	subscriber := make(chan CheckpointEvent, subscriberBufferSize)
+	if ce.subscribers[checkpointIdentifier] == nil {
+		ce.subscribers[checkpointIdentifier] = make(map[chan CheckpointEvent]struct{})
+	}
+	ce.subscribers[checkpointIdentifier][subscriber] = struct{}{}
+
+	return subscriber, func() {
+		ce.mu.Lock()
+		defer ce.mu.Unlock()
+		if _, found := ce.subscribers[checkpointIdentifier][subscriber]; found {
+			delete(ce.subscribers[checkpointIdentifier], subscriber)
+			if len(ce.subscribers[checkpointIdentifier]) == 0 {
+				delete(ce.subscribers, checkpointIdentifier)
+			}
+			close(subscriber)
+		}
+	}
+}
+
+// Publish sends event to all subscribers of checkpointIdentifier without blocking.
+func (ce *checkpointEvents) Publish(checkpointIdentifier string, event CheckpointEvent) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+
+	for subscriber := range ce.subscribers[checkpointIdentifier] {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Close closes channels of all subscribers of checkpointIdentifier.
+func (ce *checkpointEvents) Close(checkpointIdentifier string) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+
+	for subscriber := range ce.subscribers[checkpointIdentifier] {
+		close(subscriber)
+	}
+	delete(ce.subscribers, checkpointIdentifier)
+}
+
+// logHook returns zerolog.Hook publishing every log line written while checkpointing as EventTypeLog.
+func (ce *checkpointEvents) logHook(checkpointIdentifier string) zerolog.Hook {
+	return zerolog.HookFunc(func(_ *zerolog.Event, level zerolog.Level, message string) {
+		if message == "" {
+			return
+		}
+		ce.Publish(checkpointIdentifier, CheckpointEvent{
+			Type:      EventTypeLog,
+			Timestamp: time.Now().Unix(),
+			Level:     level.String(),
+			Message:   message,
+		})
+	})
+}
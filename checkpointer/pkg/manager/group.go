@@ -0,0 +1,627 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GroupLabel marks the member checkpoints of a group checkpoint, its value is the identifier of the group.
+const GroupLabel = "checkpoint.k8s/group"
+
+// groupPollPeriod is how often the coordinator reads the results of the member checkpoints.
+const groupPollPeriod = time.Second
+
+// maxGroupEntries bounds the number of group entries kept, the oldest finished ones are forgotten first.
+const maxGroupEntries = 256
+
+// groupEntryKeyPrefix prefixes the storage keys of group checkpoints. They are stored alongside the latest entries, so
+// that they are not listed as checkpoints.
+const groupEntryKeyPrefix = latestEntryKeyPrefix + "group_"
+
+// groupIndexKey is the storage key of the identifiers of all stored group checkpoints.
+const groupIndexKey = latestEntryKeyPrefix + "groups"
+
+var errGroupInterrupted = errors.New("group checkpoint was interrupted by Checkpointer restart")
+
+var ErrNoGroupMembers = errors.New("no running Pod matches the label selector")
+
+// GroupPhase represents the phase of a group checkpoint.
+type GroupPhase string
+
+const (
+	// GroupPhaseFreezing runs the pre checkpoint hooks of every member.
+	GroupPhaseFreezing GroupPhase = "Freezing"
+
+	// GroupPhaseDumping waits for Kubelet to checkpoint every member while they are frozen.
+	GroupPhaseDumping GroupPhase = "Dumping"
+
+	// GroupPhaseUnfreezing runs the post checkpoint hooks of every member.
+	GroupPhaseUnfreezing GroupPhase = "Unfreezing"
+
+	// GroupPhasePublishing waits for the checkpoint images of every member to be pushed.
+	GroupPhasePublishing GroupPhase = "Publishing"
+
+	// GroupPhaseDeletingPods deletes the Pods of every member, only once all of them succeeded.
+	GroupPhaseDeletingPods GroupPhase = "DeletingPods"
+
+	GroupPhaseSucceeded GroupPhase = "Succeeded"
+	GroupPhaseFailed    GroupPhase = "Failed"
+)
+
+// Finished reports whether the group checkpoint ended in the phase.
+func (phase GroupPhase) Finished() bool {
+	return phase == GroupPhaseSucceeded || phase == GroupPhaseFailed
+}
+
+// GroupRequest represents the parameters of a group checkpoint.
+type GroupRequest struct {
+	// Namespace is the Namespace of the member Pods.
+	Namespace string `json:"namespace"`
+
+	// LabelSelector selects the member Pods, only the running ones are checkpointed.
+	LabelSelector string `json:"labelSelector"`
+
+	// Container is the checkpointed container of each member Pod, the first container of the Pod by default.
+	Container string `json:"container,omitempty"`
+
+	// DeletePod instructs to delete every member Pod, but only once all of them are checkpointed.
+	DeletePod bool `json:"deletePod,omitempty"`
+
+	// Hooks are the freeze and unfreeze hooks of every member. If nil, the hooks are read from the annotations of each
+	// member Pod.
+	Hooks *checkpoint.Hooks `json:"hooks,omitempty"`
+
+	// Labels are recorded with every member checkpoint, together with GroupLabel.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Priority orders the member checkpoints in the checkpoint queues of their Nodes.
+	Priority int64 `json:"priority,omitempty"`
+}
+
+// GroupEntry represents the result of a group checkpoint.
+type GroupEntry struct {
+	// GroupIdentifier is the tracking handle of the group in format {node}:{groupIdentifier}, the Node being the one of
+	// the coordinating Checkpointer.
+	GroupIdentifier string `json:"groupIdentifier"`
+
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+	DeletePod     bool   `json:"deletePod,omitempty"`
+
+	// BeginTimestamp is a Unix timestamp representing the time the group checkpoint was initiated.
+	BeginTimestamp int64 `json:"beginTimestamp"`
+
+	// EndTimestamp is a Unix timestamp representing the time the group checkpoint was finished.
+	EndTimestamp int64 `json:"endTimestamp"`
+
+	Phase   GroupPhase    `json:"phase"`
+	Members []GroupMember `json:"members"`
+
+	// Error describes why the group checkpoint failed, the causes are in the errors of the members.
+	Error string `json:"error,omitempty"`
+}
+
+// GroupMember represents the checkpoint of a single container of a group checkpoint.
+type GroupMember struct {
+	ContainerIdentifier checkpoint.ContainerIdentifier `json:"containerIdentifier"`
+
+	// Node is the Node of the member Pod, whose Checkpointer checkpoints the container.
+	Node string `json:"node"`
+
+	// CheckpointIdentifier is the tracking handle of the member checkpoint, empty until it is requested.
+	CheckpointIdentifier string `json:"checkpointIdentifier,omitempty"`
+
+	Phase              checkpoint.Phase        `json:"phase,omitempty"`
+	ContainerImageName string                  `json:"containerImageName,omitempty"`
+	Hooks              []checkpoint.HookResult `json:"hooks,omitempty"`
+
+	// Error is the reason the member failed the group checkpoint.
+	Error *checkpoint.CheckpointError `json:"error,omitempty"`
+
+	// StopError is the error that occurred while deleting the member Pod, it does not fail the group checkpoint.
+	StopError *checkpoint.CheckpointError `json:"stopError,omitempty"`
+}
+
+// InProgress reports whether the group checkpoint has not finished yet.
+func (entry *GroupEntry) InProgress() bool {
+	return !entry.Phase.Finished()
+}
+
+// GroupRecord represents a group checkpoint in CheckpointStorage, stored in the Group of a CheckpointEntry.
+type GroupRecord struct {
+	// Entry is the result of the group checkpoint.
+	Entry *GroupEntry `json:"entry,omitempty"`
+
+	// Request is the request of the group checkpoint, needed to complete it after Checkpointer restarts.
+	Request *GroupRequest `json:"request,omitempty"`
+
+	// GroupIdentifiers are the identifiers of all stored group checkpoints, set only in the record under groupIndexKey.
+	GroupIdentifiers []string `json:"groupIdentifiers,omitempty"`
+}
+
+// GroupMemberCheckpointer is responsible for checkpointing the members of a group by the Checkpointers of their Nodes.
+type GroupMemberCheckpointer interface {
+
+	// CheckpointMember requests an asynchronous checkpoint of the container of params from the Checkpointer of its Node.
+	// Returns the tracking handle of the checkpoint or error if it was not accepted.
+	CheckpointMember(ctx context.Context, params checkpoint.CheckpointerParams) (string, error)
+
+	// MemberResult returns the current entry of the member checkpoint identified by trackingHandle, including a failed
+	// one with its Error. Returns error if the result could not be read.
+	MemberResult(ctx context.Context, trackingHandle string) (*CheckpointEntry, error)
+
+	// CancelMember cancels the member checkpoint identified by trackingHandle. Returns error if it could not be
+	// cancelled, e.g. because it already finished.
+	CancelMember(ctx context.Context, trackingHandle string) error
+}
+
+// GroupCoordinator checkpoints groups of Pods, possibly spread across Nodes, at the same logical moment. It runs the
+// freeze hooks of every member first, then waits for every member to be checkpointed by Kubelet, and only then runs
+// their unfreeze hooks. The member Pods are deleted only if every member succeeded. Group checkpoints are stored in
+// CheckpointStorage whenever they enter a phase, so that they can be completed after Checkpointer restarts.
+type GroupCoordinator struct {
+	config     config.GroupConfig
+	client     kubernetes.Interface
+	members    GroupMemberCheckpointer
+	hookRunner checkpoint.HookRunner
+	podStopper checkpoint.PodStopper
+	storage    CheckpointStorage
+	node       string
+	pollPeriod time.Duration
+
+	mu     sync.Mutex
+	groups map[string]*GroupRecord
+}
+
+func NewGroupCoordinator(
+	groupConfig config.GroupConfig,
+	client kubernetes.Interface,
+	members GroupMemberCheckpointer,
+	hookRunner checkpoint.HookRunner,
+	podStopper checkpoint.PodStopper,
+	storage CheckpointStorage,
+	node string,
+) *GroupCoordinator {
+	return &GroupCoordinator{
+		config:     groupConfig,
+		client:     client,
+		members:    members,
+		hookRunner: hookRunner,
+		podStopper: podStopper,
+		storage:    storage,
+		node:       node,
+		pollPeriod: groupPollPeriod,
+		groups:     make(map[string]*GroupRecord),
+	}
+}
+
+// CheckpointGroup starts the group checkpoint of the running Pods matching request in the background. Returns the
+// GroupEntry in its first phase, ErrNoGroupMembers if no running Pod matches, or error if the Pods could not be listed
+// or the group checkpoint could not be stored.
+func (c *GroupCoordinator) CheckpointGroup(ctx context.Context, request GroupRequest) (*GroupEntry, error) {
+	selector, err := labels.Parse(request.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("malformed label selector: %w", err)
+	}
+	pods, err := c.client.CoreV1().Pods(request.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Pods: %w", err)
+	}
+	groupIdentifier, err := newCheckpointIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &GroupEntry{
+		GroupIdentifier: c.node + ":" + groupIdentifier,
+		Namespace:       request.Namespace,
+		LabelSelector:   selector.String(),
+		DeletePod:       request.DeletePod,
+		BeginTimestamp:  time.Now().Unix(),
+		Phase:           GroupPhaseFreezing,
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil || len(pod.Spec.Containers) == 0 {
+			continue
+		}
+		container := request.Container
+		if container == "" {
+			container = pod.Spec.Containers[0].Name
+		}
+		entry.Members = append(entry.Members, GroupMember{
+			ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: pod.Namespace, Pod: pod.Name, Container: container},
+			Node:                pod.Spec.NodeName,
+		})
+	}
+	if len(entry.Members) == 0 {
+		return nil, ErrNoGroupMembers
+	}
+
+	c.mu.Lock()
+	c.forgetOldestGroup()
+	c.groups[groupIdentifier] = &GroupRecord{Entry: entry, Request: &request}
+	err = c.storeGroup(groupIdentifier)
+	if err == nil {
+		err = c.storeGroupIndex()
+	}
+	if err != nil {
+		delete(c.groups, groupIdentifier)
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.mu.Unlock()
+
+	lg := log.With().Str("group", entry.GroupIdentifier).Int("members", len(entry.Members)).Logger()
+	lg.Info().Str("labelSelector", entry.LabelSelector).Msg("starting group checkpoint")
+	go c.run(lg.WithContext(context.Background()), groupIdentifier, request)
+	return c.GroupResult(groupIdentifier)
+}
+
+// GroupResult returns the current GroupEntry of the group checkpoint under groupIdentifier, or ErrEntryNotFound.
+func (c *GroupCoordinator) GroupResult(groupIdentifier string) (*GroupEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, found := c.groups[groupIdentifier]
+	if !found {
+		return nil, ErrEntryNotFound
+	}
+	entry := record.Entry
+	snapshot := *entry
+	snapshot.Members = slices.Clone(entry.Members)
+	for i := range snapshot.Members {
+		snapshot.Members[i].Hooks = slices.Clone(snapshot.Members[i].Hooks)
+	}
+	return &snapshot, nil
+}
+
+// forgetOldestGroup forgets the oldest finished group checkpoint once maxGroupEntries is reached, including its record
+// in storage. Has to be called with mu locked.
+func (c *GroupCoordinator) forgetOldestGroup() {
+	if len(c.groups) < maxGroupEntries {
+		return
+	}
+	oldest := ""
+	for groupIdentifier, record := range c.groups {
+		if !record.Entry.InProgress() && (oldest == "" || record.Entry.BeginTimestamp < c.groups[oldest].Entry.BeginTimestamp) {
+			oldest = groupIdentifier
+		}
+	}
+	if oldest == "" {
+		return
+	}
+	delete(c.groups, oldest)
+	if err := c.storage.DeleteEntry(groupEntryKeyPrefix + oldest); err != nil {
+		log.Warn().Err(err).Str("group", c.node+":"+oldest).Msg("failed to erase forgotten group checkpoint")
+	}
+}
+
+// RecoverGroups reads the group checkpoints stored by the previous run of Checkpointer and completes the ones it
+// interrupted in the background. Members are unfrozen again in case they were frozen when Checkpointer stopped. A group
+// interrupted before every member was checkpointed fails, as its members can no longer be checkpointed at the same
+// logical moment. Should be called once on startup.
+func (c *GroupCoordinator) RecoverGroups() {
+	index, err := c.storage.ReadEntry(groupIndexKey)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read group checkpoints, interrupted group checkpoints cannot be recovered")
+		return
+	}
+	if index == nil || index.Group == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, groupIdentifier := range index.Group.GroupIdentifiers {
+		stored, err := c.storage.ReadEntry(groupEntryKeyPrefix + groupIdentifier)
+		if err != nil || stored == nil || stored.Group == nil || stored.Group.Entry == nil || stored.Group.Request == nil {
+			log.Warn().Err(err).Str("group", c.node+":"+groupIdentifier).Msg("skipping unreadable group checkpoint")
+			continue
+		}
+		record := stored.Group
+		c.groups[groupIdentifier] = record
+		if !record.Entry.InProgress() {
+			continue
+		}
+
+		lg := log.With().Str("group", record.Entry.GroupIdentifier).Int("members", len(record.Entry.Members)).Logger()
+		lg.Info().Str("phase", string(record.Entry.Phase)).Msg("resuming group checkpoint interrupted by Checkpointer restart")
+		go c.resume(lg.WithContext(context.Background()), groupIdentifier, *record.Request, record.Entry.Phase)
+	}
+}
+
+// resume completes the group checkpoint under groupIdentifier interrupted in phase.
+func (c *GroupCoordinator) resume(ctx context.Context, groupIdentifier string, request GroupRequest, phase GroupPhase) {
+	ctx, cancel := context.WithTimeout(ctx, checkpointResultWait)
+	defer cancel()
+
+	ok := true
+	c.update(groupIdentifier, func(entry *GroupEntry) {
+		for i := range entry.Members {
+			if entry.Members[i].Error != nil {
+				ok = false
+			} else if phase == GroupPhaseFreezing || phase == GroupPhaseDumping {
+				entry.Members[i].Error = checkpoint.NewCheckpointError(checkpoint.ErrorCodeCheckpointerRestarted, entry.Members[i].Phase, errGroupInterrupted)
+				ok = false
+			}
+		}
+	})
+	if phase == GroupPhaseFreezing || phase == GroupPhaseDumping {
+		phase = GroupPhaseUnfreezing
+	}
+	c.complete(ctx, groupIdentifier, request, ok, phase)
+}
+
+// run runs the group checkpoint under groupIdentifier through all its phases.
+func (c *GroupCoordinator) run(ctx context.Context, groupIdentifier string, request GroupRequest) {
+	ctx, cancel := context.WithTimeout(ctx, checkpointResultWait)
+	defer cancel()
+	lg := zerolog.Ctx(ctx)
+
+	lg.Debug().Msg("freezing group members")
+	ok := c.forEachMember(groupIdentifier, func(i int, member GroupMember) error {
+		return c.hookRunner.RunHook(ctx, c.memberParams(groupIdentifier, i, member, request), checkpoint.HookTypePre)
+	})
+	if ok {
+		c.setPhase(groupIdentifier, GroupPhaseDumping)
+		ok = c.dump(ctx, groupIdentifier, request)
+	}
+	c.complete(ctx, groupIdentifier, request, ok, GroupPhaseUnfreezing)
+}
+
+// complete runs the group checkpoint under groupIdentifier through the remaining phases from phase on, ok reporting
+// whether every member succeeded so far.
+func (c *GroupCoordinator) complete(ctx context.Context, groupIdentifier string, request GroupRequest, ok bool, phase GroupPhase) {
+	lg := zerolog.Ctx(ctx)
+
+	switch phase {
+	case GroupPhaseUnfreezing:
+		// The members are unfrozen even if freezing or dumping failed, so that the hooks can undo the freeze.
+		c.setPhase(groupIdentifier, GroupPhaseUnfreezing)
+		unfrozen := c.forEachMember(groupIdentifier, func(i int, member GroupMember) error {
+			return c.hookRunner.RunHook(context.WithoutCancel(ctx), c.memberParams(groupIdentifier, i, member, request), checkpoint.HookTypePost)
+		})
+		ok = ok && unfrozen
+		fallthrough
+	case GroupPhasePublishing:
+		c.setPhase(groupIdentifier, GroupPhasePublishing)
+		published := c.forEachMember(groupIdentifier, func(i int, member GroupMember) error {
+			if member.CheckpointIdentifier == "" {
+				return nil
+			}
+			if !ok {
+				// The members of a failed group are not consistent with each other, so they are not worth publishing.
+				if err := c.members.CancelMember(ctx, member.CheckpointIdentifier); err != nil {
+					lg.Debug().Err(err).Str("checkpointIdentifier", member.CheckpointIdentifier).Msg("could not cancel member checkpoint")
+				}
+			}
+			return c.awaitMember(ctx, groupIdentifier, i, member.CheckpointIdentifier, func(entry *CheckpointEntry) bool {
+				return !entry.InProgress()
+			})
+		})
+		ok = ok && published
+		fallthrough
+	case GroupPhaseDeletingPods:
+		if ok && request.DeletePod {
+			c.setPhase(groupIdentifier, GroupPhaseDeletingPods)
+			c.deletePods(ctx, groupIdentifier)
+		}
+	}
+	c.finish(groupIdentifier, ok)
+}
+
+// dump requests the checkpoints of all members and waits until Kubelet checkpointed every one of them, at most
+// DumpTimeoutSeconds. Returns true if all of them were checkpointed.
+func (c *GroupCoordinator) dump(ctx context.Context, groupIdentifier string, request GroupRequest) bool {
+	dumpCtx, cancel := context.WithTimeout(ctx, time.Duration(c.config.DumpTimeoutSeconds)*time.Second)
+	defer cancel()
+	return c.forEachMember(groupIdentifier, func(i int, member GroupMember) error {
+		params := c.memberParams(groupIdentifier, i, member, request)
+		// The hooks are run by the coordinator around every member at once, not by the member checkpoints.
+		params.Hooks = &checkpoint.Hooks{}
+		trackingHandle, err := c.members.CheckpointMember(dumpCtx, params)
+		if err != nil {
+			return err
+		}
+		// The tracking handle is stored right away, so that the member can be cancelled after Checkpointer restarts.
+		c.record(groupIdentifier, func(entry *GroupEntry) {
+			entry.Members[i].CheckpointIdentifier = trackingHandle
+			entry.Members[i].Phase = checkpoint.PhaseQueued
+		})
+		return c.awaitMember(dumpCtx, groupIdentifier, i, trackingHandle, dumped)
+	})
+}
+
+// dumped reports whether Kubelet already checkpointed the container of the member checkpoint entry. The Kaniko Pod is
+// created either before the container is checkpointed or after its build context is prepared.
+func dumped(entry *CheckpointEntry) bool {
+	switch entry.Phase {
+	case checkpoint.PhaseQueued, checkpoint.PhaseCheckpointingContainer:
+		return false
+	case checkpoint.PhaseCreatingBuilder:
+		return slices.ContainsFunc(entry.PhaseTransitions, func(transition PhaseTransition) bool {
+			return transition.Phase == checkpoint.PhaseBuildingContext
+		})
+	}
+	return true
+}
+
+// awaitMember reads the result of the member checkpoint under trackingHandle until done reports true. Returns the
+// error of the member checkpoint if it failed, or error if ctx is done first.
+func (c *GroupCoordinator) awaitMember(ctx context.Context, groupIdentifier string, i int, trackingHandle string, done func(entry *CheckpointEntry) bool) error {
+	for {
+		entry, err := c.members.MemberResult(ctx, trackingHandle)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("checkpointIdentifier", trackingHandle).Msg("could not read member checkpoint result")
+		} else {
+			c.update(groupIdentifier, func(group *GroupEntry) {
+				group.Members[i].Phase = entry.Phase
+				group.Members[i].ContainerImageName = entry.ContainerImageName
+			})
+			if entry.Error != nil {
+				return entry.Error
+			}
+			if done(entry) {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("member checkpoint did not proceed in time: %w", ctx.Err())
+		case <-time.After(c.pollPeriod):
+		}
+	}
+}
+
+// deletePods deletes the Pods of all members one by one, skipping the ones already deleted before Checkpointer
+// restarted. Failing to delete a Pod does not fail the group checkpoint.
+func (c *GroupCoordinator) deletePods(ctx context.Context, groupIdentifier string) {
+	group, _ := c.GroupResult(groupIdentifier)
+	for i, member := range group.Members {
+		_, err := c.client.CoreV1().Pods(member.ContainerIdentifier.Namespace).Get(ctx, member.ContainerIdentifier.Pod, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if _, err := c.podStopper.StopPod(ctx, member.ContainerIdentifier, checkpoint.StopPolicyDelete); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("containerIdentifier", member.ContainerIdentifier.String()).Msg("could not delete member Pod")
+			c.update(groupIdentifier, func(entry *GroupEntry) {
+				entry.Members[i].StopError = checkpoint.NewCheckpointError(checkpoint.ErrorCodePodDeleteFailed, checkpoint.PhaseDeletingPod, err)
+			})
+		}
+	}
+}
+
+// forEachMember calls fn for every member of the group at once and records the errors it returns in the members.
+// Returns true if fn succeeded for every member.
+func (c *GroupCoordinator) forEachMember(groupIdentifier string, fn func(i int, member GroupMember) error) bool {
+	group, _ := c.GroupResult(groupIdentifier)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i, member := range group.Members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fn(i, member)
+			if err == nil {
+				return
+			}
+			failed.Store(true)
+			c.update(groupIdentifier, func(entry *GroupEntry) {
+				// The first error of the member is its cause, later ones are its consequences.
+				if entry.Members[i].Error == nil {
+					entry.Members[i].Error = checkpoint.AsCheckpointError(err, entry.Members[i].Phase)
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	return !failed.Load()
+}
+
+// memberParams returns the parameters of the checkpoint of the i-th member of the group.
+func (c *GroupCoordinator) memberParams(groupIdentifier string, i int, member GroupMember, request GroupRequest) checkpoint.CheckpointerParams {
+	memberLabels := maps.Clone(request.Labels)
+	if memberLabels == nil {
+		memberLabels = make(map[string]string)
+	}
+	memberLabels[GroupLabel] = groupIdentifier
+	return checkpoint.CheckpointerParams{
+		ContainerIdentifier:  member.ContainerIdentifier,
+		StopPolicy:           checkpoint.StopPolicyNone,
+		CheckpointIdentifier: fmt.Sprintf("%s-%d", groupIdentifier, i),
+		Priority:             request.Priority,
+		Labels:               memberLabels,
+		Hooks:                request.Hooks,
+		OnHookResult: func(result checkpoint.HookResult) {
+			c.update(groupIdentifier, func(entry *GroupEntry) {
+				entry.Members[i].Hooks = append(entry.Members[i].Hooks, result)
+			})
+		},
+	}
+}
+
+// setPhase records that the group checkpoint entered phase.
+func (c *GroupCoordinator) setPhase(groupIdentifier string, phase GroupPhase) {
+	c.record(groupIdentifier, func(entry *GroupEntry) {
+		entry.Phase = phase
+	})
+}
+
+// finish records the final phase of the group checkpoint.
+func (c *GroupCoordinator) finish(groupIdentifier string, ok bool) {
+	c.record(groupIdentifier, func(entry *GroupEntry) {
+		entry.EndTimestamp = time.Now().Unix()
+		if ok {
+			entry.Phase = GroupPhaseSucceeded
+			log.Info().Str("group", entry.GroupIdentifier).Msg("group checkpoint succeeded")
+			return
+		}
+		failed := 0
+		for _, member := range entry.Members {
+			if member.Error != nil {
+				failed++
+			}
+		}
+		entry.Phase = GroupPhaseFailed
+		entry.Error = fmt.Sprintf("%d of %d members did not succeed", failed, len(entry.Members))
+		if entry.DeletePod {
+			entry.Error += ", no Pod was deleted"
+		}
+		log.Warn().Str("group", entry.GroupIdentifier).Msg("group checkpoint failed: " + entry.Error)
+	})
+}
+
+// update applies fn to the entry of the group checkpoint under groupIdentifier.
+func (c *GroupCoordinator) update(groupIdentifier string, fn func(entry *GroupEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if record, found := c.groups[groupIdentifier]; found {
+		fn(record.Entry)
+	}
+}
+
+// record applies fn to the entry of the group checkpoint under groupIdentifier and stores it. Failing to store it
+// does not fail the group checkpoint, only its recovery after Checkpointer restarts.
+func (c *GroupCoordinator) record(groupIdentifier string, fn func(entry *GroupEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if record, found := c.groups[groupIdentifier]; found {
+		fn(record.Entry)
+		if err := c.storeGroup(groupIdentifier); err != nil {
+			log.Warn().Err(err).Str("group", record.Entry.GroupIdentifier).Msg("failed to store group checkpoint")
+		}
+	}
+}
+
+// storeGroup stores the group checkpoint under groupIdentifier. Has to be called with mu locked.
+func (c *GroupCoordinator) storeGroup(groupIdentifier string) error {
+	return c.storage.StoreEntry(groupEntryKeyPrefix+groupIdentifier, CheckpointEntry{
+		CheckpointIdentifier: groupIdentifier,
+		Group:                c.groups[groupIdentifier],
+	})
+}
+
+// storeGroupIndex stores the identifiers of all group checkpoints, so that they can be read after Checkpointer
+// restarts. Has to be called with mu locked.
+func (c *GroupCoordinator) storeGroupIndex() error {
+	groupIdentifiers := make([]string, 0, len(c.groups))
+	for groupIdentifier := range c.groups {
+		groupIdentifiers = append(groupIdentifiers, groupIdentifier)
+	}
+	slices.Sort(groupIdentifiers)
+	return c.storage.StoreEntry(groupIndexKey, CheckpointEntry{Group: &GroupRecord{GroupIdentifiers: groupIdentifiers}})
+}
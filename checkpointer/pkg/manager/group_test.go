@@ -0,0 +1,267 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"errors"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// groupCalls records the calls of mockHookRunner and mockMemberCheckpointer in the order they happened.
+type groupCalls struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (g *groupCalls) record(call string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls = append(g.calls, call)
+}
+
+type mockHookRunner struct {
+	*groupCalls
+}
+
+func (m mockHookRunner) RunHook(_ context.Context, params checkpoint.CheckpointerParams, hookType checkpoint.HookType) error {
+	m.record(string(hookType) + ":" + params.ContainerIdentifier.Pod)
+	params.OnHookResult(checkpoint.HookResult{Type: hookType, Command: []string{"sync"}})
+	return nil
+}
+
+// mockMemberCheckpointer dumps the members right away and finishes them on the next read of their result. Members in
+// failing Pods fail as if Kubelet could not find the container.
+type mockMemberCheckpointer struct {
+	*groupCalls
+	failing map[string]bool
+	entries map[string]*CheckpointEntry
+}
+
+func (m mockMemberCheckpointer) CheckpointMember(_ context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	m.record("dump:" + params.ContainerIdentifier.Pod)
+	if params.Labels[GroupLabel] == "" || params.StopPolicy != checkpoint.StopPolicyNone || params.Hooks == nil || params.Hooks.Pre != nil {
+		return "", fmt.Errorf("member checkpoint is malformed: %+v", params)
+	}
+	trackingHandle := "node:" + params.CheckpointIdentifier
+	entry := &CheckpointEntry{CheckpointIdentifier: trackingHandle, ContainerIdentifier: params.ContainerIdentifier, Phase: checkpoint.PhaseBuildingContext}
+	if m.failing[params.ContainerIdentifier.Pod] {
+		entry.Phase = checkpoint.PhaseFailed
+		entry.Error = checkpoint.AsCheckpointError(internal.ErrContainerNotFound, checkpoint.PhaseCheckpointingContainer)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[trackingHandle] = entry
+	return trackingHandle, nil
+}
+
+func (m mockMemberCheckpointer) MemberResult(_ context.Context, trackingHandle string) (*CheckpointEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := *m.entries[trackingHandle]
+	if entry.Phase == checkpoint.PhaseBuildingContext {
+		m.entries[trackingHandle].Phase = checkpoint.PhaseSucceeded
+		m.entries[trackingHandle].ContainerImageName = "quay.io/checkpointed"
+	}
+	return &entry, nil
+}
+
+func (m mockMemberCheckpointer) CancelMember(_ context.Context, trackingHandle string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry := m.entries[trackingHandle]; entry.InProgress() {
+		entry.Phase = checkpoint.PhaseCancelled
+		entry.Error = checkpoint.NewCheckpointError(checkpoint.ErrorCodeCancelled, checkpoint.PhaseBuildingContext, ErrCheckpointCancelled)
+		return nil
+	}
+	return ErrNotCancellable
+}
+
+func newTestGroupMember(name, node string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns", Labels: map[string]string{"app": "notebook"}},
+		Spec:       v1.PodSpec{NodeName: node, Containers: []v1.Container{{Name: "ctrn"}}},
+		Status:     v1.PodStatus{Phase: phase},
+	}
+}
+
+func newTestGroupCoordinator(failing ...string) (*GroupCoordinator, *groupCalls, *mockPodStopper, *syncStorage) {
+	calls := &groupCalls{}
+	members := mockMemberCheckpointer{calls, make(map[string]bool), make(map[string]*CheckpointEntry)}
+	for _, pod := range failing {
+		members.failing[pod] = true
+	}
+	client := fake.NewSimpleClientset(
+		newTestGroupMember("database", "node-a", v1.PodRunning),
+		newTestGroupMember("notebook", "node-b", v1.PodRunning),
+		newTestGroupMember("pending", "", v1.PodPending),
+	)
+	podStopper := &mockPodStopper{}
+	storage := &syncStorage{storage: make(map[string]CheckpointEntry)}
+	c := NewGroupCoordinator(config.GroupConfig{DumpTimeoutSeconds: 5}, client, members, mockHookRunner{calls}, podStopper, storage, "node")
+	c.pollPeriod = time.Millisecond
+	return c, calls, podStopper, storage
+}
+
+func awaitGroup(t *testing.T, c *GroupCoordinator, groupIdentifier string) *GroupEntry {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		entry, err := c.GroupResult(groupIdentifier[len("node:"):])
+		if err != nil {
+			t.Fatalf("GroupResult() error = %v", err)
+		}
+		if !entry.InProgress() {
+			return entry
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("group checkpoint did not finish in time")
+	return nil
+}
+
+func Test_GroupCoordinator_CheckpointGroup(t *testing.T) {
+	c, calls, podStopper, _ := newTestGroupCoordinator()
+
+	entry, err := c.CheckpointGroup(context.TODO(), GroupRequest{Namespace: "ns", LabelSelector: "app=notebook", DeletePod: true})
+	if err != nil {
+		t.Fatalf("CheckpointGroup() error = %v", err)
+	}
+	if len(entry.Members) != 2 {
+		t.Fatalf("only running Pods should be members, got: %+v", entry.Members)
+	}
+	entry = awaitGroup(t, c, entry.GroupIdentifier)
+	if entry.Phase != GroupPhaseSucceeded || entry.Error != "" {
+		t.Fatalf("group checkpoint should succeed, got: %+v", entry)
+	}
+	for _, member := range entry.Members {
+		if member.Phase != checkpoint.PhaseSucceeded || member.ContainerImageName == "" || len(member.Hooks) != 2 || member.Error != nil {
+			t.Fatalf("member should succeed between its hooks, got: %+v", member)
+		}
+	}
+	if !podStopper.stopped {
+		t.Fatal("member Pods should be deleted once every member succeeded")
+	}
+
+	// Every member is frozen before any is dumped, and every member is dumped before any is unfrozen.
+	stages := map[string]int{"pre": 0, "dump": 1, "post": 2}
+	last := 0
+	for _, call := range calls.calls {
+		stage := stages[strings.Split(call, ":")[0]]
+		if stage < last {
+			t.Fatalf("group checkpoint should pass the barrier in order, got: %v", calls.calls)
+		}
+		last = stage
+	}
+}
+
+func Test_GroupCoordinator_CheckpointGroup_AllOrNothing(t *testing.T) {
+	c, calls, podStopper, _ := newTestGroupCoordinator("notebook")
+
+	entry, err := c.CheckpointGroup(context.TODO(), GroupRequest{Namespace: "ns", LabelSelector: "app=notebook", DeletePod: true})
+	if err != nil {
+		t.Fatalf("CheckpointGroup() error = %v", err)
+	}
+	entry = awaitGroup(t, c, entry.GroupIdentifier)
+	if entry.Phase != GroupPhaseFailed || !strings.Contains(entry.Error, "no Pod was deleted") {
+		t.Fatalf("group checkpoint should fail, got: %+v", entry)
+	}
+	if podStopper.stopped {
+		t.Fatal("no member Pod should be deleted when any member failed")
+	}
+	for _, member := range entry.Members {
+		if member.ContainerIdentifier.Pod == "notebook" && (member.Error == nil || member.Error.Code != checkpoint.ErrorCodeContainerNotFound) {
+			t.Fatalf("failed member should record its error, got: %+v", member)
+		}
+		if len(member.Hooks) != 2 {
+			t.Fatalf("every member should be unfrozen even when the group failed, got: %+v", member)
+		}
+	}
+	if len(calls.calls) != 6 {
+		t.Fatalf("every member should be frozen, dumped and unfrozen once, got: %v", calls.calls)
+	}
+}
+
+func Test_GroupCoordinator_CheckpointGroup_NoMembers(t *testing.T) {
+	c, _, _, _ := newTestGroupCoordinator()
+
+	if _, err := c.CheckpointGroup(context.TODO(), GroupRequest{Namespace: "ns", LabelSelector: "app=database"}); !errors.Is(err, ErrNoGroupMembers) {
+		t.Fatalf("CheckpointGroup() error = %v, want %v", err, ErrNoGroupMembers)
+	}
+}
+
+func Test_dumped(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    CheckpointEntry
+		expected bool
+	}{
+		{"Queued", CheckpointEntry{Phase: checkpoint.PhaseQueued}, false},
+		{"CheckpointingContainer", CheckpointEntry{Phase: checkpoint.PhaseCheckpointingContainer}, false},
+		{"builder created first", CheckpointEntry{Phase: checkpoint.PhaseCreatingBuilder}, false},
+		{"builder created after build context", CheckpointEntry{
+			Phase:            checkpoint.PhaseCreatingBuilder,
+			PhaseTransitions: []PhaseTransition{{Phase: checkpoint.PhaseBuildingContext}, {Phase: checkpoint.PhaseCreatingBuilder}},
+		}, true},
+		{"BuildingContext", CheckpointEntry{Phase: checkpoint.PhaseBuildingContext}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dumped(&tt.entry); got != tt.expected {
+				t.Fatalf("dumped() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_GroupCoordinator_RecoverGroups(t *testing.T) {
+	c, calls, _, storage := newTestGroupCoordinator()
+
+	entry, err := c.CheckpointGroup(context.TODO(), GroupRequest{Namespace: "ns", LabelSelector: "app=notebook", DeletePod: true})
+	if err != nil {
+		t.Fatalf("CheckpointGroup() error = %v", err)
+	}
+	entry = awaitGroup(t, c, entry.GroupIdentifier)
+	groupIdentifier := entry.GroupIdentifier[len("node:"):]
+
+	// The group is stored as if Checkpointer restarted while its members were frozen and being dumped.
+	interrupted := *entry
+	interrupted.Phase = GroupPhaseDumping
+	interrupted.EndTimestamp = 0
+	interrupted.Members = []GroupMember{entry.Members[0], entry.Members[1]}
+	interrupted.Members[1].CheckpointIdentifier = ""
+	for i := range interrupted.Members {
+		interrupted.Members[i].Phase = checkpoint.PhaseQueued
+		interrupted.Members[i].Hooks = nil
+	}
+	stored, _ := storage.ReadEntry(groupEntryKeyPrefix + groupIdentifier)
+	storage.StoreEntry(groupEntryKeyPrefix+groupIdentifier, CheckpointEntry{Group: &GroupRecord{Entry: &interrupted, Request: stored.Group.Request}})
+	calls.calls = nil
+
+	podStopper := &mockPodStopper{}
+	recovered := NewGroupCoordinator(c.config, c.client, c.members, c.hookRunner, podStopper, storage, "node")
+	recovered.pollPeriod = time.Millisecond
+	recovered.RecoverGroups()
+	entry = awaitGroup(t, recovered, entry.GroupIdentifier)
+	if entry.Phase != GroupPhaseFailed || podStopper.stopped {
+		t.Fatalf("group interrupted before every member was dumped should fail without deleting Pods, got: %+v", entry)
+	}
+	for _, member := range entry.Members {
+		if member.Error == nil || member.Error.Code != checkpoint.ErrorCodeCheckpointerRestarted || len(member.Hooks) != 1 {
+			t.Fatalf("interrupted member should be unfrozen and fail, got: %+v", member)
+		}
+	}
+	if len(calls.calls) != 2 || !strings.HasPrefix(calls.calls[0], "post:") || !strings.HasPrefix(calls.calls[1], "post:") {
+		t.Fatalf("only the post hooks should be run again, got: %v", calls.calls)
+	}
+	if stored, _ := storage.ReadEntry(groupEntryKeyPrefix + groupIdentifier); stored.Group.Entry.Phase != GroupPhaseFailed {
+		t.Fatalf("recovered group checkpoint should be stored, got: %+v", stored.Group.Entry)
+	}
+}
@@ -0,0 +1,400 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// IdleCheckpointAnnotation opts the Pod into being checkpointed and deleted once it stays idle, its value is "true".
+	IdleCheckpointAnnotation = "checkpoint.k8s/idle-checkpoint"
+
+	// IdleContainerAnnotation selects the container whose CPU usage decides whether the Pod is idle and which is
+	// checkpointed, the first container of the Pod by default.
+	IdleContainerAnnotation = "checkpoint.k8s/idle-container"
+
+	// IdleLabel marks the checkpoints of idle Pods, its value is "true".
+	IdleLabel = "checkpoint.k8s/idle"
+)
+
+// IdleReport represents the idleness of a Pod opted into idle checkpoints.
+type IdleReport struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+
+	// CPUMillicores is the last read CPU usage of the container.
+	CPUMillicores int64 `json:"cpuMillicores"`
+
+	// NetworkBytesPerSecond is the network traffic of the Pod between the last two readings, -1 if unknown yet.
+	NetworkBytesPerSecond int64 `json:"networkBytesPerSecond"`
+
+	// IdleSince is a Unix timestamp representing the time the Pod became idle, 0 if the Pod is busy.
+	IdleSince int64 `json:"idleSince,omitempty"`
+
+	// Due is true once the Pod stayed idle for the whole window, so that it is checkpointed and deleted unless the
+	// detector runs in dry run or within an exclusion window.
+	Due bool `json:"due"`
+
+	// CheckpointIdentifier is the tracking handle of the checkpoint of the idle Pod, once requested.
+	CheckpointIdentifier string `json:"checkpointIdentifier,omitempty"`
+}
+
+// idlePod represents the readings of a Pod opted into idle checkpoints.
+type idlePod struct {
+	report IdleReport
+
+	// networkBytes is the network traffic of the Pod since its creation at networkTime, as last read.
+	networkBytes uint64
+	networkTime  time.Time
+
+	// checkpointing is true while the checkpoint of the Pod is in progress.
+	checkpointing bool
+}
+
+// IdleDetector checkpoints and deletes the Pods annotated with IdleCheckpointAnnotation on the Node of this
+// Checkpointer once their CPU usage and network traffic, read from Kubelet, stay under the thresholds for the
+// configured window.
+type IdleDetector struct {
+	config  config.IdleConfig
+	manager CheckpointManager
+	client  kubernetes.Interface
+	stats   internal.KubeletStatsReader
+	node    string
+
+	// exclusionWindows are the parsed config.IdleConfig.ExclusionWindows.
+	exclusionWindows []exclusionWindow
+
+	// mu guards pods.
+	mu sync.Mutex
+
+	// pods holds the Pods opted into idle checkpoints keyed by their UID.
+	pods map[types.UID]*idlePod
+}
+
+// NewIdleDetector constructs IdleDetector of the Checkpointer of checkpointerNode. Malformed exclusion windows are
+// reported and ignored.
+func NewIdleDetector(idleConfig config.IdleConfig, checkpointManager CheckpointManager, client kubernetes.Interface, stats internal.KubeletStatsReader, checkpointerNode string) *IdleDetector {
+	var exclusionWindows []exclusionWindow
+	for _, value := range idleConfig.ExclusionWindows {
+		window, err := parseExclusionWindow(value)
+		if err != nil {
+			log.Warn().Err(err).Msg("ignoring malformed idle exclusion window")
+			continue
+		}
+		exclusionWindows = append(exclusionWindows, window)
+	}
+	return &IdleDetector{
+		config:           idleConfig,
+		manager:          checkpointManager,
+		client:           client,
+		stats:            stats,
+		node:             checkpointerNode,
+		exclusionWindows: exclusionWindows,
+		pods:             make(map[types.UID]*idlePod),
+	}
+}
+
+// Run reads the resource usage every config.IdleConfig.IntervalSeconds and checkpoints the idle Pods until ctx is
+// done.
+func (d *IdleDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(d.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	log.Info().Bool("dryRun", d.config.DryRun).Msg("detecting idle Pods")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.detect(ctx, now)
+		}
+	}
+}
+
+// Report returns the idleness of the Pods opted into idle checkpoints, ordered by namespace and name.
+func (d *IdleDetector) Report() []IdleReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reports := make([]IdleReport, 0, len(d.pods))
+	for _, pod := range d.pods {
+		reports = append(reports, pod.report)
+	}
+	slices.SortFunc(reports, func(a, b IdleReport) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Pod, b.Pod))
+	})
+	return reports
+}
+
+// detect reads the resource usage of the Pods opted into idle checkpoints at now and checkpoints the ones which
+// stayed idle for the whole window.
+func (d *IdleDetector) detect(ctx context.Context, now time.Time) {
+	pods, err := d.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", d.node).String(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list Pods for idle detection")
+		return
+	}
+	optedIn := make(map[types.UID]v1.Pod)
+	for _, pod := range pods.Items {
+		if pod.Annotations[IdleCheckpointAnnotation] == "true" && pod.DeletionTimestamp == nil && pod.Status.Phase == v1.PodRunning && len(pod.Spec.Containers) > 0 {
+			optedIn[pod.UID] = pod
+		}
+	}
+
+	summary, err := d.stats.CallKubeletStatsSummary(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read resource usage from Kubelet")
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := make(map[types.UID]bool)
+	var due []types.UID
+	for _, podStats := range summary.Pods {
+		uid := types.UID(podStats.PodRef.UID)
+		pod, found := optedIn[uid]
+		if !found {
+			continue
+		}
+		seen[uid] = true
+		if d.observe(uid, pod, podStats, now) {
+			due = append(due, uid)
+		}
+	}
+	for uid, pod := range d.pods {
+		if !seen[uid] && !pod.checkpointing {
+			delete(d.pods, uid)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	if d.excluded(now) {
+		log.Debug().Int("idle", len(due)).Msg("within idle exclusion window, not checkpointing idle Pods")
+		return
+	}
+	for _, uid := range due {
+		d.checkpoint(ctx, uid)
+	}
+}
+
+// observe updates the readings of the Pod with uid by podStats read at now. Returns true if the Pod is due to be
+// checkpointed, i.e. it stayed idle for the whole window and is not being checkpointed already.
+func (d *IdleDetector) observe(uid types.UID, pod v1.Pod, podStats internal.PodStats, now time.Time) bool {
+	container := pod.Annotations[IdleContainerAnnotation]
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+	idle := d.pods[uid]
+	if idle == nil {
+		idle = &idlePod{report: IdleReport{Namespace: pod.Namespace, Pod: pod.Name, NetworkBytesPerSecond: -1}}
+		d.pods[uid] = idle
+	}
+	idle.report.Container = container
+
+	cpuKnown := false
+	for _, containerStats := range podStats.Containers {
+		if containerStats.Name == container && containerStats.CPU != nil && containerStats.CPU.UsageNanoCores != nil {
+			idle.report.CPUMillicores = int64(*containerStats.CPU.UsageNanoCores / 1_000_000)
+			cpuKnown = true
+		}
+	}
+	// Pods in the host network namespace have no network readings, their network traffic is not considered.
+	networkIdle := true
+	if network := podStats.Network; network != nil && network.RxBytes != nil && network.TxBytes != nil {
+		networkBytes := *network.RxBytes + *network.TxBytes
+		switch elapsed := network.Time.Sub(idle.networkTime).Seconds(); {
+		case idle.networkTime.IsZero() || networkBytes < idle.networkBytes:
+			// The first reading, or the counters were reset, the traffic is unknown until the next reading.
+			idle.report.NetworkBytesPerSecond = -1
+		case elapsed > 0:
+			idle.report.NetworkBytesPerSecond = int64(float64(networkBytes-idle.networkBytes) / elapsed)
+		}
+		// Kubelet might not have read the network traffic again since the last reading, the last rate is kept then.
+		idle.networkBytes, idle.networkTime = networkBytes, network.Time
+		networkIdle = idle.report.NetworkBytesPerSecond >= 0 && idle.report.NetworkBytesPerSecond < d.config.NetworkThresholdBytes
+	}
+
+	if !cpuKnown || idle.report.CPUMillicores >= d.config.CPUThresholdMillicores || !networkIdle {
+		idle.report.IdleSince, idle.report.Due = 0, false
+		return false
+	}
+	if idle.report.IdleSince == 0 {
+		idle.report.IdleSince = now.Unix()
+	}
+	wasDue := idle.report.Due
+	idle.report.Due = now.Unix()-idle.report.IdleSince >= d.config.WindowSeconds
+	if idle.report.Due && !wasDue && d.config.DryRun {
+		log.Info().Str("namespace", pod.Namespace).Str("pod", pod.Name).Int64("idleSince", idle.report.IdleSince).Msg("idle Pod would be checkpointed and deleted, dry run")
+	}
+	return idle.report.Due && !idle.checkpointing && !d.config.DryRun
+}
+
+// excluded reports whether now is within any exclusion window.
+func (d *IdleDetector) excluded(now time.Time) bool {
+	for _, window := range d.exclusionWindows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpoint requests the checkpoint of the idle Pod with uid which deletes the Pod, and waits for its result in the
+// background. If the checkpoint cannot be requested or fails, the Pod has to stay idle for the whole window again.
+// Expects mu to be held.
+func (d *IdleDetector) checkpoint(ctx context.Context, uid types.UID) {
+	idle := d.pods[uid]
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: idle.report.Namespace, Pod: idle.report.Pod, Container: idle.report.Container}
+	lg := log.With().Str("containerIdentifier", containerIdentifier.String()).Logger()
+	ctx = lg.WithContext(ctx)
+
+	checkpointIdentifier, err := newCheckpointIdentifier()
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to generate checkpoint identifier")
+		return
+	}
+	_, err = d.manager.Checkpoint(ctx, true, checkpoint.CheckpointerParams{
+		ContainerIdentifier:  containerIdentifier,
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: checkpointIdentifier,
+		Labels:               map[string]string{IdleLabel: "true"},
+	})
+	var duplicateErr *DuplicateCheckpointError
+	var queueFullErr *QueueFullError
+	switch {
+	case errors.As(err, &duplicateErr), errors.As(err, &queueFullErr):
+		lg.Info().Err(err).Msg("idle Pod not checkpointed, trying again later")
+		return
+	case err != nil:
+		lg.Error().Err(err).Msg("failed to checkpoint idle Pod")
+		idle.report.IdleSince, idle.report.Due = 0, false
+		return
+	}
+	lg.Info().Str("checkpointIdentifier", checkpointIdentifier).Int64("idleSince", idle.report.IdleSince).Msg("checkpointing and deleting idle Pod")
+	idle.checkpointing = true
+	idle.report.CheckpointIdentifier = d.node + ":" + checkpointIdentifier
+
+	go func() {
+		entry := awaitCheckpointResult(context.WithoutCancel(ctx), d.manager, checkpointIdentifier, checkpointResultTimeout)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		idle.checkpointing = false
+		if entry == nil || entry.Phase != checkpoint.PhaseSucceeded {
+			zerolog.Ctx(ctx).Error().Str("checkpointIdentifier", checkpointIdentifier).Msg("checkpoint of idle Pod failed")
+			idle.report.IdleSince, idle.report.Due = 0, false
+		}
+	}()
+}
+
+// exclusionWindow represents a time of day idle Pods are never checkpointed, on some days of the week.
+type exclusionWindow struct {
+	// weekdays holds the days of the week the window begins on.
+	weekdays [7]bool
+
+	// start and end are the times of day the window begins and ends, as time since midnight. If end is not after
+	// start, the window ends on the next day.
+	start, end time.Duration
+}
+
+// parseExclusionWindow parses the exclusion window from "[<day>[-<day>]] <hh:mm>-<hh:mm>", e.g. "Mon-Fri 09:00-17:00"
+// or "22:00-06:00". The window applies to every day if the days are omitted. Returns error if value is malformed.
+func parseExclusionWindow(value string) (exclusionWindow, error) {
+	var window exclusionWindow
+	parts := strings.Fields(value)
+	if len(parts) == 0 || len(parts) > 2 {
+		return window, fmt.Errorf("malformed exclusion window %q, expected e.g. 'Mon-Fri 09:00-17:00'", value)
+	}
+
+	if len(parts) == 1 {
+		for day := range window.weekdays {
+			window.weekdays[day] = true
+		}
+	} else {
+		first, last, isRange := strings.Cut(parts[0], "-")
+		if !isRange {
+			last = first
+		}
+		firstDay, err := parseWeekday(first)
+		if err != nil {
+			return window, fmt.Errorf("malformed exclusion window %q: %w", value, err)
+		}
+		lastDay, err := parseWeekday(last)
+		if err != nil {
+			return window, fmt.Errorf("malformed exclusion window %q: %w", value, err)
+		}
+		for day := firstDay; ; day = (day + 1) % 7 {
+			window.weekdays[day] = true
+			if day == lastDay {
+				break
+			}
+		}
+	}
+
+	start, end, isRange := strings.Cut(parts[len(parts)-1], "-")
+	if !isRange {
+		return window, fmt.Errorf("malformed exclusion window %q, expected time range e.g. '09:00-17:00'", value)
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(start); err != nil {
+		return window, fmt.Errorf("malformed exclusion window %q: %w", value, err)
+	}
+	if window.end, err = parseTimeOfDay(end); err != nil {
+		return window, fmt.Errorf("malformed exclusion window %q: %w", value, err)
+	}
+	return window, nil
+}
+
+// contains reports whether t is within the window, in the time zone of t.
+func (window exclusionWindow) contains(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if window.start < window.end {
+		return window.weekdays[t.Weekday()] && sinceMidnight >= window.start && sinceMidnight < window.end
+	}
+	if sinceMidnight >= window.start {
+		return window.weekdays[t.Weekday()]
+	}
+	// The part after midnight belongs to the window which began the day before.
+	return sinceMidnight < window.end && window.weekdays[(t.Weekday()+6)%7]
+}
+
+// parseWeekday parses the three-letter English abbreviation of a day of the week, e.g. "Mon".
+func parseWeekday(value string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String()[:3], value) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day of week %q", value)
+}
+
+// parseTimeOfDay parses "hh:mm" as time since midnight, "24:00" is the end of the day.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	if value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("malformed time of day %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,163 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+type mockStatsReader struct {
+	cpuNanoCores uint64
+	networkBytes uint64
+	now          time.Time
+}
+
+func (m *mockStatsReader) CallKubeletStatsSummary(_ context.Context) (*internal.StatsSummary, error) {
+	cpu, networkBytes := m.cpuNanoCores, m.networkBytes
+	return &internal.StatsSummary{Pods: []internal.PodStats{{
+		PodRef:     internal.PodReference{Name: "pod", Namespace: "ns", UID: "uid"},
+		Containers: []internal.ContainerStats{{Name: "ctrn", CPU: &internal.CPUStats{Time: m.now, UsageNanoCores: &cpu}}},
+		Network:    &internal.NetworkStats{Time: m.now, RxBytes: &networkBytes, TxBytes: new(uint64)},
+	}}}, nil
+}
+
+func newTestIdleDetector(idleConfig config.IdleConfig) (*IdleDetector, *mockStatsReader, mockStorage, *mockPodStopper) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	podStopper := &mockPodStopper{}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            podStopper,
+		verifier:              mockVerifier{},
+		checkpointStorage:     storage,
+		checkpointerNode:      "node",
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns", UID: "uid", Annotations: map[string]string{IdleCheckpointAnnotation: "true"}},
+		Spec:       v1.PodSpec{NodeName: "node", Containers: []v1.Container{{Name: "ctrn"}}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	stats := &mockStatsReader{}
+	idleConfig.Enabled, idleConfig.WindowSeconds, idleConfig.CPUThresholdMillicores, idleConfig.NetworkThresholdBytes = true, 60, 10, 1024
+	return NewIdleDetector(idleConfig, manager, fake.NewSimpleClientset(pod), stats, "node"), stats, storage, podStopper
+}
+
+// detectAt reads the usage at offset seconds from the beginning of the test, the network traffic of the Pod growing
+// by networkBytesPerSecond.
+func detectAt(d *IdleDetector, stats *mockStatsReader, begin time.Time, offset int64, cpuMillicores, networkBytesPerSecond uint64) IdleReport {
+	now := begin.Add(time.Duration(offset) * time.Second)
+	stats.networkBytes += networkBytesPerSecond * uint64(now.Sub(stats.now).Seconds())
+	stats.cpuNanoCores, stats.now = cpuMillicores*1_000_000, now
+	d.detect(context.TODO(), now)
+	return d.Report()[0]
+}
+
+func Test_IdleDetector_detect(t *testing.T) {
+	d, stats, storage, podStopper := newTestIdleDetector(config.IdleConfig{})
+	begin := time.Date(2024, 12, 16, 12, 0, 0, 0, time.UTC)
+	stats.now = begin
+
+	// The network traffic is unknown until the second reading.
+	if report := detectAt(d, stats, begin, 0, 2, 0); report.IdleSince != 0 || report.NetworkBytesPerSecond != -1 {
+		t.Fatalf("Pod should not be idle before its network traffic is known, got: %+v", report)
+	}
+	if report := detectAt(d, stats, begin, 30, 2, 10); report.IdleSince != begin.Unix()+30 || report.Due {
+		t.Fatalf("Pod under thresholds should become idle, got: %+v", report)
+	}
+	if report := detectAt(d, stats, begin, 60, 2, 4096); report.IdleSince != 0 || report.NetworkBytesPerSecond != 4096 {
+		t.Fatalf("Pod with network traffic over threshold should be busy, got: %+v", report)
+	}
+	if report := detectAt(d, stats, begin, 90, 50, 0); report.IdleSince != 0 || report.CPUMillicores != 50 {
+		t.Fatalf("Pod with CPU usage over threshold should be busy, got: %+v", report)
+	}
+	detectAt(d, stats, begin, 120, 2, 0)
+	if len(storage.storage) != 0 {
+		t.Fatalf("Pod should not be checkpointed before staying idle for the window, got: %v", storage.storage)
+	}
+
+	report := detectAt(d, stats, begin, 180, 2, 0)
+	if !report.Due || report.CheckpointIdentifier == "" {
+		t.Fatalf("Pod idle for the window should be checkpointed, got: %+v", report)
+	}
+	entry, _ := d.manager.CheckpointResult(context.TODO(), report.CheckpointIdentifier[len("node:"):], 5*time.Second)
+	if entry == nil || entry.Phase != checkpoint.PhaseSucceeded || entry.StopPolicy != checkpoint.StopPolicyDelete || entry.Labels[IdleLabel] != "true" {
+		t.Fatalf("idle Pod should be checkpointed and deleted, got: %+v", entry)
+	}
+	if !podStopper.stopped {
+		t.Fatal("idle Pod should be deleted after checkpoint")
+	}
+}
+
+func Test_IdleDetector_detect_DryRun(t *testing.T) {
+	d, stats, storage, _ := newTestIdleDetector(config.IdleConfig{DryRun: true})
+	begin := time.Date(2024, 12, 16, 12, 0, 0, 0, time.UTC)
+	stats.now = begin
+
+	detectAt(d, stats, begin, 0, 2, 0)
+	detectAt(d, stats, begin, 30, 2, 0)
+	if report := detectAt(d, stats, begin, 90, 2, 0); !report.Due || report.CheckpointIdentifier != "" || len(storage.storage) != 0 {
+		t.Fatalf("idle Pod should only be reported in dry run, got: %+v", report)
+	}
+}
+
+func Test_IdleDetector_detect_ExclusionWindow(t *testing.T) {
+	d, stats, storage, _ := newTestIdleDetector(config.IdleConfig{ExclusionWindows: []string{"Mon-Fri 09:00-17:00"}})
+	// Monday noon is within the exclusion window.
+	begin := time.Date(2024, 12, 16, 12, 0, 0, 0, time.UTC)
+	stats.now = begin
+
+	detectAt(d, stats, begin, 0, 2, 0)
+	detectAt(d, stats, begin, 30, 2, 0)
+	if report := detectAt(d, stats, begin, 90, 2, 0); !report.Due || report.CheckpointIdentifier != "" || len(storage.storage) != 0 {
+		t.Fatalf("idle Pod should not be checkpointed within exclusion window, got: %+v", report)
+	}
+	// Once the window ends, the Pod still idle is checkpointed right away.
+	if report := detectAt(d, stats, begin, 5*3600, 2, 0); report.CheckpointIdentifier == "" {
+		t.Fatalf("idle Pod should be checkpointed after exclusion window, got: %+v", report)
+	}
+}
+
+func Test_parseExclusionWindow(t *testing.T) {
+	monday := time.Date(2024, 12, 16, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		window  string
+		at      time.Time
+		want    bool
+		wantErr bool
+	}{
+		{window: "Mon-Fri 09:00-17:00", at: monday.Add(9 * time.Hour), want: true},
+		{window: "Mon-Fri 09:00-17:00", at: monday.Add(17 * time.Hour), want: false},
+		{window: "Mon-Fri 09:00-17:00", at: monday.Add(-12 * time.Hour), want: false},
+		{window: "Fri-Mon 09:00-17:00", at: monday.Add(-12 * time.Hour), want: true},
+		{window: "sat 00:00-24:00", at: monday.Add(-36 * time.Hour), want: true},
+		{window: "22:00-06:00", at: monday.Add(23 * time.Hour), want: true},
+		{window: "22:00-06:00", at: monday.Add(5 * time.Hour), want: true},
+		{window: "22:00-06:00", at: monday.Add(7 * time.Hour), want: false},
+		{window: "Sun 22:00-06:00", at: monday.Add(5 * time.Hour), want: true},
+		{window: "Mon 22:00-06:00", at: monday.Add(5 * time.Hour), want: false},
+		{window: "Mon-Fri", wantErr: true},
+		{window: "Funday 09:00-17:00", wantErr: true},
+		{window: "09:00-25:00", wantErr: true},
+		{window: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			window, err := parseExclusionWindow(tt.window)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExclusionWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && window.contains(tt.at) != tt.want {
+				t.Errorf("contains(%v) = %v, want %v", tt.at, !tt.want, tt.want)
+			}
+		})
+	}
+}
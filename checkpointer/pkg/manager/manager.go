@@ -2,8 +2,11 @@ package manager
 
 import (
 	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
 	"context"
+	"errors"
 	"sync"
+	"time"
 )
 
 // CheckpointManager is responsible for running initiating synchronous and asynchronous checkpoints.
@@ -14,41 +17,224 @@ type CheckpointManager interface {
 	// async checkpoint, it is his responsibility to save the checkpointIdentifier which is part of checkpointParams.
 	// In case of async=true, Checkpoint returns (nil, nil) and the result of the checkpoint should be obtained through
 	// CheckpointResult. Otherwise, returns CheckpointEntry pointer or error on failure.
+	// In case of checkpoint.PublishDeferred, Checkpoint returns the CheckpointEntry in the PublishQueued phase once the
+	// container is checkpointed and its Pod stopped, the image is published in the background. Returns
+	// ErrPublishQueueFull or ErrInsufficientStorage if the checkpoint cannot be admitted to the publisher queue.
+	// Returns QueueFullError if the checkpoint cannot be queued or DuplicateCheckpointError if the container is
+	// already being checkpointed.
+	// If there already is a checkpoint under the checkpointIdentifier requested with the same parameters, Checkpoint
+	// returns its CheckpointEntry instead of checkpointing again, regardless of async. Returns ErrIdempotencyConflict
+	// if the checkpointIdentifier was used for a checkpoint with different parameters or ErrCheckpointInProgress if the
+	// checkpoint under the checkpointIdentifier is being deleted.
 	Checkpoint(ctx context.Context, async bool, checkpointParams checkpoint.CheckpointerParams) (*CheckpointEntry, error)
 
-	// CheckpointResult returns CheckpointEntry pointer based on the checkpointIdentifier.
-	CheckpointResult(checkpointIdentifier string) (*CheckpointEntry, error)
+	// CheckpointResult returns CheckpointEntry pointer based on the checkpointIdentifier. If the checkpoint is still in
+	// progress, it waits at most for the wait duration for the checkpoint to finish, and returns the entry in its
+	// current Phase afterward, with its QueuePosition if it is still queued. Returns nil pointer if there is no such
+	// checkpoint or ErrCheckpointExpired if it was removed by retention policy. Other methods return
+	// ErrCheckpointExpired instead of ErrEntryNotFound for such checkpoints as well.
+	CheckpointResult(ctx context.Context, checkpointIdentifier string, wait time.Duration) (*CheckpointEntry, error)
+
+	// CheckpointEvents returns channel receiving CheckpointEvent instances of the checkpoint under
+	// checkpointIdentifier. The phases the checkpoint already went through are replayed first. The channel receives
+	// EventTypeResult as the last event and is closed afterward, or when ctx is done. Returns ErrEntryNotFound if there
+	// is no such checkpoint.
+	CheckpointEvents(ctx context.Context, checkpointIdentifier string) (<-chan CheckpointEvent, error)
+
+	// CancelCheckpoint cancels the asynchronous checkpoint under checkpointIdentifier, which is still in progress, and
+	// waits until it is cleaned up. Returns the CheckpointEntry in the Cancelled phase, ErrEntryNotFound if there is no
+	// such checkpoint, ErrNotCancellable if the checkpoint is synchronous, not in progress anymore or already pushing
+	// its image, or ErrCheckpointInProgress if the checkpoint is being deleted.
+	CancelCheckpoint(ctx context.Context, checkpointIdentifier string) (*CheckpointEntry, error)
+
+	// RetryCheckpoint retries the failed checkpoint under checkpointIdentifier asynchronously from its retained
+	// checkpoint archive, so that the container is not checkpointed again. Returns the CheckpointEntry in the Queued
+	// phase, ErrEntryNotFound if there is no such checkpoint, ErrNotRetryable if the checkpoint did not fail or its
+	// checkpoint archive was not retained, or ErrCheckpointInProgress if the checkpoint is being deleted. Returns the
+	// same scheduler errors as Checkpoint.
+	RetryCheckpoint(ctx context.Context, checkpointIdentifier string) (*CheckpointEntry, error)
+
+	// RecoverCheckpoints recovers checkpoints interrupted by Checkpointer restart. Asynchronous checkpoints are resumed
+	// in the background if the checkpoint archive created by Kubelet is still on disk or the image was already pushed,
+	// others are marked as failed with checkpoint.ErrorCodeCheckpointerRestarted. Should be called once on startup.
+	RecoverCheckpoints()
+
+	// LatestCheckpointResult returns the latest successful CheckpointEntry of the container made by this manager.
+	// Returns nil pointer if the container was never successfully checkpointed.
+	LatestCheckpointResult(containerIdentifier checkpoint.ContainerIdentifier) (*CheckpointEntry, error)
+
+	// ListCheckpoints returns the CheckpointEntry instances made by this manager selected by filter, the most recently
+	// begun first. If there are more entries than filter.Limit, CheckpointList.Continue holds the continue token of
+	// the next page.
+	ListCheckpoints(filter EntryFilter) (*CheckpointList, error)
+
+	// DeleteCheckpoint deletes the finished checkpoint under checkpointIdentifier together with its retained
+	// checkpoint archive, and its image from the container registry if deleteImage is true. Returns the deleted
+	// CheckpointEntry, ErrEntryNotFound if there is no such checkpoint, ErrCheckpointInProgress if the checkpoint is not
+	// finished or is being deleted already, or ErrImageNotDeleted if the registry refused to delete the image, in which case the entry is kept.
+	DeleteCheckpoint(ctx context.Context, checkpointIdentifier string, deleteImage bool) (*CheckpointEntry, error)
+
+	// ScaleOwnerUp scales the owner of the Pod checkpointed under checkpointIdentifier back to its original number of
+	// replicas and sets templateAnnotations on the owner's Pod template. Returns the CheckpointEntry, ErrEntryNotFound
+	// if there is no such checkpoint or ErrNoScaledOwner if the checkpoint did not scale down any owner.
+	ScaleOwnerUp(ctx context.Context, checkpointIdentifier string, templateAnnotations map[string]string) (*CheckpointEntry, error)
+
+	// EnforceRetention removes the finished checkpoint results expired by the configured retention policies, the same
+	// way DeleteCheckpoint does without deleting the images. If dryRun is true or the retention is configured as dry
+	// run, the expired results are only reported. Returns the RetentionReport.
+	EnforceRetention(ctx context.Context, dryRun bool) (*RetentionReport, error)
+}
+
+var (
+	ErrEntryNotFound        = errors.New("checkpoint entry not found")
+	ErrNoScaledOwner        = errors.New("checkpoint did not scale down any owner")
+	ErrNotCancellable       = errors.New("checkpoint is not an asynchronous checkpoint in progress")
+	ErrNotRetryable         = errors.New("checkpoint did not fail with retained checkpoint archive")
+	ErrCheckpointCancelled  = errors.New("checkpoint cancelled")
+	ErrIdempotencyConflict  = errors.New("checkpoint identifier was already used for a different checkpoint request")
+	ErrCheckpointInProgress = errors.New("checkpoint is still in progress")
+	ErrImageNotDeleted      = errors.New("checkpoint image could not be deleted")
+)
+
+// CheckpointList represents a page of listed CheckpointEntry instances.
+type CheckpointList struct {
+	// Items are the listed entries.
+	Items []CheckpointEntry `json:"items"`
+
+	// Continue is the continue token of the next page, empty if this is the last page.
+	Continue string `json:"continue,omitempty"`
 }
 
-func NewCheckpointManager(checkpointer checkpoint.Checkpointer, checkpointStorage CheckpointStorage) CheckpointManager {
-	return &checkpointManager{
-		&checkpointsInProgress{doneMap: make(map[string]chan struct{})},
+func NewCheckpointManager(checkpointer checkpoint.Checkpointer, podStopper checkpoint.PodStopper, verifier checkpoint.Verifier, imageDeleter checkpoint.ImageDeleter, checkpointStorage CheckpointStorage, pendingStorage PendingCheckpointStorage, callbackDispatcher CallbackDispatcher, eventSink EventSink, schedulerConfig config.SchedulerConfig, buildRetryConfig config.BuildRetryConfig, publishConfig config.PublishConfig, retentionConfig config.RetentionConfig, checkpointerNode string) CheckpointManager {
+	publishQueue := newPublishQueue(publishConfig)
+	publishQueue.start()
+	var checkpointRetention *retention
+	if retentionConfig.Enabled() {
+		checkpointRetention = newRetention(retentionConfig)
+	}
+	cm := &checkpointManager{
+		&checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		newCheckpointEvents(),
 		checkpointer,
+		podStopper,
+		verifier,
+		imageDeleter,
 		checkpointStorage,
+		callbackDispatcher,
+		pendingStorage,
+		eventSink,
+		newScheduler(schedulerConfig),
+		buildRetryConfig,
+		publishQueue,
+		checkpointRetention,
+		checkpointerNode,
 	}
+	if checkpointRetention != nil {
+		go cm.runJanitor()
+	}
+	if buildRetryConfig.RetainedArchiveTTLSeconds > 0 {
+		go cm.runArchiveJanitor()
+	}
+	return cm
 }
 
-// checkpointsInProgress represents an in memory map where the key is checkpointIdentifier and value is the done
-// channel, which can be used by other goroutine to wait for checkpointing to finish.
+// checkpointsInProgress represents an in memory map where the key is checkpointIdentifier and value is
+// checkpointInProgress of an asynchronous checkpoint.
 type checkpointsInProgress struct {
-	mu      sync.Mutex
-	doneMap map[string]chan struct{}
+	mu            sync.Mutex
+	inProgressMap map[string]checkpointInProgress
+}
+
+// checkpointInProgress holds the done channel, which can be used by other goroutine to wait for checkpointing to
+// finish, and the cancel function of the checkpoint context.
+type checkpointInProgress struct {
+	done   chan struct{}
+	cancel context.CancelCauseFunc
+
+	// publishing is set once the checkpoint image is being pushed, from then on the checkpoint cannot be cancelled.
+	publishing bool
+
+	// deleting is set if the finished checkpoint is reserved by its deletion rather than running, so that it is
+	// neither cancelled, retried nor replayed meanwhile.
+	deleting bool
 }
 
-func (c *checkpointsInProgress) Put(key string, value chan struct{}) {
+func (c *checkpointsInProgress) Put(key string, done chan struct{}, cancel context.CancelCauseFunc) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.doneMap[key] = value
+	c.inProgressMap[key] = checkpointInProgress{done: done, cancel: cancel}
+}
+
+// PutIfAbsent puts the checkpoint under key only if there is no checkpoint in progress under key yet. Returns false
+// if there is.
+func (c *checkpointsInProgress) PutIfAbsent(key string, done chan struct{}, cancel context.CancelCauseFunc) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.inProgressMap[key]; found {
+		return false
+	}
+	c.inProgressMap[key] = checkpointInProgress{done: done, cancel: cancel}
+	return true
+}
+
+// ReserveDeletion reserves the finished checkpoint under key for its deletion only if there is no checkpoint in
+// progress under key yet. Returns false if there is.
+func (c *checkpointsInProgress) ReserveDeletion(key string, done chan struct{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.inProgressMap[key]; found {
+		return false
+	}
+	c.inProgressMap[key] = checkpointInProgress{done: done, cancel: func(error) {}, deleting: true}
+	return true
+}
+
+// Deleting reports whether the checkpoint under key is reserved by its deletion.
+func (c *checkpointsInProgress) Deleting(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inProgressMap[key].deleting
 }
 
 func (c *checkpointsInProgress) Get(key string) chan struct{} {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.doneMap[key]
+	return c.inProgressMap[key].done
+}
+
+// Cancel cancels the context of the checkpoint under key with ErrCheckpointCancelled. Returns the done channel of
+// the checkpoint or nil if there is no such checkpoint in progress, ErrNotCancellable if the checkpoint is
+// publishing its image already, and ErrCheckpointInProgress if the checkpoint is being deleted.
+func (c *checkpointsInProgress) Cancel(key string) (chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inProgress, found := c.inProgressMap[key]
+	if !found {
+		return nil, nil
+	}
+	if inProgress.deleting {
+		return nil, ErrCheckpointInProgress
+	}
+	if inProgress.publishing {
+		return nil, ErrNotCancellable
+	}
+	inProgress.cancel(ErrCheckpointCancelled)
+	return inProgress.done, nil
+}
+
+// MarkPublishing records that the checkpoint under key started to publish its image, so that it is not cancelled
+// anymore and does not leave the image behind.
+func (c *checkpointsInProgress) MarkPublishing(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if inProgress, found := c.inProgressMap[key]; found {
+		inProgress.publishing = true
+		c.inProgressMap[key] = inProgress
+	}
 }
 
 func (c *checkpointsInProgress) Delete(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.doneMap, key)
+	delete(c.inProgressMap, key)
 }
@@ -0,0 +1,353 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ScheduleAnnotation holds the cron schedule of the periodic checkpoints of the Pod, e.g. "*/30 * * * *".
+	ScheduleAnnotation = "checkpoint.k8s/schedule"
+
+	// ScheduleContainerAnnotation selects the periodically checkpointed container, the first container of the Pod by
+	// default.
+	ScheduleContainerAnnotation = "checkpoint.k8s/schedule-container"
+
+	// ScheduleKeepAnnotation holds the number of the most recent periodic checkpoints of the Pod which are kept, older
+	// ones are deleted together with their images. Every periodic checkpoint is kept by default.
+	ScheduleKeepAnnotation = "checkpoint.k8s/schedule-keep"
+
+	// LastRunAnnotation holds the ScheduledRun of the last periodic checkpoint of the Pod, written by Checkpointer.
+	LastRunAnnotation = "checkpoint.k8s/last-run"
+
+	// ScheduledLabel marks the periodic checkpoints, its value is "true".
+	ScheduledLabel = "checkpoint.k8s/scheduled"
+)
+
+// checkpointResultWait bounds a single wait for the result of a checkpoint triggered by Checkpointer itself.
+const checkpointResultWait = 10 * time.Minute
+
+// checkpointResultTimeout bounds the whole wait for the result of a checkpoint triggered by Checkpointer itself, so
+// that a checkpoint stuck in progress does not hold its caller forever.
+const checkpointResultTimeout = time.Hour
+
+// ScheduledRun represents a single periodic checkpoint of a Pod.
+type ScheduledRun struct {
+	// CheckpointIdentifier is the tracking handle of the checkpoint.
+	CheckpointIdentifier string `json:"checkpointIdentifier,omitempty"`
+
+	// Timestamp is a Unix timestamp representing the time the run was triggered.
+	Timestamp int64 `json:"timestamp"`
+
+	// Phase is the phase of the checkpoint, updated once it finishes.
+	Phase checkpoint.Phase `json:"phase"`
+
+	// Error is the error that might have occurred during checkpointing.
+	Error *checkpoint.CheckpointError `json:"error,omitempty"`
+}
+
+// scheduledPod represents the periodic checkpoints of a single Pod.
+type scheduledPod struct {
+	namespace string
+	name      string
+	container string
+	keep      int
+
+	// schedule is the value of ScheduleAnnotation the entry was scheduled by.
+	schedule string
+
+	// entry is the cron entry, zero if the schedule is malformed.
+	entry cron.EntryID
+
+	// running is true while a periodic checkpoint of the Pod is in progress.
+	running bool
+}
+
+// PeriodicCheckpointer checkpoints the Pods on the Node of this Checkpointer by the cron schedule in their
+// ScheduleAnnotation, watching the Pods through an informer. The checkpoints never stop the Pods, a run is skipped
+// while the previous one is still in progress and the last run is written to LastRunAnnotation of the Pod.
+type PeriodicCheckpointer struct {
+	manager CheckpointManager
+	client  kubernetes.Interface
+	node    string
+	cron    *cron.Cron
+
+	// mu guards pods and every scheduledPod.
+	mu sync.Mutex
+
+	// pods holds the scheduled Pods keyed by their UID.
+	pods map[types.UID]*scheduledPod
+}
+
+// NewPeriodicCheckpointer constructs PeriodicCheckpointer of the Checkpointer of checkpointerNode.
+func NewPeriodicCheckpointer(checkpointManager CheckpointManager, client kubernetes.Interface, checkpointerNode string) *PeriodicCheckpointer {
+	return &PeriodicCheckpointer{
+		manager: checkpointManager,
+		client:  client,
+		node:    checkpointerNode,
+		cron:    cron.New(),
+		pods:    make(map[types.UID]*scheduledPod),
+	}
+}
+
+// Run watches the Pods on the Node and checkpoints them by their schedules until ctx is done.
+func (p *PeriodicCheckpointer) Run(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(p.client, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", p.node).String()
+	}))
+	_, err := factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { p.sync(ctx, obj.(*v1.Pod)) },
+		UpdateFunc: func(_, obj interface{}) { p.sync(ctx, obj.(*v1.Pod)) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*v1.Pod); ok {
+				p.unschedule(pod.UID)
+			}
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to watch Pods for periodic checkpoints")
+		return
+	}
+
+	factory.Start(ctx.Done())
+	p.cron.Start()
+	log.Info().Msg("checkpointing Pods by their schedules")
+	<-ctx.Done()
+	<-p.cron.Stop().Done()
+}
+
+// sync schedules the periodic checkpoints of pod by its ScheduleAnnotation, reschedules them if the annotation
+// changed or unschedules them if the annotation was removed or the Pod terminated. The periodic checkpoints run with
+// ctx, so that they stop waiting for their results once ctx is done.
+func (p *PeriodicCheckpointer) sync(ctx context.Context, pod *v1.Pod) {
+	schedule := pod.Annotations[ScheduleAnnotation]
+	if schedule == "" || pod.DeletionTimestamp != nil || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed || len(pod.Spec.Containers) == 0 {
+		p.unschedule(pod.UID)
+		return
+	}
+	lg := log.With().Str("namespace", pod.Namespace).Str("pod", pod.Name).Str("schedule", schedule).Logger()
+
+	container := pod.Annotations[ScheduleContainerAnnotation]
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+	keep := 0
+	if value := pod.Annotations[ScheduleKeepAnnotation]; value != "" {
+		var err error
+		if keep, err = strconv.Atoi(value); err != nil || keep < 0 {
+			lg.Warn().Str("keep", value).Msg("keep of periodic checkpoints has to be a non-negative number, keeping all")
+			keep = 0
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	scheduled := p.pods[pod.UID]
+	if scheduled != nil && scheduled.schedule == schedule {
+		scheduled.container = container
+		scheduled.keep = keep
+		return
+	}
+	if scheduled != nil {
+		p.cron.Remove(scheduled.entry)
+	}
+
+	scheduled = &scheduledPod{namespace: pod.Namespace, name: pod.Name, container: container, keep: keep, schedule: schedule}
+	p.pods[pod.UID] = scheduled
+	cronSchedule, err := cron.ParseStandard(schedule)
+	if err != nil {
+		// The malformed schedule is remembered anyway, so that it is not reported on every update of the Pod.
+		lg.Warn().Err(err).Msg("malformed schedule of periodic checkpoints")
+		return
+	}
+	scheduled.entry = p.cron.Schedule(cronSchedule, cron.FuncJob(func() { p.run(ctx, scheduled) }))
+	lg.Info().Str("container", container).Int("keep", keep).Msg("scheduled periodic checkpoints")
+}
+
+// unschedule stops the periodic checkpoints of the Pod with uid, if there are any.
+func (p *PeriodicCheckpointer) unschedule(uid types.UID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if scheduled, found := p.pods[uid]; found {
+		p.cron.Remove(scheduled.entry)
+		delete(p.pods, uid)
+		log.Info().Str("namespace", scheduled.namespace).Str("pod", scheduled.name).Msg("unscheduled periodic checkpoints")
+	}
+}
+
+// run checkpoints the scheduled Pod asynchronously without stopping it and waits for the result, unless the previous
+// run is still in progress. Once the checkpoint succeeds, the periodic checkpoints beyond keep are deleted.
+func (p *PeriodicCheckpointer) run(ctx context.Context, scheduled *scheduledPod) {
+	p.mu.Lock()
+	if scheduled.running {
+		p.mu.Unlock()
+		log.Info().Str("namespace", scheduled.namespace).Str("pod", scheduled.name).Msg("previous periodic checkpoint still in progress, skipping")
+		return
+	}
+	scheduled.running = true
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: scheduled.namespace, Pod: scheduled.name, Container: scheduled.container}
+	keep := scheduled.keep
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		scheduled.running = false
+	}()
+
+	lg := log.With().Str("containerIdentifier", containerIdentifier.String()).Logger()
+	ctx = lg.WithContext(ctx)
+	checkpointIdentifier, err := newCheckpointIdentifier()
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to generate checkpoint identifier")
+		return
+	}
+	run := ScheduledRun{CheckpointIdentifier: p.node + ":" + checkpointIdentifier, Timestamp: time.Now().Unix(), Phase: checkpoint.PhaseQueued}
+
+	_, err = p.manager.Checkpoint(ctx, true, checkpoint.CheckpointerParams{
+		ContainerIdentifier:  containerIdentifier,
+		StopPolicy:           checkpoint.StopPolicyNone,
+		CheckpointIdentifier: checkpointIdentifier,
+		Labels:               map[string]string{ScheduledLabel: "true"},
+	})
+	var duplicateErr *DuplicateCheckpointError
+	var queueFullErr *QueueFullError
+	switch {
+	case errors.As(err, &duplicateErr):
+		lg.Info().Str("checkpointIdentifier", duplicateErr.CheckpointIdentifier).Msg("container already being checkpointed, skipping periodic checkpoint")
+		return
+	case errors.As(err, &queueFullErr):
+		lg.Warn().Msg("checkpoint queue full, skipping periodic checkpoint")
+		return
+	case err != nil:
+		lg.Error().Err(err).Msg("periodic checkpoint failed")
+		run.Phase, run.Error = checkpoint.PhaseFailed, checkpoint.AsCheckpointError(err, "")
+		p.recordRun(ctx, scheduled, run)
+		return
+	}
+	lg.Info().Str("checkpointIdentifier", checkpointIdentifier).Msg("periodic checkpoint triggered")
+	p.recordRun(ctx, scheduled, run)
+
+	result := awaitCheckpointResult(ctx, p.manager, checkpointIdentifier, checkpointResultTimeout)
+	if result == nil {
+		return
+	}
+	run.Phase, run.Error = result.Phase, result.Error
+	p.recordRun(ctx, scheduled, run)
+	if result.Phase == checkpoint.PhaseSucceeded && keep > 0 {
+		p.prune(ctx, containerIdentifier, keep)
+	}
+}
+
+// recordRun writes run to LastRunAnnotation of the scheduled Pod.
+func (p *PeriodicCheckpointer) recordRun(ctx context.Context, scheduled *scheduledPod, run ScheduledRun) {
+	marshalledRun, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{LastRunAnnotation: string(marshalledRun)},
+		},
+	})
+	if err != nil {
+		return
+	}
+	_, err = p.client.CoreV1().Pods(scheduled.namespace).Patch(ctx, scheduled.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to record last run of periodic checkpoint")
+	}
+}
+
+// prune deletes the finished periodic checkpoints of the container older than the keep most recent successful ones,
+// together with their images. Failed checkpoints do not count toward keep, so that they never push out a successful
+// one. Pinned checkpoints are never deleted. If the registry refuses to delete an image, only the
+// checkpoint result is deleted, so that the image can be collected later.
+func (p *PeriodicCheckpointer) prune(ctx context.Context, containerIdentifier checkpoint.ContainerIdentifier, keep int) {
+	lg := zerolog.Ctx(ctx)
+	list, err := p.manager.ListCheckpoints(EntryFilter{
+		Namespace:     containerIdentifier.Namespace,
+		Pod:           containerIdentifier.Pod,
+		Container:     containerIdentifier.Container,
+		LabelSelector: labels.SelectorFromSet(labels.Set{ScheduledLabel: "true"}),
+	})
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list periodic checkpoints")
+		return
+	}
+
+	succeeded := 0
+	for _, entry := range list.Items {
+		if entry.InProgress() || entry.Labels[PinnedLabel] == "true" {
+			continue
+		}
+		if succeeded < keep {
+			if entry.Phase == checkpoint.PhaseSucceeded {
+				succeeded++
+			}
+			continue
+		}
+		checkpointIdentifier := strings.TrimPrefix(entry.CheckpointIdentifier, p.node+":")
+		_, err := p.manager.DeleteCheckpoint(ctx, checkpointIdentifier, true)
+		if errors.Is(err, ErrImageNotDeleted) {
+			_, err = p.manager.DeleteCheckpoint(ctx, checkpointIdentifier, false)
+		}
+		if err != nil && !errors.Is(err, ErrEntryNotFound) {
+			lg.Warn().Err(err).Str("checkpointIdentifier", entry.CheckpointIdentifier).Msg("failed to delete old periodic checkpoint")
+			continue
+		}
+		lg.Info().Str("checkpointIdentifier", entry.CheckpointIdentifier).Msg("deleted old periodic checkpoint")
+	}
+}
+
+// newCheckpointIdentifier returns a random identifier of a checkpoint triggered by Checkpointer itself.
+func newCheckpointIdentifier() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate checkpoint identifier: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// awaitCheckpointResult waits at most timeout for the checkpoint under checkpointIdentifier to finish. Returns nil
+// pointer if its result cannot be read, or ctx is done or timeout elapses first.
+func awaitCheckpointResult(ctx context.Context, checkpointManager CheckpointManager, checkpointIdentifier string, timeout time.Duration) *CheckpointEntry {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		entry, err := checkpointManager.CheckpointResult(ctx, checkpointIdentifier, checkpointResultWait)
+		if err != nil || entry == nil {
+			zerolog.Ctx(ctx).Error().Err(err).Str("checkpointIdentifier", checkpointIdentifier).Msg("failed to read checkpoint result")
+			return nil
+		}
+		if !entry.InProgress() {
+			return entry
+		}
+		if ctx.Err() != nil {
+			zerolog.Ctx(ctx).Warn().Str("checkpointIdentifier", checkpointIdentifier).Msg("checkpoint still in progress, giving up waiting for its result")
+			return nil
+		}
+	}
+}
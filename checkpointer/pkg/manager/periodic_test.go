@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"encoding/json"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPeriodicCheckpointer(pod *v1.Pod) (*PeriodicCheckpointer, mockStorage, *mockImageDeleter) {
+	storage := mockStorage{make(map[string]*CheckpointEntry)}
+	imageDeleter := &mockImageDeleter{}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		verifier:              mockVerifier{},
+		checkpointStorage:     storage,
+		imageDeleter:          imageDeleter,
+		checkpointerNode:      "node",
+	}
+	return NewPeriodicCheckpointer(manager, fake.NewSimpleClientset(pod), "node"), storage, imageDeleter
+}
+
+func newTestScheduledPod(annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns", UID: "uid", Annotations: annotations},
+		Spec:       v1.PodSpec{NodeName: "node", Containers: []v1.Container{{Name: "ctrn"}, {Name: "sidecar"}}},
+	}
+}
+
+func Test_PeriodicCheckpointer_sync(t *testing.T) {
+	pod := newTestScheduledPod(map[string]string{ScheduleAnnotation: "*/5 * * * *", ScheduleKeepAnnotation: "2"})
+	p, _, _ := newTestPeriodicCheckpointer(pod)
+
+	p.sync(context.TODO(), pod)
+	scheduled := p.pods["uid"]
+	if scheduled == nil || scheduled.entry == 0 || scheduled.container != "ctrn" || scheduled.keep != 2 || len(p.cron.Entries()) != 1 {
+		t.Fatalf("annotated Pod should be scheduled with its first container, got: %+v", scheduled)
+	}
+
+	// Changing the container keeps the schedule.
+	pod.Annotations[ScheduleContainerAnnotation] = "sidecar"
+	p.sync(context.TODO(), pod)
+	if p.pods["uid"] != scheduled || scheduled.container != "sidecar" || len(p.cron.Entries()) != 1 {
+		t.Fatalf("Pod should stay scheduled with the annotated container, got: %+v", p.pods["uid"])
+	}
+
+	// Changing the schedule replaces the cron entry.
+	pod.Annotations[ScheduleAnnotation] = "@hourly"
+	p.sync(context.TODO(), pod)
+	if rescheduled := p.pods["uid"]; rescheduled == scheduled || rescheduled.entry == 0 || len(p.cron.Entries()) != 1 {
+		t.Fatalf("Pod should be rescheduled, got: %+v", rescheduled)
+	}
+
+	// Malformed schedule is remembered without cron entry.
+	pod.Annotations[ScheduleAnnotation] = "every minute"
+	p.sync(context.TODO(), pod)
+	if scheduled := p.pods["uid"]; scheduled == nil || scheduled.entry != 0 || len(p.cron.Entries()) != 0 {
+		t.Fatalf("Pod with malformed schedule should not be scheduled, got: %+v", scheduled)
+	}
+
+	delete(pod.Annotations, ScheduleAnnotation)
+	p.sync(context.TODO(), pod)
+	if len(p.pods) != 0 || len(p.cron.Entries()) != 0 {
+		t.Fatalf("Pod without schedule should be unscheduled, got: %+v", p.pods)
+	}
+}
+
+func Test_PeriodicCheckpointer_run(t *testing.T) {
+	pod := newTestScheduledPod(map[string]string{ScheduleAnnotation: "@hourly", ScheduleKeepAnnotation: "2"})
+	p, storage, imageDeleter := newTestPeriodicCheckpointer(pod)
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+	for i, id := range []string{"a", "b", "c"} {
+		storage.storage[id] = &CheckpointEntry{
+			CheckpointIdentifier: "node:" + id,
+			ContainerIdentifier:  containerIdentifier,
+			ContainerImageName:   "quay.io/" + id,
+			Labels:               map[string]string{ScheduledLabel: "true"},
+			Phase:                checkpoint.PhaseSucceeded,
+			BeginTimestamp:       int64(i + 1),
+		}
+	}
+	storage.storage["a"].Labels[PinnedLabel] = "true"
+	storage.storage["d"] = &CheckpointEntry{
+		CheckpointIdentifier: "node:d",
+		ContainerIdentifier:  containerIdentifier,
+		Labels:               map[string]string{ScheduledLabel: "true"},
+		Phase:                checkpoint.PhaseFailed,
+		BeginTimestamp:       4,
+	}
+	storage.storage["manual"] = &CheckpointEntry{
+		CheckpointIdentifier: "node:manual",
+		ContainerIdentifier:  containerIdentifier,
+		Phase:                checkpoint.PhaseSucceeded,
+	}
+
+	p.sync(context.TODO(), pod)
+	p.run(context.TODO(), p.pods["uid"])
+
+	updated, _ := p.client.CoreV1().Pods("ns").Get(context.TODO(), "pod", metav1.GetOptions{})
+	var run ScheduledRun
+	if err := json.Unmarshal([]byte(updated.Annotations[LastRunAnnotation]), &run); err != nil {
+		t.Fatalf("last run should be recorded in the Pod annotation: %v", err)
+	}
+	entry := storage.storage[strings.TrimPrefix(run.CheckpointIdentifier, "node:")]
+	if run.Phase != checkpoint.PhaseSucceeded || entry == nil || entry.CheckpointIdentifier != run.CheckpointIdentifier {
+		t.Fatalf("last run should hold the result of the periodic checkpoint, got: %+v", run)
+	}
+	if entry.Labels[ScheduledLabel] != "true" || entry.StopPolicy != checkpoint.StopPolicyNone {
+		t.Fatalf("periodic checkpoint should be labeled and should not stop the Pod, got: %+v", entry)
+	}
+	if storage.storage["b"] != nil || storage.storage["c"] == nil || storage.storage["a"] == nil || storage.storage["d"] == nil || storage.storage["manual"] == nil {
+		t.Fatalf("only the oldest unpinned periodic checkpoint beyond keep successful ones should be deleted, got: %v", storage.storage)
+	}
+	if len(imageDeleter.deleted) != 1 || imageDeleter.deleted[0] != "quay.io/b" {
+		t.Fatalf("image of the deleted periodic checkpoint should be deleted, got: %v", imageDeleter.deleted)
+	}
+}
+
+func Test_PeriodicCheckpointer_run_InProgress(t *testing.T) {
+	pod := newTestScheduledPod(map[string]string{ScheduleAnnotation: "@hourly"})
+	p, storage, _ := newTestPeriodicCheckpointer(pod)
+
+	p.sync(context.TODO(), pod)
+	p.pods["uid"].running = true
+	p.run(context.TODO(), p.pods["uid"])
+
+	if len(storage.storage) != 0 {
+		t.Fatalf("run should be skipped while the previous one is in progress, got: %v", storage.storage)
+	}
+	if updated, _ := p.client.CoreV1().Pods("ns").Get(context.TODO(), "pod", metav1.GetOptions{}); updated.Annotations[LastRunAnnotation] != "" {
+		t.Fatalf("skipped run should not be recorded, got: %s", updated.Annotations[LastRunAnnotation])
+	}
+}
+
+func Test_awaitCheckpointResult(t *testing.T) {
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		checkpointStorage:     mockStorage{map[string]*CheckpointEntry{"id": {CheckpointIdentifier: "node:id", Phase: checkpoint.PhasePushing}}},
+	}
+	manager.checkpointsInProgress.Put("id", make(chan struct{}), func(error) {})
+
+	if entry := awaitCheckpointResult(context.TODO(), manager, "id", 10*time.Millisecond); entry != nil {
+		t.Fatalf("wait for checkpoint in progress should time out, got: %+v", entry)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if entry := awaitCheckpointResult(ctx, manager, "id", time.Hour); entry != nil {
+		t.Fatalf("wait for checkpoint in progress should stop once ctx is done, got: %+v", entry)
+	}
+}
@@ -0,0 +1,180 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"github.com/rs/zerolog"
+	"os"
+	"time"
+)
+
+// checkpointProgress holds the CheckpointEntry of a single checkpoint and stores it whenever the checkpoint enters
+// a new phase, so that clients can observe the progress while the checkpoint is running.
+type checkpointProgress struct {
+	entry                CheckpointEntry
+	checkpointIdentifier string
+	entryWriter          entryWriter
+	events               *checkpointEvents
+	eventSink            EventSink
+	pendingStorage       PendingCheckpointStorage
+	pending              PendingCheckpoint
+	lg                   zerolog.Logger
+
+	// ticket is the place of the checkpoint in the scheduler. Nil if the checkpoint is not scheduled, e.g. when it is
+	// resumed after restart.
+	ticket *schedulerTicket
+}
+
+// entryWriter stores the entries of checkpoints.
+type entryWriter interface {
+	StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error
+}
+
+// entryWriter returns where the checkpoint progress stores its entry. It is CallbackDispatcher if there is one, so that
+// the writes are serialized with the updates of the callback delivery.
+func (cm checkpointManager) entryWriter() entryWriter {
+	if cm.callbackDispatcher != nil {
+		return cm.callbackDispatcher
+	}
+	return cm.checkpointStorage
+}
+
+// newCheckpointProgress creates checkpointProgress for checkpointParams, stores it as PendingCheckpoint, so that it can
+// be recovered after restart, and stores its entry in the Queued phase.
+func (cm checkpointManager) newCheckpointProgress(checkpointParams checkpoint.CheckpointerParams, async bool, lg zerolog.Logger) *checkpointProgress {
+	progress := &checkpointProgress{
+		entry: CheckpointEntry{
+			CheckpointIdentifier: cm.trackingHandle(checkpointParams.CheckpointIdentifier),
+			RequestFingerprint:   requestFingerprint(checkpointParams),
+			ContainerIdentifier:  checkpointParams.ContainerIdentifier,
+			BeginTimestamp:       time.Now().Unix(),
+			StopPolicy:           checkpointParams.StopPolicy,
+			Labels:               checkpointParams.Labels,
+			Slot:                 checkpointParams.Slot,
+		},
+		checkpointIdentifier: checkpointParams.CheckpointIdentifier,
+		entryWriter:          cm.entryWriter(),
+		events:               cm.events,
+		eventSink:            cm.eventSink,
+		pendingStorage:       cm.pendingStorage,
+		pending:              PendingCheckpoint{checkpointParams, async},
+		lg:                   lg,
+	}
+	if checkpointParams.CallbackUrl != "" {
+		progress.entry.Callback = &CallbackDelivery{Url: checkpointParams.CallbackUrl, Status: CallbackStatusPending}
+	}
+	progress.storePending()
+	progress.reportPhase(checkpoint.PhaseQueued)
+	return progress
+}
+
+// resumeCheckpointProgress creates checkpointProgress continuing from entry of the recovered pending checkpoint.
+func (cm checkpointManager) resumeCheckpointProgress(entry CheckpointEntry, pending PendingCheckpoint, lg zerolog.Logger) *checkpointProgress {
+	return &checkpointProgress{
+		entry:                entry,
+		checkpointIdentifier: pending.Params.CheckpointIdentifier,
+		entryWriter:          cm.entryWriter(),
+		events:               cm.events,
+		eventSink:            cm.eventSink,
+		pendingStorage:       cm.pendingStorage,
+		pending:              pending,
+		lg:                   lg,
+	}
+}
+
+// reportPhase records that the checkpoint entered phase, stores the entry and publishes the phase to subscribers and
+// to the event sink. Failing to store the entry does not fail the checkpoint, only the clients observe stale phase.
+func (p *checkpointProgress) reportPhase(phase checkpoint.Phase) {
+	transition := PhaseTransition{phase, time.Now().Unix()}
+	p.entry.Phase = phase
+	p.entry.PhaseTransitions = append(p.entry.PhaseTransitions, transition)
+	p.lg.Debug().Str("phase", string(phase)).Msg("checkpoint entered new phase")
+
+	if err := p.entryWriter.StoreEntry(p.checkpointIdentifier, p.entry); err != nil {
+		p.lg.Error().Err(err).Str("phase", string(phase)).Msg("failed to store checkpoint entry, this is a PROBLEM")
+	}
+	p.events.Publish(p.checkpointIdentifier, CheckpointEvent{Type: EventTypePhase, Timestamp: transition.Timestamp, Phase: phase})
+	if p.eventSink != nil {
+		p.eventSink.Emit(p.entry)
+	}
+}
+
+// reportCancelled records that the checkpoint was cancelled. Returns the final entry and CheckpointError wrapping
+// ErrCheckpointCancelled.
+func (p *checkpointProgress) reportCancelled() (CheckpointEntry, error) {
+	p.entry.Error = checkpoint.NewCheckpointError(checkpoint.ErrorCodeCancelled, p.entry.Phase, ErrCheckpointCancelled)
+	p.entry.EndTimestamp = time.Now().Unix()
+	p.reportPhase(checkpoint.PhaseCancelled)
+	return p.entry, p.entry.Error
+}
+
+// reportFailed records that the checkpoint failed with err in its current phase. The checkpoint archive is retained
+// if the error is retryable, otherwise it is removed. Returns the final entry and err as CheckpointError.
+func (p *checkpointProgress) reportFailed(err error) (CheckpointEntry, error) {
+	p.entry.Error = checkpoint.AsCheckpointError(err, p.entry.Phase)
+	p.entry.ArchiveRetained = p.entry.Error.Retryable && archiveExists(p.pending.Params.CheckpointArchive)
+	if !p.entry.ArchiveRetained {
+		p.removeArchive()
+	}
+	p.entry.EndTimestamp = time.Now().Unix()
+	p.reportPhase(checkpoint.PhaseFailed)
+	return p.entry, p.entry.Error
+}
+
+// reportRestarted records that the checkpoint was interrupted by Checkpointer restart and finishes it. Returns the
+// final entry.
+func (p *checkpointProgress) reportRestarted() CheckpointEntry {
+	p.entry.Error = checkpoint.NewCheckpointError(checkpoint.ErrorCodeCheckpointerRestarted, p.entry.Phase, errCheckpointerRestarted)
+	p.entry.EndTimestamp = time.Now().Unix()
+	p.reportPhase(checkpoint.PhaseFailed)
+	p.finish()
+	return p.entry
+}
+
+// recordArchive records the checkpoint archive created by Kubelet, so that the checkpoint can be resumed from it.
+func (p *checkpointProgress) recordArchive(checkpointArchive string) {
+	p.pending.Params.CheckpointArchive = checkpointArchive
+	p.storePending()
+}
+
+// recordHook records the result of a checkpoint hook and stores the entry, so that clients can see the hook output
+// while the checkpoint is running.
+func (p *checkpointProgress) recordHook(result checkpoint.HookResult) {
+	p.entry.Hooks = append(p.entry.Hooks, result)
+	if err := p.entryWriter.StoreEntry(p.checkpointIdentifier, p.entry); err != nil {
+		p.lg.Error().Err(err).Str("hook", string(result.Type)).Msg("failed to store checkpoint entry, this is a PROBLEM")
+	}
+}
+
+// removeArchive removes the checkpoint archive created by Kubelet, if there is one.
+func (p *checkpointProgress) removeArchive() {
+	if p.pending.Params.CheckpointArchive != "" {
+		_ = os.Remove(p.pending.Params.CheckpointArchive)
+	}
+}
+
+// storePending stores the PendingCheckpoint. Failing to do so does not fail the checkpoint, it just cannot be
+// resumed after restart.
+func (p *checkpointProgress) storePending() {
+	if err := p.pendingStorage.StorePending(p.checkpointIdentifier, p.pending); err != nil {
+		p.lg.Warn().Err(err).Msg("failed to store pending checkpoint")
+	}
+}
+
+// finish forgets the PendingCheckpoint, unless its checkpoint archive is retained for retry, publishes the final entry
+// to subscribers and closes their channels. The entry has to be stored in its final phase beforehand, so that
+// subscribers which missed the result can read it from storage.
+func (p *checkpointProgress) finish() {
+	if p.entry.ArchiveRetained {
+		p.storePending()
+	} else if err := p.pendingStorage.ErasePending(p.checkpointIdentifier); err != nil {
+		p.lg.Warn().Err(err).Msg("failed to erase pending checkpoint")
+	}
+	entry := p.entry
+	p.events.Publish(p.checkpointIdentifier, CheckpointEvent{Type: EventTypeResult, Timestamp: time.Now().Unix(), Entry: &entry})
+	p.events.Close(p.checkpointIdentifier)
+}
+
+// logger returns lg extended with a hook publishing its log lines to subscribers.
+func (p *checkpointProgress) logger(lg zerolog.Logger) zerolog.Logger {
+	return lg.Hook(p.events.logHook(p.checkpointIdentifier))
+}
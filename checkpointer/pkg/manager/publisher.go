@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/config"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"syscall"
+)
+
+var (
+	ErrPublishQueueFull    = errors.New("publisher queue of deferred checkpoints is full")
+	ErrInsufficientStorage = errors.New("not enough free space for checkpoint archive")
+)
+
+// publishQueue runs the builds and pushes of deferred checkpoint images in the background, in the order the
+// checkpoints were queued. The queued checkpoints are persisted as PendingCheckpoint, so the queue itself only lives
+// in memory and is refilled by RecoverCheckpoints after restart.
+type publishQueue struct {
+	config.PublishConfig
+
+	// mu guards admitted and tasks.
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// admitted is the number of deferred checkpoints admitted, but not published yet, including the ones which are
+	// still creating their checkpoint archive.
+	admitted int64
+	tasks    []func()
+
+	// freeBytes returns the number of bytes available in a directory.
+	freeBytes func(dir string) (int64, error)
+}
+
+func newPublishQueue(publishConfig config.PublishConfig) *publishQueue {
+	queue := &publishQueue{PublishConfig: publishConfig, freeBytes: freeBytes}
+	queue.cond = sync.NewCond(&queue.mu)
+	return queue
+}
+
+// start starts the workers publishing the queued checkpoints.
+func (q *publishQueue) start() {
+	for range max(q.Workers, 1) {
+		go q.run()
+	}
+}
+
+// admit reserves a place in the queue for a deferred checkpoint. Returns ErrPublishQueueFull if the queue is full or
+// ErrInsufficientStorage if the checkpoint archive might not fit on the disk.
+func (q *publishQueue) admit() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.admitted >= q.MaxQueued {
+		return ErrPublishQueueFull
+	}
+	free, err := q.freeBytes(q.ArchiveDir)
+	if err != nil {
+		log.Warn().Err(err).Str("archiveDir", q.ArchiveDir).Msg("failed to check free space for checkpoint archive, admitting anyway")
+	} else if free < q.MinFreeBytes {
+		return ErrInsufficientStorage
+	}
+	q.admitted++
+	return nil
+}
+
+// reserve reserves a place in the queue regardless of its capacity, used for checkpoints recovered after restart.
+func (q *publishQueue) reserve() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.admitted++
+}
+
+// release frees the place of a checkpoint which was published or will not be published.
+func (q *publishQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.admitted--
+}
+
+// enqueue queues the publish of an admitted checkpoint. Its place is released once publish returns.
+func (q *publishQueue) enqueue(publish func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, publish)
+	q.cond.Signal()
+}
+
+func (q *publishQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.tasks) == 0 {
+			q.cond.Wait()
+		}
+		publish := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.mu.Unlock()
+
+		publish()
+		q.release()
+	}
+}
+
+// freeBytes returns the number of bytes available to unprivileged users in the file system of dir.
+func freeBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestPublishQueue(maxQueued, free int64) *publishQueue {
+	queue := newPublishQueue(config.PublishConfig{MinFreeBytes: 1024, MaxQueued: maxQueued, Workers: 1})
+	queue.freeBytes = func(string) (int64, error) {
+		return free, nil
+	}
+	queue.start()
+	return queue
+}
+
+func Test_publishQueue_admit(t *testing.T) {
+	queue := newTestPublishQueue(1, 2048)
+	if err := queue.admit(); err != nil {
+		t.Fatalf("first checkpoint should be admitted, got: %v", err)
+	}
+	if err := queue.admit(); !errors.Is(err, ErrPublishQueueFull) {
+		t.Fatalf("second checkpoint should not fit into the queue, got: %v", err)
+	}
+	queue.release()
+	if err := queue.admit(); err != nil {
+		t.Fatalf("released place should be admitted again, got: %v", err)
+	}
+
+	if err := newTestPublishQueue(1, 512).admit(); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("checkpoint should not be admitted without free space, got: %v", err)
+	}
+}
+
+func Test_checkpointManager_Checkpoint_Deferred(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "checkpoint.tar")
+	if err := os.WriteFile(archive, nil, 0644); err != nil {
+		t.Fatalf("failed to create checkpoint archive: %v", err)
+	}
+	checkpointer := &flakyCheckpointer{archive: archive}
+	podStopper := &mockPodStopper{}
+	pendingStorage := &mockPendingStorage{storage: make(map[string]PendingCheckpoint)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		scheduler:             newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1}),
+		pendingStorage:        pendingStorage,
+		checkpointer:          checkpointer,
+		podStopper:            podStopper,
+		checkpointStorage:     &syncStorage{storage: make(map[string]CheckpointEntry)},
+		publishQueue:          newTestPublishQueue(1, 2048),
+	}
+	params := checkpoint.CheckpointerParams{
+		StopPolicy:           checkpoint.StopPolicyDelete,
+		CheckpointIdentifier: "id",
+		Publish:              checkpoint.PublishDeferred,
+	}
+
+	queuedEntry, err := manager.Checkpoint(context.TODO(), false, params)
+	if err != nil {
+		t.Fatalf("Checkpoint returned unexpected error: %v", err)
+	}
+	if queuedEntry.Phase != checkpoint.PhasePublishQueued || !podStopper.stopped {
+		t.Fatalf("deferred checkpoint should return once the Pod is stopped, got phase: %s", queuedEntry.Phase)
+	}
+
+	entry, _ := manager.CheckpointResult(context.TODO(), "id", time.Second*5)
+	if entry.Phase != checkpoint.PhaseSucceeded || entry.ContainerImageName != "quay.io/checkpointed" {
+		t.Fatalf("deferred checkpoint should be published, got phase: %s", entry.Phase)
+	}
+	if checkpointer.archives[0] != archive {
+		t.Fatalf("image should be built from the checkpoint archive, got: %v", checkpointer.archives)
+	}
+	if entry.StopPolicy != checkpoint.StopPolicyDelete {
+		t.Fatalf("published entry should keep the requested stop policy, got: %s", entry.StopPolicy)
+	}
+	if pending, _ := pendingStorage.ReadPending("id"); pending != nil {
+		t.Fatalf("published checkpoint should not be pending")
+	}
+}
@@ -0,0 +1,225 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/diskv/v3"
+	"github.com/rs/zerolog/log"
+	"os"
+	"time"
+)
+
+// errCheckpointerRestarted is the cause of checkpoints interrupted by Checkpointer restart, which could not be resumed.
+var errCheckpointerRestarted = errors.New("checkpoint was interrupted by Checkpointer restart")
+
+// errCallbackSecretLost is why the signed callback of a recovered checkpoint is not delivered, as its secret is not
+// persisted.
+var errCallbackSecretLost = errors.New("callback secret is not persisted, signed callback dropped after Checkpointer restart")
+
+// PendingCheckpoint is the persisted state of a checkpoint in progress, from which it can be recovered after
+// Checkpointer restarts.
+type PendingCheckpoint struct {
+	// Params are the parameters the checkpoint was requested with. Once Kubelet created the checkpoint archive,
+	// its path is recorded in Params.CheckpointArchive.
+	Params checkpoint.CheckpointerParams `json:"params"`
+
+	// Async is true if the checkpoint is asynchronous. Synchronous checkpoints are never resumed, as there is no
+	// client waiting for them after restart.
+	Async bool `json:"async"`
+}
+
+// PendingCheckpointStorage is responsible for storing PendingCheckpoint instances.
+type PendingCheckpointStorage interface {
+	// StorePending stores PendingCheckpoint under the given checkpointIdentifier key.
+	// Returns error on fail or nil otherwise.
+	StorePending(checkpointIdentifier string, pending PendingCheckpoint) error
+
+	// ErasePending removes PendingCheckpoint stored under checkpointIdentifier key.
+	// Returns error on fail or nil otherwise.
+	ErasePending(checkpointIdentifier string) error
+
+	// ReadPending reads PendingCheckpoint stored under checkpointIdentifier key.
+	// Returns error on fail. If there is no PendingCheckpoint stored under given key, returns nil pointer.
+	ReadPending(checkpointIdentifier string) (*PendingCheckpoint, error)
+
+	// ReadAllPending reads all stored PendingCheckpoint instances by their checkpointIdentifier keys.
+	// Returns error on fail.
+	ReadAllPending() (map[string]PendingCheckpoint, error)
+}
+
+// pendingCheckpointDiskStorage stores instances of PendingCheckpoint as files on the file system.
+type pendingCheckpointDiskStorage struct {
+	storageBackend *diskv.Diskv
+}
+
+func NewPendingCheckpointStorage(config config.GlobalConfig) PendingCheckpointStorage {
+	storageBackend := diskv.New(diskv.Options{
+		BasePath:     config.PendingStoragePath,
+		CacheSizeMax: 1024 * 1024,
+	})
+	return &pendingCheckpointDiskStorage{storageBackend}
+}
+
+func (ps *pendingCheckpointDiskStorage) StorePending(checkpointIdentifier string, pending PendingCheckpoint) error {
+	marshalled, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending checkpoint: %w", err)
+	}
+	if err := ps.storageBackend.Write(checkpointIdentifier, marshalled); err != nil {
+		return fmt.Errorf("failed to write pending checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (ps *pendingCheckpointDiskStorage) ErasePending(checkpointIdentifier string) error {
+	if !ps.storageBackend.Has(checkpointIdentifier) {
+		return nil
+	}
+	if err := ps.storageBackend.Erase(checkpointIdentifier); err != nil {
+		return fmt.Errorf("failed to erase pending checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (ps *pendingCheckpointDiskStorage) ReadPending(checkpointIdentifier string) (*PendingCheckpoint, error) {
+	if !ps.storageBackend.Has(checkpointIdentifier) {
+		return nil, nil
+	}
+	marshalled, err := ps.storageBackend.Read(checkpointIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending checkpoint: %w", err)
+	}
+	pending := &PendingCheckpoint{}
+	if err := json.Unmarshal(marshalled, pending); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pending checkpoint: %w", err)
+	}
+	return pending, nil
+}
+
+func (ps *pendingCheckpointDiskStorage) ReadAllPending() (map[string]PendingCheckpoint, error) {
+	pendingCheckpoints := make(map[string]PendingCheckpoint)
+	for checkpointIdentifier := range ps.storageBackend.Keys(nil) {
+		pending, err := ps.ReadPending(checkpointIdentifier)
+		if err != nil {
+			return nil, err
+		}
+		if pending != nil {
+			pendingCheckpoints[checkpointIdentifier] = *pending
+		}
+	}
+	return pendingCheckpoints, nil
+}
+
+func (cm checkpointManager) RecoverCheckpoints() {
+	pendingCheckpoints, err := cm.pendingStorage.ReadAllPending()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read pending checkpoints, interrupted checkpoints cannot be recovered")
+		return
+	}
+
+	for checkpointIdentifier, pending := range pendingCheckpoints {
+		lg := log.With().
+			Str("checkpointIdentifier", checkpointIdentifier).
+			Str("containerIdentifier", pending.Params.ContainerIdentifier.String()).
+			Logger()
+
+		entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+		if err == nil && entry != nil && entry.ArchiveRetained && archiveExists(pending.Params.CheckpointArchive) {
+			// The checkpoint failed, but can still be retried from its checkpoint archive.
+			continue
+		}
+		if err != nil || entry == nil || !entry.InProgress() {
+			// The checkpoint finished, but Checkpointer restarted before forgetting it.
+			lg.Debug().Err(err).Msg("dropping pending checkpoint without entry in progress")
+			if err := cm.pendingStorage.ErasePending(checkpointIdentifier); err != nil {
+				lg.Warn().Err(err).Msg("failed to erase pending checkpoint")
+			}
+			continue
+		}
+
+		progress := cm.resumeCheckpointProgress(*entry, pending, lg)
+		if pending.Params.Publish == checkpoint.PublishDeferred && entry.ContainerImageName == "" && archiveExists(pending.Params.CheckpointArchive) {
+			lg.Info().Str("phase", string(entry.Phase)).Msg("queueing deferred checkpoint interrupted by Checkpointer restart")
+			cm.publishQueue.reserve()
+			cm.enqueuePublish(progress)
+			continue
+		}
+		if pending.Async && (entry.ContainerImageName != "" || archiveExists(pending.Params.CheckpointArchive)) {
+			lg.Info().Str("phase", string(entry.Phase)).Msg("resuming checkpoint interrupted by Checkpointer restart")
+			checkpointCtx, cancel := context.WithCancelCause(context.Background())
+			doneChan := make(chan struct{})
+			cm.checkpointsInProgress.Put(checkpointIdentifier, doneChan, cancel)
+			go cm.doCheckpointAsync(checkpointCtx, pending.Params, progress, doneChan)
+			continue
+		}
+
+		lg.Warn().Str("phase", string(entry.Phase)).Msg("checkpoint was interrupted by Checkpointer restart, marking it as failed")
+		if pending.Params.CheckpointArchive != "" {
+			_ = os.Remove(pending.Params.CheckpointArchive)
+		}
+		failedEntry := progress.reportRestarted()
+		if pending.Async {
+			cm.dispatchCallback(pending.Params, failedEntry, lg)
+		}
+	}
+}
+
+// archiveJanitorInterval is how often the retained checkpoint archives are checked for expiry.
+const archiveJanitorInterval = 10 * time.Minute
+
+// runArchiveJanitor removes the expired retained checkpoint archives every archiveJanitorInterval, or more often if
+// RetainedArchiveTTLSeconds is shorter, for the lifetime of the process.
+func (cm checkpointManager) runArchiveJanitor() {
+	ticker := time.NewTicker(min(archiveJanitorInterval, time.Duration(cm.buildRetry.RetainedArchiveTTLSeconds)*time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		cm.expireRetainedArchives(time.Now().Unix())
+	}
+}
+
+// expireRetainedArchives removes the checkpoint archives retained by checkpoints which failed more than
+// RetainedArchiveTTLSeconds before now, so that they cannot be retried anymore.
+func (cm checkpointManager) expireRetainedArchives(now int64) {
+	allPending, err := cm.pendingStorage.ReadAllPending()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read pending checkpoints, retained checkpoint archives are not expired")
+		return
+	}
+	for checkpointIdentifier, pending := range allPending {
+		lg := log.With().Str("checkpointIdentifier", checkpointIdentifier).Logger()
+
+		// Reserving the checkpoint makes sure that it is not retried meanwhile.
+		doneChan := make(chan struct{})
+		if !cm.checkpointsInProgress.PutIfAbsent(checkpointIdentifier, doneChan, func(error) {}) {
+			continue
+		}
+		entry, err := cm.checkpointStorage.ReadEntry(checkpointIdentifier)
+		if err == nil && entry != nil && entry.ArchiveRetained && now-entry.EndTimestamp > cm.buildRetry.RetainedArchiveTTLSeconds {
+			lg.Info().Str("checkpointArchive", pending.Params.CheckpointArchive).Msg("retained checkpoint archive expired, removing it")
+			if pending.Params.CheckpointArchive != "" {
+				_ = os.Remove(pending.Params.CheckpointArchive)
+			}
+			entry.ArchiveRetained = false
+			if err := cm.entryWriter().StoreEntry(checkpointIdentifier, *entry); err != nil {
+				lg.Error().Err(err).Msg("failed to store checkpoint entry without retained archive")
+			} else if err := cm.pendingStorage.ErasePending(checkpointIdentifier); err != nil {
+				lg.Warn().Err(err).Msg("failed to erase pending checkpoint")
+			}
+		}
+		cm.checkpointsInProgress.Delete(checkpointIdentifier)
+		close(doneChan)
+	}
+}
+
+// archiveExists reports whether the checkpoint archive created by Kubelet is still on disk.
+func archiveExists(checkpointArchive string) bool {
+	if checkpointArchive == "" {
+		return false
+	}
+	_, err := os.Stat(checkpointArchive)
+	return err == nil
+}
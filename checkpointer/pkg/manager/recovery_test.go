@@ -0,0 +1,144 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_checkpointManager_RecoverCheckpoints(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "checkpoint.tar")
+	syncArchive := filepath.Join(t.TempDir(), "sync-checkpoint.tar")
+	for _, path := range []string{archive, syncArchive} {
+		if err := os.WriteFile(path, []byte("checkpoint"), 0644); err != nil {
+			t.Fatalf("failed to create checkpoint archive: %v", err)
+		}
+	}
+
+	storage := &syncStorage{storage: map[string]CheckpointEntry{
+		"resumed":     {CheckpointIdentifier: "node:resumed", Phase: checkpoint.PhaseBuildingContext},
+		"interrupted": {CheckpointIdentifier: "node:interrupted", Phase: checkpoint.PhaseCheckpointingContainer},
+		"sync":        {CheckpointIdentifier: "node:sync", Phase: checkpoint.PhasePushing},
+		"finished":    {CheckpointIdentifier: "node:finished", Phase: checkpoint.PhaseSucceeded},
+	}}
+	pendingStorage := &mockPendingStorage{storage: map[string]PendingCheckpoint{
+		"resumed":     {checkpoint.CheckpointerParams{CheckpointIdentifier: "resumed", CheckpointArchive: archive}, true},
+		"interrupted": {checkpoint.CheckpointerParams{CheckpointIdentifier: "interrupted"}, true},
+		"sync":        {checkpoint.CheckpointerParams{CheckpointIdentifier: "sync", CheckpointArchive: syncArchive}, false},
+		"finished":    {checkpoint.CheckpointerParams{CheckpointIdentifier: "finished"}, true},
+	}}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		pendingStorage:        pendingStorage,
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		checkpointStorage:     storage,
+	}
+
+	manager.RecoverCheckpoints()
+
+	// The resumed checkpoint is running in the background.
+	if doneChan := manager.checkpointsInProgress.Get("resumed"); doneChan != nil {
+		select {
+		case <-doneChan:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("resumed checkpoint did not finish in time")
+		}
+	}
+	resumed, _ := storage.ReadEntry("resumed")
+	if resumed.Phase != checkpoint.PhaseSucceeded || resumed.ContainerImageName != "quay.io/checkpointed" {
+		t.Fatalf("checkpoint with archive on disk should be resumed, got phase: %s", resumed.Phase)
+	}
+
+	for _, checkpointIdentifier := range []string{"interrupted", "sync"} {
+		entry, _ := storage.ReadEntry(checkpointIdentifier)
+		if entry.Phase != checkpoint.PhaseFailed || entry.Error == nil || entry.Error.Code != checkpoint.ErrorCodeCheckpointerRestarted {
+			t.Fatalf("checkpoint %s should fail with %s code, got phase: %s", checkpointIdentifier, checkpoint.ErrorCodeCheckpointerRestarted, entry.Phase)
+		}
+	}
+
+	if _, err := os.Stat(syncArchive); !os.IsNotExist(err) {
+		t.Fatalf("archive of checkpoint marked as failed should be removed")
+	}
+
+	finished, _ := storage.ReadEntry("finished")
+	if finished.Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("finished checkpoint should not be touched")
+	}
+	if pending, _ := pendingStorage.ReadAllPending(); len(pending) != 0 {
+		t.Fatalf("all pending checkpoints should be forgotten, got: %v", pending)
+	}
+}
+
+func Test_checkpointManager_RecoverCheckpoints_SignedCallback(t *testing.T) {
+	params := checkpoint.CheckpointerParams{CheckpointIdentifier: "id", CallbackUrl: "https://example.com", CallbackSecret: "secret", CallbackSigned: true}
+	if marshalled, _ := json.Marshal(PendingCheckpoint{params, true}); strings.Contains(string(marshalled), "secret\"") {
+		t.Fatalf("callback secret should not be persisted, got: %s", marshalled)
+	}
+	params.CallbackSecret = ""
+
+	storage := &syncStorage{storage: map[string]CheckpointEntry{
+		"id": {CheckpointIdentifier: "node:id", Phase: checkpoint.PhaseCheckpointingContainer},
+	}}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		pendingStorage:        &mockPendingStorage{storage: map[string]PendingCheckpoint{"id": {params, true}}},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		checkpointStorage:     storage,
+	}
+
+	manager.RecoverCheckpoints()
+
+	entry, _ := storage.ReadEntry("id")
+	if entry.Phase != checkpoint.PhaseFailed || entry.Callback == nil || entry.Callback.Status != CallbackStatusFailed {
+		t.Fatalf("signed callback of recovered checkpoint should be dropped, got: %+v", entry.Callback)
+	}
+}
+
+func Test_checkpointManager_expireRetainedArchives(t *testing.T) {
+	storage := &syncStorage{storage: make(map[string]CheckpointEntry)}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		events:                newCheckpointEvents(),
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointer:          mockCheckpointer{},
+		podStopper:            &mockPodStopper{},
+		checkpointStorage:     storage,
+	}
+	manager.buildRetry.RetainedArchiveTTLSeconds = 60
+	now := time.Now().Unix()
+	for checkpointIdentifier, endTimestamp := range map[string]int64{"expired": now - 120, "retained": now - 30} {
+		archive := filepath.Join(t.TempDir(), "checkpoint.tar")
+		if err := os.WriteFile(archive, []byte("checkpoint"), 0644); err != nil {
+			t.Fatalf("failed to create checkpoint archive: %v", err)
+		}
+		_ = storage.StoreEntry(checkpointIdentifier, CheckpointEntry{Phase: checkpoint.PhaseFailed, ArchiveRetained: true, EndTimestamp: endTimestamp})
+		_ = manager.pendingStorage.StorePending(checkpointIdentifier, PendingCheckpoint{checkpoint.CheckpointerParams{CheckpointIdentifier: checkpointIdentifier, CheckpointArchive: archive}, true})
+	}
+	expiredPending, _ := manager.pendingStorage.ReadPending("expired")
+
+	manager.expireRetainedArchives(now)
+
+	if entry, _ := storage.ReadEntry("expired"); entry.ArchiveRetained || archiveExists(expiredPending.Params.CheckpointArchive) {
+		t.Fatal("expired retained checkpoint archive should be removed")
+	}
+	if pending, _ := manager.pendingStorage.ReadPending("expired"); pending != nil {
+		t.Fatal("pending checkpoint of expired retained checkpoint archive should be erased")
+	}
+	retainedPending, _ := manager.pendingStorage.ReadPending("retained")
+	if entry, _ := storage.ReadEntry("retained"); !entry.ArchiveRetained || retainedPending == nil || !archiveExists(retainedPending.Params.CheckpointArchive) {
+		t.Fatal("retained checkpoint archive should be kept until it expires")
+	}
+	if _, err := manager.RetryCheckpoint(context.TODO(), "expired"); !errors.Is(err, ErrNotRetryable) {
+		t.Fatalf("checkpoint with expired archive should not be retryable, got: %v", err)
+	}
+}
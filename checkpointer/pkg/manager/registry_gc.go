@@ -0,0 +1,242 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"strings"
+	"time"
+)
+
+const (
+	// leaseDuration, leaseRenewDeadline and leaseRetryPeriod configure the leader election of RegistryCollector.
+	leaseDuration      = 30 * time.Second
+	leaseRenewDeadline = 20 * time.Second
+	leaseRetryPeriod   = 5 * time.Second
+)
+
+// ClusterEntryLister is responsible for listing the checkpoint results of every Checkpointer in the cluster. It is
+// implemented by cluster-wide storages as well, which list the results of Nodes without a running Checkpointer too.
+type ClusterEntryLister interface {
+
+	// ListClusterEntries returns the CheckpointEntry instances stored by every Checkpointer. Returns error if the
+	// entries of any Node could not be listed, as the entries would be incomplete.
+	ListClusterEntries(ctx context.Context) ([]CheckpointEntry, error)
+}
+
+// RegistryGCReport represents the outcome of a single garbage collection of checkpoint images.
+type RegistryGCReport struct {
+	// DryRun is true if the Reclaimed images were only reported, not deleted.
+	DryRun bool `json:"dryRun"`
+
+	// Retained is the number of images with a stored checkpoint result.
+	Retained int `json:"retained"`
+
+	// Reclaimed are the deleted images without a stored checkpoint result.
+	Reclaimed []string `json:"reclaimed"`
+
+	// InUse are the images without a stored checkpoint result, which were kept as they are used by Pods.
+	InUse []string `json:"inUse,omitempty"`
+
+	// Failed are the images which could not be deleted.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// RegistryCollector deletes the checkpoint images without a stored checkpoint result from the container registry, e.g.
+// after the results expired by retention policy or were deleted without their images. Images used by Pods which did
+// not terminate yet are never deleted, and neither are the images of pinned checkpoints, as pinned checkpoint results
+// never expire. Garbage is collected by a single Checkpointer elected through a Lease.
+type RegistryCollector struct {
+	config.RegistryGCConfig
+	client   kubernetes.Interface
+	images   checkpoint.ImageCollector
+	entries  ClusterEntryLister
+	lock     resourcelock.Interface
+	identity string
+}
+
+// NewRegistryCollector constructs RegistryCollector electing the leader through the Lease in namespace, identified
+// by checkpointerNode.
+func NewRegistryCollector(registryGCConfig config.RegistryGCConfig, client kubernetes.Interface, images checkpoint.ImageCollector, entries ClusterEntryLister, namespace, checkpointerNode string) *RegistryCollector {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: registryGCConfig.LeaseName, Namespace: namespace},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: checkpointerNode},
+	}
+	return &RegistryCollector{registryGCConfig, client, images, entries, lock, checkpointerNode}
+}
+
+// Run competes for the Lease and collects garbage every IntervalSeconds while holding it, until ctx is done.
+func (rc *RegistryCollector) Run(ctx context.Context) {
+	lg := log.With().Str("lease", rc.LeaseName).Str("identity", rc.identity).Logger()
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            rc.lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   leaseRenewDeadline,
+			RetryPeriod:     leaseRetryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					lg.Info().Msg("elected to collect garbage in container registry")
+					rc.collectPeriodically(lg.WithContext(ctx))
+				},
+				OnStoppedLeading: func() {
+					lg.Info().Msg("stopped collecting garbage in container registry")
+				},
+			},
+		})
+	}
+}
+
+func (rc *RegistryCollector) collectPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(rc.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		_, _ = rc.Collect(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Collect deletes the checkpoint images without a stored checkpoint result, which are not used by any Pod, or only
+// reports them if DryRun is set. Returns the RegistryGCReport, which is logged as well.
+func (rc *RegistryCollector) Collect(ctx context.Context) (*RegistryGCReport, error) {
+	lg := zerolog.Ctx(ctx).With().Bool("dryRun", rc.DryRun).Logger()
+	report := &RegistryGCReport{DryRun: rc.DryRun, Reclaimed: []string{}}
+
+	// The images are listed before the results, so that the result of every listed image is stored already, as it is
+	// stored before the image is pushed.
+	images, err := rc.images.ListImages(ctx)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list checkpoint images")
+		return nil, err
+	}
+	retained, err := rc.retainedTags(ctx)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list checkpoint results, skipping garbage collection")
+		return nil, err
+	}
+	inUse, err := rc.imagesInUse(ctx)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list Pods, skipping garbage collection")
+		return nil, err
+	}
+
+	// Images are deleted by their digest, which deletes every tag of the image, so the digests of retained images are
+	// never deleted, even if tagged by an image without a stored checkpoint result.
+	var garbage []string
+	retainedDigests := make(map[string]bool)
+	for _, image := range images {
+		ref, err := internal.ParseImageReference(image)
+		if err == nil && !retained[ref.Reference] {
+			garbage = append(garbage, image)
+			continue
+		}
+		report.Retained++
+		digest, err := rc.images.ImageDigest(ctx, image)
+		if err != nil {
+			lg.Error().Err(err).Str("image", image).Msg("failed to get digest of retained checkpoint image, skipping garbage collection")
+			return nil, err
+		}
+		retainedDigests[digest] = true
+	}
+
+	for _, image := range garbage {
+		ref, _ := internal.ParseImageReference(image)
+		digest, err := rc.images.ImageDigest(ctx, image)
+		if err != nil {
+			lg.Warn().Err(err).Str("image", image).Msg("failed to get digest of checkpoint image")
+			report.Failed = append(report.Failed, image)
+			continue
+		}
+		if digest == "" {
+			continue
+		}
+		if retainedDigests[digest] {
+			report.Retained++
+			continue
+		}
+		if inUse[image] || inUse[digest] {
+			report.InUse = append(report.InUse, image)
+			continue
+		}
+		if !rc.DryRun {
+			if err := rc.images.DeleteImage(ctx, ref.Registry+"/"+ref.Repository+"@"+digest); err != nil {
+				lg.Warn().Err(err).Str("image", image).Msg("failed to delete checkpoint image")
+				report.Failed = append(report.Failed, image)
+				continue
+			}
+		}
+		report.Reclaimed = append(report.Reclaimed, image)
+	}
+
+	lg.Info().
+		Int("retained", report.Retained).
+		Strs("reclaimed", report.Reclaimed).
+		Strs("inUse", report.InUse).
+		Strs("failed", report.Failed).
+		Msg("garbage collected in container registry")
+	return report, nil
+}
+
+// retainedTags returns the image tags of every stored checkpoint result. The checkpointIdentifier is the tag, even
+// before the image is pushed.
+func (rc *RegistryCollector) retainedTags(ctx context.Context) (map[string]bool, error) {
+	entries, err := rc.entries.ListClusterEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	retained := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		_, checkpointIdentifier, found := strings.Cut(entry.CheckpointIdentifier, ":")
+		if !found {
+			checkpointIdentifier = entry.CheckpointIdentifier
+		}
+		retained[checkpointIdentifier] = true
+		if ref, err := internal.ParseImageReference(entry.ContainerImageName); err == nil {
+			retained[ref.Reference] = true
+		}
+	}
+	return retained, nil
+}
+
+// imagesInUse returns the images and the digests of images used by the containers of every Pod which did not
+// terminate yet.
+func (rc *RegistryCollector) imagesInUse(ctx context.Context) (map[string]bool, error) {
+	pods, err := rc.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Pods: %w", err)
+	}
+
+	inUse := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			inUse[container.Image] = true
+		}
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			// Image IDs are digests, possibly prefixed by the repository, e.g. quay.io/pbaran/checkpointed@sha256:...
+			imageID := status.ImageID
+			if at := strings.LastIndex(imageID, "@"); at >= 0 {
+				imageID = imageID[at+1:]
+			}
+			inUse[imageID] = true
+		}
+	}
+	return inUse, nil
+}
@@ -0,0 +1,88 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"slices"
+	"testing"
+)
+
+type mockImageCollector struct {
+	mockImageDeleter
+	images  []string
+	digests map[string]string
+}
+
+func (m *mockImageCollector) ListImages(context.Context) ([]string, error) {
+	return m.images, nil
+}
+
+func (m *mockImageCollector) ImageDigest(_ context.Context, image string) (string, error) {
+	return m.digests[image], nil
+}
+
+type mockClusterEntryLister struct {
+	entries []CheckpointEntry
+	err     error
+}
+
+func (m mockClusterEntryLister) ListClusterEntries(context.Context) ([]CheckpointEntry, error) {
+	return m.entries, m.err
+}
+
+func Test_RegistryCollector_Collect(t *testing.T) {
+	const prefix = "quay.io/pbaran/checkpointed"
+	images := &mockImageCollector{
+		images: []string{prefix + ":retained", prefix + ":pinned", prefix + ":running", prefix + ":restored", prefix + ":expired", prefix + ":gone", prefix + ":alias"},
+		digests: map[string]string{
+			prefix + ":retained": "sha256:1",
+			prefix + ":running":  "sha256:3",
+			prefix + ":restored": "sha256:4",
+			prefix + ":expired":  "sha256:5",
+			prefix + ":alias":    "sha256:1",
+		},
+	}
+	entries := mockClusterEntryLister{entries: []CheckpointEntry{
+		{CheckpointIdentifier: "node:retained", ContainerImageName: prefix + ":retained"},
+		{CheckpointIdentifier: "node:pinned", Labels: map[string]string{PinnedLabel: "true"}},
+	}}
+	client := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "ns"},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Image: prefix + ":running"}}},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "restored", Namespace: "ns"},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Image: "restored-by-digest"}}},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, ContainerStatuses: []v1.ContainerStatus{{ImageID: prefix + "@sha256:4"}}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "completed", Namespace: "ns"},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Image: prefix + ":expired"}}},
+			Status:     v1.PodStatus{Phase: v1.PodSucceeded},
+		},
+	)
+	collector := NewRegistryCollector(config.RegistryGCConfig{LeaseName: "gc"}, client, images, entries, "kube-system", "node")
+
+	report, err := collector.Collect(context.TODO())
+	if err != nil {
+		t.Fatalf("Collect returned unexpected error: %v", err)
+	}
+	if !slices.Equal(report.Reclaimed, []string{prefix + ":expired"}) || !slices.Equal(images.deleted, []string{prefix + "@sha256:5"}) {
+		t.Fatalf("only the expired image should be deleted by its digest, got: %+v, deleted: %v", report, images.deleted)
+	}
+	if !slices.Equal(report.InUse, []string{prefix + ":running", prefix + ":restored"}) || report.Retained != 3 {
+		t.Fatalf("images of running Pods and stored results and their other tags should be kept, got: %+v", report)
+	}
+
+	images.deleted = nil
+	collector.entries = mockClusterEntryLister{err: errors.New("node unreachable")}
+	if _, err := collector.Collect(context.TODO()); err == nil || len(images.deleted) != 0 {
+		t.Fatalf("nothing should be collected if checkpoint results cannot be listed, deleted: %v", images.deleted)
+	}
+}
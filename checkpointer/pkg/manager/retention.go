@@ -0,0 +1,209 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peterbourgon/diskv/v3"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// ErrCheckpointExpired is returned for checkpoints whose result was removed by retention policy. It wraps
+// ErrEntryNotFound, as the checkpoint result does not exist anymore.
+var ErrCheckpointExpired = fmt.Errorf("%w: checkpoint result expired", ErrEntryNotFound)
+
+// PinnedLabel is the label of checkpoints which never expire, so that their images are never collected either. Its
+// value has to be "true".
+const PinnedLabel = "checkpoint.k8s/pinned"
+
+// RetentionReason is the retention policy a checkpoint result expired by.
+type RetentionReason string
+
+const (
+	// RetentionReasonMaxAge means that the checkpoint result finished earlier than the maximum age ago.
+	RetentionReasonMaxAge RetentionReason = "MaxAge"
+
+	// RetentionReasonMaxPerContainer means that there are more recent checkpoint results of the container than allowed.
+	RetentionReasonMaxPerContainer RetentionReason = "MaxPerContainer"
+)
+
+// ExpiredCheckpoint represents a checkpoint result expired by retention policy.
+type ExpiredCheckpoint struct {
+	// CheckpointIdentifier is the tracking handle of the expired checkpoint.
+	CheckpointIdentifier string `json:"checkpointIdentifier"`
+
+	// ContainerIdentifier represents the container that was checkpointed.
+	ContainerIdentifier checkpoint.ContainerIdentifier `json:"containerIdentifier"`
+
+	// Reason is the retention policy the checkpoint result expired by.
+	Reason RetentionReason `json:"reason"`
+
+	// ExpiredTimestamp is a Unix timestamp representing the time the checkpoint result expired.
+	ExpiredTimestamp int64 `json:"expiredTimestamp"`
+}
+
+// RetentionReport represents the outcome of a single enforcement of the retention policies.
+type RetentionReport struct {
+	// DryRun is true if the expired checkpoint results were only reported, not removed.
+	DryRun bool `json:"dryRun"`
+
+	// Expired are the expired checkpoint results, in the order given by CompareEntries.
+	Expired []ExpiredCheckpoint `json:"expired"`
+
+	// Failed are the tracking handles of the expired checkpoint results which could not be removed.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// retention enforces config.RetentionConfig on the stored checkpoint results. The removed results are remembered as
+// tombstones for TombstoneTTLSeconds, so that requests for them can be answered with ErrCheckpointExpired.
+type retention struct {
+	config.RetentionConfig
+	tombstones *diskv.Diskv
+}
+
+func newRetention(retentionConfig config.RetentionConfig) *retention {
+	return &retention{
+		retentionConfig,
+		diskv.New(diskv.Options{
+			BasePath:     retentionConfig.TombstonePath,
+			CacheSizeMax: 1024 * 1024,
+		}),
+	}
+}
+
+// expired reports whether the checkpoint result under checkpointIdentifier was removed by retention policy.
+func (r *retention) expired(checkpointIdentifier string) bool {
+	return r != nil && r.tombstones.Has(checkpointIdentifier)
+}
+
+// forget erases the tombstone of the checkpoint result under checkpointIdentifier, if there is one.
+func (r *retention) forget(checkpointIdentifier string) {
+	if r.expired(checkpointIdentifier) {
+		_ = r.tombstones.Erase(checkpointIdentifier)
+	}
+}
+
+// bury stores the tombstone of the expired checkpoint result under checkpointIdentifier.
+func (r *retention) bury(checkpointIdentifier string, expired ExpiredCheckpoint) error {
+	marshalled, err := json.Marshal(expired)
+	if err != nil {
+		return fmt.Errorf("failed to marshal expired checkpoint: %w", err)
+	}
+	if err := r.tombstones.Write(checkpointIdentifier, marshalled); err != nil {
+		return fmt.Errorf("failed to write expired checkpoint: %w", err)
+	}
+	return nil
+}
+
+// pruneTombstones erases the tombstones older than TombstoneTTLSeconds at now.
+func (r *retention) pruneTombstones(now int64) {
+	for checkpointIdentifier := range r.tombstones.Keys(nil) {
+		var expired ExpiredCheckpoint
+		marshalled, err := r.tombstones.Read(checkpointIdentifier)
+		if err == nil {
+			err = json.Unmarshal(marshalled, &expired)
+		}
+		if err != nil || now-expired.ExpiredTimestamp > r.TombstoneTTLSeconds {
+			_ = r.tombstones.Erase(checkpointIdentifier)
+		}
+	}
+}
+
+// selectExpired returns the finished entries expired at now, except the pinned ones. The entries are expected in the
+// order given by CompareEntries, so that the most recent results of every container and slot are counted first.
+func (r *retention) selectExpired(entries []CheckpointEntry, now int64) []ExpiredCheckpoint {
+	finished := make(map[checkpoint.ContainerIdentifier]int64)
+	succeeded := make(map[checkpoint.ContainerIdentifier]int64)
+	slotSucceeded := make(map[string]int64)
+
+	var expired []ExpiredCheckpoint
+	for _, entry := range entries {
+		if entry.InProgress() || entry.Labels[PinnedLabel] == "true" {
+			continue
+		}
+		ci := entry.ContainerIdentifier
+		finished[ci]++
+		if entry.Phase == checkpoint.PhaseSucceeded {
+			succeeded[ci]++
+			if entry.Slot != "" {
+				slotSucceeded[entry.Slot]++
+			}
+			// The most recent successful checkpoints of a slot are kept even if its container was checkpointed since.
+			if succeeded[ci] <= r.KeepSucceeded || (entry.Slot != "" && slotSucceeded[entry.Slot] <= r.KeepSucceeded) {
+				continue
+			}
+		}
+
+		finishedTimestamp := entry.EndTimestamp
+		if finishedTimestamp == 0 {
+			finishedTimestamp = entry.BeginTimestamp
+		}
+		var reason RetentionReason
+		switch {
+		case r.MaxPerContainer > 0 && finished[ci] > r.MaxPerContainer:
+			reason = RetentionReasonMaxPerContainer
+		case r.MaxAgeSeconds > 0 && now-finishedTimestamp > r.MaxAgeSeconds:
+			reason = RetentionReasonMaxAge
+		default:
+			continue
+		}
+		expired = append(expired, ExpiredCheckpoint{entry.CheckpointIdentifier, ci, reason, now})
+	}
+	return expired
+}
+
+func (cm checkpointManager) EnforceRetention(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{DryRun: dryRun, Expired: []ExpiredCheckpoint{}}
+	if cm.retention == nil {
+		return report, nil
+	}
+	report.DryRun = dryRun || cm.retention.DryRun
+	lg := log.With().Bool("dryRun", report.DryRun).Logger()
+	ctx = lg.WithContext(ctx)
+
+	entries, err := cm.checkpointStorage.ListEntries(EntryFilter{})
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list checkpoint results")
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, expired := range cm.retention.selectExpired(entries, now) {
+		report.Expired = append(report.Expired, expired)
+		elg := lg.With().Str("checkpointIdentifier", expired.CheckpointIdentifier).Str("reason", string(expired.Reason)).Logger()
+		if report.DryRun {
+			elg.Info().Msg("checkpoint result would expire")
+			continue
+		}
+
+		checkpointIdentifier := strings.TrimPrefix(expired.CheckpointIdentifier, cm.checkpointerNode+":")
+		if _, err := cm.DeleteCheckpoint(ctx, checkpointIdentifier, false); err != nil && !errors.Is(err, ErrEntryNotFound) {
+			elg.Warn().Err(err).Msg("failed to remove expired checkpoint result")
+			report.Failed = append(report.Failed, expired.CheckpointIdentifier)
+			continue
+		}
+		if err := cm.retention.bury(checkpointIdentifier, expired); err != nil {
+			elg.Warn().Err(err).Msg("failed to remember expired checkpoint result")
+		}
+		elg.Info().Msg("checkpoint result expired")
+	}
+	if !report.DryRun {
+		cm.retention.pruneTombstones(now)
+	}
+	lg.Info().Int("expired", len(report.Expired)).Int("failed", len(report.Failed)).Msg("retention policies enforced")
+	return report, nil
+}
+
+// runJanitor enforces the retention policies every IntervalSeconds for the lifetime of the process.
+func (cm checkpointManager) runJanitor() {
+	ticker := time.NewTicker(time.Duration(cm.retention.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, _ = cm.EnforceRetention(context.Background(), false)
+	}
+}
@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_retention_selectExpired(t *testing.T) {
+	web := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "web", Container: "ctrn"}
+	db := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "db", Container: "ctrn"}
+	entries := []CheckpointEntry{
+		{CheckpointIdentifier: "node:e", ContainerIdentifier: web, BeginTimestamp: 900, Phase: checkpoint.PhasePushing},
+		{CheckpointIdentifier: "node:d", ContainerIdentifier: web, BeginTimestamp: 800, EndTimestamp: 810, Phase: checkpoint.PhaseFailed},
+		{CheckpointIdentifier: "node:c", ContainerIdentifier: web, BeginTimestamp: 700, EndTimestamp: 710, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node:b", ContainerIdentifier: web, BeginTimestamp: 600, EndTimestamp: 610, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node:a", ContainerIdentifier: db, BeginTimestamp: 100, EndTimestamp: 110, Phase: checkpoint.PhaseSucceeded},
+	}
+
+	r := &retention{RetentionConfig: config.RetentionConfig{MaxPerContainer: 1, KeepSucceeded: 1}}
+	expired := r.selectExpired(entries, 1000)
+	if len(expired) != 1 || expired[0].CheckpointIdentifier != "node:b" || expired[0].Reason != RetentionReasonMaxPerContainer {
+		t.Fatalf("only the older web checkpoint should expire, the running and the last succeeded are kept, got: %v", expired)
+	}
+
+	r = &retention{RetentionConfig: config.RetentionConfig{MaxAgeSeconds: 300}}
+	expired = r.selectExpired(entries, 1000)
+	if len(expired) != 2 || expired[0].CheckpointIdentifier != "node:b" || expired[1].CheckpointIdentifier != "node:a" || expired[1].Reason != RetentionReasonMaxAge {
+		t.Fatalf("checkpoints finished more than max age ago should expire, got: %v", expired)
+	}
+}
+
+func Test_retention_selectExpired_slot(t *testing.T) {
+	alice := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "alice", Container: "ctrn"}
+	rescheduled := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "alice-2", Container: "ctrn"}
+	entries := []CheckpointEntry{
+		{CheckpointIdentifier: "node:c", ContainerIdentifier: alice, Slot: "other", BeginTimestamp: 700, EndTimestamp: 710, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node:b", ContainerIdentifier: rescheduled, Slot: "alice", BeginTimestamp: 600, EndTimestamp: 610, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node:a", ContainerIdentifier: alice, Slot: "alice", BeginTimestamp: 500, EndTimestamp: 510, Phase: checkpoint.PhaseSucceeded},
+	}
+
+	r := &retention{RetentionConfig: config.RetentionConfig{MaxAgeSeconds: 100, KeepSucceeded: 1}}
+	expired := r.selectExpired(entries, 1000)
+	if len(expired) != 1 || expired[0].CheckpointIdentifier != "node:a" {
+		t.Fatalf("only the checkpoint superseded in both its container and its slot should expire, got: %v", expired)
+	}
+}
+
+func Test_checkpointManager_EnforceRetention(t *testing.T) {
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+	old := &CheckpointEntry{CheckpointIdentifier: "node:old", ContainerIdentifier: containerIdentifier, EndTimestamp: 1, Phase: checkpoint.PhaseFailed}
+	storage := mockStorage{map[string]*CheckpointEntry{
+		"old":    old,
+		"recent": {CheckpointIdentifier: "node:recent", ContainerIdentifier: containerIdentifier, EndTimestamp: time.Now().Unix(), Phase: checkpoint.PhaseFailed},
+	}}
+	manager := &checkpointManager{
+		checkpointsInProgress: &checkpointsInProgress{inProgressMap: make(map[string]checkpointInProgress)},
+		pendingStorage:        &mockPendingStorage{storage: make(map[string]PendingCheckpoint)},
+		checkpointStorage:     storage,
+		retention:             newRetention(config.RetentionConfig{MaxAgeSeconds: 3600, TombstonePath: t.TempDir(), TombstoneTTLSeconds: 3600}),
+		checkpointerNode:      "node",
+	}
+
+	report, err := manager.EnforceRetention(context.TODO(), true)
+	if err != nil || !report.DryRun || len(report.Expired) != 1 || report.Expired[0].CheckpointIdentifier != "node:old" {
+		t.Fatalf("dry run should report the old checkpoint, got: %+v, %v", report, err)
+	}
+	if storage.storage["old"] == nil {
+		t.Fatalf("dry run should not remove the checkpoint result")
+	}
+
+	if _, err := manager.EnforceRetention(context.TODO(), false); err != nil {
+		t.Fatalf("EnforceRetention returned unexpected error: %v", err)
+	}
+	if storage.storage["old"] != nil || storage.storage["recent"] == nil {
+		t.Fatalf("only the old checkpoint result should be removed")
+	}
+	if _, err := manager.CheckpointResult(context.TODO(), "old", 0); !errors.Is(err, ErrCheckpointExpired) {
+		t.Fatalf("CheckpointResult should return ErrCheckpointExpired, got: %v", err)
+	}
+	if _, err := manager.DeleteCheckpoint(context.TODO(), "old", false); !errors.Is(err, ErrCheckpointExpired) || !errors.Is(err, ErrEntryNotFound) {
+		t.Fatalf("DeleteCheckpoint should return ErrCheckpointExpired, got: %v", err)
+	}
+	if entry, err := manager.CheckpointResult(context.TODO(), "unknown", 0); entry != nil || err != nil {
+		t.Fatalf("unknown checkpoint should not be expired, got: %v, %v", entry, err)
+	}
+}
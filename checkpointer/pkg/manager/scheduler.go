@@ -0,0 +1,172 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// QueueFullError means the checkpoint was rejected, because the scheduler queue is full.
+type QueueFullError struct {
+	// RetryAfter is how long the client should wait before requesting the checkpoint again.
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return "checkpoint queue is full"
+}
+
+// DuplicateCheckpointError means the checkpoint was rejected, because another checkpoint of the same container is
+// queued or running.
+type DuplicateCheckpointError struct {
+	// CheckpointIdentifier identifies the checkpoint of the container which is queued or running.
+	CheckpointIdentifier string
+
+	// Joinable is true if the checkpoint in progress was requested with the same parameters, so that the rejected
+	// request can follow it instead, as it does what was requested.
+	Joinable bool
+}
+
+func (e *DuplicateCheckpointError) Error() string {
+	return fmt.Sprintf("container is already being checkpointed by checkpoint %s", e.CheckpointIdentifier)
+}
+
+// scheduler limits how many checkpoints run at once on the Node. Checkpoints over the limit wait in a bounded queue
+// ordered by priority, and in the order they were requested within the same priority. Only one checkpoint of
+// a container can be queued or running at a time, and each checkpointIdentifier can be used by a single checkpoint.
+type scheduler struct {
+	config.SchedulerConfig
+
+	// admission serializes the admission of checkpoints from the lookup of the checkpoint already stored under their
+	// checkpointIdentifier to enqueue, so that concurrent requests cannot both miss it and checkpoint twice.
+	admission sync.Mutex
+
+	// mu guards all the fields below and the state of the tickets.
+	mu          sync.Mutex
+	running     int64
+	sequence    uint64
+	queue       []*schedulerTicket
+	containers  map[checkpoint.ContainerIdentifier]string
+	identifiers map[string]checkpoint.ContainerIdentifier
+}
+
+// schedulerTicket represents a checkpoint admitted by scheduler.
+type schedulerTicket struct {
+	checkpointIdentifier string
+	containerIdentifier  checkpoint.ContainerIdentifier
+	priority             int64
+	sequence             uint64
+
+	// scheduled is closed once the checkpoint can run.
+	scheduled chan struct{}
+	running   bool
+	released  bool
+}
+
+func newScheduler(schedulerConfig config.SchedulerConfig) *scheduler {
+	return &scheduler{
+		SchedulerConfig: schedulerConfig,
+		containers:      make(map[checkpoint.ContainerIdentifier]string),
+		identifiers:     make(map[string]checkpoint.ContainerIdentifier),
+	}
+}
+
+// enqueue admits the checkpoint of containerIdentifier. Returns DuplicateCheckpointError if the container is already
+// being checkpointed, ErrIdempotencyConflict if checkpointIdentifier is used by a checkpoint of another container or
+// QueueFullError if the checkpoint cannot run right away and the queue is full.
+func (s *scheduler) enqueue(checkpointIdentifier string, containerIdentifier checkpoint.ContainerIdentifier, priority int64) (*schedulerTicket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, found := s.identifiers[checkpointIdentifier]; found && existing != containerIdentifier {
+		return nil, ErrIdempotencyConflict
+	}
+	if existing, found := s.containers[containerIdentifier]; found {
+		return nil, &DuplicateCheckpointError{CheckpointIdentifier: existing}
+	}
+
+	ticket := &schedulerTicket{
+		checkpointIdentifier: checkpointIdentifier,
+		containerIdentifier:  containerIdentifier,
+		priority:             priority,
+		sequence:             s.sequence,
+		scheduled:            make(chan struct{}),
+	}
+	if s.running < s.MaxConcurrent && len(s.queue) == 0 {
+		s.start(ticket)
+	} else if int64(len(s.queue)) >= s.MaxQueued {
+		return nil, &QueueFullError{time.Second * time.Duration(s.RetryAfterSeconds)}
+	} else {
+		// Tickets of the same priority keep the order they were requested in.
+		position, _ := slices.BinarySearchFunc(s.queue, ticket, func(queued, ticket *schedulerTicket) int {
+			if queued.priority != ticket.priority {
+				return cmp.Compare(ticket.priority, queued.priority)
+			}
+			return cmp.Compare(queued.sequence, ticket.sequence)
+		})
+		s.queue = slices.Insert(s.queue, position, ticket)
+	}
+	s.sequence++
+	s.containers[containerIdentifier] = checkpointIdentifier
+	s.identifiers[checkpointIdentifier] = containerIdentifier
+	return ticket, nil
+}
+
+// wait blocks until the checkpoint of ticket can run. Returns error if ctx is done before that.
+func (s *scheduler) wait(ctx context.Context, ticket *schedulerTicket) error {
+	select {
+	case <-ticket.scheduled:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the place of the ticket, whether it is still queued or already running, and starts the queued
+// checkpoints which fit into the concurrency limit.
+func (s *scheduler) release(ticket *schedulerTicket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ticket.released {
+		return
+	}
+	ticket.released = true
+	delete(s.containers, ticket.containerIdentifier)
+	delete(s.identifiers, ticket.checkpointIdentifier)
+	if ticket.running {
+		s.running--
+	} else {
+		s.queue = slices.DeleteFunc(s.queue, func(queued *schedulerTicket) bool { return queued == ticket })
+	}
+
+	for s.running < s.MaxConcurrent && len(s.queue) > 0 {
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		s.start(next)
+	}
+}
+
+// position returns the 1-based position of the checkpoint in the queue, or 0 if it is not queued.
+func (s *scheduler) position(checkpointIdentifier string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, queued := range s.queue {
+		if queued.checkpointIdentifier == checkpointIdentifier {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (s *scheduler) start(ticket *schedulerTicket) {
+	s.running++
+	ticket.running = true
+	close(ticket.scheduled)
+}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func containerOf(pod string) checkpoint.ContainerIdentifier {
+	return checkpoint.ContainerIdentifier{Namespace: "ns", Pod: pod, Container: "ctrn"}
+}
+
+func isScheduled(ticket *schedulerTicket) bool {
+	select {
+	case <-ticket.scheduled:
+		return true
+	default:
+		return false
+	}
+}
+
+func Test_scheduler_priority(t *testing.T) {
+	s := newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 3})
+
+	running, _ := s.enqueue("running", containerOf("a"), 0)
+	low, _ := s.enqueue("low", containerOf("b"), 0)
+	high, _ := s.enqueue("high", containerOf("c"), 5)
+	lowLater, _ := s.enqueue("lowLater", containerOf("d"), 0)
+
+	if !isScheduled(running) || isScheduled(low) || isScheduled(high) || isScheduled(lowLater) {
+		t.Fatalf("only the first checkpoint should be running")
+	}
+	if s.position("high") != 1 || s.position("low") != 2 || s.position("lowLater") != 3 || s.position("running") != 0 {
+		t.Fatalf("queue should be ordered by priority and then by request order")
+	}
+
+	s.release(running)
+	if !isScheduled(high) || isScheduled(low) {
+		t.Fatalf("checkpoint with the highest priority should run next")
+	}
+
+	// Releasing a queued ticket only removes it from the queue.
+	s.release(low)
+	s.release(low)
+	if s.position("lowLater") != 1 || isScheduled(lowLater) {
+		t.Fatalf("released ticket should be removed from the queue")
+	}
+
+	s.release(high)
+	if !isScheduled(lowLater) {
+		t.Fatalf("remaining checkpoint should run")
+	}
+}
+
+func Test_scheduler_rejects(t *testing.T) {
+	s := newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1, RetryAfterSeconds: 7})
+
+	first, _ := s.enqueue("first", containerOf("a"), 0)
+	if _, err := s.enqueue("second", containerOf("b"), 0); err != nil {
+		t.Fatalf("enqueue returned unexpected error: %v", err)
+	}
+
+	var duplicateErr *DuplicateCheckpointError
+	if _, err := s.enqueue("duplicate", containerOf("a"), 0); !errors.As(err, &duplicateErr) || duplicateErr.CheckpointIdentifier != "first" {
+		t.Fatalf("enqueue should fail with DuplicateCheckpointError, got: %v", err)
+	}
+
+	var queueFullErr *QueueFullError
+	if _, err := s.enqueue("third", containerOf("c"), 0); !errors.As(err, &queueFullErr) || queueFullErr.RetryAfter != 7*time.Second {
+		t.Fatalf("enqueue should fail with QueueFullError, got: %v", err)
+	}
+
+	if _, err := s.enqueue("first", containerOf("c"), 0); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("enqueue should fail with ErrIdempotencyConflict, got: %v", err)
+	}
+
+	s.release(first)
+	if _, err := s.enqueue("again", containerOf("a"), 0); err != nil {
+		t.Fatalf("container should be checkpointable again after release, got: %v", err)
+	}
+}
+
+func Test_scheduler_wait(t *testing.T) {
+	s := newScheduler(config.SchedulerConfig{MaxConcurrent: 1, MaxQueued: 1})
+
+	running, _ := s.enqueue("running", containerOf("a"), 0)
+	queued, _ := s.enqueue("queued", containerOf("b"), 0)
+
+	if err := s.wait(context.TODO(), running); err != nil {
+		t.Fatalf("wait returned unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.wait(ctx, queued); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait should fail once the context is cancelled, got: %v", err)
+	}
+}
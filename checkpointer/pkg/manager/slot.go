@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"slices"
+)
+
+// SlotHistory represents the lineage of a named slot, i.e. its successful checkpoints, the most recently begun first.
+// Only successful checkpoints join the history, so a failed checkpoint never replaces the last good image of the slot.
+// The checkpoints of a slot can be made by any Checkpointer, e.g. when the workload was rescheduled to other Node.
+type SlotHistory struct {
+	// Slot is the name of the slot.
+	Slot string `json:"slot"`
+
+	// Checkpoints are the successful checkpoints requested in the slot in the order given by CompareEntries.
+	Checkpoints []CheckpointEntry `json:"checkpoints"`
+}
+
+// SlotFilter returns EntryFilter selecting the checkpoints in the history of slot.
+func SlotFilter(slot string) EntryFilter {
+	return EntryFilter{Slot: slot, Phase: checkpoint.PhaseSucceeded}
+}
+
+// NewSlotHistory returns the SlotHistory of slot made of the entries in the history of slot, which might be listed by
+// multiple Checkpointers. Other entries are left out.
+func NewSlotHistory(slot string, entries []CheckpointEntry) *SlotHistory {
+	filter := SlotFilter(slot)
+	history := &SlotHistory{Slot: slot, Checkpoints: []CheckpointEntry{}}
+	for _, entry := range entries {
+		if filter.Matches(entry) {
+			history.Checkpoints = append(history.Checkpoints, entry)
+		}
+	}
+	slices.SortFunc(history.Checkpoints, CompareEntries)
+	return history
+}
+
+// Latest returns the most recent successful checkpoint of the slot. Returns nil pointer if there is none.
+func (history *SlotHistory) Latest() *CheckpointEntry {
+	return history.nth(0)
+}
+
+// Previous returns the successful checkpoint of the slot preceding Latest, which is the fallback if the latest image
+// cannot be restored. Returns nil pointer if there is none.
+func (history *SlotHistory) Previous() *CheckpointEntry {
+	return history.nth(1)
+}
+
+func (history *SlotHistory) nth(n int) *CheckpointEntry {
+	if n >= len(history.Checkpoints) {
+		return nil
+	}
+	return &history.Checkpoints[n]
+}
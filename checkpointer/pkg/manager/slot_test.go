@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"testing"
+)
+
+func TestNewSlotHistory(t *testing.T) {
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+	entries := []CheckpointEntry{
+		{CheckpointIdentifier: "node-a:good", ContainerIdentifier: containerIdentifier, Slot: "notebook", BeginTimestamp: 100, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node-a:failed", ContainerIdentifier: containerIdentifier, Slot: "notebook", BeginTimestamp: 300, Phase: checkpoint.PhaseFailed},
+		{CheckpointIdentifier: "node-a:running", ContainerIdentifier: containerIdentifier, Slot: "notebook", BeginTimestamp: 400, Phase: checkpoint.PhasePushing},
+		{CheckpointIdentifier: "node-b:better", ContainerIdentifier: containerIdentifier, Slot: "notebook", BeginTimestamp: 200, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node-b:other", ContainerIdentifier: containerIdentifier, Slot: "other", BeginTimestamp: 500, Phase: checkpoint.PhaseSucceeded},
+		{CheckpointIdentifier: "node-b:none", ContainerIdentifier: containerIdentifier, BeginTimestamp: 600, Phase: checkpoint.PhaseSucceeded},
+	}
+
+	history := NewSlotHistory("notebook", entries)
+	if len(history.Checkpoints) != 2 {
+		t.Fatalf("only the successful checkpoints of the slot should be in its history, got: %v", history.Checkpoints)
+	}
+	if latest := history.Latest(); latest == nil || latest.CheckpointIdentifier != "node-b:better" {
+		t.Fatalf("failed and running checkpoints should not replace the latest one, got: %v", latest)
+	}
+	if previous := history.Previous(); previous == nil || previous.CheckpointIdentifier != "node-a:good" {
+		t.Fatalf("previous checkpoint should be the one preceding the latest, got: %v", previous)
+	}
+
+	empty := NewSlotHistory("empty", entries)
+	if empty.Latest() != nil || empty.Previous() != nil || empty.Checkpoints == nil {
+		t.Fatalf("slot without checkpoints should have empty history, got: %v", empty)
+	}
+}
+
+func Test_requestFingerprint_slot(t *testing.T) {
+	params := checkpoint.CheckpointerParams{
+		ContainerIdentifier:  checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		CheckpointIdentifier: "id",
+		Slot:                 "notebook",
+	}
+	other := params
+	other.Slot = "other"
+	if requestFingerprint(params) == requestFingerprint(other) {
+		t.Fatalf("checkpoints requested in different slots should not be idempotent replays")
+	}
+}
+
+func Test_checkpointDiskStorage_ListEntries_slot(t *testing.T) {
+	storage := NewCheckpointStorage(config.GlobalConfig{StorageBasePath: t.TempDir()})
+	// The first listing builds the index, so that the entries stored afterward are filtered through it.
+	if _, err := storage.ListEntries(EntryFilter{}); err != nil {
+		t.Fatalf("failed to list entries: %v", err)
+	}
+	containerIdentifier := checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"}
+	_ = storage.StoreEntry("a", CheckpointEntry{CheckpointIdentifier: "node:a", ContainerIdentifier: containerIdentifier, Slot: "notebook", Phase: checkpoint.PhaseSucceeded})
+	_ = storage.StoreEntry("b", CheckpointEntry{CheckpointIdentifier: "node:b", ContainerIdentifier: containerIdentifier, Slot: "notebook", Phase: checkpoint.PhaseFailed})
+	_ = storage.StoreEntry("c", CheckpointEntry{CheckpointIdentifier: "node:c", ContainerIdentifier: containerIdentifier, Phase: checkpoint.PhaseSucceeded})
+
+	entries, err := storage.ListEntries(SlotFilter("notebook"))
+	if err != nil {
+		t.Fatalf("failed to list entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].CheckpointIdentifier != "node:a" {
+		t.Fatalf("slot filter should select only the successful checkpoints of the slot, got: %v", entries)
+	}
+}
@@ -3,13 +3,33 @@ package manager
 import (
 	"checkpoint-in-k8s/pkg/checkpoint"
 	"checkpoint-in-k8s/pkg/config"
+	"cmp"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/peterbourgon/diskv/v3"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// latestEntryKeyPrefix prefixes the storage keys of the latest successful checkpoints of containers.
+const latestEntryKeyPrefix = "latest_"
+
 // CheckpointEntry represent the result of a container checkpointing request.
 type CheckpointEntry struct {
+	// CheckpointIdentifier is the tracking handle of the checkpoint in format {node}:{checkpointIdentifier}.
+	CheckpointIdentifier string `json:"checkpointIdentifier,omitempty"`
+
+	// RequestFingerprint identifies the parameters the checkpoint was requested with, so that a repeated request with
+	// the same checkpointIdentifier can be told apart from a conflicting one.
+	RequestFingerprint string `json:"requestFingerprint,omitempty"`
+
 	// ContainerIdentifier represents the container that was checkpointed.
 	ContainerIdentifier checkpoint.ContainerIdentifier `json:"containerIdentifier"`
 
@@ -22,8 +42,161 @@ type CheckpointEntry struct {
 	// ContainerImageName represents the container image that is pushed to a remote container registry.
 	ContainerImageName string `json:"containerImageName"`
 
+	// Labels are the labels the checkpoint was requested with.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Slot is the name of the slot the checkpoint was requested in, see SlotHistory.
+	Slot string `json:"slot,omitempty"`
+
+	// StopPolicy is the policy that was applied to the container Pod after checkpoint.
+	StopPolicy checkpoint.StopPolicy `json:"stopPolicy,omitempty"`
+
+	// ScaledOwner represents the controller of the container Pod, which was scaled to zero replicas in case of
+	// checkpoint.StopPolicyScaleOwner.
+	ScaledOwner *checkpoint.ScaledOwner `json:"scaledOwner,omitempty"`
+
+	// Phase is the current phase of the checkpoint.
+	Phase checkpoint.Phase `json:"phase,omitempty"`
+
+	// QueuePosition is the 1-based position of the checkpoint waiting in the Queued phase for other checkpoints to
+	// finish. It is not stored, but filled in when the result is read.
+	QueuePosition int `json:"queuePosition,omitempty"`
+
+	// PhaseTransitions records every phase the checkpoint went through.
+	PhaseTransitions []PhaseTransition `json:"phaseTransitions,omitempty"`
+
+	// Hooks are the results of the pre and post checkpoint hooks run in the container, in the order they ran.
+	Hooks []checkpoint.HookResult `json:"hooks,omitempty"`
+
+	// Verification is the outcome of the test restore of ContainerImageName, if verification was requested.
+	Verification *checkpoint.VerificationResult `json:"verification,omitempty"`
+
+	// Callback is the status of the delivery of this entry to the callback URL, if a callback was requested.
+	Callback *CallbackDelivery `json:"callback,omitempty"`
+
+	// Attempts is the number of times the checkpoint image was built, including retries from the same checkpoint
+	// archive.
+	Attempts int64 `json:"attempts,omitempty"`
+
+	// ArchiveRetained is true if the checkpoint failed, but the checkpoint archive created by Kubelet was kept on the
+	// Node, so that the checkpoint can be retried from it without checkpointing the container again.
+	ArchiveRetained bool `json:"archiveRetained,omitempty"`
+
+	// StopError is the error that might have occurred while stopping the checkpointed Pod. It does not fail the
+	// checkpoint, as the checkpoint image is already pushed.
+	StopError *checkpoint.CheckpointError `json:"stopError,omitempty"`
+
 	// Error is the error that might have occurred during checkpointing.
-	Error error `json:"error,omitempty"`
+	Error *checkpoint.CheckpointError `json:"error,omitempty"`
+
+	// Group is the group checkpoint stored by GroupCoordinator, nil in the entries of checkpoints.
+	Group *GroupRecord `json:"group,omitempty"`
+}
+
+// PhaseTransition represents the checkpoint entering a phase.
+type PhaseTransition struct {
+	// Phase is the phase the checkpoint entered.
+	Phase checkpoint.Phase `json:"phase"`
+
+	// Timestamp is a Unix timestamp representing the time the checkpoint entered the phase.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// InProgress reports whether the checkpoint has not finished yet.
+func (entry *CheckpointEntry) InProgress() bool {
+	return !entry.Phase.Finished()
+}
+
+// EntryFilter selects CheckpointEntry instances when listing them. Zero values of the fields match every entry.
+type EntryFilter struct {
+	Namespace string
+	Pod       string
+	Container string
+	Phase     checkpoint.Phase
+	Slot      string
+
+	// LabelSelector selects entries by their Labels. Nil selector matches every entry.
+	LabelSelector labels.Selector
+
+	// Since and Until bound BeginTimestamp of the entries, both inclusive.
+	Since int64
+	Until int64
+
+	// After skips the entries up to and including the one at the cursor, so that listing continues with the next page.
+	After *EntryCursor
+
+	// Limit is the maximum number of entries listed, 0 means no limit.
+	Limit int
+}
+
+// Matches reports whether entry is selected by the filter, regardless of After and Limit.
+func (filter EntryFilter) Matches(entry CheckpointEntry) bool {
+	ci := entry.ContainerIdentifier
+	return (filter.Namespace == "" || filter.Namespace == ci.Namespace) &&
+		(filter.Pod == "" || filter.Pod == ci.Pod) &&
+		(filter.Container == "" || filter.Container == ci.Container) &&
+		(filter.Phase == "" || filter.Phase == entry.Phase) &&
+		(filter.Slot == "" || filter.Slot == entry.Slot) &&
+		(filter.LabelSelector == nil || filter.LabelSelector.Matches(labels.Set(entry.Labels))) &&
+		(filter.Since == 0 || entry.BeginTimestamp >= filter.Since) &&
+		(filter.Until == 0 || entry.BeginTimestamp <= filter.Until)
+}
+
+// CompareEntries orders entries the way they are listed, the most recently begun first. Entries which began at the
+// same time are ordered by their tracking handle, so that the order is the same on every Checkpointer.
+func CompareEntries(a, b CheckpointEntry) int {
+	if a.BeginTimestamp != b.BeginTimestamp {
+		return cmp.Compare(b.BeginTimestamp, a.BeginTimestamp)
+	}
+	return cmp.Compare(a.CheckpointIdentifier, b.CheckpointIdentifier)
+}
+
+// EntryCursor marks the position of an entry in the listing order, so that listing can continue after it.
+type EntryCursor struct {
+	BeginTimestamp       int64
+	CheckpointIdentifier string
+}
+
+// EntryCursorOf returns the cursor pointing at entry.
+func EntryCursorOf(entry CheckpointEntry) EntryCursor {
+	return EntryCursor{entry.BeginTimestamp, entry.CheckpointIdentifier}
+}
+
+// String encodes the cursor as an opaque continue token.
+func (c EntryCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.BeginTimestamp, 10) + "/" + c.CheckpointIdentifier))
+}
+
+// ParseEntryCursor decodes the continue token created by EntryCursor.String. Returns error if the token is malformed.
+func ParseEntryCursor(token string) (*EntryCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed continue token")
+	}
+	timestamp, checkpointIdentifier, found := strings.Cut(string(decoded), "/")
+	beginTimestamp, err := strconv.ParseInt(timestamp, 10, 64)
+	if !found || err != nil {
+		return nil, fmt.Errorf("malformed continue token")
+	}
+	return &EntryCursor{beginTimestamp, checkpointIdentifier}, nil
+}
+
+// filterEntries returns the entries selected by filter in the listing order.
+func filterEntries(entries []CheckpointEntry, filter EntryFilter) []CheckpointEntry {
+	selected := slices.DeleteFunc(entries, func(entry CheckpointEntry) bool { return !filter.Matches(entry) })
+	slices.SortFunc(selected, CompareEntries)
+	if filter.After != nil {
+		after := CheckpointEntry{BeginTimestamp: filter.After.BeginTimestamp, CheckpointIdentifier: filter.After.CheckpointIdentifier}
+		start, _ := slices.BinarySearchFunc(selected, after, CompareEntries)
+		if start < len(selected) && CompareEntries(selected[start], after) == 0 {
+			start++
+		}
+		selected = selected[start:]
+	}
+	if filter.Limit > 0 && len(selected) > filter.Limit {
+		selected = selected[:filter.Limit]
+	}
+	return selected
 }
 
 // CheckpointStorage is responsible for storing CheckpointEntry instances.
@@ -36,6 +209,14 @@ type CheckpointStorage interface {
 	// Returns error on fail. If there is CheckpointEntry stored under given key, returns pointer to a CheckpointEntry
 	// instance, otherwise returns nil pointer.
 	ReadEntry(checkpointIdentifier string) (*CheckpointEntry, error)
+
+	// ListEntries returns the stored checkpoint entries selected by filter in the order given by CompareEntries.
+	// The latest checkpoints of containers are not listed, as they are copies of other entries. Returns error on fail.
+	ListEntries(filter EntryFilter) ([]CheckpointEntry, error)
+
+	// DeleteEntry deletes CheckpointEntry stored under checkpointIdentifier key. Deleting entry which does not exist
+	// succeeds. Returns error on fail.
+	DeleteEntry(checkpointIdentifier string) error
 }
 
 // checkpointDiskStorage stores instances of CheckpointEntry as files on the file system using storageBackend.
@@ -43,6 +224,13 @@ type CheckpointStorage interface {
 // for read/write.
 type checkpointDiskStorage struct {
 	storageBackend *diskv.Diskv
+
+	// mu guards index.
+	mu sync.Mutex
+
+	// index holds the fields entries are filtered and ordered by, keyed by checkpointIdentifier, so that listing does
+	// not read every entry. It is built on first listing and kept up to date by StoreEntry and DeleteEntry.
+	index map[string]CheckpointEntry
 }
 
 func NewCheckpointStorage(config config.GlobalConfig) CheckpointStorage {
@@ -50,7 +238,20 @@ func NewCheckpointStorage(config config.GlobalConfig) CheckpointStorage {
 		BasePath:     config.StorageBasePath,
 		CacheSizeMax: 1024 * 1024,
 	})
-	return &checkpointDiskStorage{storageBackend}
+	return &checkpointDiskStorage{storageBackend: storageBackend}
+}
+
+// OpenCheckpointStorage returns CheckpointStorage of the backend selected by globalConfig. The client is only used
+// by config.StorageBackendConfigMap. Returns error if the storage cannot be opened.
+func OpenCheckpointStorage(globalConfig config.GlobalConfig, client kubernetes.Interface) (CheckpointStorage, error) {
+	switch globalConfig.StorageConfig.Backend {
+	case config.StorageBackendBolt:
+		return NewBoltCheckpointStorage(globalConfig.StorageConfig.BoltPath)
+	case config.StorageBackendConfigMap:
+		checkpointConfig := globalConfig.CheckpointConfig
+		return NewConfigMapCheckpointStorage(client, checkpointConfig.CheckpointerNamespace, checkpointConfig.CheckpointerNode), nil
+	}
+	return NewCheckpointStorage(globalConfig), nil
 }
 
 func (cs *checkpointDiskStorage) StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error {
@@ -58,9 +259,15 @@ func (cs *checkpointDiskStorage) StoreEntry(checkpointIdentifier string, entry C
 	if err != nil {
 		return fmt.Errorf("failed to marshal checkpoint entry: %w", err)
 	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 	if err := cs.storageBackend.Write(checkpointIdentifier, marshalled); err != nil {
 		return fmt.Errorf("failed to write checkpoint entry: %w", err)
 	}
+	if cs.index != nil && !strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix) {
+		cs.index[checkpointIdentifier] = indexedEntry(checkpointIdentifier, entry)
+	}
 	return nil
 }
 
@@ -78,3 +285,91 @@ func (cs *checkpointDiskStorage) ReadEntry(checkpointIdentifier string) (*Checkp
 	}
 	return entry, nil
 }
+
+func (cs *checkpointDiskStorage) ListEntries(filter EntryFilter) ([]CheckpointEntry, error) {
+	cs.mu.Lock()
+	if err := cs.buildIndex(); err != nil {
+		cs.mu.Unlock()
+		return nil, err
+	}
+	indexed := make([]CheckpointEntry, 0, len(cs.index))
+	keys := make(map[string]string, len(cs.index))
+	for checkpointIdentifier, entry := range cs.index {
+		indexed = append(indexed, entry)
+		keys[entry.CheckpointIdentifier] = checkpointIdentifier
+	}
+	cs.mu.Unlock()
+
+	selected := filterEntries(indexed, filter)
+	entries := make([]CheckpointEntry, 0, len(selected))
+	for _, summary := range selected {
+		entry, err := cs.ReadEntry(keys[summary.CheckpointIdentifier])
+		if err != nil {
+			return nil, err
+		}
+		// The entry might have been deleted meanwhile.
+		if entry != nil {
+			entry.CheckpointIdentifier = summary.CheckpointIdentifier
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+func (cs *checkpointDiskStorage) DeleteEntry(checkpointIdentifier string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.storageBackend.Has(checkpointIdentifier) {
+		if err := cs.storageBackend.Erase(checkpointIdentifier); err != nil {
+			return fmt.Errorf("failed to erase checkpoint entry: %w", err)
+		}
+	}
+	if cs.index != nil {
+		delete(cs.index, checkpointIdentifier)
+	}
+	return nil
+}
+
+// buildIndex reads every stored entry into index, unless it is built already. Only the files directly within the base
+// path are entries, the subdirectories belong to other storages sharing the base path. Must be called with mu held.
+func (cs *checkpointDiskStorage) buildIndex() error {
+	if cs.index != nil {
+		return nil
+	}
+	files, err := os.ReadDir(cs.storageBackend.BasePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to list checkpoint entries: %w", err)
+	}
+
+	index := make(map[string]CheckpointEntry, len(files))
+	for _, file := range files {
+		checkpointIdentifier := file.Name()
+		if file.IsDir() || strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix) || strings.HasPrefix(checkpointIdentifier, ".") {
+			continue
+		}
+		entry, err := cs.ReadEntry(checkpointIdentifier)
+		if err != nil || entry == nil {
+			log.Warn().Err(err).Str("checkpointIdentifier", checkpointIdentifier).Msg("skipping unreadable checkpoint entry")
+			continue
+		}
+		index[checkpointIdentifier] = indexedEntry(checkpointIdentifier, *entry)
+	}
+	cs.index = index
+	return nil
+}
+
+// indexedEntry returns the fields of entry needed to filter and order it. Entries stored before tracking handles
+// were recorded are indexed under their checkpointIdentifier.
+func indexedEntry(checkpointIdentifier string, entry CheckpointEntry) CheckpointEntry {
+	if entry.CheckpointIdentifier == "" {
+		entry.CheckpointIdentifier = checkpointIdentifier
+	}
+	return CheckpointEntry{
+		CheckpointIdentifier: entry.CheckpointIdentifier,
+		ContainerIdentifier:  entry.ContainerIdentifier,
+		BeginTimestamp:       entry.BeginTimestamp,
+		Labels:               entry.Labels,
+		Slot:                 entry.Slot,
+		Phase:                entry.Phase,
+	}
+}
@@ -0,0 +1,236 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// entriesBucket holds the marshalled entries keyed by checkpointIdentifier.
+	entriesBucket = []byte("entries")
+
+	// latestBucket holds the latest successful checkpoints of containers, which are not listed.
+	latestBucket = []byte("latest")
+
+	// beginIndexBucket indexes entries in the listing order, see beginIndexKey.
+	beginIndexBucket = []byte("index-begin")
+
+	// podIndexBucket indexes entries by their Pod and then in the listing order, see podIndexKey.
+	podIndexBucket = []byte("index-pod")
+)
+
+// boltOpenTimeout bounds the time waiting for the lock of the database file, which is held by another process using
+// the same file.
+const boltOpenTimeout = 5 * time.Second
+
+// checkpointBoltStorage stores instances of CheckpointEntry in a bbolt database. Next to the entries, the database
+// holds secondary indexes ordered by CompareEntries, so that listing reads only the selected entries. The entries and
+// their index keys are always written in the same transaction.
+type checkpointBoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltCheckpointStorage opens the bbolt database at path, creating it if it does not exist, and returns
+// CheckpointStorage backed by it. Returns error if the database cannot be opened, e.g. because another process holds it.
+func NewBoltCheckpointStorage(path string) (CheckpointStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint database directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{entriesBucket, latestBucket, beginIndexBucket, podIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize checkpoint database: %w", err)
+	}
+	return &checkpointBoltStorage{db}, nil
+}
+
+func (cs *checkpointBoltStorage) StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error {
+	marshalled, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint entry: %w", err)
+	}
+
+	err = cs.db.Update(func(tx *bolt.Tx) error {
+		if strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix) {
+			return tx.Bucket(latestBucket).Put([]byte(checkpointIdentifier), marshalled)
+		}
+		if err := deleteIndexKeys(tx, checkpointIdentifier); err != nil {
+			return err
+		}
+		if err := tx.Bucket(entriesBucket).Put([]byte(checkpointIdentifier), marshalled); err != nil {
+			return err
+		}
+		summary := indexedEntry(checkpointIdentifier, entry)
+		if err := tx.Bucket(beginIndexBucket).Put(beginIndexKey(summary), []byte(checkpointIdentifier)); err != nil {
+			return err
+		}
+		return tx.Bucket(podIndexBucket).Put(podIndexKey(summary), []byte(checkpointIdentifier))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint entry: %w", err)
+	}
+	return nil
+}
+
+func (cs *checkpointBoltStorage) ReadEntry(checkpointIdentifier string) (*CheckpointEntry, error) {
+	var entry *CheckpointEntry
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = readBoltEntry(tx, checkpointIdentifier)
+		return err
+	})
+	return entry, err
+}
+
+func (cs *checkpointBoltStorage) ListEntries(filter EntryFilter) ([]CheckpointEntry, error) {
+	// Entries of a single Pod are read from the Pod index, other listings walk every entry in the listing order.
+	index, prefix := beginIndexBucket, []byte{}
+	if filter.Namespace != "" && filter.Pod != "" {
+		index, prefix = podIndexBucket, podIndexPrefix(filter.Namespace, filter.Pod)
+	}
+
+	// The index keys are ordered like the entries are listed, so the walk starts at the cursor or at Until and stops
+	// at Since or once Limit entries are selected.
+	start := bytes.Clone(prefix)
+	if filter.Until != 0 {
+		start = append(start, invertedTimestamp(filter.Until)...)
+	}
+	if filter.After != nil {
+		start = append(bytes.Clone(prefix), indexSuffix(filter.After.BeginTimestamp, filter.After.CheckpointIdentifier)...)
+	}
+
+	var entries []CheckpointEntry
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(index).Cursor()
+		for key, value := cursor.Seek(start); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			if filter.After != nil && bytes.Equal(key, start) {
+				continue
+			}
+			beginTimestamp := math.MaxInt64 - int64(binary.BigEndian.Uint64(key[len(prefix):]))
+			if filter.Since != 0 && beginTimestamp < filter.Since {
+				break
+			}
+
+			entry, err := readBoltEntry(tx, string(value))
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				continue
+			}
+			if entry.CheckpointIdentifier == "" {
+				entry.CheckpointIdentifier = string(value)
+			}
+			if !filter.Matches(*entry) {
+				continue
+			}
+			entries = append(entries, *entry)
+			if filter.Limit > 0 && len(entries) == filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoint entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (cs *checkpointBoltStorage) DeleteEntry(checkpointIdentifier string) error {
+	err := cs.db.Update(func(tx *bolt.Tx) error {
+		if strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix) {
+			return tx.Bucket(latestBucket).Delete([]byte(checkpointIdentifier))
+		}
+		if err := deleteIndexKeys(tx, checkpointIdentifier); err != nil {
+			return err
+		}
+		return tx.Bucket(entriesBucket).Delete([]byte(checkpointIdentifier))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to erase checkpoint entry: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database, so that other processes can open it.
+func (cs *checkpointBoltStorage) Close() error {
+	return cs.db.Close()
+}
+
+// readBoltEntry reads the entry stored under checkpointIdentifier within tx. Returns nil pointer if there is none.
+func readBoltEntry(tx *bolt.Tx, checkpointIdentifier string) (*CheckpointEntry, error) {
+	bucket := entriesBucket
+	if strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix) {
+		bucket = latestBucket
+	}
+	marshalled := tx.Bucket(bucket).Get([]byte(checkpointIdentifier))
+	if marshalled == nil {
+		return nil, nil
+	}
+	entry := &CheckpointEntry{}
+	if err := json.Unmarshal(marshalled, entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal checkpoint entry: %w", err)
+	}
+	return entry, nil
+}
+
+// deleteIndexKeys deletes the index keys of the entry stored under checkpointIdentifier within tx, if there is one.
+func deleteIndexKeys(tx *bolt.Tx, checkpointIdentifier string) error {
+	previous, err := readBoltEntry(tx, checkpointIdentifier)
+	if err != nil || previous == nil {
+		return err
+	}
+	summary := indexedEntry(checkpointIdentifier, *previous)
+	if err := tx.Bucket(beginIndexBucket).Delete(beginIndexKey(summary)); err != nil {
+		return err
+	}
+	return tx.Bucket(podIndexBucket).Delete(podIndexKey(summary))
+}
+
+// beginIndexKey returns the key of entry in beginIndexBucket. The keys sort in the order given by CompareEntries.
+func beginIndexKey(entry CheckpointEntry) []byte {
+	return indexSuffix(entry.BeginTimestamp, entry.CheckpointIdentifier)
+}
+
+// podIndexKey returns the key of entry in podIndexBucket. The keys of the entries of a Pod share a prefix and sort in
+// the order given by CompareEntries.
+func podIndexKey(entry CheckpointEntry) []byte {
+	ci := entry.ContainerIdentifier
+	return append(podIndexPrefix(ci.Namespace, ci.Pod), beginIndexKey(entry)...)
+}
+
+// podIndexPrefix returns the prefix shared by the podIndexBucket keys of the entries of a Pod. Namespaces and Pod
+// names cannot contain the zero byte, so the prefix of one Pod is never a prefix of another.
+func podIndexPrefix(namespace, pod string) []byte {
+	return []byte(namespace + "\x00" + pod + "\x00")
+}
+
+// indexSuffix returns the inverted beginTimestamp followed by the tracking handle, so that the most recently begun
+// entry sorts first.
+func indexSuffix(beginTimestamp int64, checkpointIdentifier string) []byte {
+	return append(invertedTimestamp(beginTimestamp), checkpointIdentifier...)
+}
+
+func invertedTimestamp(timestamp int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(math.MaxInt64-timestamp))
+}
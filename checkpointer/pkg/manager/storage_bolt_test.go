@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"io"
+	"k8s.io/apimachinery/pkg/labels"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_checkpointBoltStorage_ListEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bolt", "checkpoints.db")
+	storage, err := NewBoltCheckpointStorage(path)
+	if err != nil {
+		t.Fatalf("failed to open bolt storage: %v", err)
+	}
+
+	entries := []CheckpointEntry{
+		{CheckpointIdentifier: "node:a", ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "web"}, BeginTimestamp: 100, Phase: checkpoint.PhaseSucceeded, Labels: map[string]string{"app": "web"}},
+		{CheckpointIdentifier: "node:b", ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "db"}, BeginTimestamp: 200, Phase: checkpoint.PhaseFailed},
+		{CheckpointIdentifier: "node:c", ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "web"}, BeginTimestamp: 300, Phase: checkpoint.PhasePushing, Labels: map[string]string{"app": "web"}},
+	}
+	for _, entry := range entries {
+		if err := storage.StoreEntry(entry.CheckpointIdentifier[len("node:"):], entry); err != nil {
+			t.Fatalf("failed to store CheckpointEntry: %v", err)
+		}
+	}
+	// Storing the entry again replaces its index keys.
+	entries[2].Phase = checkpoint.PhaseSucceeded
+	_ = storage.StoreEntry("c", entries[2])
+	_ = storage.StoreEntry(latestEntryKey(entries[2].ContainerIdentifier), entries[2])
+
+	latest, err := storage.ReadEntry(latestEntryKey(entries[2].ContainerIdentifier))
+	if err != nil || latest == nil || !reflect.DeepEqual(*latest, entries[2]) {
+		t.Fatalf("latest checkpoint should be readable, got: %v, %v", latest, err)
+	}
+
+	listed, err := storage.ListEntries(EntryFilter{})
+	if err != nil {
+		t.Fatalf("failed to list CheckpointEntry: %v", err)
+	}
+	if len(listed) != 3 || listed[0].CheckpointIdentifier != "node:c" || listed[2].CheckpointIdentifier != "node:a" {
+		t.Fatalf("entries should be listed newest first without the latest checkpoints, got: %v", listed)
+	}
+
+	selector, _ := labels.Parse("app=web")
+	listed, _ = storage.ListEntries(EntryFilter{Namespace: "ns", Pod: "web", LabelSelector: selector, Phase: checkpoint.PhaseSucceeded, Limit: 1})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:c" {
+		t.Fatalf("filter should select the newest web checkpoint, got: %v", listed)
+	}
+	cursor := EntryCursorOf(listed[0])
+	listed, _ = storage.ListEntries(EntryFilter{Namespace: "ns", Pod: "web", After: &cursor})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:a" {
+		t.Fatalf("listing should continue after the cursor, got: %v", listed)
+	}
+	listed, _ = storage.ListEntries(EntryFilter{Since: 150, Until: 250})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:b" {
+		t.Fatalf("listing should be bounded by since and until, got: %v", listed)
+	}
+
+	if err := storage.DeleteEntry("b"); err != nil {
+		t.Fatalf("failed to delete CheckpointEntry: %v", err)
+	}
+	_ = storage.(io.Closer).Close()
+
+	// The entries and their indexes outlive the process.
+	storage, err = NewBoltCheckpointStorage(path)
+	if err != nil {
+		t.Fatalf("failed to reopen bolt storage: %v", err)
+	}
+	defer storage.(io.Closer).Close()
+	listed, _ = storage.ListEntries(EntryFilter{Since: 150})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:c" {
+		t.Fatalf("deleted entry should not be listed, got: %v", listed)
+	}
+}
+
+func Test_MigrateDiskStorage(t *testing.T) {
+	basePath := t.TempDir()
+	source := NewCheckpointStorage(config.GlobalConfig{StorageBasePath: basePath})
+	_ = source.StoreEntry("a", checkpointEntry)
+	_ = source.StoreEntry(latestEntryKey(checkpointEntry.ContainerIdentifier), checkpointEntry)
+
+	target, err := NewBoltCheckpointStorage(filepath.Join(basePath, "bolt", "checkpoints.db"))
+	if err != nil {
+		t.Fatalf("failed to open bolt storage: %v", err)
+	}
+	defer target.(io.Closer).Close()
+
+	migrated, err := MigrateDiskStorage(basePath, target)
+	if err != nil || migrated != 2 {
+		t.Fatalf("both entries should be migrated, got: %d, %v", migrated, err)
+	}
+	for _, key := range []string{"a", latestEntryKey(checkpointEntry.ContainerIdentifier)} {
+		if entry, _ := target.ReadEntry(key); entry == nil || !reflect.DeepEqual(*entry, checkpointEntry) {
+			t.Errorf("entry %s was not migrated, got: %v", key, entry)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// configMapEntryKey is the key of the marshalled entry within the data of its ConfigMap.
+	configMapEntryKey = "entry.json"
+
+	// configMapManagedByLabel marks the ConfigMaps storing checkpoint entries.
+	configMapManagedByLabel = "app.kubernetes.io/managed-by"
+	configMapManagedBy      = "checkpointer"
+
+	// configMapNodeLabel holds the Node of the Checkpointer the entry belongs to, see nodeLabelValue.
+	configMapNodeLabel = "checkpoint.k8s/node"
+
+	// configMapLatestLabel marks the ConfigMaps storing the latest checkpoints of containers, which are not listed.
+	configMapLatestLabel = "checkpoint.k8s/latest"
+
+	// configMapKeyAnnotation holds the storage key of the entry, which might not be a valid ConfigMap name.
+	configMapKeyAnnotation = "checkpoint.k8s/key"
+
+	// configMapRequestTimeout bounds every request to the API server.
+	configMapRequestTimeout = 10 * time.Second
+)
+
+// NodeEntryReader reads the entries stored by the Checkpointers of other Nodes. It is implemented by cluster-wide
+// storages, so that the results of a Node without a running Checkpointer can still be read.
+type NodeEntryReader interface {
+
+	// ReadNodeEntry reads CheckpointEntry stored by the Checkpointer of node under checkpointIdentifier key. Returns
+	// nil pointer if there is none.
+	ReadNodeEntry(node, checkpointIdentifier string) (*CheckpointEntry, error)
+}
+
+// NodeEntryLister lists the entries stored by the Checkpointers of other Nodes. It is implemented by cluster-wide
+// storages, so that the results of Nodes without a running Checkpointer, including deleted Nodes, can still be listed.
+type NodeEntryLister interface {
+
+	// ListEntriesExcept returns the entries stored by the Checkpointers of every Node except nodes selected by
+	// filter, like CheckpointStorage.ListEntries.
+	ListEntriesExcept(nodes []string, filter EntryFilter) ([]CheckpointEntry, error)
+}
+
+// checkpointConfigMapStorage stores every instance of CheckpointEntry as a ConfigMap in the Checkpointer Namespace.
+// The entries of each Checkpointer are told apart by the Node label, so that the storage is shared by the whole
+// cluster, but every Checkpointer lists only its own entries.
+type checkpointConfigMapStorage struct {
+	client    kubernetes.Interface
+	namespace string
+	node      string
+
+	// resourceVersions holds the resourceVersion of every ConfigMap last written or read by the storage, keyed by its
+	// name, so that updates are rejected with a conflict if the ConfigMap has been changed since.
+	mu               sync.Mutex
+	resourceVersions map[string]string
+}
+
+// NewConfigMapCheckpointStorage constructs CheckpointStorage storing the entries of the Checkpointer of node as
+// ConfigMaps in namespace.
+func NewConfigMapCheckpointStorage(client kubernetes.Interface, namespace, node string) CheckpointStorage {
+	return &checkpointConfigMapStorage{
+		client:           client,
+		namespace:        namespace,
+		node:             node,
+		resourceVersions: make(map[string]string),
+	}
+}
+
+func (cs *checkpointConfigMapStorage) StoreEntry(checkpointIdentifier string, entry CheckpointEntry) error {
+	marshalled, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint entry: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configMapRequestTimeout)
+	defer cancel()
+
+	configMap := cs.configMap(checkpointIdentifier, marshalled)
+	configMaps := cs.client.CoreV1().ConfigMaps(cs.namespace)
+	// The ConfigMap is updated with the resourceVersion it was last seen with. On conflict, the ConfigMap has been
+	// changed since, so its current resourceVersion is read and the update is retried.
+	refresh := false
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		resourceVersion := cs.resourceVersion(configMap.Name)
+		if refresh || resourceVersion == "" {
+			existing, err := configMaps.Get(ctx, configMap.Name, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				written, err := configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+				if errors.IsAlreadyExists(err) {
+					refresh = true
+					return errors.NewConflict(v1.Resource("configmaps"), configMap.Name, err)
+				}
+				if err == nil {
+					cs.setResourceVersion(configMap.Name, written.ResourceVersion)
+				}
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			resourceVersion = existing.ResourceVersion
+		}
+		configMap.ResourceVersion = resourceVersion
+		written, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		if errors.IsConflict(err) || errors.IsNotFound(err) {
+			refresh = true
+			return errors.NewConflict(v1.Resource("configmaps"), configMap.Name, err)
+		}
+		if err == nil {
+			cs.setResourceVersion(configMap.Name, written.ResourceVersion)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint entry: %w", err)
+	}
+	return nil
+}
+
+func (cs *checkpointConfigMapStorage) ReadEntry(checkpointIdentifier string) (*CheckpointEntry, error) {
+	return cs.ReadNodeEntry(cs.node, checkpointIdentifier)
+}
+
+func (cs *checkpointConfigMapStorage) ReadNodeEntry(node, checkpointIdentifier string) (*CheckpointEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configMapRequestTimeout)
+	defer cancel()
+
+	configMap, err := cs.client.CoreV1().ConfigMaps(cs.namespace).Get(ctx, configMapName(node, checkpointIdentifier), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint entry: %w", err)
+	}
+	if node == cs.node {
+		cs.setResourceVersion(configMap.Name, configMap.ResourceVersion)
+	}
+	return unmarshalConfigMapEntry(configMap)
+}
+
+func (cs *checkpointConfigMapStorage) ListEntries(filter EntryFilter) ([]CheckpointEntry, error) {
+	// Only the entries of this Checkpointer's Node are listed by the API server, the rest of filter is applied here.
+	nodeRequirement, err := labels.NewRequirement(configMapNodeLabel, selection.Equals, []string{nodeLabelValue(cs.node)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to select checkpoint entries: %w", err)
+	}
+	return cs.listEntries(*nodeRequirement, filter)
+}
+
+func (cs *checkpointConfigMapStorage) ListEntriesExcept(nodes []string, filter EntryFilter) ([]CheckpointEntry, error) {
+	values := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		values = append(values, nodeLabelValue(node))
+	}
+	operator := selection.NotIn
+	if len(values) == 0 {
+		operator = selection.Exists
+	}
+	nodeRequirement, err := labels.NewRequirement(configMapNodeLabel, operator, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select checkpoint entries: %w", err)
+	}
+	return cs.listEntries(*nodeRequirement, filter)
+}
+
+// listEntries lists the entries, except the latest checkpoints of containers, of the Nodes selected by
+// nodeRequirement and applies filter to them.
+func (cs *checkpointConfigMapStorage) listEntries(nodeRequirement labels.Requirement, filter EntryFilter) ([]CheckpointEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configMapRequestTimeout)
+	defer cancel()
+
+	selector := labels.SelectorFromSet(labels.Set{
+		configMapManagedByLabel: configMapManagedBy,
+		configMapLatestLabel:    "false",
+	}).Add(nodeRequirement)
+	configMaps, err := cs.client.CoreV1().ConfigMaps(cs.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoint entries: %w", err)
+	}
+
+	entries := make([]CheckpointEntry, 0, len(configMaps.Items))
+	for _, configMap := range configMaps.Items {
+		entry, err := unmarshalConfigMapEntry(&configMap)
+		if err != nil {
+			return nil, err
+		}
+		if entry.CheckpointIdentifier == "" {
+			entry.CheckpointIdentifier = configMap.Annotations[configMapKeyAnnotation]
+		}
+		entries = append(entries, *entry)
+	}
+	return filterEntries(entries, filter), nil
+}
+
+func (cs *checkpointConfigMapStorage) ListClusterEntries(ctx context.Context) ([]CheckpointEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, configMapRequestTimeout)
+	defer cancel()
+
+	selector := labels.SelectorFromSet(labels.Set{configMapManagedByLabel: configMapManagedBy})
+	configMaps, err := cs.client.CoreV1().ConfigMaps(cs.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoint entries: %w", err)
+	}
+
+	entries := make([]CheckpointEntry, 0, len(configMaps.Items))
+	for _, configMap := range configMaps.Items {
+		entry, err := unmarshalConfigMapEntry(&configMap)
+		if err != nil {
+			return nil, err
+		}
+		if entry.CheckpointIdentifier == "" {
+			entry.CheckpointIdentifier = configMap.Annotations[configMapKeyAnnotation]
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+func (cs *checkpointConfigMapStorage) DeleteEntry(checkpointIdentifier string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), configMapRequestTimeout)
+	defer cancel()
+
+	name := configMapName(cs.node, checkpointIdentifier)
+	err := cs.client.CoreV1().ConfigMaps(cs.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to erase checkpoint entry: %w", err)
+	}
+	cs.setResourceVersion(name, "")
+	return nil
+}
+
+// resourceVersion returns the resourceVersion the ConfigMap with name was last seen with or empty string if unknown.
+func (cs *checkpointConfigMapStorage) resourceVersion(name string) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.resourceVersions[name]
+}
+
+// setResourceVersion remembers resourceVersion of the ConfigMap with name, empty resourceVersion forgets it.
+func (cs *checkpointConfigMapStorage) setResourceVersion(name, resourceVersion string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if resourceVersion == "" {
+		delete(cs.resourceVersions, name)
+		return
+	}
+	cs.resourceVersions[name] = resourceVersion
+}
+
+// configMap returns the ConfigMap storing the marshalled entry under checkpointIdentifier key.
+func (cs *checkpointConfigMapStorage) configMap(checkpointIdentifier string, marshalled []byte) *v1.ConfigMap {
+	latest := strings.HasPrefix(checkpointIdentifier, latestEntryKeyPrefix)
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configMapName(cs.node, checkpointIdentifier),
+			Namespace: cs.namespace,
+			Labels: map[string]string{
+				configMapManagedByLabel: configMapManagedBy,
+				configMapNodeLabel:      nodeLabelValue(cs.node),
+				configMapLatestLabel:    fmt.Sprint(latest),
+			},
+			Annotations: map[string]string{
+				configMapKeyAnnotation: checkpointIdentifier,
+			},
+		},
+		Data: map[string]string{configMapEntryKey: string(marshalled)},
+	}
+}
+
+func unmarshalConfigMapEntry(configMap *v1.ConfigMap) (*CheckpointEntry, error) {
+	entry := &CheckpointEntry{}
+	if err := json.Unmarshal([]byte(configMap.Data[configMapEntryKey]), entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal checkpoint entry %s: %w", configMap.Name, err)
+	}
+	return entry, nil
+}
+
+// configMapName returns the name of the ConfigMap storing the entry of the Checkpointer of node under
+// checkpointIdentifier key. Storage keys are not valid ConfigMap names and are only unique per Node, so the name is
+// derived from the hash of both.
+func configMapName(node, checkpointIdentifier string) string {
+	hash := sha256.Sum256([]byte(node + ":" + checkpointIdentifier))
+	return "checkpoint-" + hex.EncodeToString(hash[:16])
+}
+
+// nodeLabelValue returns node as a label value. Node names longer than label values are allowed to be are replaced
+// by their hash.
+func nodeLabelValue(node string) string {
+	if len(validation.IsValidLabelValue(node)) == 0 {
+		return node
+	}
+	hash := sha256.Sum256([]byte(node))
+	return hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,126 @@
+package manager
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_checkpointConfigMapStorage(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	storage := NewConfigMapCheckpointStorage(client, "checkpointer", "node-1")
+	otherStorage := NewConfigMapCheckpointStorage(client, "checkpointer", "node-2")
+
+	entry := checkpointEntry
+	entry.CheckpointIdentifier = "node-1:Upper_Case.id"
+	entry.Phase = checkpoint.PhasePushing
+	if err := storage.StoreEntry("Upper_Case.id", entry); err != nil {
+		t.Fatalf("failed to store CheckpointEntry: %v", err)
+	}
+	entry.Phase = checkpoint.PhaseSucceeded
+	if err := storage.StoreEntry("Upper_Case.id", entry); err != nil {
+		t.Fatalf("failed to update CheckpointEntry: %v", err)
+	}
+	_ = storage.StoreEntry(latestEntryKey(entry.ContainerIdentifier), entry)
+	_ = otherStorage.StoreEntry("Upper_Case.id", checkpointEntry)
+
+	readEntry, err := storage.ReadEntry("Upper_Case.id")
+	if err != nil || readEntry == nil || !reflect.DeepEqual(*readEntry, entry) {
+		t.Fatalf("stored entry should be read back, got: %v, %v", readEntry, err)
+	}
+	readEntry, _ = otherStorage.(NodeEntryReader).ReadNodeEntry("node-1", "Upper_Case.id")
+	if readEntry == nil || readEntry.Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("entry should be readable by Checkpointers of other Nodes, got: %v", readEntry)
+	}
+
+	listed, err := storage.ListEntries(EntryFilter{})
+	if err != nil {
+		t.Fatalf("failed to list CheckpointEntry: %v", err)
+	}
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != entry.CheckpointIdentifier {
+		t.Fatalf("only the entries of the Node should be listed without the latest checkpoints, got: %v", listed)
+	}
+
+	orphaned, err := storage.(NodeEntryLister).ListEntriesExcept([]string{"node-1"}, EntryFilter{})
+	if err != nil || len(orphaned) != 1 || orphaned[0].Phase != checkpointEntry.Phase {
+		t.Fatalf("only the entries of other Nodes should be listed, got: %v, %v", orphaned, err)
+	}
+
+	clusterEntries, err := otherStorage.(ClusterEntryLister).ListClusterEntries(context.TODO())
+	if err != nil || len(clusterEntries) != 3 {
+		t.Fatalf("entries of every Node should be listed cluster-wide, got: %v, %v", clusterEntries, err)
+	}
+
+	if err := storage.DeleteEntry("Upper_Case.id"); err != nil {
+		t.Fatalf("failed to delete CheckpointEntry: %v", err)
+	}
+	if err := storage.DeleteEntry("Upper_Case.id"); err != nil {
+		t.Fatalf("deleting missing CheckpointEntry should succeed, got: %v", err)
+	}
+	if readEntry, _ := storage.ReadEntry("Upper_Case.id"); readEntry != nil {
+		t.Fatalf("deleted entry should not be read, got: %v", readEntry)
+	}
+	if readEntry, _ := otherStorage.ReadEntry("Upper_Case.id"); readEntry == nil {
+		t.Fatalf("entry of other Node with the same key should be kept")
+	}
+}
+
+func Test_checkpointConfigMapStorage_Conflict(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	storage := NewConfigMapCheckpointStorage(client, "checkpointer", "node-1")
+	entry := checkpointEntry
+	entry.Phase = checkpoint.PhasePushing
+	if err := storage.StoreEntry("id", entry); err != nil {
+		t.Fatalf("failed to store CheckpointEntry: %v", err)
+	}
+
+	conflicts := 0
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, errors.NewConflict(v1.Resource("configmaps"), "id", nil)
+	})
+	entry.Phase = checkpoint.PhaseSucceeded
+	if err := storage.StoreEntry("id", entry); err != nil {
+		t.Fatalf("update should be retried on conflict, got: %v", err)
+	}
+	if readEntry, _ := storage.ReadEntry("id"); readEntry == nil || readEntry.Phase != checkpoint.PhaseSucceeded {
+		t.Fatalf("retried update should be stored, got: %v", readEntry)
+	}
+}
+
+func Test_checkpointConfigMapStorage_ListSelector(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	storage := NewConfigMapCheckpointStorage(client, "checkpointer", "node-1")
+	if _, err := storage.ListEntries(EntryFilter{}); err != nil {
+		t.Fatalf("failed to list CheckpointEntry: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if list, ok := action.(k8stesting.ListAction); ok {
+			if selector := list.GetListRestrictions().Labels.String(); !strings.Contains(selector, configMapNodeLabel+"=node-1") {
+				t.Fatalf("entries should be selected by the Node label, got: %s", selector)
+			}
+			return
+		}
+	}
+	t.Fatalf("ConfigMaps should be listed")
+}
+
+func Test_nodeLabelValue(t *testing.T) {
+	if nodeLabelValue("node-1") != "node-1" {
+		t.Errorf("valid label value should be kept")
+	}
+	long := strings.Repeat("node.", 20)
+	if value := nodeLabelValue(long); len(value) > 63 || value == long {
+		t.Errorf("long Node name should be hashed, got: %s", value)
+	}
+}
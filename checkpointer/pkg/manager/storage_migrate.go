@@ -0,0 +1,40 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/peterbourgon/diskv/v3"
+	"os"
+	"strings"
+)
+
+// MigrateDiskStorage copies every CheckpointEntry stored by diskv storage in basePath to target, including the
+// latest checkpoints of containers, and returns the number of copied entries. Entries already stored in target under
+// the same key are overwritten, so that an interrupted migration can be run again. The diskv storage is left intact.
+func MigrateDiskStorage(basePath string, target CheckpointStorage) (int, error) {
+	files, err := os.ReadDir(basePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list checkpoint entries: %w", err)
+	}
+
+	source := &checkpointDiskStorage{storageBackend: diskv.New(diskv.Options{BasePath: basePath})}
+	migrated := 0
+	for _, file := range files {
+		// Subdirectories belong to other storages sharing the base path.
+		checkpointIdentifier := file.Name()
+		if file.IsDir() || strings.HasPrefix(checkpointIdentifier, ".") {
+			continue
+		}
+		entry, err := source.ReadEntry(checkpointIdentifier)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate checkpoint entry %s: %w", checkpointIdentifier, err)
+		}
+		if entry == nil {
+			continue
+		}
+		if err := target.StoreEntry(checkpointIdentifier, *entry); err != nil {
+			return migrated, fmt.Errorf("failed to migrate checkpoint entry %s: %w", checkpointIdentifier, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
@@ -4,6 +4,7 @@ import (
 	"checkpoint-in-k8s/pkg/checkpoint"
 	"checkpoint-in-k8s/pkg/config"
 	"io"
+	"k8s.io/apimachinery/pkg/labels"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -73,3 +74,86 @@ func Test_checkpointDiskStorage_StoreEntry(t *testing.T) {
 		t.Errorf("file contents don't match CheckpointEntry: \n%s\n%s", string(fileContent), marshalledCheckpointEntry)
 	}
 }
+
+func Test_checkpointDiskStorage_StoreEntry_Error(t *testing.T) {
+	storage := NewCheckpointStorage(config.GlobalConfig{StorageBasePath: t.TempDir()})
+
+	failedEntry := checkpointEntry
+	failedEntry.Phase = checkpoint.PhaseFailed
+	failedEntry.Error = &checkpoint.CheckpointError{
+		Code:      checkpoint.ErrorCodePushFailed,
+		Message:   "failed to attach to pod",
+		Phase:     checkpoint.PhasePushing,
+		Retryable: true,
+	}
+	if err := storage.StoreEntry("test", failedEntry); err != nil {
+		t.Fatalf("failed to store CheckpointEntry: %v", err)
+	}
+
+	readEntry, err := storage.ReadEntry("test")
+	if err != nil {
+		t.Fatalf("failed to to read CheckpointEntry: %v", err)
+	}
+	if !reflect.DeepEqual(*readEntry, failedEntry) {
+		t.Fatalf("error did not survive storage, got: %+v", readEntry.Error)
+	}
+}
+
+func Test_checkpointDiskStorage_ListEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	storage := NewCheckpointStorage(config.GlobalConfig{StorageBasePath: tempDir})
+
+	entries := []CheckpointEntry{
+		{CheckpointIdentifier: "node:a", ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "web"}, BeginTimestamp: 100, Phase: checkpoint.PhaseSucceeded, Labels: map[string]string{"app": "web"}},
+		{CheckpointIdentifier: "node:b", ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "db"}, BeginTimestamp: 200, Phase: checkpoint.PhaseFailed},
+		{CheckpointIdentifier: "node:c", ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "web"}, BeginTimestamp: 300, Phase: checkpoint.PhaseSucceeded, Labels: map[string]string{"app": "web"}},
+	}
+	for _, entry := range entries {
+		if err := storage.StoreEntry(entry.CheckpointIdentifier[len("node:"):], entry); err != nil {
+			t.Fatalf("failed to store CheckpointEntry: %v", err)
+		}
+	}
+	// Neither the latest checkpoints nor other storages sharing the base path are listed.
+	_ = storage.StoreEntry(latestEntryKey(entries[2].ContainerIdentifier), entries[2])
+	_ = os.MkdirAll(filepath.Join(tempDir, "pending"), 0755)
+	_ = os.WriteFile(filepath.Join(tempDir, "pending", "d"), []byte(marshalledCheckpointEntry), 0644)
+
+	listed, err := storage.ListEntries(EntryFilter{})
+	if err != nil {
+		t.Fatalf("failed to list CheckpointEntry: %v", err)
+	}
+	if len(listed) != 3 || listed[0].CheckpointIdentifier != "node:c" || listed[2].CheckpointIdentifier != "node:a" {
+		t.Fatalf("entries should be listed newest first, got: %v", listed)
+	}
+
+	selector, _ := labels.Parse("app=web")
+	listed, _ = storage.ListEntries(EntryFilter{Pod: "web", LabelSelector: selector, Phase: checkpoint.PhaseSucceeded, Limit: 1})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:c" {
+		t.Fatalf("filter should select the newest web checkpoint, got: %v", listed)
+	}
+	cursor := EntryCursorOf(listed[0])
+	listed, _ = storage.ListEntries(EntryFilter{Pod: "web", After: &cursor})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:a" {
+		t.Fatalf("listing should continue after the cursor, got: %v", listed)
+	}
+
+	if err := storage.DeleteEntry("b"); err != nil {
+		t.Fatalf("failed to delete CheckpointEntry: %v", err)
+	}
+	// Storage created after restart builds its index from the stored entries.
+	listed, _ = NewCheckpointStorage(config.GlobalConfig{StorageBasePath: tempDir}).ListEntries(EntryFilter{Since: 150})
+	if len(listed) != 1 || listed[0].CheckpointIdentifier != "node:c" {
+		t.Fatalf("deleted entry should not be listed, got: %v", listed)
+	}
+}
+
+func Test_EntryCursor(t *testing.T) {
+	cursor := EntryCursor{BeginTimestamp: 1734281060, CheckpointIdentifier: "node:b2c79a5bd8520ab5"}
+	parsed, err := ParseEntryCursor(cursor.String())
+	if err != nil || *parsed != cursor {
+		t.Fatalf("cursor did not survive encoding, got: %v, %v", parsed, err)
+	}
+	if _, err := ParseEntryCursor("not a cursor"); err == nil {
+		t.Fatalf("malformed continue token should be rejected")
+	}
+}
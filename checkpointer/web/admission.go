@@ -0,0 +1,398 @@
+package web
+
+import (
+	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"checkpoint-in-k8s/pkg/manager"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RestoreFromAnnotation holds a checkpointIdentifier prefixed by CheckpointReferencePrefix or a checkpoint container
+	// image the Pod should be restored from.
+	RestoreFromAnnotation = "checkpoint.k8s/restore-from"
+
+	// CheckpointReferencePrefix marks the value of RestoreFromAnnotation as a checkpointIdentifier. A container image
+	// reference never contains "://", so that images like "busybox:latest" are not mistaken for checkpointIdentifier.
+	CheckpointReferencePrefix = "checkpoint://"
+
+	// RestoreLatestAnnotation set to "true" restores every container of the Pod from its latest successful checkpoint.
+	RestoreLatestAnnotation = "checkpoint.k8s/restore-latest"
+
+	// RestoreContainerAnnotation names the container that RestoreFromAnnotation applies to. If not set, the container
+	// recorded in the checkpoint or the first container of the Pod is used.
+	RestoreContainerAnnotation = "checkpoint.k8s/restore-container"
+
+	// RestoredImageAnnotation is set by the webhook to a comma separated list of container=image pairs the Pod was
+	// restored from.
+	RestoredImageAnnotation = "checkpoint.k8s/restored-image"
+)
+
+// jsonPatchOperation represents a single JSON Patch (RFC 6902) operation returned to Kubernetes API server.
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// RestoreWebhookHandler serves the mutating admission webhook which rewrites container images of annotated Pods to
+// their checkpoint images. Whenever there is no usable checkpoint, the Pod is admitted unchanged.
+type RestoreWebhookHandler struct {
+	manager.CheckpointManager
+
+	// client reads the Jobs controlling the admitted Pods, nil if the Pods of Jobs are not restored.
+	client kubernetes.Interface
+
+	// nodePodController is used to find other Checkpointers, nil if route forwarding is disabled.
+	nodePodController internal.NodePodController
+	checkpointerNode  string
+	checkpointerPort  int64
+	httpClient        *http.Client
+	resolveTimeout    time.Duration
+
+	// runtimeAnnotations are added to every restored Pod.
+	runtimeAnnotations map[string]string
+}
+
+func NewRestoreWebhookHandler(checkpointManager manager.CheckpointManager, client *kubernetes.Clientset, config *rest.Config, globalConfig config.GlobalConfig) *RestoreWebhookHandler {
+	var nodePodController internal.NodePodController
+	if !globalConfig.DisableRouteForward {
+		nodePodController = internal.NewNodePodController(client, config)
+	}
+	return &RestoreWebhookHandler{
+		checkpointManager,
+		client,
+		nodePodController,
+		globalConfig.CheckpointConfig.CheckpointerNode,
+		globalConfig.CheckpointerPort,
+		&http.Client{},
+		time.Second * time.Duration(globalConfig.WebhookConfig.ResolveTimeoutSeconds),
+		globalConfig.WebhookConfig.RuntimeAnnotations,
+	}
+}
+
+func (wh *RestoreWebhookHandler) HandleMutate(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Unable to read req body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(rw, "AdmissionReview with request expected", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().
+		Str("namespace", review.Request.Namespace).
+		Str("pod", review.Request.Name).
+		Logger()
+
+	response := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+
+	var pod v1.Pod
+	if err := json.Unmarshal(review.Request.Object.Raw, &pod); err != nil {
+		lg.Warn().Err(err).Msg("failed to decode Pod from AdmissionReview, admitting unchanged")
+	} else {
+		if pod.Namespace == "" {
+			pod.Namespace = review.Request.Namespace
+		}
+		ctx, cancel := context.WithTimeout(lg.WithContext(req.Context()), wh.resolveTimeout)
+		patch := wh.restorePatch(ctx, &pod)
+		cancel()
+
+		if len(patch) != 0 {
+			marshalledPatch, err := json.Marshal(patch)
+			if err != nil {
+				lg.Error().Err(err).Msg("failed to marshal JSON patch, admitting unchanged")
+			} else {
+				patchType := admissionv1.PatchTypeJSONPatch
+				response.Patch = marshalledPatch
+				response.PatchType = &patchType
+			}
+		}
+	}
+
+	review.Request = nil
+	review.Response = response
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(review); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// restorePatch resolves the restore annotations of the pod, or of the Job controlling it, and returns JSON Patch which
+// rewrites the container images. Returns nil if the Pod is not annotated or there is no usable checkpoint.
+func (wh *RestoreWebhookHandler) restorePatch(ctx context.Context, pod *v1.Pod) []jsonPatchOperation {
+	lg := zerolog.Ctx(ctx)
+	restoreImages := make(map[int]string)
+
+	annotations := pod.Annotations
+	if annotations[RestoreFromAnnotation] == "" && annotations[RestoreLatestAnnotation] != "true" {
+		annotations = wh.jobAnnotations(ctx, pod)
+	}
+
+	if restoreFrom := annotations[RestoreFromAnnotation]; restoreFrom != "" {
+		index, image := wh.resolveRestoreFrom(ctx, pod, restoreFrom, annotations[RestoreContainerAnnotation])
+		if image != "" {
+			restoreImages[index] = image
+		}
+	} else if annotations[RestoreLatestAnnotation] == "true" {
+		if pod.Name == "" {
+			lg.Info().Msg("cannot restore latest checkpoint of a Pod with generated name")
+			return nil
+		}
+		for index, container := range pod.Spec.Containers {
+			entry := wh.resolveLatest(ctx, checkpoint.ContainerIdentifier{
+				Namespace: pod.Namespace, Pod: pod.Name, Container: container.Name,
+			})
+			if entry != nil {
+				restoreImages[index] = entry.ContainerImageName
+			}
+		}
+	}
+
+	if len(restoreImages) == 0 {
+		return nil
+	}
+	return restorePatchOperations(pod, restoreImages, wh.runtimeAnnotations)
+}
+
+// restorePatchOperations returns JSON Patch which rewrites the images of the containers at the indexes of
+// restoreImages and adds the restored-image record and runtimeAnnotations to the annotations of the Pod.
+func restorePatchOperations(pod *v1.Pod, restoreImages map[int]string, runtimeAnnotations map[string]string) []jsonPatchOperation {
+	indexes := make([]int, 0, len(restoreImages))
+	for index := range restoreImages {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	patch := make([]jsonPatchOperation, 0, 2*len(indexes)+len(runtimeAnnotations)+2)
+	restored := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		image := restoreImages[index]
+		patch = append(patch,
+			jsonPatchOperation{"replace", fmt.Sprintf("/spec/containers/%d/image", index), image},
+			jsonPatchOperation{"add", fmt.Sprintf("/spec/containers/%d/imagePullPolicy", index), v1.PullAlways},
+		)
+		restored = append(restored, pod.Spec.Containers[index].Name+"="+image)
+	}
+
+	// Pods of Jobs are restored by the annotations of the Job, so the Pod itself does not have to be annotated.
+	if pod.Annotations == nil {
+		patch = append(patch, jsonPatchOperation{"add", "/metadata/annotations", map[string]string{}})
+	}
+	patch = append(patch, jsonPatchOperation{"add", annotationPatchPath(RestoredImageAnnotation), strings.Join(restored, ",")})
+	keys := make([]string, 0, len(runtimeAnnotations))
+	for key := range runtimeAnnotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		patch = append(patch, jsonPatchOperation{"add", annotationPatchPath(key), runtimeAnnotations[key]})
+	}
+	return patch
+}
+
+// annotationPatchPath returns JSON Pointer (RFC 6901) to the annotation under key.
+func annotationPatchPath(key string) string {
+	return "/metadata/annotations/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// jobAnnotations returns the annotations of the Job controlling the pod, which carry the restore annotations for its
+// Pods as the Pod template of a Job is immutable. Returns nil if the Pod is not controlled by a Job or the Job cannot
+// be read.
+func (wh *RestoreWebhookHandler) jobAnnotations(ctx context.Context, pod *v1.Pod) map[string]string {
+	ownerRef := metav1.GetControllerOf(pod)
+	if ownerRef == nil || ownerRef.Kind != internal.OwnerKindJob || wh.client == nil {
+		return nil
+	}
+	job, err := wh.client.BatchV1().Jobs(pod.Namespace).Get(ctx, ownerRef.Name, metav1.GetOptions{})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("job", ownerRef.Name).Msg("could not get Job of the Pod, admitting unchanged")
+		return nil
+	}
+	return job.Annotations
+}
+
+// resolveRestoreFrom resolves the value of RestoreFromAnnotation to the index of the container to be restored and the
+// checkpoint image, restoreContainer being the value of RestoreContainerAnnotation. Returns empty image if there is no
+// usable checkpoint.
+func (wh *RestoreWebhookHandler) resolveRestoreFrom(ctx context.Context, pod *v1.Pod, restoreFrom, restoreContainer string) (int, string) {
+	lg := zerolog.Ctx(ctx).With().Str("restoreFrom", restoreFrom).Logger()
+
+	reference, isCheckpoint := strings.CutPrefix(restoreFrom, CheckpointReferencePrefix)
+	if !isCheckpoint {
+		index := containerIndex(pod, restoreContainer)
+		if index < 0 {
+			lg.Info().Msg("restore container not found in Pod")
+			return 0, ""
+		}
+		return index, restoreFrom
+	}
+
+	node, checkpointIdentifier, found := strings.Cut(reference, ":")
+	if !found || node == "" || checkpointIdentifier == "" {
+		lg.Info().Msg("malformed checkpointIdentifier, admitting unchanged")
+		return 0, ""
+	}
+
+	entry := wh.resolveCheckpointIdentifier(ctx, node, checkpointIdentifier)
+	if entry == nil || entry.InProgress() || entry.Error != nil || entry.ContainerImageName == "" {
+		lg.Info().Msg("no usable checkpoint found, admitting unchanged")
+		return 0, ""
+	}
+
+	containerName := restoreContainer
+	if containerName == "" && containerIndex(pod, entry.ContainerIdentifier.Container) >= 0 {
+		containerName = entry.ContainerIdentifier.Container
+	}
+	index := containerIndex(pod, containerName)
+	if index < 0 {
+		lg.Info().Msg("restore container not found in Pod")
+		return 0, ""
+	}
+	return index, entry.ContainerImageName
+}
+
+// resolveCheckpointIdentifier returns the stored CheckpointEntry from the Checkpointer running on node, or nil if there
+// is none or it cannot be obtained.
+func (wh *RestoreWebhookHandler) resolveCheckpointIdentifier(ctx context.Context, node, checkpointIdentifier string) *manager.CheckpointEntry {
+	lg := zerolog.Ctx(ctx)
+
+	if node == wh.checkpointerNode {
+		entry, err := wh.CheckpointResult(ctx, checkpointIdentifier, 0)
+		if err != nil {
+			return nil
+		}
+		return entry
+	}
+
+	if wh.nodePodController == nil {
+		lg.Info().Str("node", node).Msg("route forwarding disabled, cannot resolve checkpoint of another Node")
+		return nil
+	}
+
+	podIP, err := wh.nodePodController.GetPodIPForNode(ctx, node, checkpointerLabelSelector)
+	if err != nil || podIP == "" {
+		lg.Warn().Err(err).Str("node", node).Msg("could not find Checkpointer of the Node")
+		return nil
+	}
+
+	query := url.Values{"checkpointIdentifier": {node + ":" + checkpointIdentifier}}
+	entry, err := wh.fetchEntry(ctx, fmt.Sprintf("http://%s:%d/checkpoint?%s", podIP, wh.checkpointerPort, query.Encode()))
+	if err != nil {
+		lg.Warn().Err(err).Str("node", node).Msg("could not fetch checkpoint result from another Checkpointer")
+		return nil
+	}
+	return entry
+}
+
+// resolveLatest returns the latest successful CheckpointEntry of the container across all Checkpointers or nil if
+// there is none.
+func (wh *RestoreWebhookHandler) resolveLatest(ctx context.Context, containerIdentifier checkpoint.ContainerIdentifier) *manager.CheckpointEntry {
+	lg := zerolog.Ctx(ctx).With().Str("containerIdentifier", containerIdentifier.String()).Logger()
+
+	latest, err := wh.LatestCheckpointResult(containerIdentifier)
+	if err != nil {
+		latest = nil
+	}
+
+	if wh.nodePodController == nil {
+		return latest
+	}
+
+	podIPs, err := wh.nodePodController.GetPodIPsByNode(ctx, checkpointerLabelSelector)
+	if err != nil {
+		lg.Warn().Err(err).Msg("could not list other Checkpointers")
+		return latest
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for node, podIP := range podIPs {
+		if node == wh.checkpointerNode {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := wh.fetchEntry(ctx, fmt.Sprintf("http://%s:%d/checkpoint/%s/latest", podIP, wh.checkpointerPort, containerIdentifier))
+			if err != nil {
+				lg.Warn().Err(err).Str("node", node).Msg("could not fetch latest checkpoint from another Checkpointer")
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if entry != nil && (latest == nil || entry.EndTimestamp > latest.EndTimestamp) {
+				latest = entry
+			}
+		}()
+	}
+	wg.Wait()
+
+	return latest
+}
+
+// fetchEntry sends GET request to another Checkpointer and decodes the CheckpointEntry from the response. Returns nil
+// entry if the Checkpointer does not respond with 200 status code.
+func (wh *RestoreWebhookHandler) fetchEntry(ctx context.Context, requestURL string) (*manager.CheckpointEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %w", err)
+	}
+
+	res, err := wh.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	entry := &manager.CheckpointEntry{}
+	if err := json.NewDecoder(res.Body).Decode(entry); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint entry: %w", err)
+	}
+	return entry, nil
+}
+
+// containerIndex returns index of the container named containerName within the pod, index of the first container if
+// containerName is empty, or -1 if there is no such container.
+func containerIndex(pod *v1.Pod, containerName string) int {
+	if len(pod.Spec.Containers) == 0 {
+		return -1
+	}
+	if containerName == "" {
+		return 0
+	}
+	for index, container := range pod.Spec.Containers {
+		if container.Name == containerName {
+			return index
+		}
+	}
+	return -1
+}
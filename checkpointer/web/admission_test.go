@@ -0,0 +1,196 @@
+package web
+
+import (
+	"bytes"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/manager"
+	"context"
+	"encoding/json"
+	admissionv1 "k8s.io/api/admission/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mockCheckpointManager resolves the checkpoints of the webhook and the repeated checkpoint requests from entries, the
+// rest of CheckpointManager is not implemented.
+type mockCheckpointManager struct {
+	manager.CheckpointManager
+	entries map[string]*manager.CheckpointEntry
+	latest  map[string]*manager.CheckpointEntry
+}
+
+func (m mockCheckpointManager) CheckpointResult(_ context.Context, checkpointIdentifier string, _ time.Duration) (*manager.CheckpointEntry, error) {
+	if entry, found := m.entries[checkpointIdentifier]; found {
+		return entry, nil
+	}
+	return nil, manager.ErrEntryNotFound
+}
+
+func (m mockCheckpointManager) Checkpoint(_ context.Context, _ bool, checkpointParams checkpoint.CheckpointerParams) (*manager.CheckpointEntry, error) {
+	return m.entries[checkpointParams.CheckpointIdentifier], nil
+}
+
+func (m mockCheckpointManager) LatestCheckpointResult(containerIdentifier checkpoint.ContainerIdentifier) (*manager.CheckpointEntry, error) {
+	return m.latest[containerIdentifier.String()], nil
+}
+
+func newTestRestoreWebhookHandler(checkpointManager mockCheckpointManager, objects ...runtime.Object) *RestoreWebhookHandler {
+	return &RestoreWebhookHandler{
+		CheckpointManager:  checkpointManager,
+		client:             fake.NewSimpleClientset(objects...),
+		checkpointerNode:   "node",
+		httpClient:         &http.Client{},
+		resolveTimeout:     time.Second,
+		runtimeAnnotations: map[string]string{"runtime.example.com/restore": "true"},
+	}
+}
+
+func newTestRestoredPod(annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns", Annotations: annotations},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "sidecar", Image: "sidecar"}, {Name: "ctrn", Image: "original"}}},
+	}
+}
+
+// mutate sends the AdmissionReview of pod to the webhook and returns its response.
+func mutate(t *testing.T, wh *RestoreWebhookHandler, pod *v1.Pod) *admissionv1.AdmissionResponse {
+	t.Helper()
+	marshalledPod, _ := json.Marshal(pod)
+	body, _ := json.Marshal(admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Namespace: pod.Namespace,
+		Object:    runtime.RawExtension{Raw: marshalledPod},
+	}})
+	rw := httptest.NewRecorder()
+	wh.HandleMutate(rw, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("HandleMutate() responded with %d: %s", rw.Code, rw.Body.String())
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(rw.Body.Bytes(), &review); err != nil || review.Response == nil {
+		t.Fatalf("HandleMutate() responded with malformed AdmissionReview: %s", rw.Body.String())
+	}
+	if !review.Response.Allowed || review.Response.UID != "uid" {
+		t.Fatalf("Pod should always be admitted, got: %+v", review.Response)
+	}
+	return review.Response
+}
+
+func decodePatch(t *testing.T, response *admissionv1.AdmissionResponse) []jsonPatchOperation {
+	t.Helper()
+	var patch []jsonPatchOperation
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatalf("malformed JSON patch: %v", err)
+	}
+	return patch
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_RestoreFrom(t *testing.T) {
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{entries: map[string]*manager.CheckpointEntry{"id": {
+		ContainerIdentifier: checkpoint.ContainerIdentifier{Namespace: "ns", Pod: "pod", Container: "ctrn"},
+		ContainerImageName:  "quay.io/checkpointed",
+		Phase:               checkpoint.PhaseSucceeded,
+	}}})
+
+	patch := decodePatch(t, mutate(t, wh, newTestRestoredPod(map[string]string{RestoreFromAnnotation: CheckpointReferencePrefix + "node:id"})))
+	expected := []jsonPatchOperation{
+		{"replace", "/spec/containers/1/image", "quay.io/checkpointed"},
+		{"add", "/spec/containers/1/imagePullPolicy", string(v1.PullAlways)},
+		{"add", "/metadata/annotations/checkpoint.k8s~1restored-image", "ctrn=quay.io/checkpointed"},
+		{"add", "/metadata/annotations/runtime.example.com~1restore", "true"},
+	}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Fatalf("checkpointed container should be restored with the runtime annotations, got: %+v", patch)
+	}
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_RestoreFromImage(t *testing.T) {
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{})
+
+	pod := newTestRestoredPod(map[string]string{RestoreFromAnnotation: "quay.io/image", RestoreContainerAnnotation: "ctrn"})
+	patch := decodePatch(t, mutate(t, wh, pod))
+	if len(patch) != 4 || patch[0].Path != "/spec/containers/1/image" || patch[0].Value != "quay.io/image" {
+		t.Fatalf("restore container should be restored from the image, got: %+v", patch)
+	}
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_RestoreFromSingleSegmentImage(t *testing.T) {
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{entries: map[string]*manager.CheckpointEntry{"latest": {
+		ContainerImageName: "quay.io/checkpointed",
+		Phase:              checkpoint.PhaseSucceeded,
+	}}})
+
+	for _, image := range []string{"nginx:1.2", "busybox:latest"} {
+		pod := newTestRestoredPod(map[string]string{RestoreFromAnnotation: image, RestoreContainerAnnotation: "ctrn"})
+		patch := decodePatch(t, mutate(t, wh, pod))
+		if len(patch) != 4 || patch[0].Path != "/spec/containers/1/image" || patch[0].Value != image {
+			t.Fatalf("restore container should be restored from the image %s, got: %+v", image, patch)
+		}
+	}
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_RestoreLatest(t *testing.T) {
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{latest: map[string]*manager.CheckpointEntry{"ns/pod/ctrn": {
+		ContainerImageName: "quay.io/latest",
+	}}})
+
+	patch := decodePatch(t, mutate(t, wh, newTestRestoredPod(map[string]string{RestoreLatestAnnotation: "true"})))
+	if len(patch) != 4 || patch[0].Path != "/spec/containers/1/image" || patch[0].Value != "quay.io/latest" {
+		t.Fatalf("only the container with a checkpoint should be restored, got: %+v", patch)
+	}
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_Job(t *testing.T) {
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "ns", Annotations: map[string]string{
+		RestoreFromAnnotation:      "quay.io/job",
+		RestoreContainerAnnotation: "ctrn",
+	}}}
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{}, job)
+
+	controller := true
+	pod := newTestRestoredPod(nil)
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "Job", Name: "job", Controller: &controller}}
+	patch := decodePatch(t, mutate(t, wh, pod))
+	if len(patch) != 5 || patch[0].Value != "quay.io/job" || patch[2].Path != "/metadata/annotations" {
+		t.Fatalf("Pod of annotated Job should be restored, got: %+v", patch)
+	}
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_Unchanged(t *testing.T) {
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{entries: map[string]*manager.CheckpointEntry{
+		"in-progress": {ContainerImageName: "quay.io/checkpointed", Phase: checkpoint.PhasePushing},
+		"failed":      {Phase: checkpoint.PhaseFailed, Error: &checkpoint.CheckpointError{Code: checkpoint.ErrorCodePushFailed}},
+	}})
+
+	for _, annotations := range []map[string]string{
+		nil,
+		{RestoreFromAnnotation: CheckpointReferencePrefix + "node:in-progress"},
+		{RestoreFromAnnotation: CheckpointReferencePrefix + "node:failed"},
+		{RestoreFromAnnotation: CheckpointReferencePrefix + "node:missing"},
+		{RestoreFromAnnotation: CheckpointReferencePrefix + "malformed"},
+		{RestoreFromAnnotation: "quay.io/image", RestoreContainerAnnotation: "missing"},
+		{RestoreLatestAnnotation: "true"},
+	} {
+		if response := mutate(t, wh, newTestRestoredPod(annotations)); response.Patch != nil || response.PatchType != nil {
+			t.Fatalf("Pod annotated with %v should be admitted unchanged, got patch: %s", annotations, response.Patch)
+		}
+	}
+}
+
+func Test_RestoreWebhookHandler_HandleMutate_Malformed(t *testing.T) {
+	wh := newTestRestoreWebhookHandler(mockCheckpointManager{})
+
+	rw := httptest.NewRecorder()
+	wh.HandleMutate(rw, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte(`{}`))))
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("AdmissionReview without request should be rejected, got: %d", rw.Code)
+	}
+}
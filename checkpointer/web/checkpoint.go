@@ -1,23 +1,61 @@
 package web
 
 import (
-	"checkpoint-in-k8s/internal"
 	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
 	"checkpoint-in-k8s/pkg/manager"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"io"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// maxWaitSeconds limits how long a client can wait for a checkpoint in progress within a single request.
+const maxWaitSeconds = 600
+
+// idempotencyKeyHeader is the header a client can set to make repeated checkpoint requests idempotent.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// checkpointIdentifierPattern restricts client-chosen checkpoint identifiers, so that they are usable as image tags,
+// storage keys and in tracking handles.
+var checkpointIdentifierPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+// eventsKeepAlivePeriod is how often a comment is sent on an idle event stream, so that proxies do not close it.
+const eventsKeepAlivePeriod = time.Second * 15
+
 type CheckpointRequestBody struct {
-	DeletePod bool `json:"deletePod,omitempty"`
-	Async     bool `json:"async,omitempty"`
+	DeletePod      bool   `json:"deletePod,omitempty"`
+	StopPolicy     string `json:"stopPolicy,omitempty"`
+	Async          bool   `json:"async,omitempty"`
+	Verify         bool   `json:"verify,omitempty"`
+	VerifyNode     string `json:"verifyNode,omitempty"`
+	CallbackUrl    string `json:"callbackUrl,omitempty"`
+	CallbackSecret string `json:"callbackSecret,omitempty"`
+	Publish        string `json:"publish,omitempty"`
+	Priority       int64  `json:"priority,omitempty"`
+
+	// Labels are recorded with the checkpoint, so that checkpoints can be listed by them.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// CheckpointIdentifier is the client-chosen checkpoint identifier, same as the Idempotency-Key header.
+	CheckpointIdentifier string `json:"checkpointIdentifier,omitempty"`
+
+	// Slot is the name of the slot whose history the checkpoint joins once it succeeds.
+	Slot string `json:"slot,omitempty"`
+
+	// Hooks are run in the container around its checkpoint, overriding the hooks in the Pod annotations.
+	Hooks *checkpoint.Hooks `json:"hooks,omitempty"`
 }
 
 type TrackingHandleResponseBody struct {
@@ -27,10 +65,19 @@ type TrackingHandleResponseBody struct {
 type CheckpointHandler struct {
 	manager.CheckpointManager
 	checkpointerNode string
+
+	// callbackConfig restricts the callback URLs clients can request.
+	callbackConfig config.CallbackConfig
+
+	// schedulerConfig restricts the priorities clients can request.
+	schedulerConfig config.SchedulerConfig
+
+	// hookConfig restricts the hooks clients can request.
+	hookConfig config.HookConfig
 }
 
-func NewCheckpointHandler(checkpointManager manager.CheckpointManager, checkpointerNode string) *CheckpointHandler {
-	return &CheckpointHandler{checkpointManager, checkpointerNode}
+func NewCheckpointHandler(checkpointManager manager.CheckpointManager, checkpointerNode string, callbackConfig config.CallbackConfig, schedulerConfig config.SchedulerConfig, hookConfig config.HookConfig) *CheckpointHandler {
+	return &CheckpointHandler{checkpointManager, checkpointerNode, callbackConfig, schedulerConfig, hookConfig}
 }
 
 func (ch *CheckpointHandler) HandleCheckpoint(rw http.ResponseWriter, req *http.Request) {
@@ -48,6 +95,38 @@ func (ch *CheckpointHandler) HandleCheckpoint(rw http.ResponseWriter, req *http.
 		}
 	}
 
+	stopPolicy, err := requestBody.stopPolicy()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := requestBody.validateCallback(ch.callbackConfig); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	publishMode, err := requestBody.publishMode()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := requestBody.validateLabels(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateSlot(requestBody.Slot); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateRequestHooks(requestBody.Hooks, ch.hookConfig); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	containerIdentifier := getContainerIdentifier(req)
 	if containerIdentifier == nil {
 		http.Error(rw, "container path in format /{namespace}{pod}/{container} expected", http.StatusBadRequest)
@@ -57,31 +136,74 @@ func (ch *CheckpointHandler) HandleCheckpoint(rw http.ResponseWriter, req *http.
 	lg := log.With().Str("containerIdentifier", containerIdentifier.String()).Logger()
 	lg.Info().Msg("request to checkpoint container")
 
-	checkpointIdentifier, err := generateCheckpointIdentifier()
+	checkpointIdentifier, err := requestBody.checkpointIdentifier(req.Header.Get(idempotencyKeyHeader))
 	if err != nil {
-		lg.Error().Err(err).Msg("failed to generate checkpoint identifier")
-		http.Error(rw, "failed to generate checkpoint identifier", http.StatusInternalServerError)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if checkpointIdentifier == "" {
+		checkpointIdentifier, err = generateCheckpointIdentifier()
+		if err != nil {
+			lg.Error().Err(err).Msg("failed to generate checkpoint identifier")
+			http.Error(rw, "failed to generate checkpoint identifier", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	cp, err := ch.Checkpoint(req.Context(), requestBody.Async, checkpoint.CheckpointerParams{
 		ContainerIdentifier:  *containerIdentifier,
-		DeletePod:            requestBody.DeletePod,
+		StopPolicy:           stopPolicy,
 		CheckpointIdentifier: checkpointIdentifier,
+		Verify:               requestBody.Verify,
+		VerifyNode:           requestBody.VerifyNode,
+		CallbackUrl:          requestBody.CallbackUrl,
+		CallbackSecret:       requestBody.CallbackSecret,
+		Publish:              publishMode,
+		Priority:             min(max(requestBody.Priority, -ch.schedulerConfig.MaxRequestPriority), ch.schedulerConfig.MaxRequestPriority),
+		Labels:               requestBody.Labels,
+		Slot:                 requestBody.Slot,
+		Hooks:                requestBody.Hooks,
 	})
 
 	if err != nil {
-		if errors.Is(err, internal.ErrContainerNotFound) {
-			http.Error(rw, "checkpointer could not find the container", http.StatusNotFound)
+		// Async request joins the checkpoint of the container which is already queued or running with the same
+		// parameters, otherwise it is rejected, as it would not do what was requested.
+		var duplicateErr *manager.DuplicateCheckpointError
+		if requestBody.Async && errors.As(err, &duplicateErr) && duplicateErr.Joinable {
+			lg.Info().Str("checkpointIdentifier", duplicateErr.CheckpointIdentifier).Msg("joining checkpoint in progress")
+			checkpointIdentifier = duplicateErr.CheckpointIdentifier
+			err = nil
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, manager.ErrIdempotencyConflict) {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, manager.ErrCheckpointInProgress) {
+			http.Error(rw, "checkpoint is being deleted", http.StatusConflict)
+			return
+		}
+		if writeSchedulerError(rw, err) {
+			return
+		}
+		if errors.Is(err, manager.ErrPublishQueueFull) {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, manager.ErrInsufficientStorage) {
+			http.Error(rw, err.Error(), http.StatusInsufficientStorage)
 			return
 		}
 		lg.Error().Err(err).Msg("checkpointing failed")
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		writeProblem(rw, checkpoint.AsCheckpointError(err, ""), ch.checkpointerNode+":"+checkpointIdentifier, lg)
 		return
 	}
 
 	rw.Header().Set("Content-Type", "application/json")
-	if cp == nil {
+	// Repeated async request is answered with the tracking handle like the original one.
+	if cp == nil || requestBody.Async {
 		response := TrackingHandleResponseBody{CheckpointIdentifier: ch.checkpointerNode + ":" + checkpointIdentifier}
 		rw.WriteHeader(http.StatusAccepted)
 		if err := json.NewEncoder(rw).Encode(response); err != nil {
@@ -92,7 +214,18 @@ func (ch *CheckpointHandler) HandleCheckpoint(rw http.ResponseWriter, req *http.
 		return
 	}
 
-	rw.WriteHeader(http.StatusCreated)
+	// Repeated request of a checkpoint which already failed.
+	if cp.Error != nil {
+		writeProblem(rw, cp.Error, cp.CheckpointIdentifier, lg)
+		return
+	}
+
+	// Image of a deferred checkpoint is still being published, or repeated request of a checkpoint in progress.
+	if cp.InProgress() {
+		rw.WriteHeader(http.StatusAccepted)
+	} else {
+		rw.WriteHeader(http.StatusCreated)
+	}
 	if err := json.NewEncoder(rw).Encode(cp); err != nil {
 		lg.Error().Err(err).Msg("unable to encode JSON")
 		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
@@ -113,35 +246,429 @@ func (ch *CheckpointHandler) HandleCheckState(rw http.ResponseWriter, req *http.
 
 	lg.Info().Msg("received request to check status of checkpointing")
 
-	checkpointState, err := ch.CheckpointResult(checkpointIdentifier)
+	wait, err := getWaitDuration(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	checkpointState, err := ch.CheckpointResult(req.Context(), checkpointIdentifier, wait)
+	if errors.Is(err, manager.ErrCheckpointExpired) {
+		writeNotFound(rw, err)
+		return
+	}
 	if err != nil {
 		http.Error(rw, "failed to get the state of a checkpoint", http.StatusInternalServerError)
 		return
 	}
 
+	writeCheckpointState(rw, checkpointState, lg)
+}
+
+// writeCheckpointState writes checkpointState as the response to a state request, 404 if it is nil.
+func writeCheckpointState(rw http.ResponseWriter, checkpointState *manager.CheckpointEntry, lg zerolog.Logger) {
 	if checkpointState == nil {
 		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	if checkpointState.Error == nil && checkpointState.Phase == checkpoint.PhaseFailed {
+		// Entries stored by older versions do not carry the error.
+		checkpointState.Error = checkpoint.NewCheckpointError(checkpoint.ErrorCodeInternal, "", errors.New("checkpointing failed"))
+	}
 	if checkpointState.Error != nil {
-		if errors.Is(checkpointState.Error, internal.ErrContainerNotFound) {
-			http.Error(rw, "checkpointer could not find the container", http.StatusNotFound)
+		writeProblem(rw, checkpointState.Error, checkpointState.CheckpointIdentifier, lg)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if checkpointState.InProgress() {
+		rw.WriteHeader(http.StatusAccepted)
+	} else {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(rw).Encode(checkpointState); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (ch *CheckpointHandler) HandleCheckpointEvents(rw http.ResponseWriter, req *http.Request) {
+	_, checkpointIdentifier := getCheckpointIdentifier(req)
+	if checkpointIdentifier == "" {
+		http.Error(rw, "checkpointIdentifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().
+		Str("checkpointIdentifier", checkpointIdentifier).
+		Logger()
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		lg.Error().Msg("response writer does not support flushing")
+		http.Error(rw, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, err := ch.CheckpointEvents(req.Context(), checkpointIdentifier)
+	if errors.Is(err, manager.ErrEntryNotFound) {
+		writeNotFound(rw, err)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "failed to get the state of a checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	lg.Info().Msg("streaming checkpoint events")
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlivePeriod)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				lg.Debug().Msg("checkpoint event stream finished")
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				lg.Error().Err(err).Msg("unable to encode JSON")
+				return
+			}
+			if _, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				lg.Debug().Err(err).Msg("client closed event stream")
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(rw, ": keep-alive\n\n"); err != nil {
+				lg.Debug().Err(err).Msg("client closed event stream")
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (ch *CheckpointHandler) HandleLatestCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	containerIdentifier := getContainerIdentifier(req)
+	if containerIdentifier == nil {
+		http.Error(rw, "container path in format /{namespace}{pod}/{container} expected", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().Str("containerIdentifier", containerIdentifier.String()).Logger()
+	lg.Debug().Msg("received request for latest checkpoint of container")
+
+	latestEntry, err := ch.LatestCheckpointResult(*containerIdentifier)
+	if err != nil {
+		http.Error(rw, "failed to get the latest checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	if latestEntry == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(latestEntry); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (ch *CheckpointHandler) HandleScaleOwnerUp(rw http.ResponseWriter, req *http.Request) {
+	_, checkpointIdentifier := getCheckpointIdentifier(req)
+	if checkpointIdentifier == "" {
+		http.Error(rw, "checkpointIdentifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().
+		Str("checkpointIdentifier", checkpointIdentifier).
+		Logger()
+
+	lg.Info().Msg("received request to scale up owner of checkpointed Pod")
+
+	storedEntry, err := ch.CheckpointResult(req.Context(), checkpointIdentifier, 0)
+	if errors.Is(err, manager.ErrCheckpointExpired) {
+		writeNotFound(rw, err)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "failed to get the state of a checkpoint", http.StatusInternalServerError)
+		return
+	}
+	if storedEntry == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// New Pods of the owner are restored from the checkpoint if the restore webhook is enabled.
+	entry, err := ch.ScaleOwnerUp(req.Context(), checkpointIdentifier, map[string]string{
+		RestoreFromAnnotation:      storedEntry.ContainerImageName,
+		RestoreContainerAnnotation: storedEntry.ContainerIdentifier.Container,
+	})
+	if err != nil {
+		if errors.Is(err, manager.ErrEntryNotFound) {
+			writeNotFound(rw, err)
+			return
+		}
+		if errors.Is(err, manager.ErrNoScaledOwner) {
+			http.Error(rw, "checkpoint did not scale down any owner", http.StatusConflict)
 			return
 		}
-		http.Error(rw, "checkpointing failed", http.StatusInternalServerError)
+		http.Error(rw, "failed to scale up owner of checkpointed Pod", http.StatusInternalServerError)
 		return
 	}
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(rw).Encode(checkpointState); err != nil {
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (ch *CheckpointHandler) HandleCancelCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	_, checkpointIdentifier := getCheckpointIdentifier(req)
+	if checkpointIdentifier == "" {
+		http.Error(rw, "query param checkpointIdentifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().
+		Str("checkpointIdentifier", checkpointIdentifier).
+		Logger()
+
+	lg.Info().Msg("received request to cancel checkpoint")
+
+	entry, err := ch.CancelCheckpoint(req.Context(), checkpointIdentifier)
+	if err != nil {
+		if errors.Is(err, manager.ErrEntryNotFound) {
+			writeNotFound(rw, err)
+			return
+		}
+		if errors.Is(err, manager.ErrNotCancellable) {
+			http.Error(rw, "only asynchronous checkpoints in progress, which are not pushing their image yet, can be cancelled", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, manager.ErrCheckpointInProgress) {
+			http.Error(rw, "checkpoint is being deleted", http.StatusConflict)
+			return
+		}
+		http.Error(rw, "failed to cancel checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (ch *CheckpointHandler) HandleRetryCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	_, checkpointIdentifier := getCheckpointIdentifier(req)
+	if checkpointIdentifier == "" {
+		http.Error(rw, "checkpointIdentifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().
+		Str("checkpointIdentifier", checkpointIdentifier).
+		Logger()
+
+	lg.Info().Msg("received request to retry checkpoint")
+
+	entry, err := ch.RetryCheckpoint(req.Context(), checkpointIdentifier)
+	if err != nil {
+		if errors.Is(err, manager.ErrEntryNotFound) {
+			writeNotFound(rw, err)
+			return
+		}
+		if errors.Is(err, manager.ErrNotRetryable) {
+			http.Error(rw, "only failed checkpoints with retained checkpoint archive can be retried", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, manager.ErrCheckpointInProgress) {
+			http.Error(rw, "checkpoint is being deleted", http.StatusConflict)
+			return
+		}
+		if writeSchedulerError(rw, err) {
+			return
+		}
+		http.Error(rw, "failed to retry checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
 		lg.Error().Err(err).Msg("unable to encode JSON")
 		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
 		return
 	}
 }
 
+// writeNotFound responds to a request for a checkpoint which does not exist, with 410 if its result expired and with
+// 404 otherwise.
+func writeNotFound(rw http.ResponseWriter, err error) {
+	if errors.Is(err, manager.ErrCheckpointExpired) {
+		http.Error(rw, "checkpoint result expired by retention policy", http.StatusGone)
+		return
+	}
+	rw.WriteHeader(http.StatusNotFound)
+}
+
+// writeSchedulerError responds with 429 Too Many Requests and Retry-After header if the checkpoint queue is full or
+// with 409 Conflict if the container is already being checkpointed. Returns false if err is neither of those.
+func writeSchedulerError(rw http.ResponseWriter, err error) bool {
+	var queueFullErr *manager.QueueFullError
+	if errors.As(err, &queueFullErr) {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(queueFullErr.RetryAfter.Seconds())))
+		http.Error(rw, err.Error(), http.StatusTooManyRequests)
+		return true
+	}
+	var duplicateErr *manager.DuplicateCheckpointError
+	if errors.As(err, &duplicateErr) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// checkpointIdentifier returns the client-chosen checkpoint identifier from the body or from idempotencyKey, or empty
+// string if neither is set. Returns error if they differ or if the identifier is malformed.
+func (body CheckpointRequestBody) checkpointIdentifier(idempotencyKey string) (string, error) {
+	checkpointIdentifier := body.CheckpointIdentifier
+	if idempotencyKey != "" {
+		if checkpointIdentifier != "" && checkpointIdentifier != idempotencyKey {
+			return "", fmt.Errorf("checkpointIdentifier conflicts with %s header", idempotencyKeyHeader)
+		}
+		checkpointIdentifier = idempotencyKey
+	}
+	if checkpointIdentifier == "" {
+		return "", nil
+	}
+	// Latest checkpoints of containers are stored under keys with the latest_ prefix.
+	if !checkpointIdentifierPattern.MatchString(checkpointIdentifier) || strings.HasPrefix(checkpointIdentifier, "latest_") {
+		return "", fmt.Errorf("checkpointIdentifier has to be at most 128 alphanumeric characters, '.', '_' or '-', not starting with latest_")
+	}
+	return checkpointIdentifier, nil
+}
+
+// validateLabels returns error if any of the labels is not a valid Kubernetes label, as they are selected by label
+// selectors when listing checkpoints.
+func (body CheckpointRequestBody) validateLabels() error {
+	for key, value := range body.Labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid value of label %q: %s", key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// stopPolicy returns the requested checkpoint.StopPolicy. If stopPolicy is not set, deletePod decides between
+// checkpoint.StopPolicyDelete and checkpoint.StopPolicyNone.
+func (body CheckpointRequestBody) stopPolicy() (checkpoint.StopPolicy, error) {
+	if body.StopPolicy == "" {
+		if body.DeletePod {
+			return checkpoint.StopPolicyDelete, nil
+		}
+		return checkpoint.StopPolicyNone, nil
+	}
+
+	stopPolicy, err := checkpoint.ParseStopPolicy(body.StopPolicy)
+	if err != nil {
+		return "", err
+	}
+	if body.DeletePod && stopPolicy != checkpoint.StopPolicyDelete {
+		return "", fmt.Errorf("deletePod conflicts with stopPolicy: %s", stopPolicy)
+	}
+	return stopPolicy, nil
+}
+
+// validateCallback returns error if the callback is requested for synchronous checkpoint or if the callbackUrl is
+// not an absolute URL allowed by callbackConfig.
+func (body CheckpointRequestBody) validateCallback(callbackConfig config.CallbackConfig) error {
+	if body.CallbackUrl == "" {
+		if body.CallbackSecret != "" {
+			return fmt.Errorf("callbackSecret requires callbackUrl")
+		}
+		return nil
+	}
+	if !body.Async {
+		return fmt.Errorf("callbackUrl can only be used with async checkpoint")
+	}
+	callbackUrl, err := url.Parse(body.CallbackUrl)
+	if err != nil || callbackUrl.Host == "" {
+		return fmt.Errorf("callbackUrl has to be an absolute URL")
+	}
+	return callbackConfig.AllowsUrl(callbackUrl)
+}
+
+// publishMode returns the requested checkpoint.PublishMode, checkpoint.PublishImmediate by default. Returns error if
+// checkpoint.PublishDeferred is combined with async checkpoint or verification, which needs the image to be pushed.
+func (body CheckpointRequestBody) publishMode() (checkpoint.PublishMode, error) {
+	if body.Publish == "" {
+		return checkpoint.PublishImmediate, nil
+	}
+	publishMode, err := checkpoint.ParsePublishMode(body.Publish)
+	if err != nil {
+		return "", err
+	}
+	if publishMode == checkpoint.PublishDeferred && body.Async {
+		return "", fmt.Errorf("publish deferred can only be used with sync checkpoint")
+	}
+	if publishMode == checkpoint.PublishDeferred && body.Verify {
+		return "", fmt.Errorf("publish deferred cannot be combined with verify")
+	}
+	return publishMode, nil
+}
+
+// getWaitDuration returns how long the client is willing to wait for a checkpoint in progress to finish, taken from
+// the wait query parameter in seconds. Returns zero duration if the parameter is not set.
+func getWaitDuration(req *http.Request) (time.Duration, error) {
+	wait := req.URL.Query().Get("wait")
+	if wait == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(wait, 10, 64)
+	if err != nil || seconds < 0 || seconds > maxWaitSeconds {
+		return 0, fmt.Errorf("query param wait has to be number of seconds between 0 and %d", maxWaitSeconds)
+	}
+	return time.Second * time.Duration(seconds), nil
+}
+
+// validateRequestHooks validates the hooks from the request body. Hooks running commands are rejected unless
+// hookConfig allows them, empty hooks only disable the hooks from the Pod annotations, which is always allowed.
+func validateRequestHooks(hooks *checkpoint.Hooks, hookConfig config.HookConfig) error {
+	if hooks == nil || hooks.Empty() {
+		return nil
+	}
+	if !hookConfig.AllowRequestHooks {
+		return errors.New("hooks in the request body are not allowed, define them in the Pod annotations instead")
+	}
+	return hooks.Validate()
+}
+
 func generateCheckpointIdentifier() (string, error) {
 	bytes := make([]byte, 8)
 	_, err := rand.Read(bytes)
@@ -164,8 +691,14 @@ func getContainerIdentifier(req *http.Request) *checkpoint.ContainerIdentifier {
 	}
 }
 
+// getCheckpointIdentifier splits the tracking handle in format {node}:{checkpointIdentifier} taken from the {id} path
+// value or from the checkpointIdentifier query parameter.
 func getCheckpointIdentifier(req *http.Request) (leftSide, rightSide string) {
-	l, r, found := strings.Cut(req.URL.Query().Get("checkpointIdentifier"), ":")
+	trackingHandle := req.PathValue("id")
+	if trackingHandle == "" {
+		trackingHandle = req.URL.Query().Get("checkpointIdentifier")
+	}
+	l, r, found := strings.Cut(trackingHandle, ":")
 	if found {
 		return l, r
 	}
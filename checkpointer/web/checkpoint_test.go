@@ -0,0 +1,60 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"checkpoint-in-k8s/pkg/manager"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_validateRequestHooks(t *testing.T) {
+	hooks := &checkpoint.Hooks{Pre: &checkpoint.Hook{Command: []string{"/bin/true"}}}
+	tests := []struct {
+		name        string
+		hooks       *checkpoint.Hooks
+		hookConfig  config.HookConfig
+		expectedErr bool
+	}{
+		{"no hooks", nil, config.HookConfig{}, false},
+		{"empty hooks disable annotations", &checkpoint.Hooks{}, config.HookConfig{}, false},
+		{"hooks not allowed", hooks, config.HookConfig{}, true},
+		{"hooks allowed", hooks, config.HookConfig{AllowRequestHooks: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRequestHooks(tt.hooks, tt.hookConfig); (err != nil) != tt.expectedErr {
+				t.Errorf("validateRequestHooks() error = %v, expectedErr %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func Test_CheckpointHandler_HandleCheckpoint_AsyncReplay(t *testing.T) {
+	ch := NewCheckpointHandler(mockCheckpointManager{entries: map[string]*manager.CheckpointEntry{"replayed": {
+		CheckpointIdentifier: "node:replayed",
+		ContainerImageName:   "quay.io/checkpointed",
+		Phase:                checkpoint.PhaseSucceeded,
+	}}}, "node", config.CallbackConfig{}, config.SchedulerConfig{}, config.HookConfig{})
+
+	for _, checkpointIdentifier := range []string{"new", "replayed"} {
+		req := httptest.NewRequest(http.MethodPost, "/checkpoint/ns/pod/ctrn", strings.NewReader(`{"async": true}`))
+		req.Header.Set(idempotencyKeyHeader, checkpointIdentifier)
+		req.SetPathValue("ns", "ns")
+		req.SetPathValue("pod", "pod")
+		req.SetPathValue("container", "ctrn")
+		rw := httptest.NewRecorder()
+		ch.HandleCheckpoint(rw, req)
+
+		var response TrackingHandleResponseBody
+		if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil || rw.Code != http.StatusAccepted || response.CheckpointIdentifier != "node:"+checkpointIdentifier {
+			t.Fatalf("async request of %s should be answered with the tracking handle, got %d: %s", checkpointIdentifier, rw.Code, rw.Body.String())
+		}
+		if strings.Contains(rw.Body.String(), "containerImageName") {
+			t.Fatalf("async request of %s should not be answered with the stored entry, got: %s", checkpointIdentifier, rw.Body.String())
+		}
+	}
+}
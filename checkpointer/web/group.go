@@ -0,0 +1,237 @@
+package web
+
+import (
+	"bytes"
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/config"
+	"checkpoint-in-k8s/pkg/manager"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type CheckpointGroupRequestBody struct {
+	// Namespace and LabelSelector select the member Pods.
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"labelSelector"`
+
+	// Container is the checkpointed container of each member Pod, the first container of the Pod by default.
+	Container string `json:"container,omitempty"`
+
+	// DeletePod deletes every member Pod, but only once all of them are checkpointed.
+	DeletePod bool `json:"deletePod,omitempty"`
+
+	// Hooks are the freeze and unfreeze hooks of every member, overriding the hooks in the Pod annotations.
+	Hooks *checkpoint.Hooks `json:"hooks,omitempty"`
+
+	Labels   map[string]string `json:"labels,omitempty"`
+	Priority int64             `json:"priority,omitempty"`
+}
+
+type GroupHandler struct {
+	coordinator *manager.GroupCoordinator
+
+	// hookConfig restricts the hooks clients can request.
+	hookConfig config.HookConfig
+}
+
+func NewGroupHandler(coordinator *manager.GroupCoordinator, hookConfig config.HookConfig) *GroupHandler {
+	return &GroupHandler{coordinator, hookConfig}
+}
+
+// HandleCheckpointGroup starts the group checkpoint of the Pods selected by the request body and responds with its
+// entry, coordinated by this Checkpointer.
+func (gh *GroupHandler) HandleCheckpointGroup(rw http.ResponseWriter, req *http.Request) {
+	var requestBody CheckpointGroupRequestBody
+	if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid JSON format: %s", err), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Namespace == "" || requestBody.LabelSelector == "" {
+		http.Error(rw, "namespace and labelSelector are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := labels.Parse(requestBody.LabelSelector); err != nil {
+		http.Error(rw, fmt.Sprintf("malformed labelSelector: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateRequestHooks(requestBody.Hooks, gh.hookConfig); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := (CheckpointRequestBody{Labels: requestBody.Labels}).validateLabels(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().Str("namespace", requestBody.Namespace).Str("labelSelector", requestBody.LabelSelector).Logger()
+	lg.Info().Msg("request to checkpoint group")
+
+	entry, err := gh.coordinator.CheckpointGroup(req.Context(), manager.GroupRequest{
+		Namespace:     requestBody.Namespace,
+		LabelSelector: requestBody.LabelSelector,
+		Container:     requestBody.Container,
+		DeletePod:     requestBody.DeletePod,
+		Hooks:         requestBody.Hooks,
+		Labels:        requestBody.Labels,
+		Priority:      requestBody.Priority,
+	})
+	if errors.Is(err, manager.ErrNoGroupMembers) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to start group checkpoint")
+		http.Error(rw, "failed to start group checkpoint", http.StatusInternalServerError)
+		return
+	}
+	writeGroupEntry(rw, entry, http.StatusAccepted)
+}
+
+// HandleGroupState responds with the entry of the group checkpoint, 202 while it is in progress.
+func (gh *GroupHandler) HandleGroupState(rw http.ResponseWriter, req *http.Request) {
+	_, groupIdentifier := getCheckpointIdentifier(req)
+	if groupIdentifier == "" {
+		http.Error(rw, "group identifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+	entry, err := gh.coordinator.GroupResult(groupIdentifier)
+	if err != nil {
+		writeNotFound(rw, err)
+		return
+	}
+	if entry.InProgress() {
+		writeGroupEntry(rw, entry, http.StatusAccepted)
+		return
+	}
+	writeGroupEntry(rw, entry, http.StatusOK)
+}
+
+func writeGroupEntry(rw http.ResponseWriter, entry *manager.GroupEntry, status int) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		log.Error().Err(err).Msg("unable to encode JSON")
+	}
+}
+
+// ClusterMemberCheckpointer checkpoints the members of a group through the checkpoint API of the local Checkpointer,
+// which forwards the requests to the Checkpointers on the Nodes of the members.
+type ClusterMemberCheckpointer struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewClusterMemberCheckpointer(checkpointerPort int64) *ClusterMemberCheckpointer {
+	return &ClusterMemberCheckpointer{
+		fmt.Sprintf("http://127.0.0.1:%d", checkpointerPort),
+		&http.Client{Timeout: 2 * fanOutTimeout},
+	}
+}
+
+func (m *ClusterMemberCheckpointer) CheckpointMember(ctx context.Context, params checkpoint.CheckpointerParams) (string, error) {
+	body, err := json.Marshal(CheckpointRequestBody{
+		StopPolicy:           string(checkpoint.StopPolicyNone),
+		Async:                true,
+		Priority:             params.Priority,
+		Labels:               params.Labels,
+		CheckpointIdentifier: params.CheckpointIdentifier,
+		// The coordinator runs the hooks itself, so the member only receives empty hooks disabling the annotations.
+		Hooks: &checkpoint.Hooks{},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode checkpoint request: %w", err)
+	}
+	containerIdentifier := params.ContainerIdentifier
+	requestURL := fmt.Sprintf("%s/checkpoint/%s/%s/%s", m.baseURL,
+		url.PathEscape(containerIdentifier.Namespace), url.PathEscape(containerIdentifier.Pod), url.PathEscape(containerIdentifier.Container))
+	res, err := m.do(ctx, http.MethodPost, requestURL, body)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return "", decodeMemberError(res, "")
+	}
+
+	var response TrackingHandleResponseBody
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode tracking handle: %w", err)
+	}
+	// Asynchronous request joins a checkpoint of the container already in progress, which began before the freeze.
+	if !strings.HasSuffix(response.CheckpointIdentifier, ":"+params.CheckpointIdentifier) {
+		return "", fmt.Errorf("container is already being checkpointed by %s", response.CheckpointIdentifier)
+	}
+	return response.CheckpointIdentifier, nil
+}
+
+func (m *ClusterMemberCheckpointer) MemberResult(ctx context.Context, trackingHandle string) (*manager.CheckpointEntry, error) {
+	res, err := m.do(ctx, http.MethodGet, m.baseURL+"/checkpoint?"+url.Values{"checkpointIdentifier": {trackingHandle}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted:
+		entry := &manager.CheckpointEntry{}
+		if err := json.NewDecoder(res.Body).Decode(entry); err != nil {
+			return nil, fmt.Errorf("failed to decode checkpoint result: %w", err)
+		}
+		return entry, nil
+	case res.Header.Get("Content-Type") == "application/problem+json":
+		checkpointErr := decodeMemberError(res, trackingHandle)
+		entry := &manager.CheckpointEntry{CheckpointIdentifier: trackingHandle, Phase: checkpoint.PhaseFailed, Error: checkpointErr}
+		if checkpointErr.Code == checkpoint.ErrorCodeCancelled {
+			entry.Phase = checkpoint.PhaseCancelled
+		}
+		return entry, nil
+	}
+	return nil, decodeMemberError(res, trackingHandle)
+}
+
+func (m *ClusterMemberCheckpointer) CancelMember(ctx context.Context, trackingHandle string) error {
+	res, err := m.do(ctx, http.MethodDelete, m.baseURL+"/checkpoint?"+url.Values{"checkpointIdentifier": {trackingHandle}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return decodeMemberError(res, trackingHandle)
+	}
+	return nil
+}
+
+func (m *ClusterMemberCheckpointer) do(ctx context.Context, method, requestURL string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an http request: %w", err)
+	}
+	return res, nil
+}
+
+// decodeMemberError returns the CheckpointError described by the problem details of res, or a generic one if res does
+// not carry them.
+func decodeMemberError(res *http.Response, trackingHandle string) *checkpoint.CheckpointError {
+	body, _ := io.ReadAll(res.Body)
+	var problem ProblemDetails
+	if res.Header.Get("Content-Type") == "application/problem+json" && json.Unmarshal(body, &problem) == nil && problem.Code != "" {
+		return &checkpoint.CheckpointError{Code: problem.Code, Message: problem.Detail, Phase: problem.Phase, Retryable: problem.Retryable}
+	}
+	cause := fmt.Errorf("checkpointer responded with %d status code and body: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	if trackingHandle != "" {
+		cause = fmt.Errorf("checkpoint %s: %w", trackingHandle, cause)
+	}
+	return checkpoint.NewCheckpointError(checkpoint.ErrorCodeInternal, "", cause)
+}
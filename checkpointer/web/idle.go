@@ -0,0 +1,41 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/manager"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+// IdleResponseBody represents the idleness of the Pods on the Node opted into idle checkpoints.
+type IdleResponseBody struct {
+	Node string `json:"node"`
+
+	// DryRun is true if idle Pods are only reported, not checkpointed.
+	DryRun bool                 `json:"dryRun"`
+	Pods   []manager.IdleReport `json:"pods"`
+}
+
+// IdleHandler serves the report of the idle detector of this Checkpointer.
+type IdleHandler struct {
+	detector *manager.IdleDetector
+	node     string
+	dryRun   bool
+}
+
+func NewIdleHandler(detector *manager.IdleDetector, checkpointerNode string, dryRun bool) *IdleHandler {
+	return &IdleHandler{detector, checkpointerNode, dryRun}
+}
+
+// HandleIdleReport responds with the idleness of the Pods on the Node of this Checkpointer as last read, e.g. to tune
+// the thresholds in dry run.
+func (ih *IdleHandler) HandleIdleReport(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	response := IdleResponseBody{Node: ih.node, DryRun: ih.dryRun, Pods: ih.detector.Report()}
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		log.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
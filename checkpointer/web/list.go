@@ -0,0 +1,211 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"checkpoint-in-k8s/pkg/manager"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// defaultListLimit is the number of checkpoints listed per page if the client does not ask for other limit.
+	defaultListLimit = 100
+
+	// maxListLimit is the maximum number of checkpoints listed per page.
+	maxListLimit = 1000
+
+	// localQueryParam set to true lists only the checkpoints of the Checkpointer serving the request. It is set when
+	// listing is fanned out to every Checkpointer.
+	localQueryParam = "local"
+)
+
+// CheckpointListResponseBody represents a page of listed checkpoints.
+type CheckpointListResponseBody struct {
+	manager.CheckpointList
+
+	// UnreachableNodes are the Nodes whose Checkpointers could not be listed, so the page might be incomplete.
+	UnreachableNodes []string `json:"unreachableNodes,omitempty"`
+}
+
+func (ch *CheckpointHandler) HandleListCheckpoints(rw http.ResponseWriter, req *http.Request) {
+	filter, err := parseEntryFilter(req.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := ch.ListCheckpoints(filter)
+	if err != nil {
+		http.Error(rw, "failed to list checkpoints", http.StatusInternalServerError)
+		return
+	}
+
+	writeCheckpointList(rw, CheckpointListResponseBody{CheckpointList: *list})
+}
+
+func (ch *CheckpointHandler) HandleDeleteCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	_, checkpointIdentifier := getCheckpointIdentifier(req)
+	if checkpointIdentifier == "" {
+		http.Error(rw, "checkpointIdentifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+
+	deleteImage := false
+	if value := req.URL.Query().Get("deleteImage"); value != "" {
+		var err error
+		if deleteImage, err = strconv.ParseBool(value); err != nil {
+			http.Error(rw, "deleteImage has to be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+
+	lg := log.With().
+		Str("checkpointIdentifier", checkpointIdentifier).
+		Bool("deleteImage", deleteImage).
+		Logger()
+
+	lg.Info().Msg("received request to delete checkpoint")
+
+	entry, err := ch.DeleteCheckpoint(req.Context(), checkpointIdentifier, deleteImage)
+	if err != nil {
+		if errors.Is(err, manager.ErrEntryNotFound) {
+			writeNotFound(rw, err)
+			return
+		}
+		if errors.Is(err, manager.ErrCheckpointInProgress) {
+			http.Error(rw, "checkpoint in progress cannot be deleted, cancel it first", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, manager.ErrImageNotDeleted) {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		http.Error(rw, "failed to delete checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(entry); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseEntryFilter returns manager.EntryFilter given by the query parameters of a list request. Returns error if any
+// of them is malformed.
+func parseEntryFilter(query url.Values) (manager.EntryFilter, error) {
+	filter := manager.EntryFilter{
+		Namespace: query.Get("namespace"),
+		Pod:       query.Get("pod"),
+		Container: query.Get("container"),
+		Phase:     checkpoint.Phase(query.Get("phase")),
+		Slot:      query.Get("slot"),
+		Limit:     defaultListLimit,
+	}
+
+	if selector := query.Get("labelSelector"); selector != "" {
+		labelSelector, err := labels.Parse(selector)
+		if err != nil {
+			return manager.EntryFilter{}, fmt.Errorf("invalid labelSelector: %w", err)
+		}
+		filter.LabelSelector = labelSelector
+	}
+
+	for param, value := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+		if query.Get(param) == "" {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(query.Get(param), 10, 64)
+		if err != nil || timestamp < 0 {
+			return manager.EntryFilter{}, fmt.Errorf("%s has to be a Unix timestamp", param)
+		}
+		*value = timestamp
+	}
+
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return manager.EntryFilter{}, fmt.Errorf("limit has to be between 1 and %d", maxListLimit)
+		}
+		filter.Limit = limit
+	}
+
+	if token := query.Get("continue"); token != "" {
+		cursor, err := manager.ParseEntryCursor(token)
+		if err != nil {
+			return manager.EntryFilter{}, err
+		}
+		filter.After = cursor
+	}
+	return filter, nil
+}
+
+func writeCheckpointList(rw http.ResponseWriter, response CheckpointListResponseBody) {
+	if response.Items == nil {
+		response.Items = []manager.CheckpointEntry{}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		log.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ClusterCheckpointLister lists the checkpoints of every Checkpointer through the list API of the local Checkpointer,
+// which fans the listing out to the other Checkpointers.
+type ClusterCheckpointLister struct {
+	listURL    string
+	httpClient *http.Client
+}
+
+func NewClusterCheckpointLister(checkpointerPort int64) *ClusterCheckpointLister {
+	return &ClusterCheckpointLister{
+		fmt.Sprintf("http://127.0.0.1:%d/checkpoints", checkpointerPort),
+		&http.Client{Timeout: 2 * fanOutTimeout},
+	}
+}
+
+func (l *ClusterCheckpointLister) ListClusterEntries(ctx context.Context) ([]manager.CheckpointEntry, error) {
+	var entries []manager.CheckpointEntry
+	query := url.Values{"limit": {strconv.Itoa(maxListLimit)}}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.listURL+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not create http request: %w", err)
+		}
+		res, err := l.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+		}
+		var page CheckpointListResponseBody
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		} else {
+			err = fmt.Errorf("checkpoint listing responded with %d status code", res.StatusCode)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(page.UnreachableNodes) > 0 {
+			return nil, fmt.Errorf("checkpoints of Nodes %v could not be listed", page.UnreachableNodes)
+		}
+
+		entries = append(entries, page.Items...)
+		if page.Continue == "" {
+			return entries, nil
+		}
+		query.Set("continue", page.Continue)
+	}
+}
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/manager"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+// OrphanCheckpointHandler answers state requests for the checkpoints of Nodes without a running Checkpointer, e.g.
+// after the Node was removed, from cluster-wide storage.
+type OrphanCheckpointHandler struct {
+	manager.NodeEntryReader
+}
+
+func NewOrphanCheckpointHandler(nodeEntryReader manager.NodeEntryReader) *OrphanCheckpointHandler {
+	return &OrphanCheckpointHandler{nodeEntryReader}
+}
+
+func (oh *OrphanCheckpointHandler) HandleCheckState(rw http.ResponseWriter, req *http.Request) {
+	node, checkpointIdentifier := getCheckpointIdentifier(req)
+	if node == "" || checkpointIdentifier == "" {
+		http.Error(rw, "query param checkpointIdentifier empty or malformed", http.StatusBadRequest)
+		return
+	}
+
+	lg := log.With().
+		Str("node", node).
+		Str("checkpointIdentifier", checkpointIdentifier).
+		Logger()
+
+	lg.Info().Msg("reading the state of checkpoint of Node without Checkpointer from cluster-wide storage")
+
+	checkpointState, err := oh.ReadNodeEntry(node, checkpointIdentifier)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to read checkpoint entry")
+		http.Error(rw, "failed to get the state of a checkpoint", http.StatusInternalServerError)
+		return
+	}
+	writeCheckpointState(rw, checkpointState, lg)
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"net/http"
+)
+
+// problemTypePrefix prefixes the error code in the type of problem details, e.g. urn:checkpointer:error:Timeout.
+const problemTypePrefix = "urn:checkpointer:error:"
+
+// ProblemDetails is the RFC 9457 problem details body describing a failed checkpoint, extended with the members of
+// checkpoint.CheckpointError.
+type ProblemDetails struct {
+	Type      string               `json:"type"`
+	Title     string               `json:"title"`
+	Status    int                  `json:"status"`
+	Detail    string               `json:"detail,omitempty"`
+	Instance  string               `json:"instance,omitempty"`
+	Code      checkpoint.ErrorCode `json:"code"`
+	Phase     checkpoint.Phase     `json:"phase,omitempty"`
+	Retryable bool                 `json:"retryable"`
+}
+
+// errorCodeStatus maps error codes to HTTP status codes. Codes not listed map to 500 Internal Server Error.
+// ContainerNotFound maps to 422 Unprocessable Entity rather than 404 Not Found, which means the checkpointIdentifier is
+// not recognized, and 410 Gone, which means the result of the checkpoint expired.
+var errorCodeStatus = map[checkpoint.ErrorCode]int{
+	checkpoint.ErrorCodeContainerNotFound:     http.StatusUnprocessableEntity,
+	checkpoint.ErrorCodeKubeletUnavailable:    http.StatusServiceUnavailable,
+	checkpoint.ErrorCodeBuildFailed:           http.StatusUnprocessableEntity,
+	checkpoint.ErrorCodePushFailed:            http.StatusBadGateway,
+	checkpoint.ErrorCodeTimeout:               http.StatusGatewayTimeout,
+	checkpoint.ErrorCodeCancelled:             http.StatusConflict,
+	checkpoint.ErrorCodeHookFailed:            http.StatusFailedDependency,
+	checkpoint.ErrorCodePodDeleteFailed:       http.StatusBadGateway,
+	checkpoint.ErrorCodeCheckpointerRestarted: http.StatusServiceUnavailable,
+	checkpoint.ErrorCodeInternal:              http.StatusInternalServerError,
+}
+
+// errorCode returns the code of checkpointErr, ErrorCodeInternal if it has none, e.g. when it was stored by older
+// Checkpointer as an empty object.
+func errorCode(checkpointErr *checkpoint.CheckpointError) checkpoint.ErrorCode {
+	if checkpointErr.Code == "" {
+		return checkpoint.ErrorCodeInternal
+	}
+	return checkpointErr.Code
+}
+
+// errorStatus returns the HTTP status code representing checkpointErr.
+func errorStatus(checkpointErr *checkpoint.CheckpointError) int {
+	if status, found := errorCodeStatus[errorCode(checkpointErr)]; found {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeProblem responds with application/problem+json body describing checkpointErr of the checkpoint identified by
+// trackingHandle.
+func writeProblem(rw http.ResponseWriter, checkpointErr *checkpoint.CheckpointError, trackingHandle string, lg zerolog.Logger) {
+	status := errorStatus(checkpointErr)
+	problem := ProblemDetails{
+		Type:      problemTypePrefix + string(errorCode(checkpointErr)),
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    checkpointErr.Message,
+		Instance:  trackingHandle,
+		Code:      errorCode(checkpointErr),
+		Phase:     checkpointErr.Phase,
+		Retryable: checkpointErr.Retryable,
+	}
+
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(problem); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+	}
+}
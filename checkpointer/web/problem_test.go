@@ -0,0 +1,48 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/checkpoint"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_writeProblem(t *testing.T) {
+	tests := []struct {
+		name           string
+		checkpointErr  *checkpoint.CheckpointError
+		expectedStatus int
+		expectedCode   checkpoint.ErrorCode
+	}{
+		{"ContainerNotFound", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeContainerNotFound}, http.StatusUnprocessableEntity, checkpoint.ErrorCodeContainerNotFound},
+		{"KubeletUnavailable", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeKubeletUnavailable}, http.StatusServiceUnavailable, checkpoint.ErrorCodeKubeletUnavailable},
+		{"BuildFailed", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeBuildFailed}, http.StatusUnprocessableEntity, checkpoint.ErrorCodeBuildFailed},
+		{"PushFailed", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodePushFailed}, http.StatusBadGateway, checkpoint.ErrorCodePushFailed},
+		{"Timeout", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeTimeout}, http.StatusGatewayTimeout, checkpoint.ErrorCodeTimeout},
+		{"Cancelled", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeCancelled}, http.StatusConflict, checkpoint.ErrorCodeCancelled},
+		{"HookFailed", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeHookFailed}, http.StatusFailedDependency, checkpoint.ErrorCodeHookFailed},
+		{"PodDeleteFailed", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodePodDeleteFailed}, http.StatusBadGateway, checkpoint.ErrorCodePodDeleteFailed},
+		{"CheckpointerRestarted", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeCheckpointerRestarted}, http.StatusServiceUnavailable, checkpoint.ErrorCodeCheckpointerRestarted},
+		{"Internal", &checkpoint.CheckpointError{Code: checkpoint.ErrorCodeInternal}, http.StatusInternalServerError, checkpoint.ErrorCodeInternal},
+		{"legacy empty error", &checkpoint.CheckpointError{}, http.StatusInternalServerError, checkpoint.ErrorCodeInternal},
+	}
+	if len(tests)-1 != len(errorCodeStatus) {
+		t.Fatalf("every mapped error code should be tested, got %d mapped codes", len(errorCodeStatus))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			writeProblem(rw, tt.checkpointErr, "node:id", zerolog.Nop())
+
+			var problem ProblemDetails
+			if err := json.Unmarshal(rw.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("malformed problem details: %s", rw.Body.String())
+			}
+			if rw.Code != tt.expectedStatus || problem.Code != tt.expectedCode || problem.Type != problemTypePrefix+string(tt.expectedCode) {
+				t.Fatalf("writeProblem() responded with %d and %+v", rw.Code, problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+)
+
+// HandleEnforceRetention removes the checkpoint results of this Checkpointer expired by the retention policies right
+// away, instead of waiting for the next run of the janitor. With dryRun=true, it only reports them.
+func (ch *CheckpointHandler) HandleEnforceRetention(rw http.ResponseWriter, req *http.Request) {
+	dryRun := false
+	if value := req.URL.Query().Get("dryRun"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(rw, "dryRun has to be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+
+	lg := log.With().Bool("dryRun", dryRun).Logger()
+	lg.Info().Msg("received request to enforce retention policies")
+
+	report, err := ch.EnforceRetention(req.Context(), dryRun)
+	if err != nil {
+		http.Error(rw, "failed to enforce retention policies", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(report); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
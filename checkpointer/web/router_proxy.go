@@ -1,7 +1,10 @@
 package web
 
 import (
+	"bytes"
 	"checkpoint-in-k8s/internal"
+	"checkpoint-in-k8s/pkg/manager"
+	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -10,14 +13,21 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"sync"
+	"time"
 )
 
 const checkpointerLabelSelector = "app.kubernetes.io/name=checkpointer"
 
+// fanOutTimeout limits how long listing waits for other Checkpointers.
+const fanOutTimeout = time.Second * 10
+
 type ProxyCheckpointHandler struct {
 	nodePodController internal.NodePodController
 	checkpointerNode  string
 	checkpointerPort  int64
+	httpClient        *http.Client
 }
 
 func NewRouteProxyMiddleware(client *kubernetes.Clientset, config *rest.Config, checkpointerNode string, checkpointerPort int64) *ProxyCheckpointHandler {
@@ -25,6 +35,7 @@ func NewRouteProxyMiddleware(client *kubernetes.Clientset, config *rest.Config,
 		internal.NewNodePodController(client, config),
 		checkpointerNode,
 		checkpointerPort,
+		&http.Client{Timeout: fanOutTimeout},
 	}
 }
 
@@ -55,23 +66,227 @@ func (proxy *ProxyCheckpointHandler) CheckpointRouteProxyMiddleware(next http.Ha
 
 		lg.Debug().Str("Node", podsNodeName).Msg("found Node of the Pod")
 
-		proxy.findCheckpointerAndForward(rw, req, podsNodeName, next, lg)
+		proxy.findCheckpointerAndForward(rw, req, podsNodeName, next, nil, lg)
 	})
 }
 
 func (proxy *ProxyCheckpointHandler) StateRouteProxyMiddleware(next http.Handler) http.Handler {
+	return proxy.OrphanStateRouteProxyMiddleware(next, nil)
+}
+
+// OrphanStateRouteProxyMiddleware is StateRouteProxyMiddleware, which serves the request by orphan instead of
+// responding with 404 if there is no Checkpointer running on the Node of the checkpoint. Nil orphan responds with 404.
+func (proxy *ProxyCheckpointHandler) OrphanStateRouteProxyMiddleware(next, orphan http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		node, _ := getCheckpointIdentifier(req)
 		if node == "" {
-			http.Error(rw, "query param checkpointIdentifier empty or malformed", http.StatusBadRequest)
+			http.Error(rw, "checkpointIdentifier empty or malformed", http.StatusBadRequest)
 			return
 		}
 		lg := log.With().Str("node", node).Logger()
-		proxy.findCheckpointerAndForward(rw, req, node, next, lg)
+		proxy.findCheckpointerAndForward(rw, req, node, next, orphan, lg)
 	})
 }
 
-func (proxy *ProxyCheckpointHandler) findCheckpointerAndForward(rw http.ResponseWriter, req *http.Request, node string, next http.Handler, lg zerolog.Logger) {
+// ListRouteProxyMiddleware fans the list request out to every Checkpointer, including the local one through next,
+// and merges their pages into a single page. Nodes without a running Checkpointer are reported as unreachable, since
+// their checkpoints cannot be listed. Requests with local=true are only served by next.
+func (proxy *ProxyCheckpointHandler) ListRouteProxyMiddleware(next http.Handler) http.Handler {
+	return proxy.OrphanListRouteProxyMiddleware(next, nil)
+}
+
+// OrphanListRouteProxyMiddleware is ListRouteProxyMiddleware, which lists the checkpoints of Nodes without a running
+// Checkpointer by orphan instead of reporting them as unreachable, including the checkpoints of deleted Nodes. Nil
+// orphan reports them as unreachable.
+func (proxy *ProxyCheckpointHandler) OrphanListRouteProxyMiddleware(next http.Handler, orphan manager.NodeEntryLister) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get(localQueryParam) == "true" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		filter, err := parseEntryFilter(query)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		nodes, err := proxy.nodePodController.ListNodes(req.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("could not list Nodes")
+			http.Error(rw, fmt.Sprintf("failed while looking for Nodes %s", err), http.StatusInternalServerError)
+			return
+		}
+		podIPs, err := proxy.nodePodController.GetPodIPsByNode(req.Context(), checkpointerLabelSelector)
+		if err != nil {
+			log.Error().Err(err).Msg("could not list other Checkpointers")
+			http.Error(rw, fmt.Sprintf("failed while looking for other Checkpointers %s", err), http.StatusInternalServerError)
+			return
+		}
+		query.Set(localQueryParam, "true")
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var pages []manager.CheckpointList
+		var response CheckpointListResponseBody
+		collect := func(node string, page *manager.CheckpointList, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Warn().Err(err).Str("node", node).Msg("could not list checkpoints of Checkpointer")
+				response.UnreachableNodes = append(response.UnreachableNodes, node)
+				return
+			}
+			pages = append(pages, *page)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page, err := proxy.listLocal(req, query, next)
+			collect(proxy.checkpointerNode, page, err)
+		}()
+		var orphaned []string
+		for _, node := range nodes {
+			if node == proxy.checkpointerNode {
+				continue
+			}
+			podIP, ok := podIPs[node]
+			if !ok {
+				orphaned = append(orphaned, node)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				page, err := proxy.listRemote(req, fmt.Sprintf("http://%s:%d/checkpoints?%s", podIP, proxy.checkpointerPort, query.Encode()))
+				collect(node, page, err)
+			}()
+		}
+		if orphan != nil {
+			running := []string{proxy.checkpointerNode}
+			for node := range podIPs {
+				running = append(running, node)
+			}
+			page, err := listOrphan(orphan, running, filter)
+			if err != nil {
+				log.Warn().Err(err).Msg("could not list checkpoints of Nodes without Checkpointer")
+			} else {
+				collect("", page, nil)
+				orphaned = nil
+			}
+		}
+		for _, node := range orphaned {
+			collect(node, nil, fmt.Errorf("no Checkpointer running on the Node"))
+		}
+		wg.Wait()
+
+		response.CheckpointList = mergeCheckpointLists(pages, filter.Limit)
+		slices.Sort(response.UnreachableNodes)
+		writeCheckpointList(rw, response)
+	})
+}
+
+// listOrphan lists the checkpoints of every Node except the running ones from cluster-wide storage.
+func listOrphan(orphan manager.NodeEntryLister, running []string, filter manager.EntryFilter) (*manager.CheckpointList, error) {
+	limit := filter.Limit
+	if limit > 0 {
+		// One more entry tells whether there is a next page.
+		filter.Limit++
+	}
+	entries, err := orphan.ListEntriesExcept(running, filter)
+	if err != nil {
+		return nil, err
+	}
+	list := &manager.CheckpointList{Items: entries}
+	if limit > 0 && len(entries) > limit {
+		list.Items = entries[:limit]
+		list.Continue = manager.EntryCursorOf(list.Items[limit-1]).String()
+	}
+	return list, nil
+}
+
+// listLocal lists the checkpoints of this Checkpointer through next.
+func (proxy *ProxyCheckpointHandler) listLocal(req *http.Request, query url.Values, next http.Handler) (*manager.CheckpointList, error) {
+	localReq := req.Clone(req.Context())
+	localReq.URL.RawQuery = query.Encode()
+	recorder := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(recorder, localReq)
+	return decodeCheckpointList(recorder.status, &recorder.body)
+}
+
+// listRemote lists the checkpoints of another Checkpointer through requestURL.
+func (proxy *ProxyCheckpointHandler) listRemote(req *http.Request, requestURL string) (*manager.CheckpointList, error) {
+	remoteReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %w", err)
+	}
+	res, err := proxy.httpClient.Do(remoteReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send an http request: %w", err)
+	}
+	defer res.Body.Close()
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(res.Body); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return decodeCheckpointList(res.StatusCode, &body)
+}
+
+func decodeCheckpointList(status int, body *bytes.Buffer) (*manager.CheckpointList, error) {
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("checkpointer responded with %d status code", status)
+	}
+	list := &manager.CheckpointList{}
+	if err := json.NewDecoder(body).Decode(list); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint list: %w", err)
+	}
+	return list, nil
+}
+
+// mergeCheckpointLists merges the pages listed by individual Checkpointers into a single page of at most limit
+// entries. Each Checkpointer lists the entries in the same order, so the next page continues after the last merged
+// entry on every Checkpointer.
+func mergeCheckpointLists(pages []manager.CheckpointList, limit int) manager.CheckpointList {
+	var merged manager.CheckpointList
+	more := false
+	for _, page := range pages {
+		merged.Items = append(merged.Items, page.Items...)
+		more = more || page.Continue != ""
+	}
+	slices.SortFunc(merged.Items, manager.CompareEntries)
+	if len(merged.Items) > limit {
+		merged.Items = merged.Items[:limit]
+		more = true
+	}
+	if more && len(merged.Items) > 0 {
+		merged.Continue = manager.EntryCursorOf(merged.Items[len(merged.Items)-1]).String()
+	}
+	return merged
+}
+
+// bufferedResponseWriter is http.ResponseWriter which keeps the response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// findCheckpointerAndForward forwards the request to the Checkpointer running on node, or serves it by next if it is
+// the local one. If there is no such Checkpointer, the request is served by orphan, or responded with 404 if it is nil.
+func (proxy *ProxyCheckpointHandler) findCheckpointerAndForward(rw http.ResponseWriter, req *http.Request, node string, next, orphan http.Handler, lg zerolog.Logger) {
 	if proxy.checkpointerNode == node {
 		log.Info().Msg("using local handler")
 		next.ServeHTTP(rw, req)
@@ -87,6 +302,11 @@ func (proxy *ProxyCheckpointHandler) findCheckpointerAndForward(rw http.Response
 	}
 	lg.Debug().Str("IP", maybeIp).Msg("found other checkpointer's IP")
 
+	if maybeIp == "" && orphan != nil {
+		lg.Info().Msg("no Pod to forward the request to, serving it from cluster-wide storage")
+		orphan.ServeHTTP(rw, req)
+		return
+	}
 	if maybeIp == "" {
 		lg.Info().Msg("no Pod to forward the request to")
 		http.Error(rw, fmt.Sprintf("no Pod to forward the request to"), http.StatusNotFound)
@@ -101,6 +321,8 @@ func (proxy *ProxyCheckpointHandler) findCheckpointerAndForward(rw http.Response
 	}
 	lg.Info().Msg("forwarding request")
 	reverseProxy := httputil.NewSingleHostReverseProxy(podUrl)
+	// Flush right after every write, so that event streams are not buffered by the proxy.
+	reverseProxy.FlushInterval = -1
 	reverseProxy.ServeHTTP(rw, req)
 	lg.Info().Msg("request complete")
 }
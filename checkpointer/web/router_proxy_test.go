@@ -0,0 +1,40 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/manager"
+	"slices"
+	"testing"
+)
+
+type mockNodeEntryLister struct {
+	entries []manager.CheckpointEntry
+	except  []string
+}
+
+func (m *mockNodeEntryLister) ListEntriesExcept(nodes []string, filter manager.EntryFilter) ([]manager.CheckpointEntry, error) {
+	m.except = nodes
+	if filter.Limit > 0 && len(m.entries) > filter.Limit {
+		return m.entries[:filter.Limit], nil
+	}
+	return m.entries, nil
+}
+
+func Test_listOrphan(t *testing.T) {
+	orphan := &mockNodeEntryLister{entries: []manager.CheckpointEntry{
+		{CheckpointIdentifier: "a", BeginTimestamp: 1},
+		{CheckpointIdentifier: "b", BeginTimestamp: 2},
+	}}
+
+	list, err := listOrphan(orphan, []string{"node-1"}, manager.EntryFilter{Limit: 1})
+	if err != nil || len(list.Items) != 1 || list.Continue != manager.EntryCursorOf(orphan.entries[0]).String() {
+		t.Fatalf("the first page with a continue token should be listed, got: %+v, %v", list, err)
+	}
+	if !slices.Equal(orphan.except, []string{"node-1"}) {
+		t.Fatalf("the running Nodes should be excluded, got: %v", orphan.except)
+	}
+
+	list, err = listOrphan(orphan, nil, manager.EntryFilter{})
+	if err != nil || len(list.Items) != 2 || list.Continue != "" {
+		t.Fatalf("every entry should be listed without a continue token, got: %+v, %v", list, err)
+	}
+}
@@ -0,0 +1,141 @@
+package web
+
+import (
+	"checkpoint-in-k8s/pkg/manager"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// SlotResponseBody represents the history of a slot.
+type SlotResponseBody struct {
+	manager.SlotHistory
+
+	// UnreachableNodes are the Nodes whose Checkpointers could not be listed, so the history might be incomplete.
+	UnreachableNodes []string `json:"unreachableNodes,omitempty"`
+}
+
+// SlotHandler serves the histories of slots. The histories are listed through the list handler, so that they hold
+// the checkpoints of every Checkpointer if the listing is fanned out.
+type SlotHandler struct {
+	list http.Handler
+}
+
+func NewSlotHandler(list http.Handler) *SlotHandler {
+	return &SlotHandler{list}
+}
+
+// HandleSlotLineage responds with the whole history of the slot, the most recent checkpoint first.
+func (sh *SlotHandler) HandleSlotLineage(rw http.ResponseWriter, req *http.Request) {
+	slot := req.PathValue("slot")
+	if err := validateSlot(slot); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lg := log.With().Str("slot", slot).Logger()
+
+	history, unreachableNodes, err := sh.slotHistory(req, slot, 0)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list slot history")
+		http.Error(rw, "failed to list slot history", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(SlotResponseBody{*history, unreachableNodes}); err != nil {
+		lg.Error().Err(err).Msg("unable to encode JSON")
+		http.Error(rw, "unable to encode JSON", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleLatestSlotCheckpoint responds with the most recent successful checkpoint of the slot.
+func (sh *SlotHandler) HandleLatestSlotCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	sh.handleSlotCheckpoint(rw, req, "latest", (*manager.SlotHistory).Latest)
+}
+
+// HandlePreviousSlotCheckpoint responds with the successful checkpoint of the slot preceding the latest one, which is
+// the fallback if the latest image cannot be restored.
+func (sh *SlotHandler) HandlePreviousSlotCheckpoint(rw http.ResponseWriter, req *http.Request) {
+	sh.handleSlotCheckpoint(rw, req, "previous", (*manager.SlotHistory).Previous)
+}
+
+// handleSlotCheckpoint responds with the checkpoint of the slot history selected by pick. As the wrong checkpoint
+// would be restored otherwise, the request fails if any Checkpointer could not be listed.
+func (sh *SlotHandler) handleSlotCheckpoint(rw http.ResponseWriter, req *http.Request, name string, pick func(*manager.SlotHistory) *manager.CheckpointEntry) {
+	slot := req.PathValue("slot")
+	if err := validateSlot(slot); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lg := log.With().Str("slot", slot).Logger()
+
+	history, unreachableNodes, err := sh.slotHistory(req, slot, 2)
+	if err != nil {
+		lg.Error().Err(err).Msg("failed to list slot history")
+		http.Error(rw, "failed to list slot history", http.StatusInternalServerError)
+		return
+	}
+	if len(unreachableNodes) > 0 {
+		lg.Warn().Strs("unreachableNodes", unreachableNodes).Msg("slot history incomplete")
+		http.Error(rw, fmt.Sprintf("checkpoints of Nodes %v could not be listed", unreachableNodes), http.StatusServiceUnavailable)
+		return
+	}
+	entry := pick(history)
+	if entry == nil {
+		http.Error(rw, fmt.Sprintf("slot has no %s checkpoint", name), http.StatusNotFound)
+		return
+	}
+	writeCheckpointState(rw, entry, lg)
+}
+
+// slotHistory lists at most limit checkpoints of the history of slot through the list handler, or every checkpoint
+// if limit is 0. Returns the Nodes whose Checkpointers could not be listed as well.
+func (sh *SlotHandler) slotHistory(req *http.Request, slot string, limit int) (*manager.SlotHistory, []string, error) {
+	filter := manager.SlotFilter(slot)
+	query := url.Values{"slot": {filter.Slot}, "phase": {string(filter.Phase)}, "limit": {strconv.Itoa(maxListLimit)}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var entries []manager.CheckpointEntry
+	var unreachableNodes []string
+	for {
+		listReq := req.Clone(req.Context())
+		listReq.URL.RawQuery = query.Encode()
+		recorder := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+		sh.list.ServeHTTP(recorder, listReq)
+		if recorder.status != http.StatusOK {
+			return nil, nil, fmt.Errorf("checkpoint listing responded with %d status code", recorder.status)
+		}
+		var page CheckpointListResponseBody
+		if err := json.NewDecoder(&recorder.body).Decode(&page); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode checkpoint list: %w", err)
+		}
+
+		entries = append(entries, page.Items...)
+		for _, node := range page.UnreachableNodes {
+			if !slices.Contains(unreachableNodes, node) {
+				unreachableNodes = append(unreachableNodes, node)
+			}
+		}
+		if page.Continue == "" || (limit > 0 && len(entries) >= limit) {
+			return manager.NewSlotHistory(slot, entries), unreachableNodes, nil
+		}
+		query.Set("continue", page.Continue)
+	}
+}
+
+// validateSlot returns error if slot is malformed. Slot names are restricted like client-chosen checkpoint
+// identifiers. Empty slot is valid, as the slot is optional.
+func validateSlot(slot string) error {
+	if slot != "" && !checkpointIdentifierPattern.MatchString(slot) {
+		return fmt.Errorf("slot has to be at most 128 alphanumeric characters, '.', '_' or '-'")
+	}
+	return nil
+}